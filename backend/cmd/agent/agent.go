@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/folstingx/server/pkg/agentproto"
+	"github.com/folstingx/server/pkg/forwarder"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	agentVersion = "1.0.1"
+
+	heartbeatInterval = 15 * time.Second
+	reportInterval    = 10 * time.Second
+	handshakeTimeout  = 10 * time.Second
+	// panelTimeout 面板定期发送 ping，超过该时间未收到任何消息视为连接已挂起并重连。
+	panelTimeout = 2 * time.Minute
+
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Agent 维护与面板的连接以及本机运行的服务、链路、规则与 relay 监听。
+// 服务与链路在断线重连期间保持运行；远程规则随连接断开而停止，与面板的约定一致。
+type Agent struct {
+	cfgPath string
+	started time.Time
+
+	mu    sync.Mutex
+	cfg   Config
+	relay *forwarder.RelayServer
+
+	services *serviceTable
+	rules    *ruleTable
+}
+
+func NewAgent(cfg Config, cfgPath string) *Agent {
+	a := &Agent{cfgPath: cfgPath, cfg: cfg, started: time.Now(), rules: newRuleTable()}
+	a.services = newServiceTable(a.secret)
+	if err := a.restartRelay(); err != nil {
+		log.Printf("start relay listener: %v", err)
+	}
+	return a
+}
+
+func (a *Agent) secret() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cfg.Secret
+}
+
+// Run 连接面板直到 ctx 结束，断开后按指数退避重连，握手成功后退避重置。
+func (a *Agent) Run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		connected, err := a.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = minBackoff
+		}
+		log.Printf("disconnected from panel: %v, retrying in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Shutdown 停止所有规则、服务与 relay 监听。
+func (a *Agent) Shutdown() {
+	a.rules.stopAll()
+	a.services.stopAll()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.relay != nil {
+		_ = a.relay.Stop()
+		a.relay = nil
+	}
+}
+
+// restartRelay 按当前配置与密钥（重新）启动节点 relay 监听。
+func (a *Agent) restartRelay() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.relay != nil {
+		_ = a.relay.Stop()
+		a.relay = nil
+	}
+	if a.cfg.RelayPort < 0 {
+		return nil
+	}
+	transport, err := forwarder.NewTransport(a.cfg.RelayTransport, forwarder.TransportOptions{
+		Path:     a.cfg.RelayPath,
+		CertFile: a.cfg.CertFile,
+		KeyFile:  a.cfg.KeyFile,
+	})
+	if err != nil {
+		return err
+	}
+	relay := forwarder.NewRelayServer("0.0.0.0", a.cfg.RelayPort, forwarder.RelayKey(a.cfg.Secret), 0)
+	relay.SetTransport(transport)
+	if err := relay.Start(); err != nil {
+		return err
+	}
+	a.relay = relay
+	return nil
+}
+
+// agentURL 将面板地址转换为 /ws/agent 地址，http(s) 对应 ws(s)，无协议时按 ws。
+func agentURL(addr string, nodeID uint, nonce []byte) (string, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "ws://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("unsupported panel address scheme %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ws/agent"
+	u.RawQuery = url.Values{"node_id": {strconv.FormatUint(uint64(nodeID), 10)}, "nonce": {hex.EncodeToString(nonce)}}.Encode()
+	return u.String(), nil
+}
+
+// ===================== 连接 =====================
+
+// conn 一次已完成握手的面板连接。
+type conn struct {
+	ws      *websocket.Conn
+	sendKey []byte
+	recvKey []byte
+
+	mu      sync.Mutex
+	sendSeq agentproto.Sequencer
+	// recvGuard 只在读取循环中使用。
+	recvGuard agentproto.ReplayGuard
+}
+
+func (c *conn) send(report agentproto.Report) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report.Seq, report.Time = c.sendSeq.Stamp(time.Now())
+	msg, err := agentproto.Seal(c.sendKey, report)
+	if err != nil {
+		return err
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, msg)
+}
+
+func (c *conn) report(typ string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.send(agentproto.Report{Type: typ, Data: data})
+}
+
+// connect 建立一次连接并运行到断开，返回是否完成了握手。
+func (a *Agent) connect(ctx context.Context) (bool, error) {
+	a.mu.Lock()
+	addr, nodeID, secret := a.cfg.Addr, a.cfg.NodeID, a.cfg.Secret
+	a.mu.Unlock()
+
+	nonce := agentproto.NewNonce()
+	u, err := agentURL(addr, nodeID, nonce)
+	if err != nil {
+		return false, err
+	}
+	dialer := websocket.Dialer{HandshakeTimeout: handshakeTimeout}
+	ws, resp, err := dialer.DialContext(ctx, u, nil)
+	if err != nil {
+		if resp != nil {
+			return false, fmt.Errorf("dial panel: %v (HTTP %d)", err, resp.StatusCode)
+		}
+		return false, fmt.Errorf("dial panel: %v", err)
+	}
+	defer ws.Close()
+
+	// 面板先发送明文 Hello，携带面板 nonce。
+	_ = ws.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	var hello agentproto.Hello
+	if err := ws.ReadJSON(&hello); err != nil {
+		return false, fmt.Errorf("read hello: %v", err)
+	}
+	if hello.Type != "hello" || hello.Version != agentproto.Version || len(hello.Nonce) != agentproto.NonceSize {
+		return false, fmt.Errorf("unsupported hello from panel (version %d)", hello.Version)
+	}
+	// 以双方 nonce 的 HMAC 证明持有节点密钥，面板校验通过后才注册连接。
+	auth := agentproto.Auth{Type: "auth", MAC: agentproto.AuthMAC(secret, nonce, hello.Nonce)}
+	if err := ws.WriteJSON(auth); err != nil {
+		return false, fmt.Errorf("send auth: %v", err)
+	}
+	_ = ws.SetReadDeadline(time.Now().Add(panelTimeout))
+	// 原样回应 pong，面板据此计算往返时延。
+	ws.SetPingHandler(func(payload string) error {
+		_ = ws.SetReadDeadline(time.Now().Add(panelTimeout))
+		err := ws.WriteControl(websocket.PongMessage, []byte(payload), time.Now().Add(handshakeTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
+	c := &conn{ws: ws}
+	c.recvKey, c.sendKey = agentproto.SessionKeys(secret, nonce, hello.Nonce)
+	log.Printf("connected to panel %s", addr)
+
+	// 断开后面板视为规则已停止，本机同步停止，重连后由面板重新下发。
+	defer a.rules.stopAll()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = ws.Close()
+		case <-done:
+		}
+	}()
+	go a.reportLoop(c, done)
+
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			// 认证被拒绝不算完成握手，按退避重试。
+			if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				return false, fmt.Errorf("panel rejected authentication: %v", err)
+			}
+			return true, err
+		}
+		_ = ws.SetReadDeadline(time.Now().Add(panelTimeout))
+		var cmd agentproto.Command
+		if err := agentproto.Open(c.recvKey, msg, &cmd); err != nil {
+			return true, fmt.Errorf("decrypt command: %v", err)
+		}
+		if err := c.recvGuard.Check(cmd.Seq, cmd.Time, time.Now()); err != nil {
+			return true, err
+		}
+		// 命令按到达顺序执行，保证 add_chain / add_limiter 先于引用它们的服务。
+		if err := c.send(a.execute(cmd)); err != nil {
+			return true, err
+		}
+	}
+}
+
+// execute 执行一条命令并生成响应，失败时返回 type=error，Data 为错误信息字符串。
+func (a *Agent) execute(cmd agentproto.Command) agentproto.Report {
+	result, err := a.handle(cmd)
+	if err != nil {
+		log.Printf("%s failed: %v", cmd.Action, err)
+		data, _ := json.Marshal(err.Error())
+		return agentproto.Report{Type: "error", ID: cmd.ID, Data: data}
+	}
+	data, _ := json.Marshal(result)
+	return agentproto.Report{Type: "response", ID: cmd.ID, Data: data}
+}
+
+func (a *Agent) handle(cmd agentproto.Command) (interface{}, error) {
+	switch cmd.Action {
+	case "add_service":
+		var svc agentproto.ServiceConfig
+		if err := json.Unmarshal(cmd.Data, &svc); err != nil {
+			return nil, err
+		}
+		return nil, a.services.addService(svc)
+
+	case "delete_service":
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(cmd.Data, &req); err != nil {
+			return nil, err
+		}
+		a.services.deleteService(req.Name)
+		return nil, nil
+
+	case "add_chain":
+		var chain agentproto.ChainConfig
+		if err := json.Unmarshal(cmd.Data, &chain); err != nil {
+			return nil, err
+		}
+		return nil, a.services.addChain(chain)
+
+	case "add_limiter", "update_limiter":
+		var limiter agentproto.LimiterConfig
+		if err := json.Unmarshal(cmd.Data, &limiter); err != nil {
+			return nil, err
+		}
+		return nil, a.services.setLimiter(limiter)
+
+	case "start_rule":
+		var req struct {
+			RuleID uint                 `json:"rule_id"`
+			Spec   forwarder.RemoteSpec `json:"spec"`
+		}
+		if err := json.Unmarshal(cmd.Data, &req); err != nil {
+			return nil, err
+		}
+		return nil, a.rules.start(req.RuleID, req.Spec)
+
+	case "stop_rule":
+		var req struct {
+			RuleID uint `json:"rule_id"`
+		}
+		if err := json.Unmarshal(cmd.Data, &req); err != nil {
+			return nil, err
+		}
+		return a.rules.stop(req.RuleID), nil
+
+	case "set_rule_rate":
+		var req struct {
+			RuleID uint  `json:"rule_id"`
+			Limit  int64 `json:"limit"`
+		}
+		if err := json.Unmarshal(cmd.Data, &req); err != nil {
+			return nil, err
+		}
+		return nil, a.rules.setRate(req.RuleID, req.Limit)
+
+	case "rotate_secret":
+		var req struct {
+			Secret string `json:"secret"`
+		}
+		if err := json.Unmarshal(cmd.Data, &req); err != nil {
+			return nil, err
+		}
+		return nil, a.rotateSecret(req.Secret)
+
+	default:
+		return nil, fmt.Errorf("unsupported action %q", cmd.Action)
+	}
+}
+
+// rotateSecret 先持久化新密钥再确认；当前连接继续使用已派生的会话密钥。
+// 节点 relay 监听换用新密钥（面板随后重载经过本节点的链路规则），
+// 已下发的 relay 服务保持原密钥直到面板重新下发。
+func (a *Agent) rotateSecret(secret string) error {
+	if secret == "" {
+		return errors.New("empty secret")
+	}
+	a.mu.Lock()
+	cfg := a.cfg
+	cfg.Secret = secret
+	if err := saveConfig(a.cfgPath, cfg); err != nil {
+		a.mu.Unlock()
+		return fmt.Errorf("save config: %v", err)
+	}
+	a.cfg = cfg
+	a.mu.Unlock()
+	if err := a.restartRelay(); err != nil {
+		log.Printf("restart relay listener: %v", err)
+	}
+	return nil
+}
+
+// ===================== 上报 =====================
+
+func (a *Agent) reportLoop(c *conn, done <-chan struct{}) {
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	stats := time.NewTicker(reportInterval)
+	defer stats.Stop()
+
+	a.sendHeartbeat(c)
+	for {
+		select {
+		case <-done:
+			return
+		case <-heartbeat.C:
+			a.sendHeartbeat(c)
+		case <-stats.C:
+			a.sendStats(c)
+		}
+	}
+}
+
+func (a *Agent) sendHeartbeat(c *conn) {
+	_ = c.report("heartbeat", map[string]interface{}{
+		"version":  agentVersion,
+		"uptime":   int64(time.Since(a.started).Seconds()),
+		"services": a.services.count(),
+		"rules":    a.rules.count(),
+	})
+}
+
+// sendStats 上报远程规则累计计数与各服务的流量增量；服务流量在发送失败时计入下一次上报。
+func (a *Agent) sendStats(c *conn) {
+	if stats := a.rules.stats(); len(stats) > 0 {
+		_ = c.report("rule_stats", stats)
+	}
+	traffic := a.services.traffic()
+	if len(traffic) == 0 {
+		return
+	}
+	if err := c.report("traffic", traffic); err != nil {
+		a.services.restore(traffic)
+	}
+}
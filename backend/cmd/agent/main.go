@@ -0,0 +1,99 @@
+// folstingx-agent 节点 Agent 参考实现：以节点 ID 连接面板 /ws/agent 并用节点密钥完成认证，按 agentproto 协议
+// 接收命令，用 pkg/forwarder 在本机运行 gost 风格的服务/链路与远程规则，并周期上报心跳与流量。
+//
+// 用法: folstingx-agent -c /etc/folstingx_agent/config.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/folstingx/server/pkg/forwarder"
+)
+
+// defaultRelayPort 与面板节点的默认 relay 端口一致。
+const defaultRelayPort = 9443
+
+// Config Agent 配置文件，addr、node_id 与 secret 由安装脚本写入，rotate_secret 会回写 secret。
+type Config struct {
+	Addr   string `json:"addr"` // 面板地址，如 https://panel.example.com
+	NodeID uint   `json:"node_id"`
+	Secret string `json:"secret"`
+	// RelayPort 节点 relay 监听端口，供经过本节点的链路规则使用；0 为默认端口，负数关闭。
+	RelayPort      int    `json:"relay_port,omitempty"`
+	RelayTransport string `json:"relay_transport,omitempty"`
+	RelayPath      string `json:"relay_path,omitempty"`
+	CertFile       string `json:"cert_file,omitempty"`
+	KeyFile        string `json:"key_file,omitempty"`
+	// CertDir 远程规则 cert_file/key_file 所在目录，为空时规则不能引用证书文件。
+	CertDir string `json:"cert_dir,omitempty"`
+}
+
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Addr == "" || cfg.NodeID == 0 || cfg.Secret == "" {
+		return cfg, errors.New("config requires addr, node_id and secret")
+	}
+	if cfg.RelayPort == 0 {
+		cfg.RelayPort = defaultRelayPort
+	}
+	return cfg, nil
+}
+
+// saveConfig 先写临时文件再替换，避免写入中途退出损坏配置。
+func saveConfig(path string, cfg Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".config-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func main() {
+	configPath := flag.String("c", "config.json", "配置文件路径")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("load config %s: %v", *configPath, err)
+	}
+
+	forwarder.SetCertDir(cfg.CertDir)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	agent := NewAgent(cfg, *configPath)
+	agent.Run(ctx)
+	agent.Shutdown()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/folstingx/server/pkg/agentproto"
+	"github.com/folstingx/server/pkg/forwarder"
+)
+
+// ruleTable 面板下发到本节点运行的规则（start_rule），按规则 ID 管理。
+type ruleTable struct {
+	mu    sync.Mutex
+	rules map[uint]forwarder.Forwarder
+}
+
+func newRuleTable() *ruleTable {
+	return &ruleTable{rules: make(map[uint]forwarder.Forwarder)}
+}
+
+// start 构建并启动规则，同一规则已在运行时先停止旧实例。
+func (t *ruleTable) start(ruleID uint, spec forwarder.RemoteSpec) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old, ok := t.rules[ruleID]; ok {
+		_ = old.Stop()
+		delete(t.rules, ruleID)
+	}
+	f, err := spec.Build()
+	if err != nil {
+		return err
+	}
+	if err := f.Start(); err != nil {
+		return err
+	}
+	t.rules[ruleID] = f
+	return nil
+}
+
+// stop 停止规则并返回最终计数；规则未在运行时返回 nil，面板据此忽略计数。
+func (t *ruleTable) stop(ruleID uint) *agentproto.RuleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.rules[ruleID]
+	if !ok {
+		return nil
+	}
+	_ = f.Stop()
+	delete(t.rules, ruleID)
+	st := ruleStats(ruleID, f)
+	return &st
+}
+
+func (t *ruleTable) setRate(ruleID uint, limit int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.rules[ruleID]
+	if !ok {
+		return fmt.Errorf("rule %d is not running", ruleID)
+	}
+	rl, ok := f.(forwarder.RateLimited)
+	if !ok {
+		return fmt.Errorf("rule %d does not support rate limiting", ruleID)
+	}
+	rl.Limiter().SetRate(limit)
+	return nil
+}
+
+func (t *ruleTable) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.rules)
+}
+
+func (t *ruleTable) stats() []agentproto.RuleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]agentproto.RuleStats, 0, len(t.rules))
+	for id, f := range t.rules {
+		out = append(out, ruleStats(id, f))
+	}
+	return out
+}
+
+func ruleStats(ruleID uint, f forwarder.Forwarder) agentproto.RuleStats {
+	st := agentproto.RuleStats{RuleID: ruleID, Stats: f.Stats()}
+	if sv, ok := f.(forwarder.Supervised); ok {
+		if err := sv.Err(); err != nil {
+			st.Error = err.Error()
+		}
+	}
+	return st
+}
+
+func (t *ruleTable) stopAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, f := range t.rules {
+		_ = f.Stop()
+		delete(t.rules, id)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/folstingx/server/pkg/agentproto"
+	"github.com/folstingx/server/pkg/forwarder"
+)
+
+// service 一个按 gost 服务配置运行的本机转发器。
+type service struct {
+	cfg    agentproto.ServiceConfig
+	fwd    forwarder.Forwarder
+	dialer *forwarder.ChainDialer
+	// 构建时使用的链路、限速与 relay 密钥，与 cfg 一起判断再次下发时是否需要重建。
+	chain  agentproto.ChainConfig
+	limit  int64
+	secret string
+
+	// 上次上报时的累计字节数与连接数，用于计算增量。
+	lastUp, lastDown, lastConns int64
+}
+
+// serviceTable 用 pkg/forwarder 模拟 gost 的服务、链路与限速器：
+//   - handler tcp/udp: 端口转发到 forwarder 的第一个节点，带 chain 时经 relay 链路出站；
+//   - handler relay: 本节点密钥认证的 relay 监听，配置了 forwarder 时所有流都转发到该地址。
+//
+// 同名的服务、链路与限速器再次下发时替换原有配置；配置未变的服务保持运行，
+// 面板在 Agent 重连后的重新下发因此不会中断已有连接。
+type serviceTable struct {
+	secret func() string
+
+	mu       sync.Mutex
+	services map[string]*service
+	// pending 已停止或替换的服务尚未上报的流量，计入下一次上报。
+	pending  map[string]agentproto.ServiceTraffic
+	chains   map[string]agentproto.ChainConfig
+	limiters map[string]int64 // name → bytes/s，0 表示不限速
+}
+
+func newServiceTable(secret func() string) *serviceTable {
+	return &serviceTable{
+		secret:   secret,
+		services: make(map[string]*service),
+		pending:  make(map[string]agentproto.ServiceTraffic),
+		chains:   make(map[string]agentproto.ChainConfig),
+		limiters: make(map[string]int64),
+	}
+}
+
+func (t *serviceTable) addService(cfg agentproto.ServiceConfig) error {
+	if cfg.Name == "" {
+		return fmt.Errorf("service name is required")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// 配置未变且仍在正常运行的同名服务保持不动；否则先停止，新配置通常沿用同一端口。
+	if old, ok := t.services[cfg.Name]; ok {
+		if t.unchanged(old, cfg) {
+			return nil
+		}
+		t.retire(cfg.Name, old)
+	}
+	svc, err := t.build(cfg)
+	if err != nil {
+		return fmt.Errorf("service %s: %v", cfg.Name, err)
+	}
+	if err := svc.fwd.Start(); err != nil {
+		svc.stop()
+		return fmt.Errorf("service %s: %v", cfg.Name, err)
+	}
+	t.services[cfg.Name] = svc
+	return nil
+}
+
+// unchanged 判断运行中的服务与再次下发的配置及其引用的链路、限速、密钥是否一致，调用方需持有 t.mu。
+func (t *serviceTable) unchanged(svc *service, cfg agentproto.ServiceConfig) bool {
+	if !reflect.DeepEqual(svc.cfg, cfg) {
+		return false
+	}
+	if sv, ok := svc.fwd.(forwarder.Supervised); ok && sv.Err() != nil {
+		return false
+	}
+	if cfg.Chain != "" && !reflect.DeepEqual(svc.chain, t.chains[cfg.Chain]) {
+		return false
+	}
+	if cfg.Limiter != "" && svc.limit != t.limiters[cfg.Limiter] {
+		return false
+	}
+	return cfg.Handler != "relay" || svc.secret == t.secret()
+}
+
+// retire 停止服务并把尚未上报的流量转入 pending，调用方需持有 t.mu。
+func (t *serviceTable) retire(name string, svc *service) {
+	st := svc.fwd.Stats()
+	svc.stop()
+	delete(t.services, name)
+	up, down := st.UpBytes-svc.lastUp, st.DownBytes-svc.lastDown
+	if up == 0 && down == 0 {
+		return
+	}
+	p := t.pending[name]
+	p.Name = name
+	p.UpBytes += up
+	p.DownBytes += down
+	t.pending[name] = p
+}
+
+// build 按配置构建尚未启动的服务，调用方需持有 t.mu。
+func (t *serviceTable) build(cfg agentproto.ServiceConfig) (*service, error) {
+	host, portStr, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid addr %q", cfg.Addr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid addr %q", cfg.Addr)
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	var limit int64
+	if cfg.Limiter != "" {
+		l, ok := t.limiters[cfg.Limiter]
+		if !ok {
+			return nil, fmt.Errorf("limiter %q not found", cfg.Limiter)
+		}
+		limit = l
+	}
+	var target string
+	if cfg.Forwarder != nil && len(cfg.Forwarder.Nodes) > 0 {
+		target = cfg.Forwarder.Nodes[0].Addr
+	}
+
+	svc := &service{cfg: cfg, limit: limit}
+	switch cfg.Handler {
+	case "tcp", "udp":
+		spec := forwarder.Spec{ListenHost: host, ListenPort: port, BandwidthLimit: limit}
+		if cfg.Chain != "" {
+			chain, ok := t.chains[cfg.Chain]
+			if !ok {
+				return nil, fmt.Errorf("chain %q not found", cfg.Chain)
+			}
+			svc.chain = chain
+			hops, err := chainHops(chain)
+			if err != nil {
+				return nil, err
+			}
+			svc.dialer = forwarder.NewChainDialer(hops)
+			spec.Dialer = svc.dialer
+			// 链路出口的 relay 服务固定转发到最终目标，入口未配置目标时请求地址只作占位。
+			if target == "" {
+				target = hops[len(hops)-1].Addr
+			}
+		}
+		if target == "" {
+			return nil, fmt.Errorf("%s handler requires a forwarder", cfg.Handler)
+		}
+		spec.TargetHost, spec.TargetPort, err = splitTarget(target)
+		if err != nil {
+			svc.stop()
+			return nil, err
+		}
+		svc.fwd, err = forwarder.Build(cfg.Handler, spec)
+		if err != nil {
+			svc.stop()
+			return nil, err
+		}
+
+	case "relay":
+		transport, err := forwarder.NewTransport(listenerTransport(cfg.Listener), forwarder.TransportOptions{})
+		if err != nil {
+			return nil, err
+		}
+		svc.secret = t.secret()
+		relay := forwarder.NewRelayServer(host, port, forwarder.RelayKey(svc.secret), limit)
+		relay.SetTransport(transport)
+		if target != "" {
+			relay.SetTarget(target)
+		}
+		svc.fwd = relay
+
+	default:
+		return nil, fmt.Errorf("unsupported handler %q", cfg.Handler)
+	}
+	return svc, nil
+}
+
+// chainHops 将 gost chain 转换为 relay 跳点，每跳取第一个节点，只支持 relay connector。
+func chainHops(chain agentproto.ChainConfig) ([]forwarder.RelayHop, error) {
+	if len(chain.Hops) == 0 {
+		return nil, fmt.Errorf("chain %s has no hops", chain.Name)
+	}
+	hops := make([]forwarder.RelayHop, 0, len(chain.Hops))
+	for _, h := range chain.Hops {
+		if len(h.Nodes) == 0 {
+			return nil, fmt.Errorf("chain %s hop %s has no nodes", chain.Name, h.Name)
+		}
+		n := h.Nodes[0]
+		if n.Connector != "relay" {
+			return nil, fmt.Errorf("chain %s: unsupported connector %q", chain.Name, n.Connector)
+		}
+		if len(n.Key) == 0 {
+			return nil, fmt.Errorf("chain %s hop %s has no relay key", chain.Name, h.Name)
+		}
+		hop, err := forwarder.HopSpec{Name: h.Name, Addr: n.Addr, Key: n.Key, Transport: listenerTransport(n.Dialer)}.RelayHop()
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// listenerTransport 将 gost listener/dialer 名称映射为传输层名称。
+func listenerTransport(name string) string {
+	switch name {
+	case "ws", "wss", "mws", "mwss", "h2":
+		return name
+	default:
+		return "tcp"
+	}
+}
+
+func splitTarget(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid target %q", addr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid target %q", addr)
+	}
+	return host, port, nil
+}
+
+func (s *service) stop() {
+	if s.fwd != nil {
+		_ = s.fwd.Stop()
+	}
+	if s.dialer != nil {
+		_ = s.dialer.Close()
+	}
+}
+
+// deleteService 删除服务，不存在时视为成功。
+func (t *serviceTable) deleteService(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if svc, ok := t.services[name]; ok {
+		t.retire(name, svc)
+	}
+}
+
+// addChain 保存链路，已引用它的服务在下次下发时生效。
+func (t *serviceTable) addChain(chain agentproto.ChainConfig) error {
+	if chain.Name == "" {
+		return fmt.Errorf("chain name is required")
+	}
+	if _, err := chainHops(chain); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.chains[chain.Name] = chain
+	return nil
+}
+
+// setLimiter 保存限速器并立即应用到引用它的服务。
+func (t *serviceTable) setLimiter(cfg agentproto.LimiterConfig) error {
+	if cfg.Name == "" {
+		return fmt.Errorf("limiter name is required")
+	}
+	limit, err := parseLimits(cfg.Limits)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limiters[cfg.Name] = limit
+	for _, svc := range t.services {
+		if svc.cfg.Limiter != cfg.Name {
+			continue
+		}
+		if rl, ok := svc.fwd.(forwarder.RateLimited); ok {
+			rl.Limiter().SetRate(limit)
+			svc.limit = limit
+		}
+	}
+	return nil
+}
+
+// parseLimits 解析服务级限速 "$ <in> <out>"，单位 B/KB/MB/GB，入出取较小值；为空表示不限速。
+func parseLimits(limits []string) (int64, error) {
+	var limit int64
+	for _, l := range limits {
+		fields := strings.Fields(l)
+		if len(fields) < 2 || fields[0] != "$" {
+			return 0, fmt.Errorf("unsupported limit %q", l)
+		}
+		for _, f := range fields[1:] {
+			n, err := parseSize(f)
+			if err != nil {
+				return 0, fmt.Errorf("unsupported limit %q", l)
+			}
+			if n > 0 && (limit == 0 || n < limit) {
+				limit = n
+			}
+		}
+	}
+	return limit, nil
+}
+
+func parseSize(s string) (int64, error) {
+	u := strings.ToUpper(s)
+	mult := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(u, unit.suffix) {
+			u, mult = strings.TrimSuffix(u, unit.suffix), unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(u, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+func (t *serviceTable) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.services)
+}
+
+// traffic 返回各服务自上次上报以来的流量增量（含已停止或替换的服务留下的部分），
+// 跳过没有流量且连接数保持为 0 的服务。
+func (t *serviceTable) traffic() []agentproto.ServiceTraffic {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []agentproto.ServiceTraffic
+	for name, svc := range t.services {
+		st := svc.fwd.Stats()
+		p := t.pending[name]
+		delete(t.pending, name)
+		up, down := p.UpBytes+st.UpBytes-svc.lastUp, p.DownBytes+st.DownBytes-svc.lastDown
+		if up == 0 && down == 0 && st.Connections == 0 && svc.lastConns == 0 {
+			continue
+		}
+		svc.lastUp, svc.lastDown, svc.lastConns = st.UpBytes, st.DownBytes, st.Connections
+		out = append(out, agentproto.ServiceTraffic{Name: name, UpBytes: up, DownBytes: down, Connections: st.Connections})
+	}
+	for name, p := range t.pending {
+		out = append(out, p)
+		delete(t.pending, name)
+	}
+	return out
+}
+
+// restore 上报失败时退回增量，计入下一次上报。
+func (t *serviceTable) restore(traffic []agentproto.ServiceTraffic) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tr := range traffic {
+		if svc, ok := t.services[tr.Name]; ok {
+			svc.lastUp -= tr.UpBytes
+			svc.lastDown -= tr.DownBytes
+			continue
+		}
+		p := t.pending[tr.Name]
+		p.Name = tr.Name
+		p.UpBytes += tr.UpBytes
+		p.DownBytes += tr.DownBytes
+		t.pending[tr.Name] = p
+	}
+}
+
+func (t *serviceTable) stopAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, svc := range t.services {
+		svc.stop()
+		delete(t.services, name)
+	}
+}
@@ -1,7 +1,9 @@
 ﻿package main
 
 import (
+  "fmt"
   "net/http"
+  "os"
   "strconv"
 
   "github.com/gin-gonic/gin"
@@ -10,6 +12,7 @@ import (
   "github.com/folstingx/server/internal/database"
   "github.com/folstingx/server/internal/middleware"
   "github.com/folstingx/server/internal/services"
+  "github.com/folstingx/server/pkg/forwarder"
 )
 
 func main() {
@@ -22,19 +25,60 @@ func main() {
     panic(err)
   }
 
+  forwarder.SetCertDir(cfg.Rules.CertDir)
   fm := services.NewForwardManager()
   collector := services.NewTrafficCollector(fm)
   xrayMgr := services.NewXrayManager("./bin/xray")
   gostMgr := services.NewGostManager("./bin/gost")
   agentHub := services.NewAgentHub()
+  agentHub.SetLiveness(cfg.Agent)
+  agentHub.StartWatchdog()
+  ports, err := services.NewPortAllocator(cfg)
+  if err != nil {
+    panic(err)
+  }
+  ports.Sync()
+
+  // config 子命令：按声明式配置文档 plan / apply 后退出。
+  if len(os.Args) > 1 && os.Args[1] == "config" {
+    if err := api.RunConfigCommand(cfg, ports, os.Args[2:]); err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(1)
+    }
+    return
+  }
 
-  api.Init(cfg, fm, collector, xrayMgr, gostMgr, agentHub)
-  services.StartNodeChecker()
+  api.Init(cfg, fm, collector, xrayMgr, gostMgr, agentHub, ports)
+  services.StartNodeChecker(agentHub)
   services.StartLogRetentionJobs()
+  if cfg.Shaper.EgressLimit > 0 {
+    fm.SetShaper(forwarder.NewHostShaper(cfg.Shaper.EgressLimit, cfg.Shaper.Weights))
+  } else {
+    services.WriteSystemLog("info", "shaper", "host egress shaping disabled (shaper.egress_limit is 0), priority classes have no effect")
+  }
+  fm.SetAgentHub(agentHub)
   _ = fm.StartAll()
   fm.StartPersistLoop()
+  services.NewBandwidthScheduler(fm, agentHub).Start()
   collector.Start()
 
+  // 面板本机作为 relay 跳点。
+  if cfg.Relay.Port > 0 {
+    relay := forwarder.NewRelayServer(cfg.Relay.Host, cfg.Relay.Port, forwarder.RelayKey(cfg.Relay.Secret), 0)
+    transport, err := forwarder.NewTransport(cfg.Relay.Transport, forwarder.TransportOptions{
+      Path:     cfg.Relay.Path,
+      CertFile: cfg.Relay.CertFile,
+      KeyFile:  cfg.Relay.KeyFile,
+    })
+    if err == nil {
+      relay.SetTransport(transport)
+      err = relay.Start()
+    }
+    if err != nil {
+      services.WriteSystemLog("error", "relay", "start relay listener failed: "+err.Error())
+    }
+  }
+
   r := gin.New()
   r.Use(gin.Logger(), gin.Recovery(), corsMiddleware(), middleware.APIKeyMiddleware(), middleware.RateLimitMiddleware(), middleware.QuotaMiddleware())
 
@@ -53,6 +97,8 @@ func main() {
     api.RegisterNodeRoutes(apiGroup)
     api.RegisterRuleRoutes(apiGroup)
     api.RegisterTunnelRoutes(apiGroup)
+    api.RegisterTemplateRoutes(apiGroup)
+    api.RegisterConfigRoutes(apiGroup)
     api.RegisterMonitorRoutes(apiGroup)
     api.RegisterUserRoutes(apiGroup)
     api.RegisterLogRoutes(apiGroup)
@@ -12,6 +12,11 @@ type Config struct {
 	DB     DBConfig     `mapstructure:"database"`
 	Auth   AuthConfig   `mapstructure:"auth"`
 	Log    LogConfig    `mapstructure:"log"`
+	Relay  RelayConfig  `mapstructure:"relay"`
+	Shaper ShaperConfig `mapstructure:"shaper"`
+	Ports  PortsConfig  `mapstructure:"ports"`
+	Agent  AgentConfig  `mapstructure:"agent"`
+	Rules  RulesConfig  `mapstructure:"rules"`
 }
 
 type ServerConfig struct {
@@ -34,12 +39,56 @@ type LogConfig struct {
 	File  string `mapstructure:"file"`
 }
 
+// RelayConfig 面板本机作为 relay 跳点时的监听配置，Port 为 0 表示不启用，启用时必须配置 Secret。
+type RelayConfig struct {
+	Host      string `mapstructure:"host"`
+	Port      int    `mapstructure:"port"`
+	Secret    string `mapstructure:"secret"`
+	Transport string `mapstructure:"transport"` // tcp, ws, wss, mws, mwss, h2
+	Path      string `mapstructure:"path"`
+	CertFile  string `mapstructure:"cert_file"`
+	KeyFile   string `mapstructure:"key_file"`
+}
+
+// ShaperConfig 主机出口整形，EgressLimit 为所有本地规则共享的总速率 bytes/s，0 表示不启用。
+// Weights 覆盖 interactive / standard / bulk 类别的默认权重 8 / 4 / 1。
+type ShaperConfig struct {
+	EgressLimit int64          `mapstructure:"egress_limit"`
+	Weights     map[string]int `mapstructure:"weights"`
+}
+
+// PortsConfig 端口自动分配池，格式如 "10000-20000,30000-30100"。
+// PanelRange 用于面板本机的规则，NodeRange 用于未单独配置 port_range 的节点。
+type PortsConfig struct {
+	PanelRange string `mapstructure:"panel_range"`
+	NodeRange  string `mapstructure:"node_range"`
+}
+
+// AgentConfig 节点 Agent 连接的存活检测，时间单位为秒。面板每 PingInterval 发送 WebSocket ping，
+// PongTimeout 内未收到任何消息即断开；连续 MissedHeartbeats 个 HeartbeatInterval 未收到心跳时注销会话。
+type AgentConfig struct {
+	PingInterval      int `mapstructure:"ping_interval"`
+	PongTimeout       int `mapstructure:"pong_timeout"`
+	HeartbeatInterval int `mapstructure:"heartbeat_interval"`
+	MissedHeartbeats  int `mapstructure:"missed_heartbeats"`
+}
+
+// RulesConfig 规则运行相关配置。CertDir 为 tcp 规则传输层 cert_file/key_file 所在目录，
+// 规则只能引用该目录内的文件；为空时规则不能引用证书文件。
+type RulesConfig struct {
+	CertDir string `mapstructure:"cert_dir"`
+}
+
 func DefaultConfig() *Config {
 	return &Config{
 		Server: ServerConfig{Host: "0.0.0.0", Port: 8080, Mode: "release"},
 		DB:     DBConfig{Type: "sqlite", DSN: "./data/folstingx.db"},
 		Auth:   AuthConfig{JWTSecret: "change-me"},
 		Log:    LogConfig{Level: "info", File: "./logs/app.log"},
+		Relay:  RelayConfig{Host: "0.0.0.0", Transport: "tcp"},
+		Ports:  PortsConfig{PanelRange: "20000-30000", NodeRange: "10000-60000"},
+		Agent:  AgentConfig{PingInterval: 15, PongTimeout: 45, HeartbeatInterval: 15, MissedHeartbeats: 3},
+		Shaper: ShaperConfig{Weights: map[string]int{"interactive": 8, "standard": 4, "bulk": 1}},
 	}
 }
 
@@ -60,6 +109,21 @@ func LoadConfig(path string) (*Config, error) {
 	v.SetDefault("auth.jwt_secret", def.Auth.JWTSecret)
 	v.SetDefault("log.level", def.Log.Level)
 	v.SetDefault("log.file", def.Log.File)
+	v.SetDefault("relay.host", def.Relay.Host)
+	v.SetDefault("relay.port", def.Relay.Port)
+	v.SetDefault("relay.secret", def.Relay.Secret)
+	v.SetDefault("relay.transport", def.Relay.Transport)
+	v.SetDefault("ports.panel_range", def.Ports.PanelRange)
+	v.SetDefault("ports.node_range", def.Ports.NodeRange)
+	v.SetDefault("agent.ping_interval", def.Agent.PingInterval)
+	v.SetDefault("agent.pong_timeout", def.Agent.PongTimeout)
+	v.SetDefault("agent.heartbeat_interval", def.Agent.HeartbeatInterval)
+	v.SetDefault("agent.missed_heartbeats", def.Agent.MissedHeartbeats)
+	v.SetDefault("shaper.egress_limit", def.Shaper.EgressLimit)
+	v.SetDefault("rules.cert_dir", def.Rules.CertDir)
+	for class, w := range def.Shaper.Weights {
+		v.SetDefault("shaper.weights."+class, w)
+	}
 
 	if err := v.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("read config failed: %w", err)
@@ -69,5 +133,20 @@ func LoadConfig(path string) (*Config, error) {
 	if err := v.Unmarshal(&cfg); err != nil {
 		return nil, fmt.Errorf("unmarshal config failed: %w", err)
 	}
+	// 空密钥派生的 relay 密钥人人可算，等同开放代理。
+	if cfg.Relay.Port > 0 && cfg.Relay.Secret == "" {
+		return nil, fmt.Errorf("relay.secret is required when relay.port is set")
+	}
+	if cfg.Shaper.EgressLimit < 0 {
+		return nil, fmt.Errorf("shaper.egress_limit must not be negative")
+	}
+	for class, w := range cfg.Shaper.Weights {
+		if _, ok := def.Shaper.Weights[class]; !ok {
+			return nil, fmt.Errorf("shaper.weights: unknown class %q", class)
+		}
+		if w <= 0 {
+			return nil, fmt.Errorf("shaper.weights.%s must be positive", class)
+		}
+	}
 	return &cfg, nil
 }
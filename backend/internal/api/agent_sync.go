@@ -0,0 +1,57 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+	"github.com/folstingx/server/internal/services"
+)
+
+// resyncNode 节点 Agent（重新）连接后，按启用中的隧道与转发重新下发该节点应运行的全部 gost 配置，
+// 并把结果记录到涉及的转发。Agent 保留配置（含引用的链路与限速）未变的同名服务，
+// 只重建有变化的服务，重连后的重新下发因此不会中断已有连接。
+func resyncNode(nodeID uint) {
+	var tunnelIDs []uint
+	if err := database.DB.Model(&models.ChainTunnel{}).Where("node_id = ?", nodeID).Distinct().Pluck("tunnel_id", &tunnelIDs).Error; err != nil || len(tunnelIDs) == 0 {
+		return
+	}
+	var tunnels []models.Tunnel
+	if err := database.DB.
+		Where("id IN ? AND is_active = ?", tunnelIDs, true).
+		Preload("ChainTunnels").
+		Preload("ChainTunnels.Node").
+		Preload("Forwards", "is_active = ?", true).
+		Find(&tunnels).Error; err != nil {
+		services.WriteSystemLog("error", "agent_hub", fmt.Sprintf("resync node %d: %v", nodeID, err))
+		return
+	}
+
+	var total, failed int
+	for _, tunnel := range tunnels {
+		steps, _ := tunnelDeploySteps(tunnel)
+		var own []deployStep
+		forwards := make(map[uint]bool)
+		for _, step := range steps {
+			if step.nodeID == nodeID {
+				own = append(own, step)
+				forwards[step.forwardID] = true
+			}
+		}
+		results := applyDeploySteps(own)
+		for id := range forwards {
+			recordDeployResult(id, results[id])
+			total++
+			if len(results[id]) > 0 {
+				failed++
+			}
+		}
+	}
+	if total > 0 {
+		level := "info"
+		if failed > 0 {
+			level = "warn"
+		}
+		services.WriteSystemLog(level, "agent_hub", fmt.Sprintf("resynced %d forwards to node %d, %d failed", total, nodeID, failed))
+	}
+}
@@ -0,0 +1,438 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 批量操作
+const (
+	batchEnable       = "enable"
+	batchDisable      = "disable"
+	batchDelete       = "delete"
+	batchSetOwner     = "set_owner"
+	batchSetBandwidth = "set_bandwidth"
+	batchMove         = "move"
+)
+
+// batchRequest 批量操作请求：ids 与 filter 至少给出一个，同时给出时取交集。
+type batchRequest struct {
+	Action         string `json:"action"`
+	IDs            []uint `json:"ids"`
+	Filter         string `json:"filter"`
+	OwnerID        *uint  `json:"owner_id"`        // set_owner，0 表示取消归属
+	BandwidthLimit *int64 `json:"bandwidth_limit"` // set_bandwidth，bytes/s
+	TunnelID       uint   `json:"tunnel_id"`       // move 的目标隧道
+	// Atomic 为 true 时任一项失败即整体回滚，否则仅回滚失败项。
+	Atomic bool `json:"atomic"`
+}
+
+type batchItemResult struct {
+	ID    uint   `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Action     string            `json:"action"`
+	Total      int               `json:"total"`
+	Succeeded  int               `json:"succeeded"`
+	Failed     int               `json:"failed"`
+	RolledBack bool              `json:"rolled_back,omitempty"`
+	Results    []batchItemResult `json:"results"`
+	// DeployErrors 提交后向节点下发配置时的错误，数据库变更不受影响。
+	DeployErrors []string `json:"deploy_errors,omitempty"`
+}
+
+// 各资源允许在过滤表达式中使用的列。
+var (
+	ruleFilterColumns    = []string{"id", "name", "protocol", "mode", "owner_id", "listen_node_id", "listen_port", "is_active", "priority_class", "quota_exceeded"}
+	forwardFilterColumns = []string{"id", "name", "protocol", "owner_id", "listen_port", "remote_address", "is_active", "quota_exceeded"}
+	nodeFilterColumns    = []string{"id", "name", "host", "location", "roles", "is_active", "is_online"}
+)
+
+// batchOps 按长度降序排列，保证 != >= <= 先于 = > < 匹配。
+var batchOps = []string{"!=", ">=", "<=", "=", ">", "<", "~"}
+
+// applyBatchFilter 解析过滤表达式，如 "protocol=tcp,owner_id=3,name~web"：
+// 支持 = != > < >= <= 与 ~（包含），多个条件以逗号分隔并取交集。
+func applyBatchFilter(q *gorm.DB, expr string, columns []string) (*gorm.DB, error) {
+	allowed := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		allowed[c] = true
+	}
+	for _, clause := range strings.Split(expr, ",") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		idx := strings.IndexAny(clause, "!=<>~")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid filter clause %q", clause)
+		}
+		op := ""
+		for _, candidate := range batchOps {
+			if strings.HasPrefix(clause[idx:], candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("invalid filter clause %q", clause)
+		}
+		field := strings.TrimSpace(clause[:idx])
+		raw := strings.TrimSpace(clause[idx+len(op):])
+		if !allowed[field] {
+			return nil, fmt.Errorf("filter field %q is not allowed", field)
+		}
+		if op == "~" {
+			q = q.Where(field+" LIKE ?", "%"+raw+"%")
+			continue
+		}
+		var value interface{} = raw
+		if b, err := strconv.ParseBool(raw); err == nil && (raw == "true" || raw == "false") {
+			value = b
+		} else if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			value = n
+		}
+		q = q.Where(field+" "+op+" ?", value)
+	}
+	return q, nil
+}
+
+// resolveBatchIDs 返回本次操作涉及的记录 ID；显式给出但不存在（或不满足过滤条件）的 ID 记为失败项。
+func resolveBatchIDs(scope *gorm.DB, req batchRequest, columns []string) ([]uint, []batchItemResult, error) {
+	if len(req.IDs) == 0 && strings.TrimSpace(req.Filter) == "" {
+		return nil, nil, errors.New("ids or filter is required")
+	}
+	q := scope
+	if req.Filter != "" {
+		var err error
+		if q, err = applyBatchFilter(q, req.Filter, columns); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(req.IDs) > 0 {
+		q = q.Where("id IN ?", req.IDs)
+	}
+	var ids []uint
+	if err := q.Order("id").Pluck("id", &ids).Error; err != nil {
+		return nil, nil, err
+	}
+	found := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		found[id] = true
+	}
+	var missing []batchItemResult
+	for _, id := range req.IDs {
+		if !found[id] {
+			missing = append(missing, batchItemResult{ID: id, Error: "not found"})
+			found[id] = true // 重复 ID 只报告一次
+		}
+	}
+	return ids, missing, nil
+}
+
+// runBatch 在一个事务内逐项执行 apply，每项使用独立保存点，失败项单独回滚；
+// atomic 为 true 时任一项失败即回滚整个事务。返回结果与事务是否已提交。
+func runBatch(ids []uint, atomic bool, apply func(tx *gorm.DB, id uint) error) ([]batchItemResult, bool) {
+	results := make([]batchItemResult, 0, len(ids))
+	errAbort := errors.New("batch aborted")
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		failed := false
+		for _, id := range ids {
+			err := tx.Transaction(func(item *gorm.DB) error { return apply(item, id) })
+			res := batchItemResult{ID: id, OK: err == nil}
+			if err != nil {
+				res.Error, failed = err.Error(), true
+			}
+			results = append(results, res)
+		}
+		if atomic && failed {
+			return errAbort
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errAbort) {
+		for i := range results {
+			if results[i].OK {
+				results[i].OK, results[i].Error = false, err.Error()
+			}
+		}
+	}
+	return results, err == nil
+}
+
+func newBatchResponse(action string, results, missing []batchItemResult, committed bool) batchResponse {
+	resp := batchResponse{Action: action, Results: append(results, missing...), RolledBack: !committed}
+	resp.Total = len(resp.Results)
+	for _, r := range resp.Results {
+		if r.OK && committed {
+			resp.Succeeded++
+		}
+	}
+	resp.Failed = resp.Total - resp.Succeeded
+	return resp
+}
+
+// validateBatchParams 校验各操作所需的参数。
+func validateBatchParams(req batchRequest, allowed ...string) error {
+	ok := false
+	for _, a := range allowed {
+		ok = ok || a == req.Action
+	}
+	if !ok {
+		return fmt.Errorf("unsupported action %q", req.Action)
+	}
+	switch req.Action {
+	case batchSetOwner:
+		if req.OwnerID == nil {
+			return errors.New("owner_id is required")
+		}
+		if *req.OwnerID > 0 {
+			var user models.User
+			if database.DB.Limit(1).Find(&user, *req.OwnerID).RowsAffected == 0 {
+				return fmt.Errorf("user %d not found", *req.OwnerID)
+			}
+		}
+	case batchSetBandwidth:
+		if req.BandwidthLimit == nil || *req.BandwidthLimit < 0 {
+			return errors.New("bandwidth_limit must be a non-negative number")
+		}
+	case batchMove:
+		if req.TunnelID == 0 {
+			return errors.New("tunnel_id is required")
+		}
+		var tunnel models.Tunnel
+		if database.DB.Limit(1).Find(&tunnel, req.TunnelID).RowsAffected == 0 {
+			return fmt.Errorf("tunnel %d not found", req.TunnelID)
+		}
+	}
+	return nil
+}
+
+// batchRules 批量启停、删除规则或修改归属与限速，提交后统一对账一次本地转发器。
+func batchRules(c *gin.Context) {
+	var req batchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+	if err := validateBatchParams(req, batchEnable, batchDisable, batchDelete, batchSetOwner, batchSetBandwidth); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ids, missing, err := resolveBatchIDs(database.DB.Model(&models.ForwardRule{}), req, ruleFilterColumns)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 删除前保存快照，提交后记入版本历史。
+	snapshots := make(map[uint][]byte)
+	if req.Action == batchDelete {
+		for _, id := range ids {
+			if snap, err := snapshotObject(database.DB, models.VersionKindRule, id); err == nil {
+				snapshots[id] = snap
+			}
+		}
+	}
+
+	results, committed := runBatch(ids, req.Atomic, func(tx *gorm.DB, id uint) error {
+		q := tx.Model(&models.ForwardRule{}).Where("id = ?", id)
+		switch req.Action {
+		case batchEnable, batchDisable:
+			return q.Update("is_active", req.Action == batchEnable).Error
+		case batchSetOwner:
+			return q.Update("owner_id", *req.OwnerID).Error
+		case batchSetBandwidth:
+			return q.Update("bandwidth_limit", *req.BandwidthLimit).Error
+		}
+		if err := app.ports.Release(tx, models.PortOwnerRule, id); err != nil {
+			return err
+		}
+		return tx.Delete(&models.ForwardRule{}, id).Error
+	})
+
+	if committed {
+		for _, r := range results {
+			if !r.OK {
+				continue
+			}
+			if req.Action == batchDelete {
+				if snap, ok := snapshots[r.ID]; ok {
+					saveVersion(c, models.VersionKindRule, r.ID, versionDelete, snap, 0)
+				}
+			} else {
+				recordVersion(c, models.VersionKindRule, r.ID, versionUpdate)
+			}
+			switch req.Action {
+			case batchDelete:
+				_, _ = app.capture.Stop(r.ID)
+				_ = app.forwarder.Stop(r.ID)
+				app.forwarder.Forget(r.ID)
+			case batchEnable:
+				// 手动启用时清除此前的失败退避，对账时立即尝试启动。
+				app.forwarder.Forget(r.ID)
+			case batchSetOwner, batchSetBandwidth:
+				var rule models.ForwardRule
+				if database.DB.Limit(1).Find(&rule, r.ID).RowsAffected > 0 {
+					app.forwarder.ApplyBandwidth(rule)
+				}
+			}
+		}
+		app.rules.Reconcile(time.Now())
+	}
+	c.JSON(http.StatusOK, newBatchResponse(req.Action, results, missing, committed))
+}
+
+// batchForwards 批量操作隧道下的转发，提交前撤下受影响隧道的服务，提交后按新状态统一重新下发一次。
+func batchForwards(c *gin.Context) {
+	tunnelID, _ := strconv.Atoi(c.Param("id"))
+	var tunnel models.Tunnel
+	if err := database.DB.First(&tunnel, tunnelID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "tunnel not found"})
+		return
+	}
+	var req batchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+	if err := validateBatchParams(req, batchEnable, batchDisable, batchDelete, batchSetOwner, batchSetBandwidth, batchMove); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Action == batchMove && req.TunnelID == tunnel.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "forwards are already in this tunnel"})
+		return
+	}
+	ids, missing, err := resolveBatchIDs(database.DB.Model(&models.Forward{}).Where("tunnel_id = ?", tunnel.ID), req, forwardFilterColumns)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	affected := []uint{tunnel.ID}
+	if req.Action == batchMove {
+		affected = append(affected, req.TunnelID)
+	}
+	if len(ids) > 0 {
+		for _, id := range affected {
+			undeploy(id)
+		}
+	}
+
+	results, committed := runBatch(ids, req.Atomic, func(tx *gorm.DB, id uint) error {
+		q := tx.Model(&models.Forward{}).Where("id = ?", id)
+		switch req.Action {
+		case batchEnable, batchDisable:
+			return q.Update("is_active", req.Action == batchEnable).Error
+		case batchSetOwner:
+			return q.Update("owner_id", *req.OwnerID).Error
+		case batchSetBandwidth:
+			return q.Update("bandwidth_limit", *req.BandwidthLimit).Error
+		case batchMove:
+			var fwd models.Forward
+			if err := tx.First(&fwd, id).Error; err != nil {
+				return err
+			}
+			fwd.TunnelID = req.TunnelID
+			if err := q.Update("tunnel_id", req.TunnelID).Error; err != nil {
+				return err
+			}
+			// 新隧道的入口节点上重新占用端口，冲突时该项失败。
+			return assignForwardPort(tx, &fwd)
+		}
+		if err := app.ports.Release(tx, models.PortOwnerForward, id); err != nil {
+			return err
+		}
+		return tx.Delete(&models.Forward{}, id).Error
+	})
+
+	resp := newBatchResponse(req.Action, results, missing, committed)
+	if len(ids) > 0 {
+		for _, id := range affected {
+			if committed && resp.Succeeded > 0 {
+				recordTunnelVersion(c, id)
+			}
+			for _, err := range redeployTunnel(id) {
+				resp.DeployErrors = append(resp.DeployErrors, err.Error())
+			}
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// redeployTunnel 按数据库当前状态重新下发启用中的隧道及其启用的转发。
+func redeployTunnel(tunnelID uint) []error {
+	var tunnel models.Tunnel
+	if err := database.DB.
+		Preload("ChainTunnels").
+		Preload("ChainTunnels.Node").
+		Preload("Forwards", "is_active = ?", true).
+		First(&tunnel, tunnelID).Error; err != nil {
+		return []error{err}
+	}
+	if !tunnel.IsActive || len(tunnel.Forwards) == 0 {
+		return nil
+	}
+	return deployTunnelToNodes(tunnel)
+}
+
+// batchNodes 批量启停或删除节点；仍被隧道链路或规则引用的节点不能删除。
+func batchNodes(c *gin.Context) {
+	var req batchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+	if err := validateBatchParams(req, batchEnable, batchDisable, batchDelete); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ids, missing, err := resolveBatchIDs(database.DB.Model(&models.Node{}), req, nodeFilterColumns)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	results, committed := runBatch(ids, req.Atomic, func(tx *gorm.DB, id uint) error {
+		if req.Action != batchDelete {
+			return tx.Model(&models.Node{}).Where("id = ?", id).Update("is_active", req.Action == batchEnable).Error
+		}
+		if err := nodeInUse(tx, id); err != nil {
+			return err
+		}
+		return tx.Delete(&models.Node{}, id).Error
+	})
+
+	if committed && req.Action == batchDelete && app.agentHub != nil {
+		for _, r := range results {
+			if r.OK && app.agentHub.IsOnline(r.ID) {
+				app.agentHub.Disconnect(r.ID)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, newBatchResponse(req.Action, results, missing, committed))
+}
+
+// nodeInUse 节点仍被隧道链路或规则（监听节点、链路节点）引用时返回错误。
+func nodeInUse(tx *gorm.DB, id uint) error {
+	var chains, rules int64
+	tx.Model(&models.ChainTunnel{}).Where("node_id = ?", id).Count(&chains)
+	tx.Model(&models.ForwardRule{}).Where("listen_node_id = ? OR chain_nodes LIKE ?", id, "%\""+strconv.Itoa(int(id))+"\"%").Count(&rules)
+	if chains > 0 || rules > 0 {
+		return fmt.Errorf("node is still used by %d chain hops and %d rules", chains, rules)
+	}
+	return nil
+}
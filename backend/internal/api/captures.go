@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+	"github.com/folstingx/server/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// ruleCapture 启动或停止规则的抓包/镜像：{"action":"start|stop","mode":"pcap|mirror",...}
+func ruleCapture(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var rule models.ForwardRule
+	if err := database.DB.First(&rule, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return
+	}
+	var input struct {
+		Action string `json:"action"`
+		services.CaptureRequest
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+
+	switch input.Action {
+	case "", "start":
+		rec, err := app.capture.Start(rule.ID, input.CaptureRequest)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, rec)
+	case "stop":
+		rec, err := app.capture.Stop(rule.ID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, rec)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "action must be start or stop"})
+	}
+}
+
+func listRuleCaptures(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var rows []models.RuleCapture
+	if err := database.DB.Where("rule_id = ?", id).Order("id DESC").Find(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// 进行中的抓包用实时字节数覆盖。
+	if active, ok := app.capture.Active(uint(id)); ok {
+		for i := range rows {
+			if rows[i].ID == active.ID {
+				rows[i] = active
+			}
+		}
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func downloadRuleCapture(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	cid, _ := strconv.Atoi(c.Param("cid"))
+	var rec models.RuleCapture
+	if err := database.DB.Where("id = ? AND rule_id = ?", cid, id).First(&rec).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "capture not found"})
+		return
+	}
+	if rec.Mode != "pcap" || rec.FilePath == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "capture has no file"})
+		return
+	}
+	if rec.Status == "running" {
+		c.JSON(http.StatusConflict, gin.H{"error": "capture still running"})
+		return
+	}
+	c.FileAttachment(rec.FilePath, rec.FileName)
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+	"github.com/folstingx/server/internal/services"
+	"github.com/folstingx/server/pkg/forwarder"
+	"github.com/gin-gonic/gin"
+)
+
+// 故障注入必须限定时间窗口，避免被遗忘在生产规则上。
+const maxChaosDuration = 24 * time.Hour
+
+// enableRuleChaos 在 duration 秒内为规则启用故障注入。
+func enableRuleChaos(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var rule models.ForwardRule
+	if err := database.DB.First(&rule, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return
+	}
+	// 故障注入只作用于本机转发器，节点 Agent 上运行的规则不支持。
+	if rule.ListenNodeID > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "fault injection is not supported on rules running on a node agent"})
+		return
+	}
+	var input struct {
+		forwarder.ChaosConfig
+		Duration int `json:"duration"` // 秒
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+	duration := time.Duration(input.Duration) * time.Second
+	if duration <= 0 || duration > maxChaosDuration {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "duration must be between 1 and 86400 seconds"})
+		return
+	}
+	if err := input.ChaosConfig.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	raw, _ := json.Marshal(input.ChaosConfig)
+	until := time.Now().Add(duration)
+	prevConfig, prevUntil := rule.ChaosConfig, rule.ChaosUntil
+	rule.ChaosConfig = string(raw)
+	rule.ChaosUntil = &until
+	if err := database.DB.Model(&rule).Updates(map[string]interface{}{"chaos_config": rule.ChaosConfig, "chaos_until": until}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := app.forwarder.SetChaos(rule); err != nil {
+		// 转发器不支持时恢复原配置，避免记录显示从未生效的故障注入。
+		_ = database.DB.Model(&rule).Updates(map[string]interface{}{"chaos_config": prevConfig, "chaos_until": prevUntil}).Error
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule.ChaosActive = true
+	services.WriteSystemLog("warn", "chaos", fmt.Sprintf("chaos enabled on rule %d (%s) until %s: %s", rule.ID, rule.Name, until.Format(time.RFC3339), raw))
+	c.JSON(http.StatusOK, rule)
+}
+
+func disableRuleChaos(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var rule models.ForwardRule
+	if err := database.DB.First(&rule, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return
+	}
+	if err := database.DB.Model(&rule).Updates(map[string]interface{}{"chaos_config": "", "chaos_until": nil}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rule.ChaosConfig, rule.ChaosUntil, rule.ChaosActive = "", nil, false
+	_ = app.forwarder.SetChaos(rule)
+	services.WriteSystemLog("info", "chaos", fmt.Sprintf("chaos disabled on rule %d (%s)", rule.ID, rule.Name))
+	c.JSON(http.StatusOK, rule)
+}
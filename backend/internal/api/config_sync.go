@@ -0,0 +1,1000 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/folstingx/server/config"
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/middleware"
+	"github.com/folstingx/server/internal/models"
+	"github.com/folstingx/server/internal/services"
+	"github.com/folstingx/server/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// configDocument 声明式配置文档，YAML 与 JSON 均可。
+// 对象按名称匹配：用户按 username，节点、隧道、规则按 name，转发按所属隧道内的 name，链路节点按顺序；
+// 引用一律写名称（owner、链路节点的 node、规则的 listen_node 与 chain_nodes）。
+// 只比较和写入文档中出现的字段；prune 为 true 时删除文档中出现的段落里未列出的对象，super_admin 用户不删除。
+type configDocument struct {
+	Prune   bool         `yaml:"prune"`
+	Users   []configItem `yaml:"users"`
+	Nodes   []configItem `yaml:"nodes"`
+	Tunnels []configItem `yaml:"tunnels"`
+	Rules   []configItem `yaml:"rules"`
+}
+
+type configItem = map[string]interface{}
+
+// 配置变更类型
+const (
+	configCreate = "create"
+	configUpdate = "update"
+	configDelete = "delete"
+)
+
+// configChange plan 中的一项变更，Fields 为更新时发生变化的字段。
+type configChange struct {
+	Kind   string   `json:"kind"` // user, node, tunnel, chain, forward, rule
+	Name   string   `json:"name"`
+	Action string   `json:"action"`
+	Fields []string `json:"fields,omitempty"`
+	ID     uint     `json:"id,omitempty"`
+}
+
+type configResult struct {
+	DryRun    bool           `json:"dry_run"`
+	Changes   []configChange `json:"changes"`
+	Unchanged int            `json:"unchanged"`
+
+	// 以下供 apply 后续处理：发生变化的规则与隧道（值为是否已删除），以及 apply 前已存在的隧道。
+	rules   map[uint]bool
+	tunnels map[uint]bool
+	existed map[uint]bool
+}
+
+// configReadOnly 由服务维护或需以名称引用的字段，不能出现在文档中。
+var configReadOnly = map[string]bool{
+	"id": true, "owner_id": true, "node_id": true, "tunnel_id": true, "listen_node_id": true, "chain_type": true,
+	"is_online": true, "agent_ver": true, "last_check": true, "latency_ms": true,
+	"traffic_used": true, "api_key": true,
+}
+
+// configAutoPorts 自动分配的端口字段：文档中为 0 时保留已分配的端口，避免每次 apply 重新分配。
+var configAutoPorts = []string{"listen_port", "port"}
+
+var hopTypes = map[string]int{"entry": models.ChainTypeEntry, "relay": models.ChainTypeRelay, "exit": models.ChainTypeExit}
+
+// errConfigDryRun 用于回滚 dry run 的事务。
+var errConfigDryRun = errors.New("dry run")
+
+func RegisterConfigRoutes(r *gin.RouterGroup) {
+	cfg := r.Group("/config")
+	cfg.Use(middleware.AuthMiddleware(app.cfg), middleware.RequireRoles(string(models.RoleSuperAdmin), string(models.RoleAdmin)))
+	{
+		cfg.POST("/apply", applyConfigDocument)
+	}
+}
+
+func parseConfigDocument(raw []byte) (configDocument, error) {
+	var doc configDocument
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil && err != io.EOF {
+		return doc, fmt.Errorf("parse config: %w", err)
+	}
+	return doc, nil
+}
+
+// applyConfigDocument 请求体为配置文档；dry_run=true 时只返回 plan。
+func applyConfigDocument(c *gin.Context) {
+	raw, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+	doc, err := parseConfigDocument(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	res, deployErrs, err := applyConfig(c, doc, c.Query("dry_run") == "true")
+	if err != nil {
+		// 收敛失败多为文档本身的问题（只读字段、引用不存在、校验失败），端口冲突仍返回 409。
+		status := portErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	var errStrs []string
+	for _, e := range deployErrs {
+		errStrs = append(errStrs, e.Error())
+	}
+	c.JSON(http.StatusOK, gin.H{"dry_run": res.DryRun, "changes": res.Changes, "unchanged": res.Unchanged, "deploy_errors": errStrs})
+}
+
+// applyConfig 先以回滚的事务生成 plan，有变化且非 dry run 时再正式执行：
+// 撤下将变化的隧道、提交、记录版本，然后停止变化的规则交由 RuleReconciler 按新配置启动，并重新下发隧道。
+// 命令行下没有转发器与 Agent 连接，只修改数据库。
+func applyConfig(c *gin.Context, doc configDocument, dryRun bool) (*configResult, []error, error) {
+	plan, err := convergeConfig(doc, true)
+	if err != nil || dryRun {
+		return plan, nil, err
+	}
+	if len(plan.Changes) == 0 {
+		plan.DryRun = false
+		return plan, nil, nil
+	}
+
+	snapshots := make(map[string][]byte)
+	for id, deleted := range plan.rules {
+		if deleted {
+			snapshots[models.VersionKindRule+strconv.Itoa(int(id))], _ = snapshotObject(database.DB, models.VersionKindRule, id)
+		}
+	}
+	for id, deleted := range plan.tunnels {
+		if deleted {
+			snapshots[models.VersionKindTunnel+strconv.Itoa(int(id))], _ = snapshotObject(database.DB, models.VersionKindTunnel, id)
+		}
+		if plan.existed[id] && app.agentHub != nil {
+			undeploy(id)
+		}
+	}
+
+	res, err := convergeConfig(doc, false)
+	if err != nil {
+		// 已撤下的隧道按数据库中未变的配置恢复。
+		for id := range plan.tunnels {
+			if plan.existed[id] && app.agentHub != nil {
+				_ = redeployTunnel(id)
+			}
+		}
+		return nil, nil, err
+	}
+
+	record := func(kind string, id uint, deleted bool) {
+		if !deleted {
+			recordVersion(c, kind, id, versionApply)
+		} else if snap := snapshots[kind+strconv.Itoa(int(id))]; snap != nil {
+			saveVersion(c, kind, id, versionDelete, snap, 0)
+		}
+	}
+	for id, deleted := range res.rules {
+		record(models.VersionKindRule, id, deleted)
+		if app.forwarder != nil {
+			_ = app.forwarder.Stop(id)
+			if deleted {
+				_, _ = app.capture.Stop(id)
+				app.forwarder.Forget(id)
+			}
+		}
+	}
+	if app.rules != nil && len(res.rules) > 0 {
+		app.rules.Reconcile(time.Now())
+	}
+
+	var deployErrs []error
+	for id, deleted := range res.tunnels {
+		record(models.VersionKindTunnel, id, deleted)
+		if !deleted && app.agentHub != nil {
+			deployErrs = append(deployErrs, redeployTunnel(id)...)
+		}
+	}
+	return res, deployErrs, nil
+}
+
+// convergeConfig 在一个事务内按用户、节点、隧道、规则的顺序收敛到文档状态，prune 按相反顺序删除；
+// dryRun 时回滚事务，返回的变更即 plan。
+func convergeConfig(doc configDocument, dryRun bool) (*configResult, error) {
+	res := &configResult{
+		DryRun:  dryRun,
+		Changes: []configChange{},
+		rules:   make(map[uint]bool),
+		tunnels: make(map[uint]bool),
+		existed: make(map[uint]bool),
+	}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		s := &configSync{tx: tx, res: res}
+		users, err := s.applyUsers(doc.Users)
+		if err != nil {
+			return err
+		}
+		nodes, err := s.applyNodes(doc.Nodes)
+		if err != nil {
+			return err
+		}
+		tunnels, err := s.applyTunnels(doc.Tunnels)
+		if err != nil {
+			return err
+		}
+		rules, err := s.applyRules(doc.Rules)
+		if err != nil {
+			return err
+		}
+		if doc.Prune {
+			// 段落缺失（nil）表示文档不管理该类对象。
+			if doc.Rules != nil {
+				if err := s.pruneRules(rules); err != nil {
+					return err
+				}
+			}
+			if doc.Tunnels != nil {
+				if err := s.pruneTunnels(tunnels); err != nil {
+					return err
+				}
+			}
+			if doc.Nodes != nil {
+				if err := s.pruneNodes(nodes); err != nil {
+					return err
+				}
+			}
+			if doc.Users != nil {
+				if err := s.pruneUsers(users); err != nil {
+					return err
+				}
+			}
+		}
+		if dryRun {
+			return errConfigDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errConfigDryRun) {
+		return nil, err
+	}
+	return res, nil
+}
+
+type configSync struct {
+	tx  *gorm.DB
+	res *configResult
+}
+
+// record 记录一项变更，返回对象是否有变化。
+func (s *configSync) record(kind, name string, found bool, id uint, fields []string) bool {
+	action := configUpdate
+	switch {
+	case !found:
+		action, fields = configCreate, nil
+	case len(fields) == 0:
+		s.res.Unchanged++
+		return false
+	}
+	s.res.Changes = append(s.res.Changes, configChange{Kind: kind, Name: name, Action: action, Fields: fields, ID: id})
+	return true
+}
+
+func (s *configSync) recordDelete(kind, name string, id uint) {
+	s.res.Changes = append(s.res.Changes, configChange{Kind: kind, Name: name, Action: configDelete, ID: id})
+}
+
+// cloneItem 复制文档对象并拒绝只读字段，名称引用在副本上解析。
+func cloneItem(raw interface{}, kind string) (configItem, error) {
+	src, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s entries must be objects", kind)
+	}
+	item := make(configItem, len(src))
+	for k, v := range src {
+		if configReadOnly[k] || snapshotVolatile[k] {
+			return nil, fmt.Errorf("%s: field %q is read-only", kind, k)
+		}
+		item[k] = v
+	}
+	return item, nil
+}
+
+func itemName(item configItem, key, kind string) (string, error) {
+	name, _ := item[key].(string)
+	if strings.TrimSpace(name) == "" {
+		return "", fmt.Errorf("%s: %s is required", kind, key)
+	}
+	return name, nil
+}
+
+func itemList(raw interface{}, what string) ([]interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list", what)
+	}
+	return list, nil
+}
+
+// configFields 按快照规则序列化对象，用于比较字段变化。
+func configFields(v interface{}) (map[string]interface{}, error) {
+	raw, err := encodeSnapshot(v, 1)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	return fields, json.Unmarshal(raw, &fields)
+}
+
+// overlayConfig 将文档对象的字段覆盖到 dst，返回值发生变化的字段。
+func overlayConfig(dst interface{}, item configItem) ([]string, error) {
+	before, err := configFields(dst)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range configAutoPorts {
+		if v, ok := item[k]; ok && fmt.Sprint(v) == "0" && fmt.Sprint(before[k]) != "0" {
+			delete(item, k)
+		}
+	}
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return nil, err
+	}
+	after, err := configFields(dst)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for k := range item {
+		if !reflect.DeepEqual(before[k], after[k]) {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func (s *configSync) lookupID(model interface{}, column, name, kind string) (uint, error) {
+	var ids []uint
+	if err := s.tx.Model(model).Where(column+" = ?", name).Limit(2).Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	switch len(ids) {
+	case 0:
+		return 0, fmt.Errorf("%s %q not found", kind, name)
+	case 1:
+		return ids[0], nil
+	}
+	return 0, fmt.Errorf("%s name %q is ambiguous", kind, name)
+}
+
+// resolveRef 将名称引用 key 替换为 ID 字段 idKey，空名称表示清除引用。
+func (s *configSync) resolveRef(item configItem, key, idKey string, model interface{}, column, kind string) error {
+	v, ok := item[key]
+	if !ok {
+		return nil
+	}
+	delete(item, key)
+	name, _ := v.(string)
+	if name == "" {
+		item[idKey] = 0
+		return nil
+	}
+	id, err := s.lookupID(model, column, name, kind)
+	if err != nil {
+		return err
+	}
+	item[idKey] = id
+	return nil
+}
+
+func (s *configSync) resolveOwner(item configItem) error {
+	return s.resolveRef(item, "owner", "owner_id", &models.User{}, "username", "user")
+}
+
+// findByName 按名称加载已有对象到切片 dst，同名对象多于一个时报错。
+func (s *configSync) findByName(dst interface{}, q *gorm.DB, column, name, kind string) (bool, error) {
+	res := q.Where(column+" = ?", name).Order("id").Limit(2).Find(dst)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected > 1 {
+		return false, fmt.Errorf("%s name %q is ambiguous", kind, name)
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// created 新建对象后补写显式停用：gorm 创建时对零值字段使用 default:true。
+func (s *configSync) created(dst interface{}, item configItem) error {
+	if v, ok := item["is_active"]; ok && v == false {
+		return s.tx.Model(dst).Update("is_active", false).Error
+	}
+	return nil
+}
+
+func (s *configSync) applyUsers(items []configItem) ([]uint, error) {
+	var keep []uint
+	for _, raw := range items {
+		item, err := cloneItem(raw, "user")
+		if err != nil {
+			return nil, err
+		}
+		name, err := itemName(item, "username", "user")
+		if err != nil {
+			return nil, err
+		}
+		var found []models.User
+		ok, err := s.findByName(&found, s.tx, "username", name, "user")
+		if err != nil {
+			return nil, err
+		}
+		var user models.User
+		if ok {
+			user = found[0]
+		}
+		password, _ := item["password"].(string)
+		delete(item, "password")
+		if !ok && password == "" {
+			return nil, fmt.Errorf("user %q: password is required for new users", name)
+		}
+
+		fields, err := overlayConfig(&user, item)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", name, err)
+		}
+		if password != "" && (!ok || !utils.CheckPassword(password, user.PasswordHash)) {
+			if user.PasswordHash, err = utils.HashPassword(password); err != nil {
+				return nil, err
+			}
+			fields = append(fields, "password")
+		}
+		switch user.Role {
+		case "":
+			user.Role = models.RoleUser
+		case models.RoleUser, models.RoleAdmin, models.RoleSuperAdmin:
+		default:
+			return nil, fmt.Errorf("user %q: invalid role %q", name, user.Role)
+		}
+		if err := user.BandwidthSchedule.Validate(); err != nil {
+			return nil, fmt.Errorf("user %q: %w", name, err)
+		}
+
+		if !ok {
+			user.APIKey = newAPIKey()
+			if err = s.tx.Create(&user).Error; err == nil {
+				err = s.created(&user, item)
+			}
+		} else if len(fields) > 0 {
+			err = s.tx.Save(&user).Error
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.record("user", name, ok, user.ID, fields)
+		keep = append(keep, user.ID)
+	}
+	return keep, nil
+}
+
+func (s *configSync) applyNodes(items []configItem) ([]uint, error) {
+	var keep []uint
+	for _, raw := range items {
+		item, err := cloneItem(raw, "node")
+		if err != nil {
+			return nil, err
+		}
+		name, err := itemName(item, "name", "node")
+		if err != nil {
+			return nil, err
+		}
+		var found []models.Node
+		ok, err := s.findByName(&found, s.tx, "name", name, "node")
+		if err != nil {
+			return nil, err
+		}
+		var node models.Node
+		if ok {
+			node = found[0]
+		}
+
+		fields, err := overlayConfig(&node, item)
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %w", name, err)
+		}
+		fillNodeDefaults(&node)
+		if _, err := services.ParsePortRanges(node.PortRange); err != nil {
+			return nil, fmt.Errorf("node %q: %w", name, err)
+		}
+
+		if !ok {
+			node.GenerateSecret()
+			if err = s.tx.Create(&node).Error; err == nil {
+				err = s.created(&node, item)
+			}
+		} else if len(fields) > 0 {
+			err = s.tx.Save(&node).Error
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.record("node", name, ok, node.ID, fields)
+		keep = append(keep, node.ID)
+	}
+	return keep, nil
+}
+
+// applyTunnels 出现 chain 时链路按列表顺序整体替换，出现 forwards 时隧道内未列出的转发被删除。
+func (s *configSync) applyTunnels(items []configItem) ([]uint, error) {
+	var keep []uint
+	for _, raw := range items {
+		item, err := cloneItem(raw, "tunnel")
+		if err != nil {
+			return nil, err
+		}
+		name, err := itemName(item, "name", "tunnel")
+		if err != nil {
+			return nil, err
+		}
+		chain, hasChain := item["chain"]
+		forwards, hasForwards := item["forwards"]
+		delete(item, "chain")
+		delete(item, "forwards")
+		if err := s.resolveOwner(item); err != nil {
+			return nil, fmt.Errorf("tunnel %q: %w", name, err)
+		}
+
+		var found []models.Tunnel
+		ok, err := s.findByName(&found, s.tx, "name", name, "tunnel")
+		if err != nil {
+			return nil, err
+		}
+		var tunnel models.Tunnel
+		if ok {
+			tunnel = found[0]
+		}
+		fields, err := overlayConfig(&tunnel, item)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel %q: %w", name, err)
+		}
+		if tunnel.TrafficRatio <= 0 {
+			tunnel.TrafficRatio = 1.0
+		}
+		if !ok {
+			if err = s.tx.Create(&tunnel).Error; err == nil {
+				err = s.created(&tunnel, item)
+			}
+		} else if len(fields) > 0 {
+			err = s.tx.Save(&tunnel).Error
+		}
+		if err != nil {
+			return nil, err
+		}
+		changed := s.record("tunnel", name, ok, tunnel.ID, fields)
+
+		entryMoved := false
+		if hasChain {
+			c, moved, err := s.syncChain(tunnel.ID, name, chain)
+			if err != nil {
+				return nil, err
+			}
+			changed, entryMoved = changed || c, moved
+		}
+		if hasForwards {
+			c, err := s.syncForwards(tunnel.ID, name, forwards)
+			if err != nil {
+				return nil, err
+			}
+			changed = changed || c
+		}
+		if entryMoved {
+			if err := reassignForwardPorts(s.tx, tunnel.ID); err != nil {
+				return nil, fmt.Errorf("tunnel %q: %w", name, err)
+			}
+		}
+		if changed {
+			s.res.tunnels[tunnel.ID] = false
+			s.res.existed[tunnel.ID] = ok
+		}
+		keep = append(keep, tunnel.ID)
+	}
+	return keep, nil
+}
+
+// syncChain 按位置匹配链路节点，返回是否有变化以及入口节点是否改变。
+func (s *configSync) syncChain(tunnelID uint, tunnelName string, raw interface{}) (bool, bool, error) {
+	list, err := itemList(raw, fmt.Sprintf("tunnel %q chain", tunnelName))
+	if err != nil {
+		return false, false, err
+	}
+	var current []models.ChainTunnel
+	if err := s.tx.Where("tunnel_id = ?", tunnelID).Order("sort_index, id").Find(&current).Error; err != nil {
+		return false, false, err
+	}
+	oldEntry, _ := services.EntryNodeID(s.tx, tunnelID)
+
+	changed := false
+	for i, el := range list {
+		hopName := fmt.Sprintf("%s#%d", tunnelName, i+1)
+		item, err := cloneItem(el, "chain hop")
+		if err != nil {
+			return false, false, err
+		}
+		if err := s.resolveRef(item, "node", "node_id", &models.Node{}, "name", "node"); err != nil {
+			return false, false, fmt.Errorf("chain hop %s: %w", hopName, err)
+		}
+		if v, ok := item["type"]; ok {
+			delete(item, "type")
+			t, ok := hopTypes[fmt.Sprint(v)]
+			if !ok {
+				return false, false, fmt.Errorf("chain hop %s: type must be entry, relay or exit", hopName)
+			}
+			item["chain_type"] = t
+		}
+		if _, ok := item["sort_index"]; !ok {
+			item["sort_index"] = i
+		}
+
+		found := i < len(current)
+		var hop models.ChainTunnel
+		if found {
+			hop = current[i]
+		}
+		fields, err := overlayConfig(&hop, item)
+		if err != nil {
+			return false, false, fmt.Errorf("chain hop %s: %w", hopName, err)
+		}
+		if hop.NodeID == 0 || hop.ChainType < models.ChainTypeEntry || hop.ChainType > models.ChainTypeExit {
+			return false, false, fmt.Errorf("chain hop %s: node and type are required", hopName)
+		}
+		hop.TunnelID = tunnelID
+		if found && len(fields) == 0 {
+			s.record("chain", hopName, true, hop.ID, nil)
+			continue
+		}
+		if err := s.tx.Save(&hop).Error; err != nil {
+			return false, false, err
+		}
+		if hop.ChainType == models.ChainTypeEntry {
+			err = app.ports.Release(s.tx, models.PortOwnerChain, hop.ID)
+		} else {
+			var port int
+			port, err = app.ports.Assign(s.tx, hop.NodeID, hop.Port, models.PortOwnerChain, hop.ID)
+			if err == nil && port != hop.Port {
+				hop.Port = port
+				err = s.tx.Model(&hop).Update("port", port).Error
+			}
+		}
+		if err != nil {
+			return false, false, fmt.Errorf("chain hop %s: %w", hopName, err)
+		}
+		changed = s.record("chain", hopName, found, hop.ID, fields) || changed
+	}
+
+	for i := len(list); i < len(current); i++ {
+		hop := current[i]
+		if err := app.ports.Release(s.tx, models.PortOwnerChain, hop.ID); err != nil {
+			return false, false, err
+		}
+		if err := s.tx.Delete(&models.ChainTunnel{}, hop.ID).Error; err != nil {
+			return false, false, err
+		}
+		s.recordDelete("chain", fmt.Sprintf("%s#%d", tunnelName, i+1), hop.ID)
+		changed = true
+	}
+
+	newEntry, _ := services.EntryNodeID(s.tx, tunnelID)
+	return changed, newEntry != oldEntry, nil
+}
+
+func (s *configSync) syncForwards(tunnelID uint, tunnelName string, raw interface{}) (bool, error) {
+	list, err := itemList(raw, fmt.Sprintf("tunnel %q forwards", tunnelName))
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	keep := []uint{0}
+	for _, el := range list {
+		item, err := cloneItem(el, "forward")
+		if err != nil {
+			return false, err
+		}
+		name, err := itemName(item, "name", "forward")
+		if err != nil {
+			return false, err
+		}
+		fwdName := tunnelName + "/" + name
+		if err := s.resolveOwner(item); err != nil {
+			return false, fmt.Errorf("forward %s: %w", fwdName, err)
+		}
+
+		var found []models.Forward
+		ok, err := s.findByName(&found, s.tx.Where("tunnel_id = ?", tunnelID), "name", name, "forward")
+		if err != nil {
+			return false, err
+		}
+		var fwd models.Forward
+		if ok {
+			fwd = found[0]
+		}
+		scheduleOff := fwd.ScheduleOff
+		fields, err := overlayConfig(&fwd, item)
+		if err != nil {
+			return false, fmt.Errorf("forward %s: %w", fwdName, err)
+		}
+		keep = append(keep, fwd.ID)
+		if ok && len(fields) == 0 {
+			s.record("forward", fwdName, true, fwd.ID, nil)
+			continue
+		}
+
+		fwd.TunnelID = tunnelID
+		if fwd.Protocol == "" {
+			fwd.Protocol = "tcp"
+		}
+		if err := validateForwardPolicy(&fwd); err != nil {
+			return false, fmt.Errorf("forward %s: %w", fwdName, err)
+		}
+		if ok {
+			// 已部署的入口服务由 ActivationScheduler 按状态变化移除或重新下发。
+			fwd.ScheduleOff = scheduleOff
+		}
+		if err := saveForwardTx(s.tx, &fwd); err != nil {
+			return false, fmt.Errorf("forward %s: %w", fwdName, err)
+		}
+		if !ok {
+			if err := s.created(&fwd, item); err != nil {
+				return false, err
+			}
+		}
+		if fwd.InboundEnabled && fwd.InboundConfig == "" {
+			fwd.InboundConfig = generateInboundConfig(fwd.InboundType, fwd.ListenPort)
+			if err := s.tx.Model(&fwd).Update("inbound_config", fwd.InboundConfig).Error; err != nil {
+				return false, err
+			}
+		}
+		keep[len(keep)-1] = fwd.ID
+		changed = s.record("forward", fwdName, ok, fwd.ID, fields) || changed
+	}
+
+	var stale []models.Forward
+	if err := s.tx.Where("tunnel_id = ? AND id NOT IN ?", tunnelID, keep).Find(&stale).Error; err != nil {
+		return false, err
+	}
+	for _, fwd := range stale {
+		if err := s.deleteForward(fwd.ID); err != nil {
+			return false, err
+		}
+		s.recordDelete("forward", tunnelName+"/"+fwd.Name, fwd.ID)
+		changed = true
+	}
+	return changed, nil
+}
+
+func (s *configSync) deleteForward(id uint) error {
+	if err := app.ports.Release(s.tx, models.PortOwnerForward, id); err != nil {
+		return err
+	}
+	if err := s.tx.Where("forward_id = ?", id).Delete(&models.ForwardPort{}).Error; err != nil {
+		return err
+	}
+	return s.tx.Delete(&models.Forward{}, id).Error
+}
+
+func (s *configSync) applyRules(items []configItem) ([]uint, error) {
+	var keep []uint
+	for _, raw := range items {
+		item, err := cloneItem(raw, "rule")
+		if err != nil {
+			return nil, err
+		}
+		name, err := itemName(item, "name", "rule")
+		if err != nil {
+			return nil, err
+		}
+		if err := s.resolveOwner(item); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", name, err)
+		}
+		if err := s.resolveRef(item, "listen_node", "listen_node_id", &models.Node{}, "name", "node"); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", name, err)
+		}
+		if v, ok := item["chain_nodes"]; ok {
+			names, err := itemList(v, fmt.Sprintf("rule %q chain_nodes", name))
+			if err != nil {
+				return nil, err
+			}
+			ids := make([]string, 0, len(names))
+			for _, n := range names {
+				id, err := s.lookupID(&models.Node{}, "name", fmt.Sprint(n), "node")
+				if err != nil {
+					return nil, fmt.Errorf("rule %q: %w", name, err)
+				}
+				ids = append(ids, strconv.Itoa(int(id)))
+			}
+			item["chain_nodes"] = ids
+		}
+
+		var found []models.ForwardRule
+		ok, err := s.findByName(&found, s.tx, "name", name, "rule")
+		if err != nil {
+			return nil, err
+		}
+		var rule models.ForwardRule
+		if ok {
+			rule = found[0]
+		}
+		fields, err := overlayConfig(&rule, item)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", name, err)
+		}
+		keep = append(keep, rule.ID)
+		if ok && len(fields) == 0 {
+			s.record("rule", name, true, rule.ID, nil)
+			continue
+		}
+
+		normalizeRuleDefaults(&rule)
+		if err := validateRule(&rule); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", name, err)
+		}
+		if err := saveRuleTx(s.tx, &rule); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", name, err)
+		}
+		if !ok {
+			if err := s.created(&rule, item); err != nil {
+				return nil, err
+			}
+		}
+		keep[len(keep)-1] = rule.ID
+		s.record("rule", name, ok, rule.ID, fields)
+		s.res.rules[rule.ID] = false
+	}
+	return keep, nil
+}
+
+func (s *configSync) pruneRules(keep []uint) error {
+	var stale []models.ForwardRule
+	if err := s.tx.Where("id NOT IN ?", append(keep, 0)).Find(&stale).Error; err != nil {
+		return err
+	}
+	for _, rule := range stale {
+		if err := app.ports.Release(s.tx, models.PortOwnerRule, rule.ID); err != nil {
+			return err
+		}
+		if err := s.tx.Delete(&models.ForwardRule{}, rule.ID).Error; err != nil {
+			return err
+		}
+		s.recordDelete("rule", rule.Name, rule.ID)
+		s.res.rules[rule.ID] = true
+	}
+	return nil
+}
+
+func (s *configSync) pruneTunnels(keep []uint) error {
+	var stale []models.Tunnel
+	if err := s.tx.Where("id NOT IN ?", append(keep, 0)).Find(&stale).Error; err != nil {
+		return err
+	}
+	for _, tunnel := range stale {
+		var chainIDs, fwdIDs []uint
+		s.tx.Model(&models.ChainTunnel{}).Where("tunnel_id = ?", tunnel.ID).Pluck("id", &chainIDs)
+		s.tx.Model(&models.Forward{}).Where("tunnel_id = ?", tunnel.ID).Pluck("id", &fwdIDs)
+		if err := app.ports.Release(s.tx, models.PortOwnerChain, chainIDs...); err != nil {
+			return err
+		}
+		for _, id := range fwdIDs {
+			if err := s.deleteForward(id); err != nil {
+				return err
+			}
+		}
+		if err := s.tx.Where("tunnel_id = ?", tunnel.ID).Delete(&models.ChainTunnel{}).Error; err != nil {
+			return err
+		}
+		if err := s.tx.Delete(&models.Tunnel{}, tunnel.ID).Error; err != nil {
+			return err
+		}
+		s.recordDelete("tunnel", tunnel.Name, tunnel.ID)
+		s.res.tunnels[tunnel.ID] = true
+		s.res.existed[tunnel.ID] = true
+	}
+	return nil
+}
+
+func (s *configSync) pruneNodes(keep []uint) error {
+	var stale []models.Node
+	if err := s.tx.Where("id NOT IN ?", append(keep, 0)).Find(&stale).Error; err != nil {
+		return err
+	}
+	for _, node := range stale {
+		if err := nodeInUse(s.tx, node.ID); err != nil {
+			return fmt.Errorf("prune node %q: %w", node.Name, err)
+		}
+		if err := s.tx.Delete(&models.Node{}, node.ID).Error; err != nil {
+			return err
+		}
+		s.recordDelete("node", node.Name, node.ID)
+	}
+	return nil
+}
+
+func (s *configSync) pruneUsers(keep []uint) error {
+	var stale []models.User
+	if err := s.tx.Where("id NOT IN ? AND role <> ?", append(keep, 0), models.RoleSuperAdmin).Find(&stale).Error; err != nil {
+		return err
+	}
+	for _, user := range stale {
+		if err := s.tx.Delete(&models.User{}, user.ID).Error; err != nil {
+			return err
+		}
+		s.recordDelete("user", user.Username, user.ID)
+	}
+	return nil
+}
+
+// RunConfigCommand 实现 server 的 config 子命令：
+//
+//	config plan  -f folstingx.yaml
+//	config apply -f folstingx.yaml [--dry-run]
+//
+// 命令行直接修改数据库：运行中的面板由 RuleReconciler 启停规则，
+// 已运行规则的配置变化需重载规则，隧道变化需重新部署（POST /tunnels/:id/deploy）。
+func RunConfigCommand(cfg *config.Config, ports *services.PortAllocator, args []string) error {
+	if len(args) == 0 || (args[0] != "plan" && args[0] != "apply") {
+		return errors.New("usage: config plan|apply -f <file> [--dry-run]")
+	}
+	fs := flag.NewFlagSet("config "+args[0], flag.ContinueOnError)
+	file := fs.String("f", "", "config document (YAML or JSON), - for stdin")
+	dryRun := fs.Bool("dry-run", false, "print the plan without applying it")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("-f is required")
+	}
+	var raw []byte
+	var err error
+	if *file == "-" {
+		raw, err = io.ReadAll(os.Stdin)
+	} else {
+		raw, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+	doc, err := parseConfigDocument(raw)
+	if err != nil {
+		return err
+	}
+
+	app = &appContext{cfg: cfg, ports: ports}
+	res, _, err := applyConfig(nil, doc, args[0] == "plan" || *dryRun)
+	if err != nil {
+		return err
+	}
+	printConfigResult(os.Stdout, res)
+	return nil
+}
+
+func printConfigResult(w io.Writer, res *configResult) {
+	marks := map[string]string{configCreate: "+", configUpdate: "~", configDelete: "-"}
+	for _, ch := range res.Changes {
+		line := fmt.Sprintf("%s %s %s", marks[ch.Action], ch.Kind, ch.Name)
+		if len(ch.Fields) > 0 {
+			line += " (" + strings.Join(ch.Fields, ", ") + ")"
+		}
+		fmt.Fprintln(w, line)
+	}
+	verb := "applied"
+	if res.DryRun {
+		verb = "planned"
+	}
+	fmt.Fprintf(w, "%d changes %s, %d unchanged\n", len(res.Changes), verb, res.Unchanged)
+}
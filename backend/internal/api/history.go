@@ -0,0 +1,470 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+	"github.com/folstingx/server/internal/services"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 版本记录的操作
+const (
+	versionCreate   = "create"
+	versionUpdate   = "update"
+	versionDelete   = "delete"
+	versionImport   = "import"
+	versionRollback = "rollback"
+	versionApply    = "apply"
+)
+
+// snapshotVolatile 运行中由服务维护或只读的字段，不入快照，回滚时保留当前值。
+var snapshotVolatile = map[string]bool{
+	"created_at": true, "updated_at": true,
+	"traffic_up": true, "traffic_down": true, "flow_in": true, "flow_out": true, "connections": true,
+	"quota_used": true, "quota_exceeded": true, "quota_reset_at": true,
+	"schedule_off": true, "next_change": true, "runtime": true,
+	"deploy_status": true, "deploy_error": true, "deployed_at": true,
+	"chaos_config": true, "chaos_until": true, "chaos_active": true,
+}
+
+// snapshotAssociations 关联对象只在顶层布局中保留，嵌套的一律去掉。
+var snapshotAssociations = map[string]bool{
+	"node": true, "tunnel": true, "chain_tunnels": true, "forwards": true, "forward_ports": true,
+}
+
+// errVersionMissing 对象不存在，无法生成快照。
+var errVersionMissing = errors.New("object not found")
+
+func stripSnapshot(node interface{}, depth int) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if snapshotVolatile[k] || (depth > 0 && snapshotAssociations[k]) {
+				delete(n, k)
+				continue
+			}
+			stripSnapshot(v, depth+1)
+		}
+	case []interface{}:
+		for _, v := range n {
+			stripSnapshot(v, depth+1)
+		}
+	}
+}
+
+// encodeSnapshot 序列化并去掉运行字段；depth 为 0 时保留顶层的关联（隧道布局）。
+func encodeSnapshot(v interface{}, depth int) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	if err := json.Unmarshal(raw, &tree); err != nil {
+		return nil, err
+	}
+	stripSnapshot(tree, depth)
+	return json.Marshal(tree)
+}
+
+// snapshotObject 生成规则或隧道（含链路节点与转发）当前配置的快照。
+func snapshotObject(tx *gorm.DB, kind string, id uint) ([]byte, error) {
+	if kind == models.VersionKindRule {
+		var rule models.ForwardRule
+		if res := tx.Limit(1).Find(&rule, id); res.Error != nil || res.RowsAffected == 0 {
+			return nil, errVersionMissing
+		}
+		return encodeSnapshot(rule, 0)
+	}
+	var layout tunnelLayout
+	if res := tx.Limit(1).Find(&layout.Tunnel, id); res.Error != nil || res.RowsAffected == 0 {
+		return nil, errVersionMissing
+	}
+	if err := tx.Where("tunnel_id = ?", id).Order("sort_index, id").Find(&layout.Chain).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("tunnel_id = ?", id).Order("id").Find(&layout.Forwards).Error; err != nil {
+		return nil, err
+	}
+	return encodeSnapshot(layout, 0)
+}
+
+// saveVersion 追加一个版本，与最新版本内容相同时不重复记录。
+func saveVersion(c *gin.Context, kind string, id uint, action string, snapshot []byte, from int) {
+	var last models.ConfigVersion
+	database.DB.Where("kind = ? AND ref_id = ?", kind, id).Order("version DESC").Limit(1).Find(&last)
+	if action != versionDelete && action != versionRollback && bytes.Equal(last.Snapshot, snapshot) {
+		return
+	}
+	v := models.ConfigVersion{Kind: kind, RefID: id, Version: last.Version + 1, Action: action, Snapshot: snapshot, RolledBackFrom: from}
+	if c != nil {
+		userIDAny, _ := c.Get("user_id")
+		v.AuthorID, _ = userIDAny.(uint)
+		v.Author = c.GetString("username")
+	}
+	if err := database.DB.Create(&v).Error; err != nil {
+		services.WriteSystemLog("warn", "history", fmt.Sprintf("record %s %d version: %v", kind, id, err))
+	}
+}
+
+// recordVersion 在修改成功后记录对象的新版本；删除需在删除前调用 snapshotObject 并以 versionDelete 保存。
+func recordVersion(c *gin.Context, kind string, id uint, action string) {
+	snapshot, err := snapshotObject(database.DB, kind, id)
+	if err != nil {
+		return
+	}
+	saveVersion(c, kind, id, action, snapshot, 0)
+}
+
+// recordTunnelVersion 链路节点与转发的修改记入所属隧道的版本。
+func recordTunnelVersion(c *gin.Context, tunnelID uint) {
+	recordVersion(c, models.VersionKindTunnel, tunnelID, versionUpdate)
+}
+
+func listRuleVersions(c *gin.Context)   { listVersions(c, models.VersionKindRule) }
+func listTunnelVersions(c *gin.Context) { listVersions(c, models.VersionKindTunnel) }
+func getRuleVersion(c *gin.Context)     { getVersion(c, models.VersionKindRule) }
+func getTunnelVersion(c *gin.Context)   { getVersion(c, models.VersionKindTunnel) }
+func diffRuleVersions(c *gin.Context)   { diffVersions(c, models.VersionKindRule) }
+func diffTunnelVersions(c *gin.Context) { diffVersions(c, models.VersionKindTunnel) }
+
+func listVersions(c *gin.Context, kind string) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var versions []models.ConfigVersion
+	if err := database.DB.Omit("snapshot").Where("kind = ? AND ref_id = ?", kind, id).Order("version DESC").Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, versions)
+}
+
+func findVersion(kind string, id uint, version int) (models.ConfigVersion, error) {
+	var v models.ConfigVersion
+	res := database.DB.Where("kind = ? AND ref_id = ? AND version = ?", kind, id, version).Limit(1).Find(&v)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return v, fmt.Errorf("version %d not found", version)
+	}
+	return v, res.Error
+}
+
+func getVersion(c *gin.Context, kind string) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	version, _ := strconv.Atoi(c.Param("version"))
+	v, err := findVersion(kind, uint(id), version)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, v)
+}
+
+// versionChange 两个版本间单个字段的差异，新增/删除的字段一侧为 null。
+type versionChange struct {
+	Path string      `json:"path"`
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// flattenSnapshot 将快照展开为 路径→值；带 id 的对象数组按 id 定位（如 forwards[id=3].listen_port），
+// 使排序或插入不会让后续元素全部显示为变化。这些元素本身另记入 objects，整条新增或删除时作为一处差异。
+func flattenSnapshot(prefix string, node interface{}, out, objects map[string]interface{}) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			p := k
+			if prefix != "" {
+				p = prefix + "." + k
+			}
+			flattenSnapshot(p, v, out, objects)
+		}
+	case []interface{}:
+		for i, v := range n {
+			key := fmt.Sprintf("%s[%d]", prefix, i)
+			if obj, ok := v.(map[string]interface{}); ok {
+				if id, ok := obj["id"]; ok {
+					key = fmt.Sprintf("%s[id=%v]", prefix, id)
+					objects[key] = obj
+				}
+			}
+			flattenSnapshot(key, v, out, objects)
+		}
+		if len(n) == 0 {
+			out[prefix] = n
+		}
+	default:
+		out[prefix] = n
+	}
+}
+
+func diffSnapshots(from, to []byte) ([]versionChange, error) {
+	var a, b interface{}
+	if err := json.Unmarshal(from, &a); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(to, &b); err != nil {
+		return nil, err
+	}
+	fa, fb := map[string]interface{}{}, map[string]interface{}{}
+	oa, ob := map[string]interface{}{}, map[string]interface{}{}
+	flattenSnapshot("", a, fa, oa)
+	flattenSnapshot("", b, fb, ob)
+
+	changes := []versionChange{}
+	// 整条新增或删除的数组元素只报告一次，并从逐字段比较中去掉。
+	whole := func(objs, other map[string]interface{}, removed bool) {
+		for key, obj := range objs {
+			if _, ok := other[key]; ok {
+				continue
+			}
+			if removed {
+				changes = append(changes, versionChange{Path: key, From: obj})
+			} else {
+				changes = append(changes, versionChange{Path: key, To: obj})
+			}
+			for p := range fa {
+				if strings.HasPrefix(p, key+".") {
+					delete(fa, p)
+				}
+			}
+			for p := range fb {
+				if strings.HasPrefix(p, key+".") {
+					delete(fb, p)
+				}
+			}
+		}
+	}
+	whole(oa, ob, true)
+	whole(ob, oa, false)
+	for p, va := range fa {
+		if vb, ok := fb[p]; !ok || !reflect.DeepEqual(va, vb) {
+			changes = append(changes, versionChange{Path: p, From: va, To: fb[p]})
+		}
+	}
+	for p, vb := range fb {
+		if _, ok := fa[p]; !ok {
+			changes = append(changes, versionChange{Path: p, To: vb})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// diffVersions 比较两个版本：?from=1&to=3，省略 to 时与当前配置比较。
+func diffVersions(c *gin.Context, kind string) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	fromVer, err := strconv.Atoi(c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from is required"})
+		return
+	}
+	from, err := findVersion(kind, uint(id), fromVer)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	var to []byte
+	toLabel := c.Query("to")
+	if toLabel == "" {
+		toLabel = "current"
+		if to, err = snapshotObject(database.DB, kind, uint(id)); err != nil {
+			to = []byte("{}")
+		}
+	} else {
+		toVer, _ := strconv.Atoi(toLabel)
+		v, err := findVersion(kind, uint(id), toVer)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		to = v.Snapshot
+	}
+	changes, err := diffSnapshots(from.Snapshot, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"from": fromVer, "to": toLabel, "changes": changes})
+}
+
+// rollbackRule 恢复规则到指定版本（已删除的规则按原 ID 重建）并重新加载转发器。
+func rollbackRule(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	version, _ := strconv.Atoi(c.Param("version"))
+	v, err := findVersion(models.VersionKindRule, uint(id), version)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 在当前记录上覆盖快照中的配置字段，流量与配额用量等保持不变。
+	var rule models.ForwardRule
+	database.DB.Limit(1).Find(&rule, id)
+	if err := json.Unmarshal(v.Snapshot, &rule); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rule.ID = uint(id)
+	normalizeRuleDefaults(&rule)
+	if err := validateRule(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := saveRule(&rule); err != nil {
+		c.JSON(portErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	_ = app.forwarder.Reload(rule)
+	_ = applyInbound(rule)
+	if snapshot, err := snapshotObject(database.DB, models.VersionKindRule, rule.ID); err == nil {
+		saveVersion(c, models.VersionKindRule, rule.ID, versionRollback, snapshot, version)
+	}
+	withRuntime(&rule)
+	c.JSON(http.StatusOK, rule)
+}
+
+// rollbackTunnel 恢复隧道及其链路节点、转发到指定版本：多出的链路节点与转发被删除，
+// 缺少的按原 ID 重建，端口重新占用，隧道启用时重新下发。
+func rollbackTunnel(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	version, _ := strconv.Atoi(c.Param("version"))
+	v, err := findVersion(models.VersionKindTunnel, uint(id), version)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	var layout tunnelLayout
+	if err := json.Unmarshal(v.Snapshot, &layout); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, chain := range layout.Chain {
+		var count int64
+		database.DB.Model(&models.Node{}).Where("id = ?", chain.NodeID).Count(&count)
+		if count == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("node %d used by chain %d no longer exists", chain.NodeID, chain.ID)})
+			return
+		}
+	}
+
+	undeploy(uint(id))
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		var tunnel models.Tunnel
+		tx.Limit(1).Find(&tunnel, id)
+		if err := overlaySnapshot(&tunnel, layout.Tunnel); err != nil {
+			return err
+		}
+		tunnel.ID = uint(id)
+		if err := tx.Save(&tunnel).Error; err != nil {
+			return err
+		}
+		if err := rollbackChains(tx, tunnel.ID, layout.Chain); err != nil {
+			return err
+		}
+		return rollbackForwards(tx, tunnel.ID, layout.Forwards)
+	})
+	if err != nil {
+		c.JSON(portErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	if snapshot, err := snapshotObject(database.DB, models.VersionKindTunnel, uint(id)); err == nil {
+		saveVersion(c, models.VersionKindTunnel, uint(id), versionRollback, snapshot, version)
+	}
+	var errStrs []string
+	for _, e := range redeployTunnel(uint(id)) {
+		errStrs = append(errStrs, e.Error())
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "rolled back", "version": version, "deploy_errors": errStrs})
+}
+
+// overlaySnapshot 将快照对象中的配置字段覆盖到 dst，快照未包含的字段保持原值。
+func overlaySnapshot(dst, snapshot interface{}) error {
+	raw, err := encodeSnapshot(snapshot, 1)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, dst)
+}
+
+func rollbackChains(tx *gorm.DB, tunnelID uint, chains []models.ChainTunnel) error {
+	keep := make([]uint, 0, len(chains))
+	for _, ch := range chains {
+		keep = append(keep, ch.ID)
+	}
+	var stale []uint
+	tx.Model(&models.ChainTunnel{}).Where("tunnel_id = ? AND id NOT IN ?", tunnelID, append(keep, 0)).Pluck("id", &stale)
+	if err := app.ports.Release(tx, models.PortOwnerChain, stale...); err != nil {
+		return err
+	}
+	if len(stale) > 0 {
+		if err := tx.Delete(&models.ChainTunnel{}, stale).Error; err != nil {
+			return err
+		}
+	}
+	for _, snap := range chains {
+		var chain models.ChainTunnel
+		tx.Limit(1).Find(&chain, snap.ID)
+		if err := overlaySnapshot(&chain, snap); err != nil {
+			return err
+		}
+		chain.TunnelID = tunnelID
+		if err := tx.Save(&chain).Error; err != nil {
+			return err
+		}
+		if chain.ChainType == models.ChainTypeEntry {
+			if err := app.ports.Release(tx, models.PortOwnerChain, chain.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		port, err := app.ports.Assign(tx, chain.NodeID, chain.Port, models.PortOwnerChain, chain.ID)
+		if err != nil {
+			return fmt.Errorf("chain %d: %w", chain.ID, err)
+		}
+		if port != chain.Port {
+			if err := tx.Model(&chain).Update("port", port).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func rollbackForwards(tx *gorm.DB, tunnelID uint, forwards []models.Forward) error {
+	keep := make([]uint, 0, len(forwards))
+	for _, f := range forwards {
+		keep = append(keep, f.ID)
+	}
+	var stale []uint
+	tx.Model(&models.Forward{}).Where("tunnel_id = ? AND id NOT IN ?", tunnelID, append(keep, 0)).Pluck("id", &stale)
+	if err := app.ports.Release(tx, models.PortOwnerForward, stale...); err != nil {
+		return err
+	}
+	if len(stale) > 0 {
+		if err := tx.Delete(&models.Forward{}, stale).Error; err != nil {
+			return err
+		}
+	}
+	for _, snap := range forwards {
+		var fwd models.Forward
+		tx.Limit(1).Find(&fwd, snap.ID)
+		if err := overlaySnapshot(&fwd, snap); err != nil {
+			return err
+		}
+		fwd.TunnelID = tunnelID
+		if err := saveForwardTx(tx, &fwd); err != nil {
+			return fmt.Errorf("forward %d: %w", fwd.ID, err)
+		}
+	}
+	return nil
+}
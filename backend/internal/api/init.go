@@ -13,11 +13,16 @@ type appContext struct {
 	gost      *services.GostManager
 	hub       *MonitorHub
 	agentHub  *services.AgentHub
+	capture   *services.CaptureManager
+	quota     *services.QuotaEnforcer
+	ports     *services.PortAllocator
+	rules     *services.RuleReconciler
+	schedule  *services.ActivationScheduler
 }
 
 var app *appContext
 
-func Init(cfg *config.Config, fm *services.ForwardManager, tc *services.TrafficCollector, xray *services.XrayManager, gost *services.GostManager, ah *services.AgentHub) {
+func Init(cfg *config.Config, fm *services.ForwardManager, tc *services.TrafficCollector, xray *services.XrayManager, gost *services.GostManager, ah *services.AgentHub, pa *services.PortAllocator) {
 	app = &appContext{
 		cfg:       cfg,
 		forwarder: fm,
@@ -26,6 +31,16 @@ func Init(cfg *config.Config, fm *services.ForwardManager, tc *services.TrafficC
 		gost:      gost,
 		hub:       NewMonitorHub(),
 		agentHub:  ah,
+		capture:   services.NewCaptureManager(fm),
+		quota:     services.NewQuotaEnforcer(fm, ah, redeployForward),
+		ports:     pa,
+		rules:     services.NewRuleReconciler(fm),
+		schedule:  services.NewActivationScheduler(fm, ah, redeployForward),
 	}
+	migrateLegacyRules()
+	ah.OnRegister(resyncNode)
 	app.hub.Start()
+	app.quota.Start()
+	app.rules.Start()
+	app.schedule.Start()
 }
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+	"github.com/folstingx/server/internal/services"
+)
+
+// migrateLegacyRules 补齐升级前创建的规则缺少的字段，须在转发器启动规则前调用。
+func migrateLegacyRules() {
+	backfillInboundConfigs()
+	backfillRuleProtocols()
+}
+
+// backfillRuleProtocols 把旧版 protocol 取值（空、tcp+udp、大写等）改写为已注册的转发类型，
+// both 仍由前端使用故保留；同时把 options 列出现前留下的 NULL 改为空串。
+func backfillRuleProtocols() {
+	var rules []models.ForwardRule
+	if err := database.DB.Select("id", "name", "protocol", "options").Find(&rules).Error; err != nil {
+		services.WriteSystemLog("error", "migrate", "load rule protocols: "+err.Error())
+		return
+	}
+	for _, rule := range rules {
+		kind := services.NormalizeProtocol(rule.Protocol)
+		if rule.Protocol == kind || rule.Protocol == "both" {
+			continue
+		}
+		if err := database.DB.Model(&models.ForwardRule{}).Where("id = ?", rule.ID).Update("protocol", kind).Error; err != nil {
+			services.WriteSystemLog("error", "migrate", fmt.Sprintf("backfill protocol for rule %d: %v", rule.ID, err))
+			continue
+		}
+		services.WriteSystemLog("info", "migrate", fmt.Sprintf("rule %d (%s): protocol %q -> %q", rule.ID, rule.Name, rule.Protocol, kind))
+	}
+	if err := database.DB.Model(&models.ForwardRule{}).Where("options IS NULL").Update("options", "").Error; err != nil {
+		services.WriteSystemLog("error", "migrate", "backfill rule options: "+err.Error())
+	}
+}
+
+// backfillInboundConfigs 为 inbound_config 为空的 shadowsocks 入站生成凭据。
+// 该列出现之前创建的规则没有凭据，原生实现会拒绝启动。
+func backfillInboundConfigs() {
+	var rules []models.ForwardRule
+	if err := database.DB.Where("inbound_proxy_enabled = ? AND inbound_type = ? AND (inbound_config = '' OR inbound_config IS NULL)", true, "shadowsocks").
+		Find(&rules).Error; err != nil {
+		services.WriteSystemLog("error", "migrate", "load shadowsocks rules: "+err.Error())
+		return
+	}
+	for _, rule := range rules {
+		cfg := generateInboundConfig(rule.InboundType, rule.ListenPort)
+		if err := database.DB.Model(&models.ForwardRule{}).Where("id = ?", rule.ID).Update("inbound_config", cfg).Error; err != nil {
+			services.WriteSystemLog("error", "migrate", fmt.Sprintf("backfill inbound_config for rule %d: %v", rule.ID, err))
+			continue
+		}
+		services.WriteSystemLog("info", "migrate", fmt.Sprintf("generated shadowsocks credentials for rule %d (%s)", rule.ID, rule.Name))
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -108,7 +109,13 @@ func monitorTraffic(c *gin.Context) {
 		from = time.Now().AddDate(0, 0, -1)
 	}
 
+	// 默认返回主机快照（rule_id=forward_id=0），指定 rule_id 或 forward_id 时返回该规则或隧道转发的按小时统计。
+	ruleID, _ := strconv.Atoi(c.DefaultQuery("rule_id", "0"))
+	forwardID, _ := strconv.Atoi(c.DefaultQuery("forward_id", "0"))
+	if ruleID > 0 {
+		forwardID = 0
+	}
 	var stats []models.TrafficStat
-	_ = database.DB.Where("created_at >= ?", from).Order("created_at ASC").Find(&stats).Error
+	_ = database.DB.Where("rule_id = ? AND forward_id = ? AND created_at >= ?", ruleID, forwardID, from).Order("created_at ASC").Find(&stats).Error
 	c.JSON(http.StatusOK, stats)
 }
@@ -1,16 +1,22 @@
 ﻿package api
 
 import (
+  "encoding/hex"
   "encoding/json"
+  "errors"
+  "net"
   "net/http"
   "strconv"
   "strings"
+  "time"
 
   "github.com/folstingx/server/internal/database"
   "github.com/folstingx/server/internal/middleware"
   "github.com/folstingx/server/internal/models"
   "github.com/folstingx/server/internal/services"
+  "github.com/folstingx/server/pkg/agentproto"
   "github.com/gin-gonic/gin"
+  "github.com/gorilla/websocket"
 )
 
 func RegisterNodeRoutes(r *gin.RouterGroup) {
@@ -18,11 +24,14 @@ func RegisterNodeRoutes(r *gin.RouterGroup) {
   nodes.Use(middleware.AuthMiddleware(app.cfg), middleware.RequireRoles(string(models.RoleSuperAdmin), string(models.RoleAdmin)))
   {
     nodes.GET("", listNodes)
+    nodes.GET("/events", listNodeEvents)
     nodes.POST("", createNode)
+    nodes.POST("/batch", batchNodes)
     nodes.GET("/:id", getNode)
     nodes.PUT("/:id", updateNode)
     nodes.DELETE("/:id", deleteNode)
     nodes.POST("/:id/check", checkNode)
+    nodes.GET("/:id/latency", nodeLatency)
     nodes.GET("/:id/install-command", getInstallCommand)
     nodes.POST("/:id/regenerate-secret", regenerateSecret)
 
@@ -60,6 +69,10 @@ func createNode(c *gin.Context) {
     return
   }
   fillNodeDefaults(&node)
+  if _, err := services.ParsePortRanges(node.PortRange); err != nil {
+    c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+    return
+  }
   node.GenerateSecret() // 自动生成 Agent 认证密钥
 
   if err := database.DB.Create(&node).Error; err != nil {
@@ -93,6 +106,10 @@ func updateNode(c *gin.Context) {
   }
   node.ID = uint(id)
   fillNodeDefaults(&node)
+  if _, err := services.ParsePortRanges(node.PortRange); err != nil {
+    c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+    return
+  }
 
   if err := database.DB.Save(&node).Error; err != nil {
     c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -126,6 +143,39 @@ func checkNode(c *gin.Context) {
   c.JSON(http.StatusOK, gin.H{"latency_ms": latency, "online": latency >= 0})
 }
 
+// listNodeEvents 节点上下线事件，按时间倒序，可按 node_id 过滤。
+func listNodeEvents(c *gin.Context) {
+  limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+  if limit <= 0 || limit > 1000 {
+    limit = 100
+  }
+  q := database.DB.Order("id DESC").Limit(limit)
+  if nodeID, _ := strconv.Atoi(c.Query("node_id")); nodeID > 0 {
+    q = q.Where("node_id = ?", nodeID)
+  }
+  var events []models.NodeEvent
+  if err := q.Find(&events).Error; err != nil {
+    c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+    return
+  }
+  c.JSON(http.StatusOK, events)
+}
+
+// nodeLatency 节点 Agent ping/pong 往返时延历史，period=day|week。
+func nodeLatency(c *gin.Context) {
+  id, _ := strconv.Atoi(c.Param("id"))
+  from := time.Now().AddDate(0, 0, -1)
+  if c.Query("period") == "week" {
+    from = time.Now().AddDate(0, 0, -7)
+  }
+  var samples []models.NodeLatency
+  if err := database.DB.Where("node_id = ? AND created_at >= ?", id, from).Order("created_at ASC").Find(&samples).Error; err != nil {
+    c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+    return
+  }
+  c.JSON(http.StatusOK, samples)
+}
+
 func importNodes(c *gin.Context) {
   file, err := c.FormFile("file")
   if err != nil {
@@ -234,6 +284,12 @@ func fillNodeDefaults(node *models.Node) {
   if node.AgentPort == 0 {
     node.AgentPort = 8443
   }
+  if node.RelayPort == 0 {
+    node.RelayPort = 9443
+  }
+  if node.RelayTransport == "" {
+    node.RelayTransport = "tcp"
+  }
 }
 
 // ==================== 安装命令 & Agent ====================
@@ -272,7 +328,9 @@ func getInstallCommand(c *gin.Context) {
   })
 }
 
-// regenerateSecret 重新生成节点密钥
+// regenerateSecret 重新生成节点密钥。先写库再经 rotate_secret 推送给在线的 Agent，
+// Agent 未确认时恢复旧密钥（库与 Agent 两侧），避免任何一侧只留下对方不认识的密钥；
+// 离线时直接更换，需在节点上更新 Agent 配置。
 func regenerateSecret(c *gin.Context) {
   id, _ := strconv.Atoi(c.Param("id"))
   var node models.Node
@@ -280,12 +338,37 @@ func regenerateSecret(c *gin.Context) {
     c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
     return
   }
+  oldSecret := node.Secret
   node.GenerateSecret()
-  if err := database.DB.Save(&node).Error; err != nil {
+  if err := database.DB.Model(&node).Update("secret", node.Secret).Error; err != nil {
     c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
     return
   }
-  c.JSON(http.StatusOK, gin.H{"message": "secret regenerated", "secret": node.Secret})
+  agentUpdated := true
+  if err := app.agentHub.RotateSecret(node.ID, node.Secret); errors.Is(err, services.ErrAgentOffline) {
+    agentUpdated = false
+  } else if err != nil {
+    // 确认超时时 Agent 可能已保存新密钥，一并推回旧密钥。
+    _ = app.agentHub.RotateSecret(node.ID, oldSecret)
+    if rbErr := database.DB.Model(&node).Update("secret", oldSecret).Error; rbErr != nil {
+      services.WriteSystemLog("error", "nodes", "roll back secret for node "+strconv.Itoa(int(node.ID))+": "+rbErr.Error())
+    }
+    c.JSON(http.StatusBadGateway, gin.H{"error": "agent did not confirm the new secret: " + err.Error()})
+    return
+  }
+  reloadChainRules(node.ID)
+  c.JSON(http.StatusOK, gin.H{"message": "secret regenerated", "secret": node.Secret, "agent_updated": agentUpdated})
+}
+
+// reloadChainRules relay 密钥由节点密钥派生，更换后重载经由该节点中转的运行中规则。
+func reloadChainRules(nodeID uint) {
+  var rules []models.ForwardRule
+  database.DB.Where("chain_nodes LIKE ?", "%\""+strconv.Itoa(int(nodeID))+"\"%").Find(&rules)
+  for _, rule := range rules {
+    if app.forwarder.Runtime(rule.ID).State == models.RuleStateRunning {
+      _ = app.forwarder.Reload(rule)
+    }
+  }
 }
 
 // serveInstallScript 提供节点安装脚本下载
@@ -295,18 +378,23 @@ func serveInstallScript(c *gin.Context) {
   c.String(200, nodeInstallScript)
 }
 
-// AgentWSHandler 节点 Agent WebSocket 连接入口
+// AgentWSHandler 节点 Agent WebSocket 连接入口，nonce 为 Agent 生成的握手 nonce（hex），见 agentproto。
 func AgentWSHandler(c *gin.Context) {
-  secret := c.Query("secret")
-  if secret == "" {
-    c.JSON(401, gin.H{"error": "missing secret"})
+  nodeID, err := strconv.Atoi(c.Query("node_id"))
+  if err != nil || nodeID <= 0 {
+    c.JSON(http.StatusBadRequest, gin.H{"error": "missing or invalid node_id, agent protocol v3 required"})
+    return
+  }
+  agentNonce, err := hex.DecodeString(c.Query("nonce"))
+  if err != nil || len(agentNonce) != agentproto.NonceSize {
+    c.JSON(http.StatusBadRequest, gin.H{"error": "missing or invalid nonce, agent protocol v3 required"})
     return
   }
 
-  // 通过 secret 查找节点
+  // 按 ID 查找节点，密钥由握手中的 Auth 证明，不出现在 URL 中
   var node models.Node
-  if err := database.DB.Where("secret = ?", secret).First(&node).Error; err != nil {
-    c.JSON(401, gin.H{"error": "invalid secret"})
+  if err := database.DB.First(&node, nodeID).Error; err != nil || node.Secret == "" {
+    c.JSON(401, gin.H{"error": "unknown node"})
     return
   }
 
@@ -315,15 +403,34 @@ func AgentWSHandler(c *gin.Context) {
     return
   }
 
-  session := app.agentHub.Register(node.ID, node.Name, node.Secret, conn)
-  defer app.agentHub.Unregister(node.ID)
+  session, err := app.agentHub.Register(node.ID, node.Name, node.Secret, agentNonce, conn)
+  if err != nil {
+    if errors.Is(err, services.ErrAgentAuth) {
+      msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "authentication failed")
+      _ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+    }
+    _ = conn.Close()
+    return
+  }
+  reason := "connection closed"
+  defer func() { app.agentHub.Unregister(session, reason) }()
 
   for {
     _, msg, err := conn.ReadMessage()
     if err != nil {
+      var ne net.Error
+      if errors.As(err, &ne) && ne.Timeout() {
+        reason = "pong timeout"
+      } else if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+        reason = "closed by agent"
+      }
+      break
+    }
+    // 无法解密或疑似重放的消息说明连接不可信，直接断开。
+    if err := app.agentHub.HandleReport(session, msg); err != nil {
+      reason = "rejected message: " + err.Error()
       break
     }
-    app.agentHub.HandleReport(session.NodeID, session.Secret, msg)
   }
 }
 
@@ -332,9 +439,10 @@ const nodeInstallScript = `#!/usr/bin/env bash
 set -euo pipefail
 
 # FolstingX Node Agent 安装脚本
-# 用法: bash install.sh -a <panel_addr> -s <secret>
+# 用法: bash install.sh -a <panel_addr> -n <node_id> -s <secret>
 
 PANEL_ADDR=""
+NODE_ID=""
 SECRET=""
 INSTALL_DIR="/etc/folstingx_agent"
 SERVICE_NAME="folstingx-agent"
@@ -342,14 +450,15 @@ SERVICE_NAME="folstingx-agent"
 while [[ $# -gt 0 ]]; do
   case "$1" in
     -a|--addr) PANEL_ADDR="$2"; shift 2 ;;
+    -n|--node) NODE_ID="$2"; shift 2 ;;
     -s|--secret) SECRET="$2"; shift 2 ;;
     -d|--dir) INSTALL_DIR="$2"; shift 2 ;;
     *) echo "未知参数: $1"; exit 1 ;;
   esac
 done
 
-if [[ -z "${PANEL_ADDR}" ]] || [[ -z "${SECRET}" ]]; then
-  echo "用法: bash install.sh -a <panel_addr> -s <secret>"
+if [[ -z "${PANEL_ADDR}" ]] || [[ -z "${NODE_ID}" ]] || [[ -z "${SECRET}" ]]; then
+  echo "用法: bash install.sh -a <panel_addr> -n <node_id> -s <secret>"
   exit 1
 fi
 
@@ -382,6 +491,7 @@ chmod +x "${INSTALL_DIR}/gost"
 cat > "${INSTALL_DIR}/config.json" <<EOF
 {
   "addr": "${PANEL_ADDR}",
+  "node_id": ${NODE_ID},
   "secret": "${SECRET}"
 }
 EOF
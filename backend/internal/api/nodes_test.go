@@ -0,0 +1,171 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/folstingx/server/config"
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+	"github.com/folstingx/server/internal/services"
+	"github.com/folstingx/server/pkg/agentproto"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// testAgent 以节点密钥完成握手的模拟 Agent，记录收到的 rotate_secret 密钥，reject 时一律回复错误。
+type testAgent struct {
+	mu      sync.Mutex
+	secrets []string
+}
+
+func (a *testAgent) received() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.secrets...)
+}
+
+func dialTestAgent(t *testing.T, url string, node models.Node, reject bool) *testAgent {
+	t.Helper()
+	agentNonce := agentproto.NewNonce()
+	ws, _, err := websocket.DefaultDialer.Dial(url+"?node_id="+strconv.Itoa(int(node.ID))+"&nonce="+hex.EncodeToString(agentNonce), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ws.Close() })
+	var hello agentproto.Hello
+	if err := ws.ReadJSON(&hello); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteJSON(agentproto.Auth{Type: "auth", MAC: agentproto.AuthMAC(node.Secret, agentNonce, hello.Nonce)}); err != nil {
+		t.Fatal(err)
+	}
+	toAgent, toPanel := agentproto.SessionKeys(node.Secret, agentNonce, hello.Nonce)
+
+	a := &testAgent{}
+	go func() {
+		var seq agentproto.Sequencer
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			var cmd agentproto.Command
+			if err := agentproto.Open(toAgent, msg, &cmd); err != nil {
+				return
+			}
+			rep := agentproto.Report{Type: "response", ID: cmd.ID}
+			if cmd.Action == "rotate_secret" {
+				var data struct{ Secret string }
+				_ = json.Unmarshal(cmd.Data, &data)
+				a.mu.Lock()
+				a.secrets = append(a.secrets, data.Secret)
+				a.mu.Unlock()
+				if reject {
+					rep = agentproto.Report{Type: "error", ID: cmd.ID, Data: json.RawMessage(`"cannot write config"`)}
+				}
+			}
+			rep.Seq, rep.Time = seq.Stamp(time.Now())
+			out, _ := agentproto.Seal(toPanel, rep)
+			if err := ws.WriteMessage(websocket.TextMessage, out); err != nil {
+				return
+			}
+		}
+	}()
+	return a
+}
+
+func TestRegenerateSecret(t *testing.T) {
+	// 系统日志写在工作目录下的 logs/，测试期间切到临时目录。
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	cfg := config.DefaultConfig()
+	cfg.DB.DSN = t.TempDir() + "/test.db"
+	if err := database.Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	app = &appContext{cfg: cfg, forwarder: services.NewForwardManager(), agentHub: services.NewAgentHub()}
+	r := gin.New()
+	r.GET("/ws/agent", AgentWSHandler)
+	r.POST("/nodes/:id/regenerate-secret", regenerateSecret)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/agent"
+
+	cases := []struct {
+		name   string
+		online bool
+		reject bool
+		code   int
+		// 期望 Agent 依次收到的密钥，new/old 分别代表新旧密钥。
+		pushed  []string
+		rotated bool // 库中密钥是否为新密钥
+		updated bool // 响应中的 agent_updated
+	}{
+		{"agent confirms", true, false, http.StatusOK, []string{"new"}, true, true},
+		{"agent rejects, rolled back", true, true, http.StatusBadGateway, []string{"new", "old"}, false, false},
+		{"agent offline", false, false, http.StatusOK, nil, true, false},
+	}
+	for i, c := range cases {
+		node := models.Node{Name: "n" + strconv.Itoa(i), Host: "10.0.0." + strconv.Itoa(i+1), SSHUser: "root", Secret: "old-secret-" + strconv.Itoa(i)}
+		if err := database.DB.Create(&node).Error; err != nil {
+			t.Fatal(err)
+		}
+		var agent *testAgent
+		if c.online {
+			agent = dialTestAgent(t, url, node, c.reject)
+			deadline := time.Now().Add(2 * time.Second)
+			for !app.agentHub.IsOnline(node.ID) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/nodes/"+strconv.Itoa(int(node.ID))+"/regenerate-secret", nil))
+		if w.Code != c.code {
+			t.Fatalf("%s: status %d: %s", c.name, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Secret       string `json:"secret"`
+			AgentUpdated bool   `json:"agent_updated"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.AgentUpdated != c.updated {
+			t.Errorf("%s: agent_updated=%v", c.name, resp.AgentUpdated)
+		}
+
+		var stored models.Node
+		database.DB.First(&stored, node.ID)
+		if rotated := stored.Secret != node.Secret; rotated != c.rotated {
+			t.Errorf("%s: stored secret rotated=%v", c.name, rotated)
+		}
+		if c.rotated && stored.Secret != resp.Secret {
+			t.Errorf("%s: response secret differs from the stored one", c.name)
+		}
+		if agent == nil {
+			continue
+		}
+		got := agent.received()
+		if len(got) != len(c.pushed) {
+			t.Fatalf("%s: agent received %d secrets, want %d", c.name, len(got), len(c.pushed))
+		}
+		for j, want := range c.pushed {
+			if want == "old" && got[j] != node.Secret || want == "new" && got[j] == node.Secret {
+				t.Errorf("%s: push %d sent the wrong secret", c.name, j)
+			}
+		}
+	}
+}
@@ -2,10 +2,14 @@
 
 import (
   "crypto/rand"
+  "encoding/base64"
   "errors"
   "encoding/hex"
   "encoding/json"
+  "fmt"
+  "net"
   "net/http"
+  "net/url"
   "strconv"
   "strings"
   "time"
@@ -13,7 +17,10 @@ import (
   "github.com/folstingx/server/internal/database"
   "github.com/folstingx/server/internal/middleware"
   "github.com/folstingx/server/internal/models"
+  "github.com/folstingx/server/internal/services"
+  "github.com/folstingx/server/pkg/forwarder"
   "github.com/gin-gonic/gin"
+  "gorm.io/gorm"
 )
 
 func RegisterRuleRoutes(r *gin.RouterGroup) {
@@ -22,6 +29,9 @@ func RegisterRuleRoutes(r *gin.RouterGroup) {
   {
     rules.GET("", listRules)
     rules.POST("", createRule)
+    rules.GET("/types", listRuleTypes)
+    rules.POST("/validate", validateRuleDryRun)
+    rules.POST("/batch", batchRules)
     rules.GET("/:id", getRule)
     rules.PUT("/:id", updateRule)
     rules.DELETE("/:id", deleteRule)
@@ -30,6 +40,17 @@ func RegisterRuleRoutes(r *gin.RouterGroup) {
     rules.PUT("/:id/disable", disableRule)
     rules.GET("/:id/stats", ruleStats)
     rules.GET("/:id/inbound", inboundPreview)
+    rules.PUT("/:id/chaos", enableRuleChaos)
+    rules.DELETE("/:id/chaos", disableRuleChaos)
+    // 抓包会复制转发中的明文流量，仅管理员可用
+    adminOnly := middleware.RequireRoles(string(models.RoleSuperAdmin), string(models.RoleAdmin))
+    rules.POST("/:id/capture", adminOnly, ruleCapture)
+    rules.GET("/:id/captures", adminOnly, listRuleCaptures)
+    rules.GET("/:id/captures/:cid/download", adminOnly, downloadRuleCapture)
+    rules.GET("/:id/versions", listRuleVersions)
+    rules.GET("/:id/versions/:version", getRuleVersion)
+    rules.GET("/:id/diff", diffRuleVersions)
+    rules.POST("/:id/rollback/:version", rollbackRule)
 
     rules.POST("/import", importRules)
     rules.POST("/import-text", importRulesText)
@@ -43,6 +64,9 @@ func listRules(c *gin.Context) {
     c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
     return
   }
+  for i := range rules {
+    withRuntime(&rules[i])
+  }
   c.JSON(http.StatusOK, rules)
 }
 
@@ -54,22 +78,30 @@ func createRule(c *gin.Context) {
   }
   normalizeRuleDefaults(&rule)
 
-  if err := validateInboundRule(&rule); err != nil {
+  if err := validateRule(&rule); err != nil {
     c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
     return
   }
 
-  if err := database.DB.Create(&rule).Error; err != nil {
-    c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+  if err := saveRule(&rule); err != nil {
+    c.JSON(portErrorStatus(err), gin.H{"error": err.Error()})
     return
   }
+  // 启动失败记录在运行状态中，由 RuleReconciler 退避重试。
   if rule.IsActive {
     _ = app.forwarder.Start(rule)
   }
   _ = applyInbound(rule)
+  recordVersion(c, models.VersionKindRule, rule.ID, versionCreate)
+  withRuntime(&rule)
   c.JSON(http.StatusCreated, rule)
 }
 
+// listRuleTypes 列出已注册的转发类型及其选项 JSON Schema，供前端生成表单。
+func listRuleTypes(c *gin.Context) {
+  c.JSON(http.StatusOK, forwarder.Kinds())
+}
+
 func getRule(c *gin.Context) {
   id, _ := strconv.Atoi(c.Param("id"))
   var rule models.ForwardRule
@@ -77,6 +109,7 @@ func getRule(c *gin.Context) {
     c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
     return
   }
+  withRuntime(&rule)
   c.JSON(http.StatusOK, rule)
 }
 
@@ -88,34 +121,51 @@ func updateRule(c *gin.Context) {
     return
   }
 
+  chaosConfig, chaosUntil := existing.ChaosConfig, existing.ChaosUntil
   if err := c.ShouldBindJSON(&existing); err != nil {
     c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
     return
   }
   existing.ID = uint(id)
+  // 故障注入只能通过 /rules/:id/chaos 修改。
+  existing.ChaosConfig, existing.ChaosUntil = chaosConfig, chaosUntil
   normalizeRuleDefaults(&existing)
 
-  if err := validateInboundRule(&existing); err != nil {
+  if err := validateRule(&existing); err != nil {
     c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
     return
   }
 
-  if err := database.DB.Save(&existing).Error; err != nil {
-    c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+  if err := saveRule(&existing); err != nil {
+    c.JSON(portErrorStatus(err), gin.H{"error": err.Error()})
     return
   }
   _ = app.forwarder.Reload(existing)
   _ = applyInbound(existing)
+  recordVersion(c, models.VersionKindRule, existing.ID, versionUpdate)
+  withRuntime(&existing)
   c.JSON(http.StatusOK, existing)
 }
 
 func deleteRule(c *gin.Context) {
   id, _ := strconv.Atoi(c.Param("id"))
+  _, _ = app.capture.Stop(uint(id))
   _ = app.forwarder.Stop(uint(id))
-  if err := database.DB.Delete(&models.ForwardRule{}, id).Error; err != nil {
+  snapshot, snapErr := snapshotObject(database.DB, models.VersionKindRule, uint(id))
+  err := database.DB.Transaction(func(tx *gorm.DB) error {
+    if err := app.ports.Release(tx, models.PortOwnerRule, uint(id)); err != nil {
+      return err
+    }
+    return tx.Delete(&models.ForwardRule{}, id).Error
+  })
+  if err != nil {
     c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
     return
   }
+  app.forwarder.Forget(uint(id))
+  if snapErr == nil {
+    saveVersion(c, models.VersionKindRule, uint(id), versionDelete, snapshot, 0)
+  }
   c.JSON(http.StatusOK, gin.H{"message": "deleted"})
 }
 
@@ -144,12 +194,14 @@ func updateRuleStatus(c *gin.Context, enabled bool) {
     return
   }
   rule.IsActive = enabled
-  _ = database.DB.Save(&rule).Error
+  _ = database.DB.Model(&rule).Update("is_active", enabled).Error
   if enabled {
     _ = app.forwarder.Start(rule)
   } else {
     _ = app.forwarder.Stop(rule.ID)
   }
+  recordVersion(c, models.VersionKindRule, rule.ID, versionUpdate)
+  withRuntime(&rule)
   c.JSON(http.StatusOK, rule)
 }
 
@@ -183,6 +235,35 @@ func inboundPreview(c *gin.Context) {
     }
   }
 
+  if services.IsProxyInbound(rule.InboundType) {
+    var opts forwarder.ProxyOptions
+    _ = json.Unmarshal([]byte(rule.InboundConfig), &opts)
+    scheme := "socks5"
+    if rule.InboundType == "http_connect" {
+      scheme = "http"
+    }
+    uris := make([]string, 0, len(opts.Users))
+    for _, u := range opts.Users {
+      uris = append(uris, scheme+"://"+u.Username+":"+u.Password+"@"+host+":"+strconv.Itoa(rule.ListenPort))
+    }
+    if len(uris) == 0 {
+      uris = append(uris, scheme+"://"+host+":"+strconv.Itoa(rule.ListenPort))
+    }
+    c.JSON(http.StatusOK, gin.H{
+      "enabled":     true,
+      "type":        rule.InboundType,
+      "listen_host": host,
+      "listen_port": rule.ListenPort,
+      "users":       opts.Users,
+      "allow":       opts.Allow,
+      "deny":        opts.EffectiveDeny(),
+      "allow_local": opts.AllowLocal,
+      "udp":         opts.UDP,
+      "uris":        uris,
+    })
+    return
+  }
+
   if rule.InboundType == "vless_reality" {
     uuid := randomHex(16)
     shortID := randomHex(4)
@@ -202,17 +283,22 @@ func inboundPreview(c *gin.Context) {
     return
   }
 
-  // shadowsocks preview
-  password := randomHex(8)
-  method := "aes-256-gcm"
+  // shadowsocks 使用规则上持久化的凭据
+  var ss forwarder.ShadowsocksOptions
+  _ = json.Unmarshal([]byte(rule.InboundConfig), &ss)
+  // SIP002：2022 系列 userinfo 不做 base64，仅做 URL 编码。
+  userinfo := base64.RawURLEncoding.EncodeToString([]byte(ss.Method + ":" + ss.Password))
+  if strings.HasPrefix(ss.Method, "2022-") {
+    userinfo = url.PathEscape(ss.Method) + ":" + url.PathEscape(ss.Password)
+  }
   c.JSON(http.StatusOK, gin.H{
     "enabled":     true,
     "type":        "shadowsocks",
-    "method":      method,
-    "password":    password,
+    "method":      ss.Method,
+    "password":    ss.Password,
     "listen_host": host,
     "listen_port": rule.ListenPort,
-    "uri":         "ss://" + method + ":" + password + "@" + host + ":" + strconv.Itoa(rule.ListenPort),
+    "uri":         "ss://" + userinfo + "@" + net.JoinHostPort(host, strconv.Itoa(rule.ListenPort)) + "#" + url.PathEscape(rule.Name),
   })
 }
 
@@ -244,18 +330,19 @@ func importRules(c *gin.Context) {
       switch strategy {
       case "overwrite":
         r.ID = exists.ID
-        _ = database.DB.Save(&r).Error
       case "rename":
         r.Name = r.Name + "-" + time.Now().Format("150405")
-        _ = database.DB.Create(&r).Error
+        r.ID = 0
       default:
         continue
       }
+    } else {
+      r.ID = 0
+    }
+    if saveRule(&r) == nil {
+      recordVersion(c, models.VersionKindRule, r.ID, versionImport)
       imported++
-      continue
     }
-    _ = database.DB.Create(&r).Error
-    imported++
   }
   c.JSON(http.StatusOK, gin.H{"imported": imported})
 }
@@ -285,7 +372,8 @@ func importRulesText(c *gin.Context) {
   for _, r := range rules {
     r.ID = 0
     normalizeRuleDefaults(&r)
-    if database.DB.Create(&r).Error == nil {
+    if saveRule(&r) == nil {
+      recordVersion(c, models.VersionKindRule, r.ID, versionImport)
       imported++
     }
   }
@@ -293,9 +381,13 @@ func importRulesText(c *gin.Context) {
 }
 
 func normalizeRuleDefaults(rule *models.ForwardRule) {
+  rule.RefreshSchedule(time.Now())
   if rule.Protocol == "" {
     rule.Protocol = "tcp"
   }
+  if rule.PriorityClass == "" {
+    rule.PriorityClass = forwarder.ClassStandard
+  }
   if rule.InboundProxyEnabled && rule.InboundType == "" {
     if rule.Mode == "direct" {
       rule.InboundType = "vless_reality"
@@ -303,6 +395,102 @@ func normalizeRuleDefaults(rule *models.ForwardRule) {
       rule.InboundType = "shadowsocks"
     }
   }
+  if rule.InboundProxyEnabled && rule.InboundConfig == "" && (services.IsProxyInbound(rule.InboundType) || rule.InboundType == "shadowsocks") {
+    rule.InboundConfig = generateInboundConfig(rule.InboundType, rule.ListenPort)
+  }
+}
+
+// withRuntime 填充仅用于展示的运行状态与下一次计划启停时间。
+func withRuntime(rule *models.ForwardRule) {
+  rule.Runtime = app.forwarder.Runtime(rule.ID)
+  rule.NextChange = rule.NextChangeAfter(time.Now())
+}
+
+// saveRule 在一个事务内保存规则并占用监听端口，listen_port 为 0 时从端口池自动分配。
+func saveRule(rule *models.ForwardRule) error {
+  return database.DB.Transaction(func(tx *gorm.DB) error {
+    return saveRuleTx(tx, rule)
+  })
+}
+
+// ruleUsageColumns 由流量落库与 QuotaEnforcer 增量维护的列。保存配置时不写入，
+// 否则请求中携带的（或加载时的）旧值会覆盖期间落库的增量。
+var ruleUsageColumns = []string{"traffic_up", "traffic_down", "connections", "quota_used", "quota_exceeded", "quota_reset_at"}
+
+func saveRuleTx(tx *gorm.DB, rule *models.ForwardRule) error {
+  // 重置日变化时清空下次重置时间，由 QuotaEnforcer 按新日期重新计算。
+  if rule.ID != 0 {
+    if err := tx.Model(&models.ForwardRule{}).Where("id = ? AND quota_reset_day <> ?", rule.ID, rule.QuotaResetDay).
+      Update("quota_reset_at", nil).Error; err != nil {
+      return err
+    }
+  }
+  if err := tx.Omit(ruleUsageColumns...).Save(rule).Error; err != nil {
+    return err
+  }
+  // 返回库中的实际用量而不是请求携带的值。
+  if err := tx.Model(&models.ForwardRule{}).Select(ruleUsageColumns).Where("id = ?", rule.ID).Take(rule).Error; err != nil {
+    return err
+  }
+  port, err := app.ports.Assign(tx, rule.ListenNodeID, rule.ListenPort, models.PortOwnerRule, rule.ID)
+  if err != nil || port == rule.ListenPort {
+    return err
+  }
+  rule.ListenPort = port
+  return tx.Model(rule).Update("listen_port", port).Error
+}
+
+// portErrorStatus 端口冲突与端口池耗尽返回 409，隧道缺少入口节点返回 400，其余按服务端错误处理。
+func portErrorStatus(err error) int {
+  var conflict *services.PortConflictError
+  switch {
+  case errors.As(err, &conflict), errors.Is(err, services.ErrPortPoolExhausted):
+    return http.StatusConflict
+  case errors.Is(err, services.ErrNoEntryNode):
+    return http.StatusBadRequest
+  }
+  return http.StatusInternalServerError
+}
+
+// fieldCheck 针对单个字段的校验，供 /rules/validate 逐项报告。
+type fieldCheck struct {
+  field string
+  check func() error
+}
+
+// ruleChecks 规则在保存前必须满足的配置约束。
+func ruleChecks(rule *models.ForwardRule) []fieldCheck {
+  return []fieldCheck{
+    {"bandwidth_schedule", rule.BandwidthSchedule.Validate},
+    {"traffic_quota", rule.ValidateQuota},
+    {"active_windows", rule.ValidateActivation},
+    {"priority_class", func() error {
+      if !forwarder.ValidPriorityClass(rule.PriorityClass) {
+        return fmt.Errorf("unsupported priority_class %q", rule.PriorityClass)
+      }
+      return nil
+    }},
+    {"inbound_type", func() error { return validateInboundRule(rule) }},
+    {"listen_node_id", func() error {
+      if rule.ListenNodeID > 0 && rule.IsChaosActive() {
+        return fmt.Errorf("fault injection is not supported on node agents, disable it before moving the rule")
+      }
+      return nil
+    }},
+    {"options", func() error {
+      return forwarder.ValidateOptions(services.RuleKind(*rule), services.RuleOptions(*rule))
+    }},
+  }
+}
+
+// validateRule 校验规则在保存前必须满足的配置约束。
+func validateRule(rule *models.ForwardRule) error {
+  for _, c := range ruleChecks(rule) {
+    if err := c.check(); err != nil {
+      return err
+    }
+  }
+  return nil
 }
 
 func validateInboundRule(rule *models.ForwardRule) error {
@@ -310,10 +498,13 @@ func validateInboundRule(rule *models.ForwardRule) error {
     return nil
   }
 
-  if rule.Mode == "direct" && rule.InboundType != "vless_reality" {
+  // 原生入站的配置由 validateRule 按注册的转发类型统一校验。
+  switch {
+  case services.IsProxyInbound(rule.InboundType):
+    // socks5 / http_connect 由转发器原生实现，任意模式均可使用。
+  case rule.Mode == "direct" && rule.InboundType != "vless_reality":
     return errors.New("direct mode inbound must be vless_reality")
-  }
-  if rule.Mode != "direct" && rule.InboundType != "shadowsocks" {
+  case rule.Mode != "direct" && rule.InboundType != "shadowsocks":
     return errors.New("relay/ix/chain inbound must be shadowsocks")
   }
 
@@ -340,13 +531,7 @@ func applyInbound(rule models.ForwardRule) error {
     }
     return app.xray.Reload()
   }
-
-  if rule.InboundType == "shadowsocks" {
-    if err := app.gost.EnsureBinary(); err != nil {
-      return err
-    }
-    return app.gost.Reload()
-  }
+  // shadowsocks / socks5 / http_connect 由转发器原生实现，无需外部进程。
   return nil
 }
 
@@ -0,0 +1,307 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/middleware"
+	"github.com/folstingx/server/internal/models"
+	"github.com/folstingx/server/internal/services"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func RegisterTemplateRoutes(r *gin.RouterGroup) {
+	templates := r.Group("/templates")
+	templates.Use(middleware.AuthMiddleware(app.cfg))
+	{
+		templates.GET("", listTemplates)
+		templates.POST("", createTemplate)
+		templates.GET("/:id", getTemplate)
+		templates.PUT("/:id", updateTemplate)
+		templates.DELETE("/:id", deleteTemplate)
+		templates.POST("/:id/instantiate", instantiateTemplate)
+	}
+}
+
+// tunnelLayout Kind=tunnel 模板渲染后的结构。
+type tunnelLayout struct {
+	Tunnel   models.Tunnel        `json:"tunnel"`
+	Chain    []models.ChainTunnel `json:"chain"`
+	Forwards []models.Forward     `json:"forwards"`
+}
+
+func listTemplates(c *gin.Context) {
+	var templates []models.Template
+	q := database.DB.Order("id DESC")
+	if kind := c.Query("kind"); kind != "" {
+		q = q.Where("kind = ?", kind)
+	}
+	if err := q.Find(&templates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, templates)
+}
+
+func createTemplate(c *gin.Context) {
+	var tpl models.Template
+	if err := c.ShouldBindJSON(&tpl); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+	if err := services.ValidateTemplate(tpl); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userIDAny, _ := c.Get("user_id")
+	tpl.ID = 0
+	tpl.OwnerID, _ = userIDAny.(uint)
+	if err := database.DB.Create(&tpl).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, tpl)
+}
+
+func getTemplate(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var tpl models.Template
+	if err := database.DB.First(&tpl, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+		return
+	}
+	c.JSON(http.StatusOK, tpl)
+}
+
+func updateTemplate(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var tpl models.Template
+	if err := database.DB.First(&tpl, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+		return
+	}
+
+	var input struct {
+		Name        string              `json:"name"`
+		Description string              `json:"description"`
+		Kind        string              `json:"kind"`
+		Variables   models.TemplateVars `json:"variables"`
+		Spec        models.JSONRaw      `json:"spec"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+	tpl.Name = input.Name
+	tpl.Description = input.Description
+	tpl.Kind = input.Kind
+	tpl.Variables = input.Variables
+	tpl.Spec = input.Spec
+	if err := services.ValidateTemplate(tpl); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.DB.Save(&tpl).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tpl)
+}
+
+func deleteTemplate(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := database.DB.Delete(&models.Template{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+// instantiateTemplate 代入变量创建模板描述的规则或隧道。
+// deploy=true 时立即启动规则 / 下发隧道；否则规则、隧道及其转发以停用状态创建，
+// 不会被 RuleReconciler、重连后的重新下发或带宽调度启动。
+func instantiateTemplate(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var tpl models.Template
+	if err := database.DB.First(&tpl, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+		return
+	}
+	var input struct {
+		Variables map[string]interface{} `json:"variables"`
+		Deploy    bool                   `json:"deploy"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+	rendered, err := services.RenderTemplate(tpl, input.Variables)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if tpl.Kind == models.TemplateKindRule {
+		instantiateRule(c, rendered, input.Deploy)
+		return
+	}
+	instantiateTunnel(c, rendered, input.Deploy)
+}
+
+func instantiateRule(c *gin.Context, rendered []byte, deploy bool) {
+	var rule models.ForwardRule
+	if err := json.Unmarshal(rendered, &rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rendered spec is not a valid rule: " + err.Error()})
+		return
+	}
+	rule.ID = 0
+	normalizeRuleDefaults(&rule)
+	if err := validateRule(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := saveRuleTx(tx, &rule); err != nil {
+			return err
+		}
+		return deactivateUnlessDeployed(tx, &rule, deploy)
+	})
+	if err != nil {
+		c.JSON(portErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if rule.IsActive {
+		_ = app.forwarder.Start(rule)
+	}
+	_ = applyInbound(rule)
+	recordVersion(c, models.VersionKindRule, rule.ID, versionCreate)
+	withRuntime(&rule)
+	c.JSON(http.StatusCreated, gin.H{"kind": models.TemplateKindRule, "rule": rule})
+}
+
+func instantiateTunnel(c *gin.Context, rendered []byte, deploy bool) {
+	var layout tunnelLayout
+	if err := json.Unmarshal(rendered, &layout); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rendered spec is not a valid tunnel layout: " + err.Error()})
+		return
+	}
+	tunnel := layout.Tunnel
+	tunnel.ID = 0
+	// 链路与转发只从 chain / forwards 创建，以便逐个分配端口。
+	tunnel.ChainTunnels, tunnel.Forwards = nil, nil
+	if tunnel.TrafficRatio <= 0 {
+		tunnel.TrafficRatio = 1.0
+	}
+	for i := range layout.Chain {
+		chain := &layout.Chain[i]
+		chain.ID, chain.Node = 0, models.Node{}
+		if chain.Protocol == "" {
+			chain.Protocol = "relay"
+		}
+		var count int64
+		database.DB.Model(&models.Node{}).Where("id = ?", chain.NodeID).Count(&count)
+		if count == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("chain[%d]: node %d not found", i, chain.NodeID)})
+			return
+		}
+	}
+	for i := range layout.Forwards {
+		fwd := &layout.Forwards[i]
+		fwd.ID, fwd.Tunnel, fwd.ForwardPorts = 0, models.Tunnel{}, nil
+		if fwd.Protocol == "" {
+			fwd.Protocol = "tcp"
+		}
+		if err := validateForwardPolicy(fwd); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("forwards[%d]: %v", i, err)})
+			return
+		}
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&tunnel).Error; err != nil {
+			return err
+		}
+		if err := deactivateUnlessDeployed(tx, &tunnel, deploy); err != nil {
+			return err
+		}
+		for i := range layout.Chain {
+			chain := &layout.Chain[i]
+			chain.TunnelID = tunnel.ID
+			if err := tx.Create(chain).Error; err != nil {
+				return err
+			}
+			if chain.ChainType == models.ChainTypeEntry {
+				continue
+			}
+			port, err := app.ports.Assign(tx, chain.NodeID, chain.Port, models.PortOwnerChain, chain.ID)
+			if err != nil {
+				return fmt.Errorf("chain[%d]: %w", i, err)
+			}
+			if port != chain.Port {
+				chain.Port = port
+				if err := tx.Model(chain).Update("port", port).Error; err != nil {
+					return err
+				}
+			}
+		}
+		for i := range layout.Forwards {
+			fwd := &layout.Forwards[i]
+			fwd.TunnelID = tunnel.ID
+			if err := tx.Omit(forwardUsageColumns...).Create(fwd).Error; err != nil {
+				return err
+			}
+			if err := refreshForwardUsage(tx, fwd); err != nil {
+				return err
+			}
+			if err := deactivateUnlessDeployed(tx, fwd, deploy); err != nil {
+				return err
+			}
+			if err := assignForwardPort(tx, fwd); err != nil {
+				return fmt.Errorf("forwards[%d]: %w", i, err)
+			}
+			if fwd.InboundEnabled {
+				fwd.InboundConfig = generateInboundConfig(fwd.InboundType, fwd.ListenPort)
+				if err := tx.Model(fwd).Update("inbound_config", fwd.InboundConfig).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(portErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	recordVersion(c, models.VersionKindTunnel, tunnel.ID, versionCreate)
+	resp := gin.H{"kind": models.TemplateKindTunnel}
+	if deploy {
+		var errStrs []string
+		for _, e := range redeployTunnel(tunnel.ID) {
+			errStrs = append(errStrs, e.Error())
+		}
+		resp["deploy_errors"] = errStrs
+	}
+	database.DB.
+		Preload("ChainTunnels").
+		Preload("ChainTunnels.Node").
+		Preload("Forwards").
+		First(&tunnel, tunnel.ID)
+	resp["tunnel"] = tunnel
+	c.JSON(http.StatusCreated, resp)
+}
+
+// deactivateUnlessDeployed 不部署时在创建事务内写入 is_active=false：该列带有默认值，
+// 创建时的零值会被默认值 true 取代，事务提交后再停用会留下被调度启动的窗口。
+func deactivateUnlessDeployed(tx *gorm.DB, model interface{}, deploy bool) error {
+	if deploy {
+		return nil
+	}
+	return tx.Model(model).Update("is_active", false).Error
+}
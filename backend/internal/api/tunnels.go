@@ -2,15 +2,20 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/folstingx/server/internal/database"
 	"github.com/folstingx/server/internal/middleware"
 	"github.com/folstingx/server/internal/models"
 	"github.com/folstingx/server/internal/services"
+	"github.com/folstingx/server/pkg/forwarder"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func RegisterTunnelRoutes(r *gin.RouterGroup) {
@@ -23,6 +28,13 @@ func RegisterTunnelRoutes(r *gin.RouterGroup) {
 		tunnels.PUT("/:id", updateTunnel)
 		tunnels.DELETE("/:id", deleteTunnel)
 		tunnels.PUT("/:id/toggle", toggleTunnel)
+		tunnels.POST("/:id/validate", validateTunnelDryRun)
+
+		// 版本历史
+		tunnels.GET("/:id/versions", listTunnelVersions)
+		tunnels.GET("/:id/versions/:version", getTunnelVersion)
+		tunnels.GET("/:id/diff", diffTunnelVersions)
+		tunnels.POST("/:id/rollback/:version", rollbackTunnel)
 
 		// 链路节点管理
 		tunnels.POST("/:id/chain", addChainNode)
@@ -31,6 +43,7 @@ func RegisterTunnelRoutes(r *gin.RouterGroup) {
 
 		// 转发管理
 		tunnels.POST("/:id/forwards", createForward)
+		tunnels.POST("/:id/forwards/batch", batchForwards)
 		tunnels.GET("/:id/forwards", listForwards)
 		tunnels.PUT("/:id/forwards/:fwd_id", updateForward)
 		tunnels.DELETE("/:id/forwards/:fwd_id", deleteForward)
@@ -69,6 +82,7 @@ func createTunnel(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordVersion(c, models.VersionKindTunnel, tunnel.ID, versionCreate)
 	c.JSON(http.StatusCreated, tunnel)
 }
 
@@ -117,20 +131,30 @@ func updateTunnel(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordTunnelVersion(c, tunnel.ID)
 	c.JSON(http.StatusOK, tunnel)
 }
 
 func deleteTunnel(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
+	snapshot, snapErr := snapshotObject(database.DB, models.VersionKindTunnel, uint(id))
 	// 先取消部署
 	undeploy(uint(id))
-	// 删除关联
+	// 释放端口并删除关联
+	var chainIDs, fwdIDs []uint
+	database.DB.Model(&models.ChainTunnel{}).Where("tunnel_id = ?", id).Pluck("id", &chainIDs)
+	database.DB.Model(&models.Forward{}).Where("tunnel_id = ?", id).Pluck("id", &fwdIDs)
+	_ = app.ports.Release(database.DB, models.PortOwnerChain, chainIDs...)
+	_ = app.ports.Release(database.DB, models.PortOwnerForward, fwdIDs...)
 	database.DB.Where("tunnel_id = ?", id).Delete(&models.ChainTunnel{})
 	database.DB.Where("tunnel_id = ?", id).Delete(&models.Forward{})
 	if err := database.DB.Delete(&models.Tunnel{}, id).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if snapErr == nil {
+		saveVersion(c, models.VersionKindTunnel, uint(id), versionDelete, snapshot, 0)
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
 }
 
@@ -146,6 +170,7 @@ func toggleTunnel(c *gin.Context) {
 	if !tunnel.IsActive {
 		undeploy(tunnel.ID)
 	}
+	recordTunnelVersion(c, tunnel.ID)
 	c.JSON(http.StatusOK, tunnel)
 }
 
@@ -170,20 +195,53 @@ func addChainNode(c *gin.Context) {
 		return
 	}
 
-	if err := database.DB.Create(&chain).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&chain).Error; err != nil {
+			return err
+		}
+		// 入口节点不单独监听，其端口即各转发的 listen_port。
+		if chain.ChainType == models.ChainTypeEntry {
+			return reassignForwardPorts(tx, chain.TunnelID)
+		}
+		port, err := app.ports.Assign(tx, chain.NodeID, chain.Port, models.PortOwnerChain, chain.ID)
+		if err != nil || port == chain.Port {
+			return err
+		}
+		chain.Port = port
+		return tx.Model(&chain).Update("port", port).Error
+	})
+	if err != nil {
+		c.JSON(portErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
+	recordTunnelVersion(c, chain.TunnelID)
 	chain.Node = node
 	c.JSON(http.StatusCreated, chain)
 }
 
 func removeChainNode(c *gin.Context) {
 	chainID, _ := strconv.Atoi(c.Param("chain_id"))
-	if err := database.DB.Delete(&models.ChainTunnel{}, chainID).Error; err != nil {
+	var chain models.ChainTunnel
+	database.DB.Limit(1).Find(&chain, chainID)
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := app.ports.Release(tx, models.PortOwnerChain, uint(chainID)); err != nil {
+			return err
+		}
+		if err := tx.Delete(&models.ChainTunnel{}, chainID).Error; err != nil {
+			return err
+		}
+		if chain.ChainType == models.ChainTypeEntry {
+			return reassignForwardPorts(tx, chain.TunnelID)
+		}
+		return nil
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if chain.TunnelID > 0 {
+		recordTunnelVersion(c, chain.TunnelID)
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "removed"})
 }
 
@@ -200,6 +258,7 @@ func sortChainNodes(c *gin.Context) {
 	for _, item := range input {
 		database.DB.Model(&models.ChainTunnel{}).Where("id = ? AND tunnel_id = ?", item.ID, tunnelID).Update("sort_index", item.SortIndex)
 	}
+	recordTunnelVersion(c, uint(tunnelID))
 	c.JSON(http.StatusOK, gin.H{"message": "sorted"})
 }
 
@@ -216,17 +275,22 @@ func createForward(c *gin.Context) {
 	if fwd.Protocol == "" {
 		fwd.Protocol = "tcp"
 	}
+	if err := validateForwardPolicy(&fwd); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	if err := database.DB.Create(&fwd).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := saveForward(&fwd); err != nil {
+		c.JSON(portErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
 	// 如果开启入站代理，生成配置
 	if fwd.InboundEnabled {
 		fwd.InboundConfig = generateInboundConfig(fwd.InboundType, fwd.ListenPort)
-		_ = database.DB.Save(&fwd).Error
+		_ = database.DB.Model(&fwd).Update("inbound_config", fwd.InboundConfig).Error
 	}
+	recordTunnelVersion(c, fwd.TunnelID)
 
 	c.JSON(http.StatusCreated, fwd)
 }
@@ -238,6 +302,10 @@ func listForwards(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	now := time.Now()
+	for i := range forwards {
+		forwards[i].NextChange = forwards[i].NextChangeAfter(now)
+	}
 	c.JSON(http.StatusOK, forwards)
 }
 
@@ -248,33 +316,140 @@ func updateForward(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "forward not found"})
 		return
 	}
+	scheduleOff := fwd.ScheduleOff
 	if err := c.ShouldBindJSON(&fwd); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
 		return
 	}
 	fwd.ID = uint(fwdID)
-
-	if fwd.InboundEnabled && fwd.InboundConfig == "" {
-		fwd.InboundConfig = generateInboundConfig(fwd.InboundType, fwd.ListenPort)
+	if err := validateForwardPolicy(&fwd); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
+	// 已部署的入口服务由 ActivationScheduler 按状态变化移除或重新下发。
+	fwd.ScheduleOff = scheduleOff
 
-	if err := database.DB.Save(&fwd).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := saveForward(&fwd); err != nil {
+		c.JSON(portErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
+	if fwd.InboundEnabled && fwd.InboundConfig == "" {
+		fwd.InboundConfig = generateInboundConfig(fwd.InboundType, fwd.ListenPort)
+		_ = database.DB.Model(&fwd).Update("inbound_config", fwd.InboundConfig).Error
+	}
+	recordTunnelVersion(c, fwd.TunnelID)
 	c.JSON(http.StatusOK, fwd)
 }
 
 func deleteForward(c *gin.Context) {
 	fwdID, _ := strconv.Atoi(c.Param("fwd_id"))
+	var fwd models.Forward
+	database.DB.Limit(1).Find(&fwd, fwdID)
 	database.DB.Where("forward_id = ?", fwdID).Delete(&models.ForwardPort{})
 	if err := database.DB.Delete(&models.Forward{}, fwdID).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if fwd.TunnelID > 0 {
+		recordTunnelVersion(c, fwd.TunnelID)
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
 }
 
+// forwardChecks 转发在保存前必须满足的配置约束，/tunnels/validate 逐项报告。
+func forwardChecks(fwd *models.Forward) []fieldCheck {
+	return []fieldCheck{
+		{"traffic_quota", fwd.ValidateQuota},
+		{"active_windows", fwd.ValidateActivation},
+		{"inbound_type", func() error {
+			if !fwd.InboundEnabled {
+				return nil
+			}
+			switch fwd.InboundType {
+			case "vless_reality", "shadowsocks", "trojan":
+				return nil
+			}
+			return fmt.Errorf("unsupported inbound_type %q", fwd.InboundType)
+		}},
+	}
+}
+
+// validateForwardPolicy 校验转发的配置约束，并按当前时间刷新计划状态。
+func validateForwardPolicy(fwd *models.Forward) error {
+	for _, c := range forwardChecks(fwd) {
+		if err := c.check(); err != nil {
+			return err
+		}
+	}
+	fwd.RefreshSchedule(time.Now())
+	return nil
+}
+
+// saveForward 在一个事务内保存转发并在入口节点上占用监听端口。
+func saveForward(fwd *models.Forward) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		return saveForwardTx(tx, fwd)
+	})
+}
+
+// forwardUsageColumns 由 Agent 流量上报与 QuotaEnforcer 增量维护的列。保存配置时不写入，
+// 否则请求中携带的（或加载时的）旧值会覆盖期间落库的增量。
+var forwardUsageColumns = []string{"flow_in", "flow_out", "connections", "quota_used", "quota_exceeded", "quota_reset_at"}
+
+func saveForwardTx(tx *gorm.DB, fwd *models.Forward) error {
+	// 重置日变化时清空下次重置时间，由 QuotaEnforcer 按新日期重新计算。
+	if fwd.ID != 0 {
+		if err := tx.Model(&models.Forward{}).Where("id = ? AND quota_reset_day <> ?", fwd.ID, fwd.QuotaResetDay).
+			Update("quota_reset_at", nil).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Omit(forwardUsageColumns...).Save(fwd).Error; err != nil {
+		return err
+	}
+	if err := refreshForwardUsage(tx, fwd); err != nil {
+		return err
+	}
+	return assignForwardPort(tx, fwd)
+}
+
+// refreshForwardUsage 以库中的实际用量替换请求携带的值。
+func refreshForwardUsage(tx *gorm.DB, fwd *models.Forward) error {
+	return tx.Model(&models.Forward{}).Select(forwardUsageColumns).Where("id = ?", fwd.ID).Take(fwd).Error
+}
+
+// assignForwardPort 在隧道入口节点上占用转发的 listen_port，为 0 时从端口池自动分配。
+func assignForwardPort(tx *gorm.DB, fwd *models.Forward) error {
+	nodeID, err := services.EntryNodeID(tx, fwd.TunnelID)
+	if err != nil {
+		return err
+	}
+	port, err := app.ports.Assign(tx, nodeID, fwd.ListenPort, models.PortOwnerForward, fwd.ID)
+	if err != nil || port == fwd.ListenPort {
+		return err
+	}
+	fwd.ListenPort = port
+	return tx.Model(fwd).Update("listen_port", port).Error
+}
+
+// reassignForwardPorts 入口节点变化后把隧道内转发的端口占用迁到新的入口节点，没有入口时释放。
+func reassignForwardPorts(tx *gorm.DB, tunnelID uint) error {
+	var forwards []models.Forward
+	if err := tx.Where("tunnel_id = ?", tunnelID).Find(&forwards).Error; err != nil {
+		return err
+	}
+	for i := range forwards {
+		err := assignForwardPort(tx, &forwards[i])
+		if errors.Is(err, services.ErrNoEntryNode) {
+			err = app.ports.Release(tx, models.PortOwnerForward, forwards[i].ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ==================== Deploy / Undeploy ====================
 
 // deployTunnel 将隧道配置下发到所有链路节点的 gost Agent
@@ -310,51 +485,83 @@ func undeployTunnel(c *gin.Context) {
 
 // ==================== 内部实现 ====================
 
-func deployTunnelToNodes(tunnel models.Tunnel) []error {
-	var errs []error
+// deployStep 下发到某个节点的一项 gost 配置，三者恰有一项非空。
+// 同一转发的步骤按生成顺序执行：限速器与 chain 先于引用它们的服务。
+type deployStep struct {
+	nodeID    uint
+	forwardID uint
+	limiter   *services.GostLimiterConfig
+	chain     *services.GostChainConfig
+	service   *services.GostServiceConfig
+}
+
+func (s deployStep) apply() error {
+	switch {
+	case s.limiter != nil:
+		if err := app.agentHub.AddGostLimiter(s.nodeID, *s.limiter); err != nil {
+			return fmt.Errorf("deploy limiter for fwd %d to node %d: %v", s.forwardID, s.nodeID, err)
+		}
+	case s.chain != nil:
+		if err := app.agentHub.AddGostChain(s.nodeID, *s.chain); err != nil {
+			return fmt.Errorf("deploy chain %s to node %d: %v", s.chain.Name, s.nodeID, err)
+		}
+	case s.service != nil:
+		if err := app.agentHub.AddGostService(s.nodeID, *s.service); err != nil {
+			return fmt.Errorf("deploy service %s to node %d: %v", s.service.Name, s.nodeID, err)
+		}
+	}
+	return nil
+}
+
+// tunnelDeploySteps 计算隧道各转发应下发到各节点的 gost 配置，跳过超额与不在启用时段的转发。
+// 链路不完整的转发返回错误且不生成步骤。
+func tunnelDeploySteps(tunnel models.Tunnel) ([]deployStep, map[uint]error) {
+	var steps []deployStep
+	failed := make(map[uint]error)
 	chains := tunnel.ChainTunnels
 
-	if tunnel.Type == models.TunnelTypePortForward {
-		// 端口转发: 在入口节点添加 gost tcp/udp 服务直达目标
-		for _, fwd := range tunnel.Forwards {
-			entryNode := findChainByType(chains, models.ChainTypeEntry)
+	for _, fwd := range tunnel.Forwards {
+		if fwd.QuotaExceeded || fwd.ScheduleOff {
+			continue
+		}
+		entryNode := findChainByType(chains, models.ChainTypeEntry)
+
+		if tunnel.Type == models.TunnelTypePortForward {
+			// 端口转发: 在入口节点添加 gost tcp/udp 服务直达目标
 			if entryNode == nil {
-				errs = append(errs, fmt.Errorf("no entry node for tunnel %d", tunnel.ID))
+				failed[fwd.ID] = fmt.Errorf("no entry node for tunnel %d", tunnel.ID)
 				continue
 			}
-			svcName := fmt.Sprintf("fwd_%d_%d", tunnel.ID, fwd.ID)
-			svc := services.GostServiceConfig{
-				Name:     svcName,
-				Addr:     fmt.Sprintf(":%d", fwd.ListenPort),
-				Handler:  "tcp",
-				Listener: "tcp",
-				Forwarder: &services.GostForwarder{
-					Nodes: []services.GostForwarderNode{
-						{Name: "target", Addr: fwd.RemoteAddress},
+			limiter := forwardLimiter(tunnel.ID, fwd)
+			steps = append(steps,
+				deployStep{nodeID: entryNode.NodeID, forwardID: fwd.ID, limiter: &limiter},
+				deployStep{nodeID: entryNode.NodeID, forwardID: fwd.ID, service: &services.GostServiceConfig{
+					Name:     fmt.Sprintf("fwd_%d_%d", tunnel.ID, fwd.ID),
+					Addr:     fmt.Sprintf(":%d", fwd.ListenPort),
+					Handler:  "tcp",
+					Listener: "tcp",
+					Limiter:  limiter.Name,
+					Forwarder: &services.GostForwarder{
+						Nodes: []services.GostForwarderNode{
+							{Name: "target", Addr: fwd.RemoteAddress},
+						},
 					},
-				},
-			}
-			if err := app.agentHub.AddGostService(entryNode.NodeID, svc); err != nil {
-				errs = append(errs, fmt.Errorf("deploy fwd %d to node %d: %v", fwd.ID, entryNode.NodeID, err))
-			}
-		}
-	} else if tunnel.Type == models.TunnelTypeChainRelay {
-		// 链式中转: 参照 flux-panel TunnelServiceImpl
-		// entry → relay1 → relay2 → ... → exit
-		for _, fwd := range tunnel.Forwards {
-			entryNode := findChainByType(chains, models.ChainTypeEntry)
+				}},
+			)
+		} else if tunnel.Type == models.TunnelTypeChainRelay {
+			// 链式中转: 参照 flux-panel TunnelServiceImpl
+			// entry → relay1 → relay2 → ... → exit
 			exitNode := findChainByType(chains, models.ChainTypeExit)
 			relayNodes := findChainsByType(chains, models.ChainTypeRelay)
 
 			if entryNode == nil || exitNode == nil {
-				errs = append(errs, fmt.Errorf("tunnel %d needs entry and exit nodes", tunnel.ID))
+				failed[fwd.ID] = fmt.Errorf("tunnel %d needs entry and exit nodes", tunnel.ID)
 				continue
 			}
 
 			// 1. Exit 节点: 添加 relay 服务，监听端口转发到最终目标
-			exitSvcName := fmt.Sprintf("chain_%d_%d_exit", tunnel.ID, fwd.ID)
-			exitSvc := services.GostServiceConfig{
-				Name:     exitSvcName,
+			steps = append(steps, deployStep{nodeID: exitNode.NodeID, forwardID: fwd.ID, service: &services.GostServiceConfig{
+				Name:     fmt.Sprintf("chain_%d_%d_exit", tunnel.ID, fwd.ID),
 				Addr:     fmt.Sprintf(":%d", exitNode.Port),
 				Handler:  "relay",
 				Listener: protocolToListener(exitNode.Protocol),
@@ -363,18 +570,14 @@ func deployTunnelToNodes(tunnel models.Tunnel) []error {
 						{Name: "target", Addr: fwd.RemoteAddress},
 					},
 				},
-			}
-			if err := app.agentHub.AddGostService(exitNode.NodeID, exitSvc); err != nil {
-				errs = append(errs, err)
-			}
+			}})
 
 			// 2. Relay 节点: 中继转发
 			prevAddr := exitNode.Node.Host + ":" + strconv.Itoa(exitNode.Port)
 			for i := len(relayNodes) - 1; i >= 0; i-- {
 				relay := relayNodes[i]
-				relaySvcName := fmt.Sprintf("chain_%d_%d_relay_%d", tunnel.ID, fwd.ID, relay.ID)
-				relaySvc := services.GostServiceConfig{
-					Name:     relaySvcName,
+				steps = append(steps, deployStep{nodeID: relay.NodeID, forwardID: fwd.ID, service: &services.GostServiceConfig{
+					Name:     fmt.Sprintf("chain_%d_%d_relay_%d", tunnel.ID, fwd.ID, relay.ID),
 					Addr:     fmt.Sprintf(":%d", relay.Port),
 					Handler:  "relay",
 					Listener: protocolToListener(relay.Protocol),
@@ -383,54 +586,128 @@ func deployTunnelToNodes(tunnel models.Tunnel) []error {
 							{Name: "next", Addr: prevAddr},
 						},
 					},
-				}
-				if err := app.agentHub.AddGostService(relay.NodeID, relaySvc); err != nil {
-					errs = append(errs, err)
-				}
+				}})
 				prevAddr = relay.Node.Host + ":" + strconv.Itoa(relay.Port)
 			}
 
-			// 3. Entry 节点: 添加服务，chain 到下一跳
-			entrySvcName := fmt.Sprintf("chain_%d_%d_entry", tunnel.ID, fwd.ID)
+			// 3. Entry 节点: 添加服务，chain 依次经过各 relay 与 exit，
+			// 每跳带该节点的 relay 密钥供原生 Agent 认证
 			chainName := fmt.Sprintf("chain_%d_%d", tunnel.ID, fwd.ID)
-
-			// 添加 chain
-			chain := services.GostChainConfig{
-				Name: chainName,
-				Hops: []services.GostChainHop{
-					{
-						Name: "hop0",
-						Nodes: []services.GostHopNode{
-							{
-								Name:      "next",
-								Addr:      prevAddr,
-								Connector: "relay",
-								Dialer:    protocolToDialer(entryNode.Protocol),
-							},
+			hopNodes := append(append([]models.ChainTunnel{}, relayNodes...), *exitNode)
+			chain := services.GostChainConfig{Name: chainName}
+			for i, hn := range hopNodes {
+				chain.Hops = append(chain.Hops, services.GostChainHop{
+					Name: fmt.Sprintf("hop%d", i),
+					Nodes: []services.GostHopNode{
+						{
+							Name:      "next",
+							Addr:      hn.Node.Host + ":" + strconv.Itoa(hn.Port),
+							Connector: "relay",
+							Dialer:    protocolToDialer(hn.Protocol),
+							Key:       forwarder.RelayKey(hn.Node.Secret),
 						},
 					},
-				},
-			}
-			if err := app.agentHub.AddGostChain(entryNode.NodeID, chain); err != nil {
-				errs = append(errs, err)
+				})
 			}
+			limiter := forwardLimiter(tunnel.ID, fwd)
+			steps = append(steps,
+				deployStep{nodeID: entryNode.NodeID, forwardID: fwd.ID, chain: &chain},
+				deployStep{nodeID: entryNode.NodeID, forwardID: fwd.ID, limiter: &limiter},
+				deployStep{nodeID: entryNode.NodeID, forwardID: fwd.ID, service: &services.GostServiceConfig{
+					Name:     fmt.Sprintf("chain_%d_%d_entry", tunnel.ID, fwd.ID),
+					Addr:     fmt.Sprintf(":%d", fwd.ListenPort),
+					Handler:  "tcp",
+					Listener: "tcp",
+					Chain:    chainName,
+					Limiter:  limiter.Name,
+				}},
+			)
+		}
+	}
+	return steps, failed
+}
 
-			entrySvc := services.GostServiceConfig{
-				Name:     entrySvcName,
-				Addr:     fmt.Sprintf(":%d", fwd.ListenPort),
-				Handler:  "tcp",
-				Listener: "tcp",
-				Chain:    chainName,
-			}
-			if err := app.agentHub.AddGostService(entryNode.NodeID, entrySvc); err != nil {
-				errs = append(errs, err)
+// applyDeploySteps 依次执行下发步骤，返回各转发遇到的错误。
+// 限速器下发失败时服务不引用它，仅受所属节点其他限制。
+func applyDeploySteps(steps []deployStep) map[uint][]error {
+	errs := make(map[uint][]error)
+	failedLimiters := make(map[string]bool)
+	for _, step := range steps {
+		if step.service != nil && step.service.Limiter != "" && failedLimiters[fmt.Sprintf("%d/%s", step.nodeID, step.service.Limiter)] {
+			svc := *step.service
+			svc.Limiter = ""
+			step.service = &svc
+		}
+		if err := step.apply(); err != nil {
+			errs[step.forwardID] = append(errs[step.forwardID], err)
+			if step.limiter != nil {
+				failedLimiters[fmt.Sprintf("%d/%s", step.nodeID, step.limiter.Name)] = true
 			}
 		}
 	}
+	return errs
+}
 
+func deployTunnelToNodes(tunnel models.Tunnel) []error {
+	steps, failed := tunnelDeploySteps(tunnel)
+	results := applyDeploySteps(steps)
+	var errs []error
+	for _, fwd := range tunnel.Forwards {
+		if fwd.QuotaExceeded || fwd.ScheduleOff {
+			continue
+		}
+		fwdErrs := results[fwd.ID]
+		if err := failed[fwd.ID]; err != nil {
+			fwdErrs = append(fwdErrs, err)
+		}
+		recordDeployResult(fwd.ID, fwdErrs)
+		errs = append(errs, fwdErrs...)
+	}
 	return errs
 }
 
+// recordDeployResult 记录转发最近一次下发的结果。
+func recordDeployResult(forwardID uint, errs []error) {
+	status, msg := models.DeployStatusOK, ""
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = e.Error()
+		}
+		status, msg = models.DeployStatusFailed, strings.Join(msgs, "; ")
+	}
+	_ = database.DB.Model(&models.Forward{}).Where("id = ?", forwardID).Updates(map[string]interface{}{
+		"deploy_status": status,
+		"deploy_error":  msg,
+		"deployed_at":   time.Now(),
+	}).Error
+}
+
+// redeployForward 重新下发单条转发，供配额重置后恢复被移除的入口服务。
+func redeployForward(fwd models.Forward) error {
+	var tunnel models.Tunnel
+	if err := database.DB.Preload("ChainTunnels").Preload("ChainTunnels.Node").First(&tunnel, fwd.TunnelID).Error; err != nil {
+		return err
+	}
+	tunnel.Forwards = []models.Forward{fwd}
+	if errs := deployTunnelToNodes(tunnel); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// forwardLimiter 入口节点上转发所属用户的限速器，服务按名称引用；
+// 后续时段切换由 BandwidthScheduler 更新该限速器。
+func forwardLimiter(tunnelID uint, fwd models.Forward) services.GostLimiterConfig {
+	var owner *models.User
+	var u models.User
+	if fwd.OwnerID > 0 && database.DB.First(&u, fwd.OwnerID).Error == nil {
+		owner = &u
+	}
+	limit := services.ForwardBandwidth(fwd, owner, time.Now())
+	return services.GostLimiter(services.GostLimiterName(tunnelID, fwd.ID), limit)
+}
+
 func undeploy(tunnelID uint) {
 	var chains []models.ChainTunnel
 	database.DB.Where("tunnel_id = ?", tunnelID).Preload("Node").Find(&chains)
@@ -506,11 +783,22 @@ func generateInboundConfig(inboundType string, listenPort int) string {
 	case "shadowsocks":
 		cfg := map[string]interface{}{
 			"method":      "aes-256-gcm",
-			"password":    hex(8),
+			"password":    forwarder.GenerateShadowsocksPassword("aes-256-gcm"),
 			"listen_port": listenPort,
 		}
 		b, _ := json.Marshal(cfg)
 		return string(b)
+	case "socks5", "http_connect":
+		cfg := map[string]interface{}{
+			"users": []map[string]string{{"username": "u" + hex(3), "password": hex(8)}},
+			"allow": []string{},
+			"deny":  []string{},
+			"udp":   inboundType == "socks5",
+			// 默认拒绝本机等地址（forwarder.DefaultProxyDeny），需要时显式开启
+			"allow_local": false,
+		}
+		b, _ := json.Marshal(cfg)
+		return string(b)
 	case "trojan":
 		cfg := map[string]interface{}{
 			"password":    hex(12),
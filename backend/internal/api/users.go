@@ -54,28 +54,34 @@ func createUser(c *gin.Context) {
 	}
 
 	var req struct {
-		Username       string    `json:"username"`
-		Password       string    `json:"password"`
-		Role           string    `json:"role"`
-		BandwidthLimit int64     `json:"bandwidth_limit"`
-		TrafficLimit   int64     `json:"traffic_limit"`
-		ExpireAt       time.Time `json:"expire_at"`
-		IsActive       bool      `json:"is_active"`
+		Username          string                   `json:"username"`
+		Password          string                   `json:"password"`
+		Role              string                   `json:"role"`
+		BandwidthLimit    int64                    `json:"bandwidth_limit"`
+		BandwidthSchedule models.BandwidthSchedule `json:"bandwidth_schedule"`
+		TrafficLimit      int64                    `json:"traffic_limit"`
+		ExpireAt          time.Time                `json:"expire_at"`
+		IsActive          bool                     `json:"is_active"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
 		return
 	}
+	if err := req.BandwidthSchedule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	hash, _ := utils.HashPassword(req.Password)
 	user := models.User{
-		Username:       req.Username,
-		PasswordHash:   hash,
-		Role:           models.UserRole(req.Role),
-		BandwidthLimit: req.BandwidthLimit,
-		TrafficLimit:   req.TrafficLimit,
-		ExpireAt:       req.ExpireAt,
-		IsActive:       req.IsActive,
+		Username:          req.Username,
+		PasswordHash:      hash,
+		Role:              models.UserRole(req.Role),
+		BandwidthLimit:    req.BandwidthLimit,
+		BandwidthSchedule: req.BandwidthSchedule,
+		TrafficLimit:      req.TrafficLimit,
+		ExpireAt:          req.ExpireAt,
+		IsActive:          req.IsActive,
 	}
 	if user.Role == "" {
 		user.Role = models.RoleUser
@@ -99,6 +105,10 @@ func updateUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
 		return
 	}
+	if err := user.BandwidthSchedule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	user.ID = uint(id)
 	if err := database.DB.Save(&user).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
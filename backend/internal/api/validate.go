@@ -0,0 +1,347 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+	"github.com/folstingx/server/internal/services"
+	"github.com/folstingx/server/pkg/forwarder"
+	"github.com/gin-gonic/gin"
+)
+
+// probeTimeout 目标解析与连通性探测的超时。
+const probeTimeout = 3 * time.Second
+
+// validationIssue 校验发现的单个问题，Field 指向出问题的字段或链路节点/转发。
+type validationIssue struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// validationReport /validate 接口的结果：errors 会导致保存或运行失败，warnings 仅作提示。
+type validationReport struct {
+	Valid    bool              `json:"valid"`
+	Errors   []validationIssue `json:"errors"`
+	Warnings []validationIssue `json:"warnings"`
+}
+
+func newValidationReport() *validationReport {
+	return &validationReport{Errors: []validationIssue{}, Warnings: []validationIssue{}}
+}
+
+func (r *validationReport) fail(field, code, format string, args ...interface{}) {
+	r.Errors = append(r.Errors, validationIssue{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *validationReport) warn(field, code, format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, validationIssue{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *validationReport) finish() *validationReport {
+	r.Valid = len(r.Errors) == 0
+	return r
+}
+
+// validateRuleDryRun 对规则执行保存与启动前的全部检查，不写库也不启动转发器。
+// 请求体与创建/更新规则相同，带 id 时按更新处理（忽略规则自身占用的端口）。
+func validateRuleDryRun(c *gin.Context) {
+	var rule models.ForwardRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+	normalizeRuleDefaults(&rule)
+	r := newValidationReport()
+
+	for _, fc := range ruleChecks(&rule) {
+		if err := fc.check(); err != nil {
+			r.fail(fc.field, "invalid", "%v", err)
+		}
+	}
+	if rule.QuotaExceeded || rule.OverQuota() {
+		r.warn("traffic_quota", "quota_exceeded", "traffic quota is exhausted, the rule will not start until the next reset")
+	}
+	if rule.ScheduleOff {
+		r.warn("active_windows", "schedule_off", "the rule is outside its activation schedule and will not start now")
+	}
+	vetOwner(r, "owner_id", rule.OwnerID)
+
+	nodeFound := true
+	if rule.ListenNodeID > 0 {
+		_, nodeFound = vetNode(r, "listen_node_id", rule.ListenNodeID, "entry")
+	}
+	if nodeFound {
+		vetRulePort(r, rule)
+	}
+
+	chained := rule.Mode != "" && rule.Mode != "direct" && len(rule.ChainNodes) > 0
+	// 经链路或在节点上监听时目标由远端连接，面板上只作参考。
+	remote := chained || rule.ListenNodeID > 0
+	for i, item := range rule.ChainNodes {
+		field := fmt.Sprintf("chain_nodes[%d]", i)
+		id, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			r.fail(field, "invalid", "invalid chain node %q", item)
+			continue
+		}
+		role := "relay"
+		if i == len(rule.ChainNodes)-1 {
+			role = "exit"
+		}
+		if node, ok := vetNode(r, field, uint(id), role); ok && node.Secret == "" {
+			r.fail(field, "node_secret", "chain node %s has no secret", node.Name)
+		}
+	}
+
+	kind, _ := forwarder.Lookup(services.RuleKind(rule))
+	probeTCP := rule.Protocol != "udp"
+	if kind.NeedsTarget || rule.TargetAddress != "" {
+		vetTarget(r, "target_address", rule.TargetAddress, rule.TargetPort, remote, probeTCP)
+	}
+	for i, item := range rule.LBTargets {
+		var t forwarder.LBTarget
+		if err := json.Unmarshal([]byte(item), &t); err != nil {
+			r.fail(fmt.Sprintf("lb_targets[%d]", i), "invalid", "invalid load balancer target: %v", err)
+			continue
+		}
+		vetTarget(r, fmt.Sprintf("lb_targets[%d]", i), t.Address, t.Port, remote, probeTCP)
+	}
+	c.JSON(http.StatusOK, r.finish())
+}
+
+// vetRulePort 检查端口分配记录；规则监听在面板本机时还会尝试实际绑定，发现面板之外的进程占用。
+func vetRulePort(r *validationReport, rule models.ForwardRule) {
+	if !vetPort(r, "listen_port", rule.ListenNodeID, rule.ListenPort, models.PortOwnerRule, rule.ID) {
+		return
+	}
+	if rule.ListenNodeID != 0 || rule.ListenPort == 0 {
+		return
+	}
+	// 规则自身正在该端口上运行时无需再绑定。
+	if rule.ID > 0 {
+		var existing models.ForwardRule
+		if database.DB.Limit(1).Find(&existing, rule.ID).RowsAffected > 0 && existing.ListenNodeID == 0 &&
+			existing.ListenPort == rule.ListenPort && app.forwarder.Runtime(rule.ID).State == models.RuleStateRunning {
+			return
+		}
+	}
+	if err := probeBind(rule.Protocol, rule.ListenPort); err != nil {
+		r.fail("listen_port", "port_in_use", "%v", err)
+	}
+}
+
+// probeBind 在本机按协议尝试监听端口后立即释放。
+func probeBind(protocol string, port int) error {
+	addr := net.JoinHostPort("0.0.0.0", strconv.Itoa(port))
+	if protocol != "udp" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		_ = ln.Close()
+	}
+	if protocol == "udp" || protocol == "both" {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		_ = pc.Close()
+	}
+	return nil
+}
+
+// vetPort 对照端口分配记录检查冲突，返回端口是否可用。
+func vetPort(r *validationReport, field string, nodeID uint, port int, kind string, refID uint) bool {
+	_, err := app.ports.Check(database.DB, nodeID, port, kind, refID)
+	var conflict *services.PortConflictError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &conflict):
+		r.fail(field, "port_conflict", "%v", err)
+	case errors.Is(err, services.ErrPortPoolExhausted):
+		r.fail(field, "port_pool_exhausted", "%v", err)
+	default:
+		r.fail(field, "invalid", "%v", err)
+	}
+	return false
+}
+
+// vetNode 检查节点存在、具备所需角色，离线或停用只作警告。
+func vetNode(r *validationReport, field string, nodeID uint, role string) (models.Node, bool) {
+	var node models.Node
+	if database.DB.Limit(1).Find(&node, nodeID).RowsAffected == 0 {
+		r.fail(field, "node_not_found", "node %d not found", nodeID)
+		return node, false
+	}
+	if role != "" && !node.HasRole(role) {
+		r.fail(field, "node_role", "node %s does not have the %s role", node.Name, role)
+	}
+	if !node.IsActive {
+		r.warn(field, "node_inactive", "node %s is disabled", node.Name)
+	}
+	if app.agentHub == nil || !app.agentHub.IsOnline(node.ID) {
+		r.warn(field, "node_offline", "node %s agent is offline", node.Name)
+	}
+	return node, true
+}
+
+// vetTarget 解析目标并探测 TCP 连通性。remote 为 true 时目标由远端节点连接，
+// 面板上的解析失败只作警告且不探测连通性；连接失败始终只作警告，目标可能暂时不可用。
+func vetTarget(r *validationReport, field, host string, port int, remote, probeTCP bool) {
+	if host == "" || port <= 0 || port > 65535 {
+		r.fail(field, "invalid_target", "target host and port are required")
+		return
+	}
+	if net.ParseIP(host) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		_, err := net.DefaultResolver.LookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			if remote {
+				r.warn(field, "dns_failed", "panel cannot resolve %s: %v", host, err)
+			} else {
+				r.fail(field, "dns_failed", "resolve %s: %v", host, err)
+			}
+			return
+		}
+	}
+	if remote || !probeTCP {
+		return
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), probeTimeout)
+	if err != nil {
+		r.warn(field, "target_unreachable", "%v", err)
+		return
+	}
+	_ = conn.Close()
+}
+
+// vetOwner 所属用户停用、过期或总流量超限时规则虽可保存但无法正常使用。
+func vetOwner(r *validationReport, field string, ownerID uint) {
+	if ownerID == 0 {
+		return
+	}
+	var user models.User
+	if database.DB.Limit(1).Find(&user, ownerID).RowsAffected == 0 {
+		r.fail(field, "owner_not_found", "user %d not found", ownerID)
+		return
+	}
+	if !user.IsActive || (!user.ExpireAt.IsZero() && user.ExpireAt.Before(time.Now())) {
+		r.warn(field, "owner_inactive", "user %s is expired or inactive", user.Username)
+	}
+	if user.TrafficLimit > 0 && user.TrafficUsed >= user.TrafficLimit {
+		r.warn(field, "owner_quota_exceeded", "user %s has used up the traffic limit", user.Username)
+	}
+}
+
+// validateTunnelDryRun 检查隧道链路与其下所有转发，不写库也不下发。
+// 请求体可选 {"forward": {...}}，用于在创建/更新转发前一并校验，带 id 时替换同 id 的已有转发。
+func validateTunnelDryRun(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	var tunnel models.Tunnel
+	if err := database.DB.Preload("ChainTunnels").Preload("Forwards").First(&tunnel, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "tunnel not found"})
+		return
+	}
+	var input struct {
+		Forward *models.Forward `json:"forward"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+			return
+		}
+	}
+	r := newValidationReport()
+	if !tunnel.IsActive {
+		r.warn("is_active", "tunnel_inactive", "tunnel is disabled and will not be deployed")
+	}
+
+	chains := tunnel.ChainTunnels
+	entry := findChainByType(chains, models.ChainTypeEntry)
+	if entry == nil {
+		r.fail("chain", "no_entry_node", "tunnel has no entry node")
+	}
+	if tunnel.Type == models.TunnelTypeChainRelay && findChainByType(chains, models.ChainTypeExit) == nil {
+		r.fail("chain", "no_exit_node", "chain relay tunnel needs an exit node")
+	}
+	for _, ch := range chains {
+		field := fmt.Sprintf("chain.%d", ch.ID)
+		role := map[int]string{models.ChainTypeEntry: "entry", models.ChainTypeRelay: "relay", models.ChainTypeExit: "exit"}[ch.ChainType]
+		if role == "" {
+			r.fail(field, "invalid", "unknown chain_type %d", ch.ChainType)
+		}
+		vetNode(r, field, ch.NodeID, role)
+		if tunnel.Type != models.TunnelTypeChainRelay || ch.ChainType == models.ChainTypeEntry {
+			continue
+		}
+		if ch.Port <= 0 {
+			r.fail(field+".port", "port_required", "relay and exit hops need a listen port")
+			continue
+		}
+		vetPort(r, field+".port", ch.NodeID, ch.Port, models.PortOwnerChain, ch.ID)
+	}
+
+	forwards := tunnel.Forwards
+	if f := input.Forward; f != nil {
+		f.TunnelID = tunnel.ID
+		if f.Protocol == "" {
+			f.Protocol = "tcp"
+		}
+		replaced := false
+		for i := range forwards {
+			if f.ID != 0 && forwards[i].ID == f.ID {
+				forwards[i], replaced = *f, true
+			}
+		}
+		if !replaced {
+			forwards = append(forwards, *f)
+		}
+	}
+	for _, fwd := range forwards {
+		validateForward(r, entry, fwd)
+	}
+	c.JSON(http.StatusOK, r.finish())
+}
+
+func validateForward(r *validationReport, entry *models.ChainTunnel, fwd models.Forward) {
+	field := "forward.new"
+	if fwd.ID != 0 {
+		field = fmt.Sprintf("forward.%d", fwd.ID)
+	}
+	for _, fc := range forwardChecks(&fwd) {
+		if err := fc.check(); err != nil {
+			r.fail(field+"."+fc.field, "invalid", "%v", err)
+		}
+	}
+	if fwd.QuotaExceeded || fwd.OverQuota() {
+		r.warn(field+".traffic_quota", "quota_exceeded", "traffic quota is exhausted, the forward will not be deployed until the next reset")
+	}
+	if fwd.ValidateActivation() == nil && !fwd.ActiveAt(time.Now()) {
+		r.warn(field+".active_windows", "schedule_off", "the forward is outside its activation schedule and will not be deployed now")
+	}
+	vetOwner(r, field+".owner_id", fwd.OwnerID)
+	if entry != nil {
+		vetPort(r, field+".listen_port", entry.NodeID, fwd.ListenPort, models.PortOwnerForward, fwd.ID)
+	}
+
+	host, portStr, err := net.SplitHostPort(fwd.RemoteAddress)
+	port, _ := strconv.Atoi(portStr)
+	if err != nil {
+		r.fail(field+".remote_address", "invalid_target", "remote_address must be host:port")
+		return
+	}
+	// 转发目标由入口/出口节点连接，面板只做解析检查。
+	vetTarget(r, field+".remote_address", host, port, true, false)
+}
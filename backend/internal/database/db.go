@@ -30,7 +30,7 @@ func Init(cfg *config.Config) error {
 		return err
 	}
 
-	if err := db.AutoMigrate(&models.User{}, &models.Node{}, &models.SystemLog{}, &models.ForwardRule{}, &models.TrafficStat{}, &models.Tunnel{}, &models.ChainTunnel{}, &models.Forward{}, &models.ForwardPort{}); err != nil {
+	if err := db.AutoMigrate(&models.User{}, &models.Node{}, &models.SystemLog{}, &models.ForwardRule{}, &models.TrafficStat{}, &models.Tunnel{}, &models.ChainTunnel{}, &models.Forward{}, &models.ForwardPort{}, &models.RuleCapture{}, &models.Template{}, &models.ConfigVersion{}, &models.NodeEvent{}, &models.NodeLatency{}); err != nil {
 		return err
 	}
 
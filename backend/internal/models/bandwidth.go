@@ -0,0 +1,135 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TimeWindow 每周重复的时段 [Start, End)。
+// Weekdays 为空表示每天（0=周日），时间为服务器本地 HH:MM，End 早于 Start 表示跨零点。
+type TimeWindow struct {
+	Weekdays []int  `json:"weekdays"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+}
+
+// BandwidthWindow 带宽时段：在时段内限速为 Limit。
+type BandwidthWindow struct {
+	TimeWindow
+	Limit int64 `json:"limit"` // bytes/s，0 表示不限速
+}
+
+// BandwidthSchedule 按顺序匹配的带宽时段，首个命中的时段生效。
+type BandwidthSchedule []BandwidthWindow
+
+func (s BandwidthSchedule) Value() (driver.Value, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (s *BandwidthSchedule) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			*s = BandwidthSchedule{}
+			return nil
+		}
+		return json.Unmarshal([]byte(v), s)
+	case []byte:
+		if len(v) == 0 {
+			*s = BandwidthSchedule{}
+			return nil
+		}
+		return json.Unmarshal(v, s)
+	default:
+		*s = BandwidthSchedule{}
+		return nil
+	}
+}
+
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w TimeWindow) validate() error {
+	if _, err := parseClock(w.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return err
+	}
+	for _, d := range w.Weekdays {
+		if d < 0 || d > 6 {
+			return fmt.Errorf("weekday must be 0-6")
+		}
+	}
+	return nil
+}
+
+func (s BandwidthSchedule) Validate() error {
+	for i, w := range s {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("schedule[%d]: %v", i, err)
+		}
+		if w.Limit < 0 {
+			return fmt.Errorf("schedule[%d]: limit must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// match 判断 t 是否落在时段内；跨零点的时段按开始那天的星期匹配。
+func (w TimeWindow) match(t time.Time) bool {
+	start, err1 := parseClock(w.Start)
+	end, err2 := parseClock(w.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+	in := false
+	switch {
+	case start < end:
+		in = now >= start && now < end
+	case start > end:
+		if now >= start {
+			in = true
+		} else if now < end {
+			in = true
+			day = (day + 6) % 7
+		}
+	default:
+		in = true // start == end 表示全天
+	}
+	if !in {
+		return false
+	}
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range w.Weekdays {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// LimitAt 返回 t 时刻生效的限速，没有时段命中时返回 fallback。
+func (s BandwidthSchedule) LimitAt(t time.Time, fallback int64) int64 {
+	for _, w := range s {
+		if w.match(t) {
+			return w.Limit
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// RuleCapture 规则流量旁路记录：pcap 抓包或镜像到副目标。
+type RuleCapture struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	RuleID       uint       `gorm:"index" json:"rule_id"`
+	Mode         string     `gorm:"size:20" json:"mode"`           // pcap, mirror
+	MirrorTarget string     `gorm:"size:255" json:"mirror_target"` // mode=mirror 时的副目标 host:port
+	FileName     string     `gorm:"size:255" json:"file_name"`     // mode=pcap 时的文件名
+	FilePath     string     `gorm:"size:500" json:"-"`
+	Status       string     `gorm:"size:20;index" json:"status"` // running, stopped
+	StopReason   string     `gorm:"size:50" json:"stop_reason"`  // manual, timeout, size_limit, rule_stopped
+	MaxBytes     int64      `gorm:"default:0" json:"max_bytes"`
+	Bytes        int64      `gorm:"default:0" json:"bytes"`
+	Packets      int64      `gorm:"default:0" json:"packets"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	StoppedAt    *time.Time `json:"stopped_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+func (RuleCapture) TableName() string { return "rule_captures" }
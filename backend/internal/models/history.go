@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// 版本记录的对象类型
+const (
+	VersionKindRule   = "rule"
+	VersionKindTunnel = "tunnel"
+)
+
+// ConfigVersion 规则或隧道配置的版本快照。
+// 隧道快照包含其链路节点与转发（结构同模板的 tunnel 布局），流量计数、配额用量等运行数据不入快照。
+type ConfigVersion struct {
+	ID       uint    `gorm:"primaryKey" json:"id"`
+	Kind     string  `gorm:"size:20;not null;uniqueIndex:idx_config_version" json:"kind"`
+	RefID    uint    `gorm:"not null;uniqueIndex:idx_config_version" json:"ref_id"`
+	Version  int     `gorm:"not null;uniqueIndex:idx_config_version" json:"version"`
+	Action   string  `gorm:"size:20" json:"action"` // create, update, delete, rollback ...
+	Snapshot JSONRaw `gorm:"type:TEXT" json:"snapshot,omitempty"`
+	// RolledBackFrom rollback 时恢复的源版本号。
+	RolledBackFrom int       `gorm:"default:0" json:"rolled_back_from,omitempty"`
+	AuthorID       uint      `json:"author_id"`
+	Author         string    `gorm:"size:100" json:"author"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (ConfigVersion) TableName() string { return "config_versions" }
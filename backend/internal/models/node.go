@@ -3,6 +3,7 @@ package models
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"strconv"
 	"time"
 )
 
@@ -21,6 +22,10 @@ type Node struct {
 	// Agent 相关字段 (参照 flux-panel Node)
 	Secret    string    `gorm:"size:64" json:"-"`             // Agent 认证密钥 (不暴露给前端)
 	AgentPort int       `gorm:"default:8443" json:"agent_port"` // Agent 监听端口
+	RelayPort int       `gorm:"default:9443" json:"relay_port"` // 原生 relay 协议监听端口
+	RelayTransport string `gorm:"size:20;default:'tcp'" json:"relay_transport"` // relay 传输层: tcp, ws, wss, mws, mwss, h2
+	RelayHost      string `gorm:"size:255" json:"relay_host"`                    // 经 CDN 中转时的域名(空=直连 Host)
+	PortRange      string `gorm:"size:255" json:"port_range"`                    // 自动分配端口池，如 "10000-20000,30000-30100"(空=全局默认)
 	AgentVer  string    `gorm:"size:32" json:"agent_ver"`     // Agent 版本
 	IsOnline  bool      `gorm:"default:false" json:"is_online"` // WebSocket 在线状态
 
@@ -53,5 +58,6 @@ func (n *Node) GenerateSecret() {
 
 // GetInstallCommand 生成该节点的安装命令（类似 flux-panel 的 getInstallCommand）
 func (n *Node) GetInstallCommand(panelAddr string) string {
-	return "curl -fsSL " + panelAddr + "/api/v1/node-agent/install.sh -o install.sh && chmod +x install.sh && bash install.sh -a " + panelAddr + " -s " + n.Secret
+	return "curl -fsSL " + panelAddr + "/api/v1/node-agent/install.sh -o install.sh && chmod +x install.sh && bash install.sh -a " + panelAddr +
+		" -n " + strconv.FormatUint(uint64(n.ID), 10) + " -s " + n.Secret
 }
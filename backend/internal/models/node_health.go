@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// NodeEvent.Type 取值
+const (
+	NodeEventOnline  = "online"
+	NodeEventOffline = "offline"
+)
+
+// NodeEvent.Source 取值
+const (
+	NodeEventSourceAgent = "agent" // Agent WebSocket 连接
+	NodeEventSourceProbe = "probe" // 未连接 Agent 的节点的 SSH 端口探测
+)
+
+// NodeEvent 节点上下线事件
+type NodeEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	NodeID    uint      `gorm:"index" json:"node_id"`
+	NodeName  string    `gorm:"size:100" json:"node_name"`
+	Type      string    `gorm:"size:20" json:"type"`
+	Source    string    `gorm:"size:20" json:"source"`
+	Reason    string    `gorm:"size:255" json:"reason"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+func (NodeEvent) TableName() string { return "node_events" }
+
+// NodeLatency 节点 Agent ping/pong 往返时延采样
+type NodeLatency struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	NodeID    uint      `gorm:"index" json:"node_id"`
+	RTTMS     float64   `json:"rtt_ms"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+func (NodeLatency) TableName() string { return "node_latencies" }
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// QuotaPolicy 规则/隧道转发的周期流量配额，嵌入到 ForwardRule 与 Forward。
+// 超额后转发停止并标记 QuotaExceeded，到 QuotaResetAt 时清零用量并自动恢复。
+type QuotaPolicy struct {
+	TrafficQuota   int64      `gorm:"default:0" json:"traffic_quota"`              // bytes，0 表示不限
+	QuotaDirection string     `gorm:"size:10;default:both" json:"quota_direction"` // up, down, both
+	QuotaResetDay  int        `gorm:"default:0" json:"quota_reset_day"`            // 每月重置日 1-31，0 表示不自动重置
+	QuotaUsed      int64      `gorm:"default:0" json:"quota_used"`
+	QuotaExceeded  bool       `gorm:"default:false;index" json:"quota_exceeded"`
+	QuotaResetAt   *time.Time `json:"quota_reset_at"`
+}
+
+// ValidateQuota 校验配额参数。
+func (q QuotaPolicy) ValidateQuota() error {
+	switch {
+	case q.TrafficQuota < 0:
+		return errors.New("traffic_quota must not be negative")
+	case q.QuotaResetDay < 0 || q.QuotaResetDay > 31:
+		return errors.New("quota_reset_day must be between 0 and 31")
+	}
+	switch q.QuotaDirection {
+	case "", "up", "down", "both":
+		return nil
+	}
+	return errors.New("quota_direction must be up, down or both")
+}
+
+// QuotaBytes 按统计方向折算本次新增的计费字节数。
+func (q QuotaPolicy) QuotaBytes(up, down int64) int64 {
+	switch q.QuotaDirection {
+	case "up":
+		return up
+	case "down":
+		return down
+	default:
+		return up + down
+	}
+}
+
+// OverQuota 判断当前周期用量是否已达配额。
+func (q QuotaPolicy) OverQuota() bool {
+	return q.TrafficQuota > 0 && q.QuotaUsed >= q.TrafficQuota
+}
+
+// NextQuotaReset 返回 after 之后的下一个重置时刻（当天 00:00），
+// 当月没有该日期时取月末；day 为 0 时返回 nil。
+func NextQuotaReset(day int, after time.Time) *time.Time {
+	if day <= 0 {
+		return nil
+	}
+	y, m, _ := after.Date()
+	for i := 0; i < 2; i++ {
+		d := day
+		if last := time.Date(y, m+1, 0, 0, 0, 0, 0, after.Location()).Day(); d > last {
+			d = last
+		}
+		t := time.Date(y, m, d, 0, 0, 0, 0, after.Location())
+		if t.After(after) {
+			return &t
+		}
+		m++
+	}
+	return nil
+}
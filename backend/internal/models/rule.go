@@ -4,6 +4,8 @@ import (
   "database/sql/driver"
   "encoding/json"
   "time"
+
+  "gorm.io/gorm"
 )
 
 type JSONList []string
@@ -38,30 +40,73 @@ type ForwardRule struct {
   Mode                string    `gorm:"size:20;index" json:"mode"`
   ListenNodeID        uint      `json:"listen_node_id"`
   ListenPort          int       `gorm:"index" json:"listen_port"`
-  Protocol            string    `gorm:"size:10" json:"protocol"`
+  Protocol            string    `gorm:"size:20" json:"protocol"`
+  // Options 转发类型的选项 JSON，结构见 GET /rules/types；原生入站类型使用 InboundConfig。
+  Options             string    `gorm:"type:TEXT" json:"options"`
   InboundProxyEnabled bool      `gorm:"default:false" json:"inbound_proxy_enabled"`
   InboundType         string    `gorm:"size:50" json:"inbound_type"`
+  InboundConfig       string    `gorm:"type:TEXT" json:"inbound_config"`
   TargetAddress       string    `gorm:"size:255" json:"target_address"`
   TargetPort          int       `json:"target_port"`
   ChainNodes          JSONList  `gorm:"type:TEXT" json:"chain_nodes"`
   LBStrategy          string    `gorm:"size:30" json:"lb_strategy"`
   LBTargets           JSONList  `gorm:"type:TEXT" json:"lb_targets"`
   BandwidthLimit      int64     `gorm:"default:0" json:"bandwidth_limit"`
+  BandwidthSchedule   BandwidthSchedule `gorm:"type:TEXT" json:"bandwidth_schedule"`
+  PriorityClass       string    `gorm:"size:20;default:standard" json:"priority_class"` // interactive, standard, bulk
   IsActive            bool      `gorm:"default:true;index" json:"is_active"`
   TrafficUp           int64     `gorm:"default:0" json:"traffic_up"`
   TrafficDown         int64     `gorm:"default:0" json:"traffic_down"`
   Connections         int64     `gorm:"default:0" json:"connections"`
   OwnerID             uint      `gorm:"index" json:"owner_id"`
+  QuotaPolicy
+  ActivationPolicy
+  // 故障注入：配置 JSON 与生效截止时间，仅通过 /rules/:id/chaos 修改。
+  ChaosConfig         string    `gorm:"type:TEXT" json:"chaos_config"`
+  ChaosUntil          *time.Time `json:"chaos_until"`
+  ChaosActive         bool      `gorm:"-" json:"chaos_active"`
+  // Runtime 本机转发器的运行状态，由 ForwardManager 维护，不落库。
+  Runtime             *RuleRuntime `gorm:"-" json:"runtime,omitempty"`
   CreatedAt           time.Time `json:"created_at"`
   UpdatedAt           time.Time `json:"updated_at"`
 }
 
 func (ForwardRule) TableName() string { return "forward_rules" }
 
+// 规则运行状态
+const (
+  RuleStateRunning   = "running"
+  RuleStateStopped   = "stopped"
+  RuleStateFailed    = "failed"
+  RuleStatePortInUse = "port_in_use"
+)
+
+// RuleRuntime 规则在本机的运行状态，启动失败或监听意外退出后按指数退避重试。
+type RuleRuntime struct {
+  State        string     `json:"state"`
+  LastError    string     `json:"last_error,omitempty"`
+  Failures     int        `json:"failures"`
+  BackoffUntil *time.Time `json:"backoff_until,omitempty"`
+  StartedAt    *time.Time `json:"started_at,omitempty"`
+  UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// IsChaosActive 判断规则当前是否处于故障注入窗口内。
+func (r *ForwardRule) IsChaosActive() bool {
+  return r.ChaosConfig != "" && r.ChaosUntil != nil && time.Now().Before(*r.ChaosUntil)
+}
+
+func (r *ForwardRule) AfterFind(tx *gorm.DB) error {
+  r.ChaosActive = r.IsChaosActive()
+  return nil
+}
+
 type TrafficStat struct {
   ID          uint      `gorm:"primaryKey" json:"id"`
   RuleID      uint      `gorm:"index" json:"rule_id"`
+  ForwardID   uint      `gorm:"index;default:0" json:"forward_id"` // 隧道转发的流量，与 RuleID 至多一个非 0，均为 0 时为主机快照
   Date        string    `gorm:"size:20;index" json:"date"`
+  Hour        int       `gorm:"default:0" json:"hour"` // 规则与转发流量按小时汇总，主机快照不使用
   TrafficUp   int64     `gorm:"default:0" json:"traffic_up"`
   TrafficDown int64     `gorm:"default:0" json:"traffic_down"`
   Connections int64     `gorm:"default:0" json:"connections"`
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ActiveWindows 每周的启用时段，任一时段命中即处于启用状态；为空表示不限时段。
+type ActiveWindows []TimeWindow
+
+func (w ActiveWindows) Value() (driver.Value, error) {
+	b, err := json.Marshal(w)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (w *ActiveWindows) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			*w = ActiveWindows{}
+			return nil
+		}
+		return json.Unmarshal([]byte(v), w)
+	case []byte:
+		if len(v) == 0 {
+			*w = ActiveWindows{}
+			return nil
+		}
+		return json.Unmarshal(v, w)
+	default:
+		*w = ActiveWindows{}
+		return nil
+	}
+}
+
+// ActivationPolicy 规则/隧道转发的启用计划，嵌入到 ForwardRule 与 Forward。
+// 在 [StartsAt, ExpiresAt) 内且命中 ActiveWindows 时转发，其余时间由 ActivationScheduler
+// 停止并标记 ScheduleOff；与 IsActive 相互独立，手动停用的转发不会被计划启用。
+type ActivationPolicy struct {
+	StartsAt      *time.Time    `json:"starts_at"`
+	ExpiresAt     *time.Time    `gorm:"index" json:"expires_at"`
+	ActiveWindows ActiveWindows `gorm:"type:TEXT" json:"active_windows"`
+	ScheduleOff   bool          `gorm:"default:false;index" json:"schedule_off"`
+	// NextChange 下一次计划启停的时间，仅用于接口展示。
+	NextChange *time.Time `gorm:"-" json:"next_change,omitempty"`
+}
+
+func (p ActivationPolicy) ValidateActivation() error {
+	if p.StartsAt != nil && p.ExpiresAt != nil && !p.ExpiresAt.After(*p.StartsAt) {
+		return errors.New("expires_at must be after starts_at")
+	}
+	for i, w := range p.ActiveWindows {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("active_windows[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Scheduled 是否配置了任何启用计划。
+func (p ActivationPolicy) Scheduled() bool {
+	return p.StartsAt != nil || p.ExpiresAt != nil || len(p.ActiveWindows) > 0
+}
+
+// ActiveAt 判断 t 时刻是否处于计划的启用时间内。
+func (p ActivationPolicy) ActiveAt(t time.Time) bool {
+	if p.StartsAt != nil && t.Before(*p.StartsAt) {
+		return false
+	}
+	if p.ExpiresAt != nil && !t.Before(*p.ExpiresAt) {
+		return false
+	}
+	if len(p.ActiveWindows) == 0 {
+		return true
+	}
+	for _, w := range p.ActiveWindows {
+		if w.match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// RefreshSchedule 按当前时间重新计算 ScheduleOff 与 NextChange，保存前调用使修改立即生效。
+func (p *ActivationPolicy) RefreshSchedule(now time.Time) {
+	p.ScheduleOff = !p.ActiveAt(now)
+	p.NextChange = p.NextChangeAfter(now)
+}
+
+// NextChangeAfter 返回 now 之后启用状态第一次变化的时刻，不会再变化时返回 nil。
+// 候选时刻为 StartsAt、ExpiresAt 以及其后一周内各时段的起止与零点，
+// 时段按周循环，一周内没有变化则之后也不会变化。
+func (p ActivationPolicy) NextChangeAfter(now time.Time) *time.Time {
+	if !p.Scheduled() {
+		return nil
+	}
+	var candidates []time.Time
+	bases := []time.Time{now}
+	for _, t := range []*time.Time{p.StartsAt, p.ExpiresAt} {
+		if t != nil && t.After(now) {
+			candidates = append(candidates, *t)
+		}
+	}
+	if p.StartsAt != nil && p.StartsAt.After(now) {
+		bases = append(bases, *p.StartsAt)
+	}
+	if len(p.ActiveWindows) > 0 {
+		for _, base := range bases {
+			y, m, d := base.Date()
+			for day := 0; day <= 8; day++ {
+				midnight := time.Date(y, m, d+day, 0, 0, 0, 0, now.Location())
+				candidates = append(candidates, midnight)
+				for _, w := range p.ActiveWindows {
+					for _, clock := range []string{w.Start, w.End} {
+						if mins, err := parseClock(clock); err == nil {
+							candidates = append(candidates, midnight.Add(time.Duration(mins)*time.Minute))
+						}
+					}
+				}
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+
+	current := p.ActiveAt(now)
+	for _, t := range candidates {
+		if t.After(now) && p.ActiveAt(t) != current {
+			next := t
+			return &next
+		}
+	}
+	return nil
+}
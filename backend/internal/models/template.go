@@ -0,0 +1,100 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// 模板类型
+const (
+	TemplateKindRule   = "rule"   // 单条 ForwardRule
+	TemplateKindTunnel = "tunnel" // Tunnel + ChainTunnel 链路 + Forward
+)
+
+// TemplateVar 模板变量声明；Spec 中以 "${name}" 引用。
+type TemplateVar struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+}
+
+type TemplateVars []TemplateVar
+
+func (v TemplateVars) Value() (driver.Value, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (v *TemplateVars) Scan(value interface{}) error {
+	switch s := value.(type) {
+	case string:
+		return json.Unmarshal([]byte(s), v)
+	case []byte:
+		return json.Unmarshal(s, v)
+	default:
+		*v = TemplateVars{}
+		return nil
+	}
+}
+
+// JSONRaw 原样存储的 JSON 文本，接口中以 JSON 对象而非字符串收发。
+type JSONRaw []byte
+
+func (j JSONRaw) Value() (driver.Value, error) {
+	if len(j) == 0 {
+		return "null", nil
+	}
+	return string(j), nil
+}
+
+func (j *JSONRaw) Scan(value interface{}) error {
+	switch s := value.(type) {
+	case string:
+		*j = append((*j)[:0], s...)
+	case []byte:
+		*j = append((*j)[:0], s...)
+	default:
+		*j = nil
+	}
+	return nil
+}
+
+func (j JSONRaw) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+	return j, nil
+}
+
+func (j *JSONRaw) UnmarshalJSON(data []byte) error {
+	if j == nil {
+		return errors.New("JSONRaw: UnmarshalJSON on nil pointer")
+	}
+	*j = append((*j)[:0], data...)
+	return nil
+}
+
+// Template 规则/隧道模板 —— 保存参数化的 ForwardRule 或 Tunnel 链路布局，
+// 通过 POST /templates/:id/instantiate 代入变量一次性创建（并可选部署）。
+//
+// Kind=rule 时 Spec 为 ForwardRule 的 JSON；Kind=tunnel 时 Spec 形如
+// {"tunnel": {...}, "chain": [ChainTunnel...], "forwards": [Forward...]}。
+type Template struct {
+	ID          uint         `gorm:"primaryKey" json:"id"`
+	Name        string       `gorm:"size:200;not null" json:"name"`
+	Description string       `gorm:"size:500" json:"description"`
+	Kind        string       `gorm:"size:20;index;not null" json:"kind"`
+	Variables   TemplateVars `gorm:"type:TEXT" json:"variables"`
+	Spec        JSONRaw      `gorm:"type:TEXT" json:"spec"`
+	OwnerID     uint         `gorm:"index" json:"owner_id"` // 创建者
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+func (Template) TableName() string { return "templates" }
@@ -67,10 +67,17 @@ type Forward struct {
 	Protocol      string    `gorm:"size:10;default:'tcp'" json:"protocol"` // tcp, udp, both
 	Strategy      string    `gorm:"size:30" json:"strategy"`               // 负载均衡策略
 	ListenPort    int       `gorm:"default:0" json:"listen_port"`          // 入口监听端口
+	BandwidthLimit int64    `gorm:"default:0" json:"bandwidth_limit"`      // bytes/s，0 表示仅受所属用户限速
 	IsActive      bool      `gorm:"default:true" json:"is_active"`
 	FlowIn        int64     `gorm:"default:0" json:"flow_in"`
 	FlowOut       int64     `gorm:"default:0" json:"flow_out"`
 	Connections   int64     `gorm:"default:0" json:"connections"`
+	// 最近一次下发到节点 Agent 的结果，手动部署与节点重连后的自动重新下发都会更新
+	DeployStatus  string    `gorm:"size:20" json:"deploy_status"` // ok, failed；空表示尚未下发
+	DeployError   string    `gorm:"type:TEXT" json:"deploy_error"`
+	DeployedAt    *time.Time `json:"deployed_at"`
+	QuotaPolicy
+	ActivationPolicy
 
 	// 入站代理配置 (FolstingX 特有，flux-panel 无此功能)
 	InboundEnabled bool   `gorm:"default:false" json:"inbound_enabled"`
@@ -87,13 +94,28 @@ type Forward struct {
 
 func (Forward) TableName() string { return "forwards" }
 
-// ForwardPort 端口分配 —— 记录每个转发在各节点上占用的端口。
-// 参照 flux-panel ForwardPort。
+// Forward.DeployStatus 取值
+const (
+	DeployStatusOK     = "ok"
+	DeployStatusFailed = "failed"
+)
+
+// 端口占用方，对应 ForwardPort.Kind。
+const (
+	PortOwnerRule    = "rule"
+	PortOwnerForward = "forward"
+	PortOwnerChain   = "chain"
+)
+
+// ForwardPort 端口分配 —— 记录规则、转发与链路节点在各节点上占用的端口。
+// 参照 flux-panel ForwardPort；NodeID 为 0 表示面板本机，(node_id, port) 唯一。
 type ForwardPort struct {
-	ID        uint `gorm:"primaryKey" json:"id"`
-	ForwardID uint `gorm:"index;not null" json:"forward_id"`
-	NodeID    uint `gorm:"index;not null" json:"node_id"`
-	Port      int  `gorm:"not null" json:"port"`
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	ForwardID uint   `gorm:"index;not null" json:"forward_id"` // 仅 Kind=forward 时非 0
+	Kind      string `gorm:"size:10;index:idx_port_owner" json:"kind"`
+	RefID     uint   `gorm:"index:idx_port_owner" json:"ref_id"`
+	NodeID    uint   `gorm:"uniqueIndex:idx_node_port;not null" json:"node_id"`
+	Port      int    `gorm:"uniqueIndex:idx_node_port;not null" json:"port"`
 
 	Node Node `gorm:"foreignKey:NodeID" json:"node,omitempty"`
 }
@@ -11,18 +11,20 @@ const (
 )
 
 type User struct {
-	ID             uint      `gorm:"primaryKey" json:"id"`
-	Username       string    `gorm:"size:64;uniqueIndex;not null" json:"username"`
-	PasswordHash   string    `gorm:"size:255;not null" json:"-"`
-	Role           UserRole  `gorm:"size:20;default:user;index" json:"role"`
-	APIKey         string    `gorm:"size:128;uniqueIndex" json:"api_key"`
-	BandwidthLimit int64     `gorm:"default:0" json:"bandwidth_limit"`
-	TrafficLimit   int64     `gorm:"default:0" json:"traffic_limit"`
-	TrafficUsed    int64     `gorm:"default:0" json:"traffic_used"`
-	IsActive       bool      `gorm:"default:true" json:"is_active"`
-	ExpireAt       time.Time `json:"expire_at"`
-	CreatedAt      time.Time `json:"created_at"`
-	UpdatedAt      time.Time `json:"updated_at"`
+	ID             uint     `gorm:"primaryKey" json:"id"`
+	Username       string   `gorm:"size:64;uniqueIndex;not null" json:"username"`
+	PasswordHash   string   `gorm:"size:255;not null" json:"-"`
+	Role           UserRole `gorm:"size:20;default:user;index" json:"role"`
+	APIKey         string   `gorm:"size:128;uniqueIndex" json:"api_key"`
+	BandwidthLimit int64    `gorm:"default:0" json:"bandwidth_limit"`
+	// 按时段覆盖 BandwidthLimit，作为该用户名下规则与隧道转发的限速上限。
+	BandwidthSchedule BandwidthSchedule `gorm:"type:TEXT" json:"bandwidth_schedule"`
+	TrafficLimit      int64             `gorm:"default:0" json:"traffic_limit"`
+	TrafficUsed       int64             `gorm:"default:0" json:"traffic_used"`
+	IsActive          bool              `gorm:"default:true" json:"is_active"`
+	ExpireAt          time.Time         `json:"expire_at"`
+	CreatedAt         time.Time         `json:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at"`
 }
 
 func (User) TableName() string {
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+)
+
+// activationCheckInterval 启用计划检查周期，时段精度为分钟。
+const activationCheckInterval = 15 * time.Second
+
+// ActivationScheduler 按 starts_at / expires_at 与每周时段启停规则和隧道转发：
+// 本机规则通过 ForwardManager 启停，隧道转发通过 AgentHub 移除或重新下发入口服务。
+type ActivationScheduler struct {
+	fm  *ForwardManager
+	hub *AgentHub
+	// redeploy 进入启用时间后重新下发隧道转发。
+	redeploy func(fwd models.Forward) error
+}
+
+func NewActivationScheduler(fm *ForwardManager, hub *AgentHub, redeploy func(fwd models.Forward) error) *ActivationScheduler {
+	return &ActivationScheduler{fm: fm, hub: hub, redeploy: redeploy}
+}
+
+func (s *ActivationScheduler) Start() {
+	go func() {
+		ticker := time.NewTicker(activationCheckInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			s.Check(now)
+		}
+	}()
+}
+
+// Check 比对各规则与转发在 now 时刻应处的启用状态，只处理发生变化的。
+func (s *ActivationScheduler) Check(now time.Time) {
+	s.checkRules(now)
+	s.checkForwards(now)
+}
+
+// transition 返回计划状态是否变化以及变化后是否停用。
+func transition(p *models.ActivationPolicy, now time.Time) (changed, off bool) {
+	if !p.Scheduled() && !p.ScheduleOff {
+		return false, false
+	}
+	off = !p.ActiveAt(now)
+	if off == p.ScheduleOff {
+		return false, off
+	}
+	p.ScheduleOff = off
+	return true, off
+}
+
+func scheduleReason(p models.ActivationPolicy, now time.Time) string {
+	switch {
+	case p.ExpiresAt != nil && !now.Before(*p.ExpiresAt):
+		return "expired"
+	case p.StartsAt != nil && now.Before(*p.StartsAt):
+		return "not started yet"
+	default:
+		return "outside active windows"
+	}
+}
+
+func (s *ActivationScheduler) checkRules(now time.Time) {
+	var rules []models.ForwardRule
+	_ = database.DB.Find(&rules).Error
+
+	for _, rule := range rules {
+		changed, off := transition(&rule.ActivationPolicy, now)
+		if !changed {
+			continue
+		}
+		_ = database.DB.Model(&models.ForwardRule{}).Where("id = ?", rule.ID).Update("schedule_off", off).Error
+		if off {
+			_ = s.fm.Stop(rule.ID)
+			WriteSystemLog("info", "schedule", fmt.Sprintf("rule %d (%s) %s, forwarding stopped", rule.ID, rule.Name, scheduleReason(rule.ActivationPolicy, now)))
+			continue
+		}
+		if rule.IsActive && !rule.QuotaExceeded {
+			if err := s.fm.Start(rule); err != nil {
+				// 启动失败由 RuleReconciler 退避重试。
+				WriteSystemLog("error", "schedule", fmt.Sprintf("rule %d scheduled start failed: %v", rule.ID, err))
+				continue
+			}
+		}
+		WriteSystemLog("info", "schedule", fmt.Sprintf("rule %d (%s) entered its active schedule, forwarding started", rule.ID, rule.Name))
+	}
+}
+
+func (s *ActivationScheduler) checkForwards(now time.Time) {
+	var forwards []models.Forward
+	_ = database.DB.Find(&forwards).Error
+
+	for _, fwd := range forwards {
+		changed, off := transition(&fwd.ActivationPolicy, now)
+		if !changed {
+			continue
+		}
+		_ = database.DB.Model(&models.Forward{}).Where("id = ?", fwd.ID).Update("schedule_off", off).Error
+		if off {
+			removeForwardEntry(s.hub, fwd)
+			WriteSystemLog("info", "schedule", fmt.Sprintf("forward %d (%s) %s, entry service removed", fwd.ID, fwd.Name, scheduleReason(fwd.ActivationPolicy, now)))
+			continue
+		}
+		if fwd.IsActive && !fwd.QuotaExceeded && s.redeploy != nil {
+			if err := s.redeploy(fwd); err != nil {
+				WriteSystemLog("error", "schedule", fmt.Sprintf("forward %d scheduled deploy failed: %v", fwd.ID, err))
+				continue
+			}
+		}
+		WriteSystemLog("info", "schedule", fmt.Sprintf("forward %d (%s) entered its active schedule, forwarding resumed", fwd.ID, fwd.Name))
+	}
+}
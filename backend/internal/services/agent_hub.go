@@ -1,154 +1,75 @@
 package services
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/folstingx/server/config"
 	"github.com/folstingx/server/internal/database"
 	"github.com/folstingx/server/internal/models"
+	"github.com/folstingx/server/pkg/agentproto"
 	"github.com/gorilla/websocket"
 )
 
-// ===================== AES 加解密 (参照 flux-panel AES 通信) =====================
-
-func aesEncrypt(key []byte, plaintext string) (string, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
-	}
-	aesGCM, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
-	}
-	nonce := make([]byte, aesGCM.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
-	}
-	ciphertext := aesGCM.Seal(nonce, nonce, []byte(plaintext), nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
-}
-
-func aesDecrypt(key []byte, cipherBase64 string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(cipherBase64)
-	if err != nil {
-		return "", err
-	}
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
-	}
-	aesGCM, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
-	}
-	nonceSize := aesGCM.NonceSize()
-	if len(data) < nonceSize {
-		return "", fmt.Errorf("ciphertext too short")
-	}
-	plaintext, err := aesGCM.Open(nil, data[:nonceSize], data[nonceSize:], nil)
-	if err != nil {
-		return "", err
-	}
-	return string(plaintext), nil
-}
-
-// deriveKey 将 secret 字符串转为 32 字节 AES 密钥
-func deriveKey(secret string) []byte {
-	key := make([]byte, 32)
-	copy(key, []byte(secret))
-	return key
-}
-
 // ===================== Agent Session =====================
 
-// AgentSession 代表一个已连接的节点 Agent
+// AgentSession 代表一个已连接的节点 Agent，消息按 agentproto 使用本连接派生的密钥加密。
 type AgentSession struct {
 	NodeID   uint
 	NodeName string
 	Secret   string
 	Conn     *websocket.Conn
 	mu       sync.Mutex
+
+	sendKey, recvKey []byte
+	sendSeq          agentproto.Sequencer
+	// recvGuard 只在读取循环中使用。
+	recvGuard agentproto.ReplayGuard
+
+	// lastHeartbeat 最近一次心跳的 UnixNano，由看门狗检查。
+	lastHeartbeat atomic.Int64
+	// done 会话注销时关闭，停止 ping 循环。
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // SendCommand 向 Agent 发送加密命令
 func (s *AgentSession) SendCommand(cmd AgentCommand) error {
-	payload, err := json.Marshal(cmd)
-	if err != nil {
-		return err
-	}
-	encrypted, err := aesEncrypt(deriveKey(s.Secret), string(payload))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd.Seq, cmd.Time = s.sendSeq.Stamp(time.Now())
+	msg, err := agentproto.Seal(s.sendKey, cmd)
 	if err != nil {
 		return err
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.Conn.WriteMessage(websocket.TextMessage, []byte(encrypted))
+	return s.Conn.WriteMessage(websocket.TextMessage, msg)
 }
 
 // AgentCommand 面板→Agent 的命令
-type AgentCommand struct {
-	Action string          `json:"action"` // add_service, delete_service, add_chain, status, etc.
-	ID     string          `json:"id"`     // 请求 ID (用于匹配响应)
-	Data   json.RawMessage `json:"data"`   // 命令载荷
-}
+type AgentCommand = agentproto.Command
 
 // AgentReport Agent→面板 的上报
-type AgentReport struct {
-	Type    string          `json:"type"`    // heartbeat, response, traffic, error
-	ID      string          `json:"id"`      // 响应 ID (匹配请求)
-	NodeID  uint            `json:"node_id"`
-	Data    json.RawMessage `json:"data"`
-}
+type AgentReport = agentproto.Report
 
 // ===================== Gost Service/Chain 数据结构 =====================
 
-// GostServiceConfig 参照 flux-panel GostUtil.AddService
-type GostServiceConfig struct {
-	Name     string `json:"name"`
-	Addr     string `json:"addr"`     // 监听地址 :port
-	Handler  string `json:"handler"`  // tcp, udp, relay, rtcp, rudp
-	Listener string `json:"listener"` // tcp, udp, rtcp, rudp, ws, wss
-	Forwarder *GostForwarder `json:"forwarder,omitempty"`
-	Chain    string `json:"chain,omitempty"` // chain 引用名
-}
-
-// GostForwarder 目标转发配置
-type GostForwarder struct {
-	Nodes []GostForwarderNode `json:"nodes"`
-}
-
-// GostForwarderNode 目标节点
-type GostForwarderNode struct {
-	Name string `json:"name"`
-	Addr string `json:"addr"`
-}
-
-// GostChainConfig 参照 flux-panel GostUtil.AddChains
-type GostChainConfig struct {
-	Name string          `json:"name"`
-	Hops []GostChainHop  `json:"hops"`
-}
-
-// GostChainHop 一跳
-type GostChainHop struct {
-	Name  string          `json:"name"`
-	Nodes []GostHopNode   `json:"nodes"`
-}
-
-// GostHopNode 跳节点
-type GostHopNode struct {
-	Name      string `json:"name"`
-	Addr      string `json:"addr"`
-	Connector string `json:"connector"` // relay, http, socks5
-	Dialer    string `json:"dialer"`    // ws, wss, tcp
-}
+// Gost 配置结构定义在 agentproto，供节点 Agent 共用。
+type (
+	GostServiceConfig = agentproto.ServiceConfig
+	GostLimiterConfig = agentproto.LimiterConfig
+	GostForwarder     = agentproto.Forwarder
+	GostForwarderNode = agentproto.ForwarderNode
+	GostChainConfig   = agentproto.ChainConfig
+	GostChainHop      = agentproto.ChainHop
+	GostHopNode       = agentproto.HopNode
+)
 
 // ===================== Agent Hub =====================
 
@@ -160,54 +81,205 @@ type AgentHub struct {
 	// 请求响应管理
 	pendingMu sync.RWMutex
 	pending   map[string]chan AgentReport
+
+	// 运行在各节点上的规则，按规则 ID 接收 rule_stats 上报
+	rulesMu sync.RWMutex
+	rules   map[uint]*remoteRule
+
+	// onRegister 节点每次（重新）连接后依次异步调用，用于恢复该节点应运行的配置
+	onRegister []func(nodeID uint)
+
+	// 存活检测参数，见 config.AgentConfig
+	pingInterval      time.Duration
+	pongTimeout       time.Duration
+	heartbeatInterval time.Duration
+	missedHeartbeats  int
 }
 
 func NewAgentHub() *AgentHub {
-	return &AgentHub{
+	h := &AgentHub{
 		sessions: make(map[uint]*AgentSession),
 		pending:  make(map[string]chan AgentReport),
+		rules:    make(map[uint]*remoteRule),
 	}
+	h.SetLiveness(config.DefaultConfig().Agent)
+	return h
 }
 
-// Register 注册节点 Agent WebSocket 连接
-func (h *AgentHub) Register(nodeID uint, nodeName string, secret string, conn *websocket.Conn) *AgentSession {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	// 关闭旧连接
-	if old, ok := h.sessions[nodeID]; ok {
-		_ = old.Conn.Close()
+// SetLiveness 设置 ping/pong 与心跳超时参数，未配置（<=0）的项使用默认值；须在接受连接前调用。
+func (h *AgentHub) SetLiveness(cfg config.AgentConfig) {
+	def := config.DefaultConfig().Agent
+	seconds := func(v, d int) time.Duration {
+		if v <= 0 {
+			v = d
+		}
+		return time.Duration(v) * time.Second
+	}
+	h.pingInterval = seconds(cfg.PingInterval, def.PingInterval)
+	h.pongTimeout = seconds(cfg.PongTimeout, def.PongTimeout)
+	h.heartbeatInterval = seconds(cfg.HeartbeatInterval, def.HeartbeatInterval)
+	h.missedHeartbeats = cfg.MissedHeartbeats
+	if h.missedHeartbeats <= 0 {
+		h.missedHeartbeats = def.MissedHeartbeats
 	}
+}
+
+// OnRegister 添加节点连接后的回调，须在接受连接前调用。
+func (h *AgentHub) OnRegister(fn func(nodeID uint)) {
+	h.onRegister = append(h.onRegister, fn)
+}
 
+// agentAuthTimeout 发送 Hello 后等待 Agent 回应 Auth 的时间。
+const agentAuthTimeout = 10 * time.Second
+
+// ErrAgentAuth Agent 未能证明持有节点密钥。
+var ErrAgentAuth = errors.New("agent authentication failed")
+
+// Register 完成握手并注册节点 Agent WebSocket 连接：发送携带面板 nonce 的 Hello，
+// 校验 Agent 回应的 Auth，再与 Agent 的 nonce 一起派生本连接的会话密钥。
+func (h *AgentHub) Register(nodeID uint, nodeName string, secret string, agentNonce []byte, conn *websocket.Conn) (*AgentSession, error) {
+	if len(agentNonce) != agentproto.NonceSize {
+		return nil, fmt.Errorf("agent nonce must be %d bytes", agentproto.NonceSize)
+	}
+	panelNonce := agentproto.NewNonce()
+	hello, _ := json.Marshal(agentproto.Hello{Type: "hello", Version: agentproto.Version, Nonce: panelNonce})
+	if err := conn.WriteMessage(websocket.TextMessage, hello); err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(agentAuthTimeout))
+	var auth agentproto.Auth
+	if err := conn.ReadJSON(&auth); err != nil {
+		return nil, fmt.Errorf("read auth: %w", err)
+	}
+	if auth.Type != "auth" || !agentproto.VerifyAuth(secret, agentNonce, panelNonce, auth.MAC) {
+		WriteSystemLog("warn", "agent_hub", fmt.Sprintf("node %d (%s) agent failed authentication", nodeID, nodeName))
+		return nil, ErrAgentAuth
+	}
 	session := &AgentSession{
 		NodeID:   nodeID,
 		NodeName: nodeName,
 		Secret:   secret,
 		Conn:     conn,
+		done:     make(chan struct{}),
+	}
+	session.sendKey, session.recvKey = agentproto.SessionKeys(secret, agentNonce, panelNonce)
+	now := time.Now()
+	session.lastHeartbeat.Store(now.UnixNano())
+
+	// 读取截止时间随每条消息与 pong 顺延，连接静默挂起时读取循环超时退出。
+	_ = conn.SetReadDeadline(now.Add(h.pongTimeout))
+	conn.SetPongHandler(func(payload string) error {
+		received := time.Now()
+		_ = conn.SetReadDeadline(received.Add(h.pongTimeout))
+		if sent, err := strconv.ParseInt(payload, 10, 64); err == nil {
+			if rtt := received.Sub(time.Unix(0, sent)); rtt >= 0 {
+				recordLatency(nodeID, rtt, received)
+			}
+		}
+		return nil
+	})
+
+	h.mu.Lock()
+	reason := "connected"
+	// 关闭旧连接，旧会话的注销不再影响新会话，因此不记录下线事件。
+	if old, ok := h.sessions[nodeID]; ok {
+		old.close()
+		reason = "reconnected, replaced previous connection"
 	}
 	h.sessions[nodeID] = session
+	h.mu.Unlock()
 
 	// 更新数据库在线状态
 	_ = database.DB.Model(&models.Node{}).Where("id = ?", nodeID).Updates(map[string]interface{}{
 		"is_online":  true,
-		"last_check": time.Now(),
+		"last_check": now,
 	}).Error
 
-	WriteSystemLog("info", "agent_hub", fmt.Sprintf("node %s (%d) connected", nodeName, nodeID))
-	return session
+	recordNodeEvent(nodeID, nodeName, models.NodeEventOnline, models.NodeEventSourceAgent, reason)
+	go h.pingLoop(session)
+	if len(h.onRegister) > 0 {
+		go func() {
+			for _, fn := range h.onRegister {
+				fn(nodeID)
+			}
+		}()
+	}
+	return session, nil
+}
+
+// pingLoop 定期发送携带发送时间的 ping，Agent 回应的 pong 用于计算往返时延。
+func (h *AgentHub) pingLoop(session *AgentSession) {
+	ticker := time.NewTicker(h.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.done:
+			return
+		case <-ticker.C:
+			payload := strconv.FormatInt(time.Now().UnixNano(), 10)
+			if err := session.Conn.WriteControl(websocket.PingMessage, []byte(payload), time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// close 关闭连接并停止 ping 循环，可重复调用。
+func (s *AgentSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		_ = s.Conn.Close()
+	})
 }
 
-// Unregister 注销节点连接
-func (h *AgentHub) Unregister(nodeID uint) {
+// Unregister 注销节点连接并记录下线事件；节点已以新连接重连时不影响新会话。
+func (h *AgentHub) Unregister(session *AgentSession, reason string) {
+	nodeID := session.NodeID
 	h.mu.Lock()
-	if s, ok := h.sessions[nodeID]; ok {
-		_ = s.Conn.Close()
-		delete(h.sessions, nodeID)
+	session.close()
+	if cur, ok := h.sessions[nodeID]; !ok || cur != session {
+		h.mu.Unlock()
+		return
 	}
+	delete(h.sessions, nodeID)
 	h.mu.Unlock()
 
 	_ = database.DB.Model(&models.Node{}).Where("id = ?", nodeID).Update("is_online", false).Error
-	WriteSystemLog("info", "agent_hub", fmt.Sprintf("node %d disconnected", nodeID))
+	recordNodeEvent(nodeID, session.NodeName, models.NodeEventOffline, models.NodeEventSourceAgent, reason)
+}
+
+// Disconnect 断开节点当前的连接。
+func (h *AgentHub) Disconnect(nodeID uint) {
+	if s, ok := h.GetSession(nodeID); ok {
+		h.Unregister(s, "disconnected by panel")
+	}
+}
+
+// StartWatchdog 每个心跳周期检查一次，注销连续 missedHeartbeats 个周期未发送心跳的会话。
+// 连接仍能回应 ping 但 Agent 进程已停止上报时，只有看门狗能发现。
+func (h *AgentHub) StartWatchdog() {
+	go func() {
+		ticker := time.NewTicker(h.heartbeatInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			h.checkHeartbeats(now)
+		}
+	}()
+}
+
+func (h *AgentHub) checkHeartbeats(now time.Time) {
+	limit := time.Duration(h.missedHeartbeats) * h.heartbeatInterval
+	h.mu.RLock()
+	var stale []*AgentSession
+	for _, s := range h.sessions {
+		if now.Sub(time.Unix(0, s.lastHeartbeat.Load())) > limit {
+			stale = append(stale, s)
+		}
+	}
+	h.mu.RUnlock()
+	for _, s := range stale {
+		h.Unregister(s, fmt.Sprintf("missed %d heartbeats", h.missedHeartbeats))
+	}
 }
 
 // GetSession 获取节点会话
@@ -275,47 +347,147 @@ func (h *AgentHub) SendToNode(nodeID uint, cmd AgentCommand, timeout time.Durati
 	}
 }
 
-// HandleReport 处理 Agent 上报 (由 WebSocket 读取循环调用)
-func (h *AgentHub) HandleReport(nodeID uint, secret string, raw []byte) {
-	// 解密消息
-	plaintext, err := aesDecrypt(deriveKey(secret), string(raw))
-	if err != nil {
+// HandleReport 处理 Agent 上报 (由 WebSocket 读取循环调用)。
+// 解密失败或序号、时间戳校验不通过时丢弃消息并返回错误，由调用方决定是否断开连接。
+func (h *AgentHub) HandleReport(session *AgentSession, raw []byte) error {
+	nodeID := session.NodeID
+	var report AgentReport
+	if err := agentproto.Open(session.recvKey, raw, &report); err != nil {
 		WriteSystemLog("warn", "agent_hub", fmt.Sprintf("decrypt failed from node %d: %v", nodeID, err))
-		return
+		return err
 	}
-
-	var report AgentReport
-	if err := json.Unmarshal([]byte(plaintext), &report); err != nil {
-		WriteSystemLog("warn", "agent_hub", fmt.Sprintf("unmarshal failed from node %d: %v", nodeID, err))
-		return
+	if err := session.recvGuard.Check(report.Seq, report.Time, time.Now()); err != nil {
+		WriteSystemLog("warn", "agent_hub", fmt.Sprintf("rejected message from node %d: %v", nodeID, err))
+		return err
 	}
 	report.NodeID = nodeID
+	now := time.Now()
+	_ = session.Conn.SetReadDeadline(now.Add(h.pongTimeout))
 
 	switch report.Type {
 	case "heartbeat":
-		_ = database.DB.Model(&models.Node{}).Where("id = ?", nodeID).Updates(map[string]interface{}{
+		session.lastHeartbeat.Store(now.UnixNano())
+		// 延迟由 ping/pong 测量，心跳只刷新在线状态与 Agent 版本。
+		updates := map[string]interface{}{
 			"is_online":  true,
-			"last_check": time.Now(),
-			"latency_ms": 0,
-		}).Error
+			"last_check": now,
+		}
+		var hb struct {
+			Version string `json:"version"`
+		}
+		if json.Unmarshal(report.Data, &hb) == nil && hb.Version != "" {
+			updates["agent_ver"] = hb.Version
+		}
+		_ = database.DB.Model(&models.Node{}).Where("id = ?", nodeID).Updates(updates).Error
 
 	case "response":
-		h.pendingMu.RLock()
-		ch, ok := h.pending[report.ID]
-		h.pendingMu.RUnlock()
-		if ok {
-			select {
-			case ch <- report:
-			default:
-			}
-		}
+		h.deliver(report)
+
+	case "rule_stats":
+		h.handleRuleStats(nodeID, report.Data)
 
 	case "traffic":
-		// 流量上报 (可扩展)
-		WriteSystemLog("debug", "agent_hub", fmt.Sprintf("traffic report from node %d", nodeID))
+		h.handleTraffic(nodeID, report.Data)
 
 	case "error":
 		WriteSystemLog("error", "agent_hub", fmt.Sprintf("error from node %d: %s", nodeID, string(report.Data)))
+		// 命令失败的响应同样交给等待方。
+		if report.ID != "" {
+			h.deliver(report)
+		}
+	}
+	return nil
+}
+
+func (h *AgentHub) deliver(report AgentReport) {
+	h.pendingMu.RLock()
+	ch, ok := h.pending[report.ID]
+	h.pendingMu.RUnlock()
+	if ok {
+		select {
+		case ch <- report:
+		default:
+		}
+	}
+}
+
+// ErrAgentOffline 节点 Agent 未连接。
+var ErrAgentOffline = errors.New("agent is not connected")
+
+// RotateSecret 在线更换节点密钥：经当前连接下发 rotate_secret，Agent 保存新密钥并确认后才返回。
+// 调用方应先写库，失败时恢复旧密钥。当前连接继续使用已派生的会话密钥，此后的连接与 relay 使用新密钥。
+func (h *AgentHub) RotateSecret(nodeID uint, secret string) error {
+	session, ok := h.GetSession(nodeID)
+	if !ok {
+		return ErrAgentOffline
+	}
+	data, _ := json.Marshal(map[string]string{"secret": secret})
+	resp, err := h.SendToNode(nodeID, AgentCommand{Action: "rotate_secret", ID: generateRequestID(), Data: data}, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if resp.Type == "error" {
+		return fmt.Errorf("rotate_secret failed: %s", string(resp.Data))
+	}
+	session.mu.Lock()
+	session.Secret = secret
+	session.mu.Unlock()
+	return nil
+}
+
+// ===================== 流量上报 =====================
+
+// parseEntryService 从入口服务名 fwd_<tunnel>_<forward> 或 chain_<tunnel>_<forward>_entry 解析隧道与转发；
+// 出口与中继服务返回 false —— 同一份流量在链路每一跳都会被上报，只在入口计数。
+func parseEntryService(name string) (tunnelID, forwardID uint, ok bool) {
+	parts := strings.Split(name, "_")
+	switch {
+	case len(parts) == 3 && parts[0] == "fwd":
+	case len(parts) == 4 && parts[0] == "chain" && parts[3] == "entry":
+	default:
+		return 0, 0, false
+	}
+	t, err1 := strconv.ParseUint(parts[1], 10, 64)
+	f, err2 := strconv.ParseUint(parts[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return uint(t), uint(f), true
+}
+
+// handleTraffic 处理 type=traffic 上报（[]agentproto.ServiceTraffic），只接受该节点作为入口的转发。
+func (h *AgentHub) handleTraffic(nodeID uint, data json.RawMessage) {
+	var items []agentproto.ServiceTraffic
+	if err := json.Unmarshal(data, &items); err != nil {
+		WriteSystemLog("warn", "agent_hub", fmt.Sprintf("invalid traffic report from node %d: %v", nodeID, err))
+		return
+	}
+	var entries []models.ChainTunnel
+	if err := database.DB.Where("node_id = ? AND chain_type = ?", nodeID, models.ChainTypeEntry).Find(&entries).Error; err != nil {
+		return
+	}
+	entryOf := make(map[uint]bool, len(entries))
+	for _, e := range entries {
+		entryOf[e.TunnelID] = true
+	}
+
+	traffic := make(map[uint]ForwardTraffic)
+	for _, it := range items {
+		tunnelID, forwardID, ok := parseEntryService(it.Name)
+		if !ok || !entryOf[tunnelID] {
+			continue
+		}
+		t := traffic[forwardID]
+		t.TunnelID = tunnelID
+		t.TrafficDelta = t.TrafficDelta.add(it.UpBytes, it.DownBytes)
+		t.Connections += it.Connections
+		traffic[forwardID] = t
+	}
+	if len(traffic) == 0 {
+		return
+	}
+	if err := flushForwardTraffic(traffic, time.Now()); err != nil {
+		WriteSystemLog("error", "agent_hub", fmt.Sprintf("save traffic from node %d: %v", nodeID, err))
 	}
 }
 
@@ -369,6 +541,33 @@ func (h *AgentHub) AddGostChain(nodeID uint, chain GostChainConfig) error {
 	return nil
 }
 
+// AddGostLimiter 在节点上添加 gost 流量限速器
+func (h *AgentHub) AddGostLimiter(nodeID uint, limiter GostLimiterConfig) error {
+	return h.sendLimiter(nodeID, "add_limiter", limiter)
+}
+
+// UpdateGostLimiter 更新节点上已有的 gost 流量限速器，引用它的服务无需重建
+func (h *AgentHub) UpdateGostLimiter(nodeID uint, limiter GostLimiterConfig) error {
+	return h.sendLimiter(nodeID, "update_limiter", limiter)
+}
+
+func (h *AgentHub) sendLimiter(nodeID uint, action string, limiter GostLimiterConfig) error {
+	data, _ := json.Marshal(limiter)
+	cmd := AgentCommand{
+		Action: action,
+		ID:     generateRequestID(),
+		Data:   data,
+	}
+	resp, err := h.SendToNode(nodeID, cmd, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if resp.Type == "error" {
+		return fmt.Errorf("%s failed: %s", action, string(resp.Data))
+	}
+	return nil
+}
+
 func generateRequestID() string {
 	b := make([]byte, 8)
 	_, _ = rand.Read(b)
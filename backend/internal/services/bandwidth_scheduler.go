@@ -0,0 +1,168 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+)
+
+// bandwidthCheckInterval 带宽时段的检查周期，时段切换最多延迟一个周期生效。
+const bandwidthCheckInterval = 30 * time.Second
+
+// UserBandwidth 返回用户在 now 时刻的限速上限，0 表示不限速。
+func UserBandwidth(user models.User, now time.Time) int64 {
+	return user.BandwidthSchedule.LimitAt(now, user.BandwidthLimit)
+}
+
+// EffectiveBandwidth 计算规则在 now 时刻的实际限速：规则自身时段/限速与所属用户上限取较小的非零值。
+func EffectiveBandwidth(rule models.ForwardRule, owner *models.User, now time.Time) int64 {
+	limit := rule.BandwidthSchedule.LimitAt(now, rule.BandwidthLimit)
+	if owner != nil {
+		limit = minLimit(limit, UserBandwidth(*owner, now))
+	}
+	return limit
+}
+
+// ForwardBandwidth 计算隧道转发在 now 时刻的实际限速：转发自身限速与所属用户上限取较小的非零值。
+func ForwardBandwidth(fwd models.Forward, owner *models.User, now time.Time) int64 {
+	limit := fwd.BandwidthLimit
+	if owner != nil {
+		limit = minLimit(limit, UserBandwidth(*owner, now))
+	}
+	return limit
+}
+
+// ruleBandwidth 读取规则所属用户后计算实际限速。
+func ruleBandwidth(rule models.ForwardRule, now time.Time) int64 {
+	if rule.OwnerID == 0 {
+		return EffectiveBandwidth(rule, nil, now)
+	}
+	var owner models.User
+	if err := database.DB.First(&owner, rule.OwnerID).Error; err != nil {
+		return EffectiveBandwidth(rule, nil, now)
+	}
+	return EffectiveBandwidth(rule, &owner, now)
+}
+
+func minLimit(a, b int64) int64 {
+	switch {
+	case a <= 0:
+		return b
+	case b <= 0:
+		return a
+	case a < b:
+		return a
+	default:
+		return b
+	}
+}
+
+// GostLimiterName 隧道转发入口服务使用的 gost 限速器名称。
+func GostLimiterName(tunnelID, forwardID uint) string {
+	return fmt.Sprintf("limiter_%d_%d", tunnelID, forwardID)
+}
+
+// GostLimiter 按限速值生成 gost 服务级限速器配置，limit<=0 时不含任何限制。
+func GostLimiter(name string, limit int64) GostLimiterConfig {
+	cfg := GostLimiterConfig{Name: name, Limits: []string{}}
+	if limit > 0 {
+		kb := (limit + 1023) / 1024
+		cfg.Limits = append(cfg.Limits, fmt.Sprintf("$ %dKB %dKB", kb, kb))
+	}
+	return cfg
+}
+
+// BandwidthScheduler 定时按带宽时段调整本地转发器与隧道入口 gost 限速器。
+type BandwidthScheduler struct {
+	fm  *ForwardManager
+	hub *AgentHub
+
+	mu     sync.Mutex
+	pushed map[uint]pushedLimit // forwardID → 已下发到入口节点的限速
+}
+
+type pushedLimit struct {
+	nodeID uint
+	limit  int64
+}
+
+func NewBandwidthScheduler(fm *ForwardManager, hub *AgentHub) *BandwidthScheduler {
+	s := &BandwidthScheduler{fm: fm, hub: hub, pushed: make(map[uint]pushedLimit)}
+	if hub != nil {
+		hub.OnRegister(s.forgetNode)
+	}
+	return s
+}
+
+// forgetNode 节点 Agent 重新连接后其限速器状态未知，清除缓存使下个周期重新下发。
+func (s *BandwidthScheduler) forgetNode(nodeID uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, p := range s.pushed {
+		if p.nodeID == nodeID {
+			delete(s.pushed, id)
+		}
+	}
+}
+
+func (s *BandwidthScheduler) Start() {
+	go func() {
+		ticker := time.NewTicker(bandwidthCheckInterval)
+		defer ticker.Stop()
+		for {
+			s.apply(time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+func (s *BandwidthScheduler) apply(now time.Time) {
+	users := make(map[uint]*models.User)
+	var list []models.User
+	_ = database.DB.Find(&list).Error
+	for i := range list {
+		users[list[i].ID] = &list[i]
+	}
+
+	var rules []models.ForwardRule
+	_ = database.DB.Where("is_active = ?", true).Find(&rules).Error
+	for _, r := range rules {
+		s.fm.SetBandwidth(r.ID, EffectiveBandwidth(r, users[r.OwnerID], now))
+	}
+
+	if s.hub != nil {
+		s.applyTunnels(users, now)
+	}
+}
+
+// applyTunnels 仅在限速值变化时向入口节点下发，节点离线时下个周期重试。
+func (s *BandwidthScheduler) applyTunnels(users map[uint]*models.User, now time.Time) {
+	var forwards []models.Forward
+	_ = database.DB.Where("is_active = ?", true).Find(&forwards).Error
+	for _, fwd := range forwards {
+		limit := ForwardBandwidth(fwd, users[fwd.OwnerID], now)
+		var entry models.ChainTunnel
+		if err := database.DB.Where("tunnel_id = ? AND chain_type = ?", fwd.TunnelID, models.ChainTypeEntry).First(&entry).Error; err != nil {
+			continue
+		}
+		s.mu.Lock()
+		last, ok := s.pushed[fwd.ID]
+		s.mu.Unlock()
+		if ok && last == (pushedLimit{entry.NodeID, limit}) {
+			continue
+		}
+		if _, online := s.hub.GetSession(entry.NodeID); !online {
+			continue
+		}
+		if err := s.hub.UpdateGostLimiter(entry.NodeID, GostLimiter(GostLimiterName(fwd.TunnelID, fwd.ID), limit)); err != nil {
+			WriteSystemLog("warn", "bandwidth", fmt.Sprintf("update limiter for forward %d: %v", fwd.ID, err))
+			continue
+		}
+		s.mu.Lock()
+		s.pushed[fwd.ID] = pushedLimit{entry.NodeID, limit}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,224 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+	"github.com/folstingx/server/pkg/forwarder"
+)
+
+// CaptureDir pcap 文件存放目录，由日志保留任务一并清理。
+const CaptureDir = "captures"
+
+const (
+	captureDefaultDuration = 5 * time.Minute
+	captureMaxDuration     = time.Hour
+	captureDefaultBytes    = 50 << 20
+	captureMaxBytes        = 500 << 20
+	captureRetentionDays   = 7
+)
+
+// CaptureRequest 启动抓包/镜像的参数。
+type CaptureRequest struct {
+	Mode         string `json:"mode"`          // pcap（默认）或 mirror
+	MirrorTarget string `json:"mirror_target"` // mode=mirror 时必填 host:port
+	Duration     int    `json:"duration"`      // 秒，默认 300，最长 3600
+	MaxBytes     int64  `json:"max_bytes"`     // pcap 文件大小上限，默认 50MB
+}
+
+type activeCapture struct {
+	record models.RuleCapture
+	tap    forwarder.Tap
+	pcap   *forwarder.PcapCapture
+	timer  *time.Timer
+}
+
+// CaptureManager 管理规则的临时抓包与流量镜像，每条规则同时最多一个。
+type CaptureManager struct {
+	fm     *ForwardManager
+	mu     sync.Mutex
+	active map[uint]*activeCapture
+}
+
+func NewCaptureManager(fm *ForwardManager) *CaptureManager {
+	// 进程重启后旁路已失效，遗留的 running 记录直接标记为停止。
+	_ = database.DB.Model(&models.RuleCapture{}).Where("status = ?", "running").
+		Updates(map[string]interface{}{"status": "stopped", "stop_reason": "restart", "stopped_at": time.Now()}).Error
+	c := &CaptureManager{fm: fm, active: make(map[uint]*activeCapture)}
+	fm.OnStop(c.ruleStopped)
+	return c
+}
+
+// ruleStopped 规则停止或删除时结束其抓包/镜像。
+func (c *CaptureManager) ruleStopped(ruleID uint) {
+	_, _ = c.stop(ruleID, nil, "rule_stopped")
+}
+
+func (c *CaptureManager) Start(ruleID uint, req CaptureRequest) (*models.RuleCapture, error) {
+	if req.Mode == "" {
+		req.Mode = "pcap"
+	}
+	duration := time.Duration(req.Duration) * time.Second
+	if duration <= 0 {
+		duration = captureDefaultDuration
+	}
+	if duration > captureMaxDuration {
+		return nil, fmt.Errorf("duration must not exceed %d seconds", int(captureMaxDuration.Seconds()))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.active[ruleID]; ok {
+		return nil, fmt.Errorf("capture already running for this rule")
+	}
+
+	ac := &activeCapture{record: models.RuleCapture{
+		RuleID:    ruleID,
+		Mode:      req.Mode,
+		Status:    "running",
+		ExpiresAt: time.Now().Add(duration),
+	}}
+	switch req.Mode {
+	case "pcap":
+		maxBytes := req.MaxBytes
+		if maxBytes <= 0 {
+			maxBytes = captureDefaultBytes
+		}
+		if maxBytes > captureMaxBytes {
+			return nil, fmt.Errorf("max_bytes must not exceed %d", captureMaxBytes)
+		}
+		if err := os.MkdirAll(CaptureDir, 0o755); err != nil {
+			return nil, err
+		}
+		name := fmt.Sprintf("rule-%d-%s.pcap", ruleID, time.Now().Format("20060102-150405"))
+		path := filepath.Join(CaptureDir, name)
+		// 时长由下方计时器统一控制，便于记录停止原因。
+		p, err := forwarder.NewPcapCapture(path, maxBytes, 0)
+		if err != nil {
+			return nil, err
+		}
+		ac.tap, ac.pcap = p, p
+		ac.record.FileName, ac.record.FilePath, ac.record.MaxBytes = name, path, maxBytes
+	case "mirror":
+		m, err := forwarder.NewMirrorTap(req.MirrorTarget)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror_target: %v", err)
+		}
+		ac.tap = m
+		ac.record.MirrorTarget = req.MirrorTarget
+	default:
+		return nil, fmt.Errorf("unsupported capture mode %q", req.Mode)
+	}
+
+	if err := c.fm.SetTap(ruleID, ac.tap); err != nil {
+		_ = ac.tap.Close()
+		if ac.record.FilePath != "" {
+			_ = os.Remove(ac.record.FilePath)
+		}
+		return nil, err
+	}
+	if err := database.DB.Create(&ac.record).Error; err != nil {
+		_ = c.fm.SetTap(ruleID, nil)
+		_ = ac.tap.Close()
+		return nil, err
+	}
+	c.active[ruleID] = ac
+
+	ac.timer = time.AfterFunc(duration, func() { _, _ = c.stop(ruleID, ac, "timeout") })
+	if ac.pcap != nil {
+		// 文件达到大小上限时 pcap 自行停止。
+		go func() {
+			<-ac.pcap.Done()
+			_, _ = c.stop(ruleID, ac, "size_limit")
+		}()
+	}
+	WriteSystemLog("info", "capture", fmt.Sprintf("rule %d %s capture started", ruleID, req.Mode))
+	rec := ac.record
+	return &rec, nil
+}
+
+// Stop 手动停止规则当前的抓包/镜像。
+func (c *CaptureManager) Stop(ruleID uint) (*models.RuleCapture, error) {
+	return c.stop(ruleID, nil, "manual")
+}
+
+// stop 停止规则当前的抓包；expect 非空时仅当当前抓包就是它才停止。
+func (c *CaptureManager) stop(ruleID uint, expect *activeCapture, reason string) (*models.RuleCapture, error) {
+	c.mu.Lock()
+	ac, ok := c.active[ruleID]
+	if ok && expect != nil && ac != expect {
+		ok = false
+	}
+	if ok {
+		delete(c.active, ruleID)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no capture running for this rule")
+	}
+
+	ac.timer.Stop()
+	_ = c.fm.SetTap(ruleID, nil)
+	_ = ac.tap.Close()
+
+	now := time.Now()
+	ac.record.Status = "stopped"
+	ac.record.StopReason = reason
+	ac.record.StoppedAt = &now
+	if ac.pcap != nil {
+		ac.record.Bytes = ac.pcap.Bytes()
+		ac.record.Packets = ac.pcap.Packets()
+	}
+	_ = database.DB.Save(&ac.record).Error
+	return &ac.record, nil
+}
+
+// Active 返回规则正在进行的抓包，pcap 的字节数为实时值。
+func (c *CaptureManager) Active(ruleID uint) (models.RuleCapture, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ac, ok := c.active[ruleID]
+	if !ok {
+		return models.RuleCapture{}, false
+	}
+	rec := ac.record
+	if ac.pcap != nil {
+		rec.Bytes = ac.pcap.Bytes()
+		rec.Packets = ac.pcap.Packets()
+	}
+	return rec, true
+}
+
+// PurgeCaptures 删除早于 cutoff 结束的抓包记录及其文件，并清理无主文件。
+func PurgeCaptures(cutoff time.Time) {
+	var old []models.RuleCapture
+	_ = database.DB.Where("status = ? AND created_at < ?", "stopped", cutoff).Find(&old).Error
+	for _, r := range old {
+		if r.FilePath != "" {
+			_ = os.Remove(r.FilePath)
+		}
+		_ = database.DB.Delete(&models.RuleCapture{}, r.ID).Error
+	}
+
+	entries, err := os.ReadDir(CaptureDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		var count int64
+		path := filepath.Join(CaptureDir, e.Name())
+		_ = database.DB.Model(&models.RuleCapture{}).Where("file_path = ? AND status = ?", path, "running").Count(&count).Error
+		if count == 0 {
+			_ = os.Remove(path)
+		}
+	}
+}
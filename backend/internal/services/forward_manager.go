@@ -2,8 +2,13 @@
 
 import (
   "encoding/json"
+  "errors"
   "fmt"
+  "net"
+  "strconv"
+  "strings"
   "sync"
+  "syscall"
   "time"
 
   "github.com/folstingx/server/internal/database"
@@ -15,15 +20,60 @@ type ForwardManager struct {
   mu         sync.RWMutex
   forwarders map[uint]forwarder.Forwarder
   statsCache map[uint]forwarder.Stats
+  taps       map[uint]forwarder.Tap
+  shaper     *forwarder.HostShaper
+  flows      map[uint]*forwarder.ShaperFlow
+  // counted 为各运行中转发器已计入增量的计数器值，pending 为已停止转发器尚未落库的增量。
+  counted    map[uint]TrafficDelta
+  pending    map[uint]TrafficDelta
+  runtime    map[uint]*models.RuleRuntime
+  // busy 正在启动或停止的规则，转发器的 Start/Stop 在不持有 mu 时执行（远程规则需等待 Agent 响应），
+  // 同一规则的启停操作经由 busy 串行化，结束时关闭对应的 channel。
+  busy       map[uint]chan struct{}
+  // hub 非空时 ListenNodeID 不为 0 的规则下发到对应节点的 Agent 运行。
+  hub        *AgentHub
+  // onStop 规则被停止或删除（不含重载）后调用，不持有 mu。
+  onStop     func(ruleID uint)
 }
 
 func NewForwardManager() *ForwardManager {
   return &ForwardManager{
     forwarders: make(map[uint]forwarder.Forwarder),
     statsCache: make(map[uint]forwarder.Stats),
+    taps:       make(map[uint]forwarder.Tap),
+    flows:      make(map[uint]*forwarder.ShaperFlow),
+    counted:    make(map[uint]TrafficDelta),
+    pending:    make(map[uint]TrafficDelta),
+    runtime:    make(map[uint]*models.RuleRuntime),
+    busy:       make(map[uint]chan struct{}),
   }
 }
 
+// SetShaper 启用主机出口整形，需在 StartAll 之前调用。
+func (m *ForwardManager) SetShaper(s *forwarder.HostShaper) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.shaper = s
+}
+
+// SetAgentHub 启用远程规则，需在 StartAll 之前调用。
+func (m *ForwardManager) SetAgentHub(h *AgentHub) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.hub = h
+}
+
+// ShaperUsage 返回主机整形器的总速率与各类别用量，未启用时 ok 为 false。
+func (m *ForwardManager) ShaperUsage() (rate int64, usage map[string]forwarder.ClassUsage, ok bool) {
+  m.mu.RLock()
+  s := m.shaper
+  m.mu.RUnlock()
+  if s == nil {
+    return 0, nil, false
+  }
+  return s.Rate(), s.Usage(), true
+}
+
 func (m *ForwardManager) buildForwarder(rule models.ForwardRule) (forwarder.Forwarder, error) {
   targetHost := rule.TargetAddress
   targetPort := rule.TargetPort
@@ -47,52 +97,408 @@ func (m *ForwardManager) buildForwarder(rule models.ForwardRule) (forwarder.Forw
     }
   }
 
-  switch rule.Protocol {
-  case "udp":
-    return forwarder.NewUDPForwarder("0.0.0.0", rule.ListenPort, targetHost, targetPort, rule.BandwidthLimit)
-  case "both":
-    return forwarder.NewTCPForwarder("0.0.0.0", rule.ListenPort, targetHost, targetPort, rule.BandwidthLimit), nil
-  default:
-    return forwarder.NewTCPForwarder("0.0.0.0", rule.ListenPort, targetHost, targetPort, rule.BandwidthLimit), nil
+  var hops []forwarder.HopSpec
+  if usesRelayChain(rule) {
+    var err error
+    if hops, err = chainHops(rule); err != nil {
+      return nil, err
+    }
+  }
+
+  if rule.ListenNodeID > 0 {
+    if m.hub == nil {
+      return nil, fmt.Errorf("rule listens on node %d but remote rules are not enabled", rule.ListenNodeID)
+    }
+    return newRemoteRule(m.hub, rule.ID, rule.ListenNodeID, forwarder.RemoteSpec{
+      Kind:           RuleKind(rule),
+      ListenPort:     rule.ListenPort,
+      TargetHost:     targetHost,
+      TargetPort:     targetPort,
+      BandwidthLimit: ruleBandwidth(rule, time.Now()),
+      Options:        RuleOptions(rule),
+      Hops:           hops,
+    }), nil
+  }
+
+  spec := forwarder.Spec{
+    ListenHost:     "0.0.0.0",
+    ListenPort:     rule.ListenPort,
+    TargetHost:     targetHost,
+    TargetPort:     targetPort,
+    BandwidthLimit: rule.BandwidthLimit,
+    Options:        RuleOptions(rule),
+  }
+  if len(hops) > 0 {
+    relayHops := make([]forwarder.RelayHop, 0, len(hops))
+    for _, h := range hops {
+      hop, err := h.RelayHop()
+      if err != nil {
+        return nil, err
+      }
+      relayHops = append(relayHops, hop)
+    }
+    spec.Dialer = forwarder.NewChainDialer(relayHops)
+  }
+  return forwarder.Build(RuleKind(rule), spec)
+}
+
+// legacyProtocols 类型注册表出现前 protocol 列的取值与对应转发类型，both 暂按 tcp 处理。
+var legacyProtocols = map[string]string{
+  "":        "tcp",
+  "tcp":     "tcp",
+  "both":    "tcp",
+  "tcp+udp": "tcp",
+  "udp":     "udp",
+}
+
+// NormalizeProtocol 把 protocol 列映射为已注册的转发类型；未知取值与旧版一致按 tcp 处理。
+func NormalizeProtocol(protocol string) string {
+  p := strings.ToLower(strings.TrimSpace(protocol))
+  if kind, ok := legacyProtocols[p]; ok {
+    return kind
+  }
+  if _, ok := forwarder.Lookup(p); ok {
+    return p
+  }
+  return "tcp"
+}
+
+// RuleKind 返回规则对应的已注册转发类型：原生入站优先，其次按协议。
+func RuleKind(rule models.ForwardRule) string {
+  if rule.InboundProxyEnabled {
+    if _, ok := forwarder.Lookup(rule.InboundType); ok {
+      return rule.InboundType
+    }
+  }
+  return NormalizeProtocol(rule.Protocol)
+}
+
+// RuleOptions 返回传给转发类型的选项：原生入站使用 InboundConfig，其余使用 Options。
+func RuleOptions(rule models.ForwardRule) json.RawMessage {
+  raw := rule.Options
+  if RuleKind(rule) == rule.InboundType {
+    raw = rule.InboundConfig
+  }
+  if raw == "" {
+    return nil
+  }
+  return json.RawMessage(raw)
+}
+
+// IsProxyInbound 判断入站类型是否为由客户端指定目标的原生代理。
+func IsProxyInbound(inboundType string) bool {
+  return inboundType == "socks5" || inboundType == "http_connect"
+}
+
+// usesRelayChain 判断规则是否需要经由 ChainNodes 逐跳中转。
+func usesRelayChain(rule models.ForwardRule) bool {
+  return rule.Mode != "" && rule.Mode != "direct" && len(rule.ChainNodes) > 0
+}
+
+// chainHops 将 ChainNodes（节点 ID 列表，按 entry→relay→exit 顺序）解析为 relay 跳点描述。
+func chainHops(rule models.ForwardRule) ([]forwarder.HopSpec, error) {
+  hops := make([]forwarder.HopSpec, 0, len(rule.ChainNodes))
+  for _, item := range rule.ChainNodes {
+    id, err := strconv.Atoi(strings.TrimSpace(item))
+    if err != nil {
+      return nil, fmt.Errorf("invalid chain node %q", item)
+    }
+    var node models.Node
+    if err := database.DB.First(&node, id).Error; err != nil {
+      return nil, fmt.Errorf("chain node %d not found", id)
+    }
+    if node.Secret == "" {
+      return nil, fmt.Errorf("chain node %s has no secret", node.Name)
+    }
+    port := node.RelayPort
+    if port == 0 {
+      port = 9443
+    }
+    host := node.Host
+    if node.RelayHost != "" {
+      host = node.RelayHost
+    }
+    hops = append(hops, forwarder.HopSpec{
+      Name:      node.Name,
+      Addr:      net.JoinHostPort(host, strconv.Itoa(port)),
+      Key:       forwarder.RelayKey(node.Secret),
+      Transport: node.RelayTransport,
+      Host:      node.RelayHost,
+    })
+  }
+  return hops, nil
+}
+
+// claimLocked 等待规则上进行中的启动或停止结束后将其标记为进行中。
+// 调用方需持有 m.mu，等待期间会释放该锁，返回时仍持有。
+func (m *ForwardManager) claimLocked(ruleID uint) {
+  for {
+    ch, ok := m.busy[ruleID]
+    if !ok {
+      break
+    }
+    m.mu.Unlock()
+    <-ch
+    m.mu.Lock()
+  }
+  m.busy[ruleID] = make(chan struct{})
+}
+
+// releaseLocked 结束 claimLocked 标记的启停操作，调用方需持有 m.mu。
+func (m *ForwardManager) releaseLocked(ruleID uint) {
+  if ch, ok := m.busy[ruleID]; ok {
+    close(ch)
+    delete(m.busy, ruleID)
   }
 }
 
 func (m *ForwardManager) Start(rule models.ForwardRule) error {
   m.mu.Lock()
-  defer m.mu.Unlock()
+  m.claimLocked(rule.ID)
+  defer func() {
+    m.releaseLocked(rule.ID)
+    m.mu.Unlock()
+  }()
   if _, ok := m.forwarders[rule.ID]; ok {
     return fmt.Errorf("rule already started")
   }
+  if rule.QuotaExceeded {
+    return fmt.Errorf("rule traffic quota exceeded")
+  }
+  if rule.ScheduleOff {
+    return fmt.Errorf("rule is outside its activation schedule")
+  }
   f, err := m.buildForwarder(rule)
   if err != nil {
+    m.recordFailure(rule.ID, err)
     return err
   }
-  if err := f.Start(); err != nil {
+  if t, ok := m.taps[rule.ID]; ok {
+    if tf, ok := f.(forwarder.Tappable); ok {
+      tf.SetTap(t)
+    }
+  }
+  if ct, ok := f.(forwarder.ChaosTarget); ok {
+    ct.SetChaos(RuleChaos(rule))
+  }
+  if rl, ok := f.(forwarder.RateLimited); ok {
+    rl.Limiter().SetRate(ruleBandwidth(rule, time.Now()))
+  }
+  var flow *forwarder.ShaperFlow
+  if sf, ok := f.(forwarder.Shapeable); ok && m.shaper != nil {
+    flow = m.shaper.Flow(rule.PriorityClass)
+    sf.SetShaperFlow(flow)
+  }
+  // 远程规则的启动需等待 Agent 响应，期间释放锁，其余操作不受影响。
+  m.mu.Unlock()
+  err = f.Start()
+  m.mu.Lock()
+  if err != nil {
+    flow.Close()
+    m.recordFailure(rule.ID, err)
     return err
   }
+  // 启动期间抓包可能已被挂上或移除，以当前记录为准。
+  if tf, ok := f.(forwarder.Tappable); ok {
+    tf.SetTap(m.taps[rule.ID])
+  }
   m.forwarders[rule.ID] = f
+  m.counted[rule.ID] = TrafficDelta{}
+  if flow != nil {
+    m.flows[rule.ID] = flow
+  }
+  now := time.Now()
+  m.runtime[rule.ID] = &models.RuleRuntime{State: models.RuleStateRunning, StartedAt: &now, UpdatedAt: now}
   return nil
 }
 
-func (m *ForwardManager) Stop(ruleID uint) error {
+// ruleBackoff 第 n 次连续失败后的重试间隔：2s 起翻倍，最长 5 分钟。
+func ruleBackoff(failures int) time.Duration {
+  d := 2 * time.Second
+  for i := 1; i < failures && d < 5*time.Minute; i++ {
+    d *= 2
+  }
+  if d > 5*time.Minute {
+    d = 5 * time.Minute
+  }
+  return d
+}
+
+// recordFailure 记录启动或运行失败并计算下次重试时间，调用方需持有 m.mu。
+func (m *ForwardManager) recordFailure(ruleID uint, err error) {
+  rt := m.runtime[ruleID]
+  if rt == nil || rt.State == models.RuleStateRunning || rt.State == models.RuleStateStopped {
+    rt = &models.RuleRuntime{}
+    m.runtime[ruleID] = rt
+  }
+  now := time.Now()
+  rt.Failures++
+  rt.State = models.RuleStateFailed
+  if errors.Is(err, syscall.EADDRINUSE) {
+    rt.State = models.RuleStatePortInUse
+  }
+  rt.LastError = err.Error()
+  until := now.Add(ruleBackoff(rt.Failures))
+  rt.BackoffUntil = &until
+  rt.StartedAt = nil
+  rt.UpdatedAt = now
+}
+
+// Runtime 返回规则的运行状态副本，从未启动过的规则视为已停止。
+func (m *ForwardManager) Runtime(ruleID uint) *models.RuleRuntime {
+  m.mu.RLock()
+  defer m.mu.RUnlock()
+  if rt, ok := m.runtime[ruleID]; ok {
+    cp := *rt
+    return &cp
+  }
+  return &models.RuleRuntime{State: models.RuleStateStopped}
+}
+
+// Forget 删除规则后清除其运行状态。
+func (m *ForwardManager) Forget(ruleID uint) {
   m.mu.Lock()
   defer m.mu.Unlock()
+  delete(m.runtime, ruleID)
+}
+
+// RuleChaos 解析规则上的故障注入配置，未启用或已过期时返回 nil。
+func RuleChaos(rule models.ForwardRule) *forwarder.Chaos {
+  if !rule.IsChaosActive() {
+    return nil
+  }
+  var cfg forwarder.ChaosConfig
+  if err := json.Unmarshal([]byte(rule.ChaosConfig), &cfg); err != nil {
+    return nil
+  }
+  return &forwarder.Chaos{Config: cfg, Until: *rule.ChaosUntil}
+}
+
+// SetChaos 将规则的故障注入配置应用到运行中的转发器。
+func (m *ForwardManager) SetChaos(rule models.ForwardRule) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  f, ok := m.forwarders[rule.ID]
+  if !ok {
+    return nil
+  }
+  ct, ok := f.(forwarder.ChaosTarget)
+  if !ok {
+    return fmt.Errorf("rule forwarder does not support fault injection")
+  }
+  ct.SetChaos(RuleChaos(rule))
+  return nil
+}
+
+// SetBandwidth 调整运行中规则的限速，不重启监听。
+func (m *ForwardManager) SetBandwidth(ruleID uint, limit int64) {
+  m.mu.RLock()
+  defer m.mu.RUnlock()
+  switch f := m.forwarders[ruleID].(type) {
+  case *remoteRule:
+    f.SetRate(limit)
+  case forwarder.RateLimited:
+    if f.Limiter().Rate() != limit {
+      f.Limiter().SetRate(limit)
+    }
+  }
+}
+
+// ApplyBandwidth 按规则当前配置与所属用户重新计算并应用限速。
+func (m *ForwardManager) ApplyBandwidth(rule models.ForwardRule) {
+  m.SetBandwidth(rule.ID, ruleBandwidth(rule, time.Now()))
+}
+
+// SetTap 为运行中的规则挂上旁路观察者（t 为 nil 时移除），规则重载后自动保留。
+func (m *ForwardManager) SetTap(ruleID uint, t forwarder.Tap) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  if t == nil {
+    delete(m.taps, ruleID)
+    if tf, ok := m.forwarders[ruleID].(forwarder.Tappable); ok {
+      tf.SetTap(nil)
+    }
+    return nil
+  }
+  f, ok := m.forwarders[ruleID]
+  if !ok {
+    return fmt.Errorf("rule is not running")
+  }
+  tf, ok := f.(forwarder.Tappable)
+  if !ok {
+    return fmt.Errorf("rule forwarder does not support capture")
+  }
+  m.taps[ruleID] = t
+  tf.SetTap(t)
+  return nil
+}
+
+// OnStop 设置规则停止后的回调，须在启动规则前调用。
+func (m *ForwardManager) OnStop(fn func(ruleID uint)) {
+  m.onStop = fn
+}
+
+// Stop 停止规则并通知 OnStop 回调，规则上的抓包等随之结束。
+func (m *ForwardManager) Stop(ruleID uint) error {
+  if err := m.stop(ruleID); err != nil {
+    return err
+  }
+  if m.onStop != nil {
+    m.onStop(ruleID)
+  }
+  return nil
+}
+
+// stop 停止规则但不通知回调，供重载使用。
+func (m *ForwardManager) stop(ruleID uint) error {
+  m.mu.Lock()
+  m.claimLocked(ruleID)
+  defer func() {
+    m.releaseLocked(ruleID)
+    m.mu.Unlock()
+  }()
+  if err := m.stopClaimedLocked(ruleID); err != nil {
+    return err
+  }
+  // 主动停止会清除失败记录与退避。
+  if _, ok := m.runtime[ruleID]; ok {
+    m.runtime[ruleID] = &models.RuleRuntime{State: models.RuleStateStopped, UpdatedAt: time.Now()}
+  }
+  return nil
+}
+
+// stopClaimedLocked 停止规则的转发器并结算剩余流量。调用方需持有 m.mu 并已 claimLocked 该规则；
+// 转发器的 Stop 在释放锁后执行，返回时仍持有锁。
+func (m *ForwardManager) stopClaimedLocked(ruleID uint) error {
   f, ok := m.forwarders[ruleID]
   if !ok {
     return nil
   }
-  if err := f.Stop(); err != nil {
+  m.mu.Unlock()
+  err := f.Stop()
+  m.mu.Lock()
+  if err != nil {
     return err
   }
+  // 转发器停止后计数器随之丢弃，先把最后一次落库之后的流量转入 pending。
+  st := f.Stats()
+  m.pending[ruleID] = m.pending[ruleID].add(st.UpBytes-m.counted[ruleID].Up, st.DownBytes-m.counted[ruleID].Down)
+  delete(m.counted, ruleID)
   delete(m.forwarders, ruleID)
+  if flow, ok := m.flows[ruleID]; ok {
+    flow.Close()
+    delete(m.flows, ruleID)
+  }
   return nil
 }
 
 func (m *ForwardManager) Reload(rule models.ForwardRule) error {
-  _ = m.Stop(rule.ID)
   if !rule.IsActive {
+    _ = m.Stop(rule.ID)
     return nil
   }
+  // 重载保留规则上的抓包，新转发器启动时重新挂上。
+  _ = m.stop(rule.ID)
   return m.Start(rule)
 }
 
@@ -107,29 +513,95 @@ func (m *ForwardManager) StartAll() error {
   return nil
 }
 
+// Running 返回运行中转发器对应的规则 ID。
+func (m *ForwardManager) Running() []uint {
+  m.mu.RLock()
+  defer m.mu.RUnlock()
+  ids := make([]uint, 0, len(m.forwarders))
+  for id := range m.forwarders {
+    ids = append(ids, id)
+  }
+  return ids
+}
+
+// ReapFailed 停止监听已意外退出的转发器，记为失败并进入退避，返回对应的规则与原因。
+func (m *ForwardManager) ReapFailed() map[uint]error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  exited := make(map[uint]forwarder.Forwarder)
+  for id, f := range m.forwarders {
+    if sv, ok := f.(forwarder.Supervised); ok && sv.Err() != nil {
+      exited[id] = f
+    }
+  }
+  failed := make(map[uint]error)
+  for id, f := range exited {
+    m.claimLocked(id)
+    // 等待期间规则可能已被停止或重载。
+    if m.forwarders[id] == f {
+      err := f.(forwarder.Supervised).Err()
+      if m.stopClaimedLocked(id) == nil {
+        m.recordFailure(id, err)
+        failed[id] = err
+      }
+    }
+    m.releaseLocked(id)
+  }
+  return failed
+}
+
 func (m *ForwardManager) Stats() map[uint]forwarder.Stats {
   m.mu.RLock()
   defer m.mu.RUnlock()
   out := make(map[uint]forwarder.Stats, len(m.forwarders))
   for id, f := range m.forwarders {
-    out[id] = f.Stats()
+    s := f.Stats()
+    if ct, ok := f.(forwarder.ChaosTarget); ok {
+      s.ChaosActive = ct.ChaosActive()
+    }
+    if rl, ok := f.(forwarder.RateLimited); ok {
+      s.BandwidthLimit = rl.Limiter().Rate()
+    }
+    out[id] = s
   }
   return out
 }
 
+// TakeDeltas 返回自上次调用以来各规则新增的流量（含已停止转发器的剩余部分），
+// 以及运行中规则的当前连接数。
+func (m *ForwardManager) TakeDeltas() (map[uint]TrafficDelta, map[uint]int64) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  deltas := m.pending
+  m.pending = make(map[uint]TrafficDelta)
+  conns := make(map[uint]int64, len(m.forwarders))
+  for id, f := range m.forwarders {
+    st := f.Stats()
+    prev := m.counted[id]
+    deltas[id] = deltas[id].add(st.UpBytes-prev.Up, st.DownBytes-prev.Down)
+    m.counted[id] = TrafficDelta{Up: st.UpBytes, Down: st.DownBytes}
+    conns[id] = st.Connections
+  }
+  return deltas, conns
+}
+
+// RestoreDeltas 落库失败时把增量放回，下次一并写入。
+func (m *ForwardManager) RestoreDeltas(deltas map[uint]TrafficDelta) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  for id, d := range deltas {
+    m.pending[id] = m.pending[id].add(d.Up, d.Down)
+  }
+}
+
 func (m *ForwardManager) StartPersistLoop() {
   ticker := time.NewTicker(5 * time.Second)
   go func() {
     defer ticker.Stop()
     for range ticker.C {
-      stats := m.Stats()
-      for ruleID, s := range stats {
-        _ = database.DB.Model(&models.ForwardRule{}).Where("id = ?", ruleID).Updates(map[string]interface{}{
-          "traffic_up":   s.UpBytes,
-          "traffic_down": s.DownBytes,
-          "connections":  s.Connections,
-          "updated_at":   time.Now(),
-        }).Error
+      deltas, conns := m.TakeDeltas()
+      if err := flushTraffic(deltas, conns, time.Now()); err != nil {
+        m.RestoreDeltas(deltas)
       }
     }
   }()
@@ -29,16 +29,20 @@ func CheckNode(node *models.Node) (int64, error) {
   oldOnline := oldLatency >= 0
   newOnline := latency >= 0
   if oldOnline != newOnline {
-    status := "offline"
+    typ, reason := models.NodeEventOffline, "ssh port unreachable"
     if newOnline {
-      status = "online"
+      typ, reason = models.NodeEventOnline, "ssh port reachable"
     }
-    WriteSystemLog("warn", "node_checker", "node "+node.Name+"("+node.Host+") => "+status)
+    if err != nil {
+      reason = err.Error()
+    }
+    recordNodeEvent(node.ID, node.Name, typ, models.NodeEventSourceProbe, reason)
   }
   return latency, err
 }
 
-func StartNodeChecker() {
+// StartNodeChecker 定期探测节点 SSH 端口；Agent 在线的节点由 ping/pong 测量延迟，不再探测。
+func StartNodeChecker(hub *AgentHub) {
   ticker := time.NewTicker(60 * time.Second)
   go func() {
     defer ticker.Stop()
@@ -48,6 +52,9 @@ func StartNodeChecker() {
         continue
       }
       for i := range nodes {
+        if hub != nil && hub.IsOnline(nodes[i].ID) {
+          continue
+        }
         _, _ = CheckNode(&nodes[i])
       }
     }
@@ -0,0 +1,42 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+)
+
+// nodeHealthRetentionDays 节点事件与时延采样的保留天数。
+const nodeHealthRetentionDays = 7
+
+// recordNodeEvent 记录节点上下线事件，取代原先分散的系统日志行。
+func recordNodeEvent(nodeID uint, nodeName, typ, source, reason string) {
+	if nodeName == "" {
+		var node models.Node
+		if database.DB.Select("name").Limit(1).Find(&node, nodeID).Error == nil {
+			nodeName = node.Name
+		}
+	}
+	ev := models.NodeEvent{NodeID: nodeID, NodeName: nodeName, Type: typ, Source: source, Reason: reason}
+	if err := database.DB.Create(&ev).Error; err != nil {
+		WriteSystemLog("error", "node_events", fmt.Sprintf("save %s event for node %d: %v", typ, nodeID, err))
+	}
+}
+
+// recordLatency 保存一次往返时延采样并更新节点当前延迟。
+func recordLatency(nodeID uint, rtt time.Duration, now time.Time) {
+	ms := float64(rtt.Microseconds()) / 1000
+	_ = database.DB.Model(&models.Node{}).Where("id = ?", nodeID).Updates(map[string]interface{}{
+		"latency_ms": rtt.Milliseconds(),
+		"last_check": now,
+	}).Error
+	_ = database.DB.Create(&models.NodeLatency{NodeID: nodeID, RTTMS: ms, CreatedAt: now}).Error
+}
+
+// purgeNodeHealth 删除过期的节点事件与时延采样。
+func purgeNodeHealth(before time.Time) {
+	_ = database.DB.Where("created_at < ?", before).Delete(&models.NodeEvent{}).Error
+	_ = database.DB.Where("created_at < ?", before).Delete(&models.NodeLatency{}).Error
+}
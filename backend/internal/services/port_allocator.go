@@ -0,0 +1,275 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/folstingx/server/config"
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+	"gorm.io/gorm"
+)
+
+// PortRange 闭区间 [Start, End]。
+type PortRange struct {
+	Start int
+	End   int
+}
+
+// ParsePortRanges 解析 "10000-20000,30000,40000-40100" 形式的端口池，空串返回 nil。
+func ParsePortRanges(s string) ([]PortRange, error) {
+	var out []PortRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, found := strings.Cut(part, "-")
+		start, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		end := start
+		if found {
+			if end, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+				return nil, fmt.Errorf("invalid port range %q", part)
+			}
+		}
+		if start < 1 || end > 65535 || start > end {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		out = append(out, PortRange{Start: start, End: end})
+	}
+	return out, nil
+}
+
+var (
+	// ErrPortPoolExhausted 端口池中已无空闲端口。
+	ErrPortPoolExhausted = errors.New("no free port left in the pool")
+	// ErrNoEntryNode 隧道尚未添加入口节点，无法确定转发的监听节点。
+	ErrNoEntryNode = errors.New("tunnel has no entry node")
+)
+
+// PortConflictError 端口已被其它规则、转发、链路节点或系统服务占用。
+type PortConflictError struct {
+	NodeID uint
+	Port   int
+	Kind   string
+	RefID  uint
+}
+
+func (e *PortConflictError) Error() string {
+	where := "panel host"
+	if e.NodeID > 0 {
+		where = fmt.Sprintf("node %d", e.NodeID)
+	}
+	if e.Kind == "system" {
+		return fmt.Sprintf("port %d on %s is reserved", e.Port, where)
+	}
+	return fmt.Sprintf("port %d on %s is already used by %s %d", e.Port, where, e.Kind, e.RefID)
+}
+
+type portOwner struct {
+	kind  string
+	refID uint
+}
+
+// PortAllocator 统一分配并记录各节点（0 为面板本机）的监听端口，占用记录写入 ForwardPort。
+// 分配在调用方事务内完成，(node_id, port) 唯一索引兜底并发写入。
+type PortAllocator struct {
+	mu       sync.Mutex
+	panel    []PortRange
+	node     []PortRange
+	reserved []int // 面板本机的 HTTP / relay 监听端口
+}
+
+func NewPortAllocator(cfg *config.Config) (*PortAllocator, error) {
+	panel, err := ParsePortRanges(cfg.Ports.PanelRange)
+	if err != nil {
+		return nil, fmt.Errorf("ports.panel_range: %w", err)
+	}
+	node, err := ParsePortRanges(cfg.Ports.NodeRange)
+	if err != nil {
+		return nil, fmt.Errorf("ports.node_range: %w", err)
+	}
+	a := &PortAllocator{panel: panel, node: node}
+	for _, p := range []int{cfg.Server.Port, cfg.Relay.Port} {
+		if p > 0 {
+			a.reserved = append(a.reserved, p)
+		}
+	}
+	return a, nil
+}
+
+// pool 返回节点的端口池与保留端口。
+func (a *PortAllocator) pool(tx *gorm.DB, nodeID uint) ([]PortRange, []int, error) {
+	if nodeID == 0 {
+		return a.panel, a.reserved, nil
+	}
+	var node models.Node
+	if err := tx.First(&node, nodeID).Error; err != nil {
+		return nil, nil, fmt.Errorf("node %d not found", nodeID)
+	}
+	ranges, err := ParsePortRanges(node.PortRange)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ranges) == 0 {
+		ranges = a.node
+	}
+	return ranges, []int{node.AgentPort, node.RelayPort}, nil
+}
+
+// occupied 返回节点的端口池及被其它占用方（含保留端口）使用的端口，kind/refID 自身的记录不计入。
+func (a *PortAllocator) occupied(tx *gorm.DB, nodeID uint, kind string, refID uint) ([]PortRange, map[int]portOwner, error) {
+	ranges, reserved, err := a.pool(tx, nodeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	used := make(map[int]portOwner)
+	for _, p := range reserved {
+		if p > 0 {
+			used[p] = portOwner{kind: "system"}
+		}
+	}
+	var rows []models.ForwardPort
+	if err := tx.Where("node_id = ? AND NOT (kind = ? AND ref_id = ?)", nodeID, kind, refID).Find(&rows).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, r := range rows {
+		used[r.Port] = portOwner{kind: r.Kind, refID: r.RefID}
+	}
+	return ranges, used, nil
+}
+
+// resolvePort 校验指定端口未被占用，port 为 0 时从端口池挑选。
+func resolvePort(nodeID uint, port int, ranges []PortRange, used map[int]portOwner) (int, error) {
+	if port < 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %d", port)
+	}
+	if port == 0 {
+		if port = pickPort(ranges, used); port == 0 {
+			return 0, ErrPortPoolExhausted
+		}
+		return port, nil
+	}
+	if owner, ok := used[port]; ok {
+		return 0, &PortConflictError{NodeID: nodeID, Port: port, Kind: owner.kind, RefID: owner.refID}
+	}
+	return port, nil
+}
+
+// Check 只校验不写入：返回 Assign 将会使用的端口或冲突原因。
+func (a *PortAllocator) Check(tx *gorm.DB, nodeID uint, port int, kind string, refID uint) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ranges, used, err := a.occupied(tx, nodeID, kind, refID)
+	if err != nil {
+		return 0, err
+	}
+	return resolvePort(nodeID, port, ranges, used)
+}
+
+// Assign 为 kind/refID 在节点上占用端口并返回实际端口；port 为 0 时从端口池自动分配。
+// 该占用方原有的记录先行释放，调用方事务回滚时一并恢复。
+func (a *PortAllocator) Assign(tx *gorm.DB, nodeID uint, port int, kind string, refID uint) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ranges, used, err := a.occupied(tx, nodeID, kind, refID)
+	if err != nil {
+		return 0, err
+	}
+	if port, err = resolvePort(nodeID, port, ranges, used); err != nil {
+		return 0, err
+	}
+	if err := tx.Where("kind = ? AND ref_id = ?", kind, refID).Delete(&models.ForwardPort{}).Error; err != nil {
+		return 0, err
+	}
+	row := models.ForwardPort{Kind: kind, RefID: refID, NodeID: nodeID, Port: port}
+	if kind == models.PortOwnerForward {
+		row.ForwardID = refID
+	}
+	if err := tx.Create(&row).Error; err != nil {
+		return 0, err
+	}
+	return port, nil
+}
+
+func pickPort(ranges []PortRange, used map[int]portOwner) int {
+	for _, r := range ranges {
+		for p := r.Start; p <= r.End; p++ {
+			if _, ok := used[p]; !ok {
+				return p
+			}
+		}
+	}
+	return 0
+}
+
+// Release 释放占用方的全部端口记录。
+func (a *PortAllocator) Release(tx *gorm.DB, kind string, refIDs ...uint) error {
+	if len(refIDs) == 0 {
+		return nil
+	}
+	return tx.Where("kind = ? AND ref_id IN ?", kind, refIDs).Delete(&models.ForwardPort{}).Error
+}
+
+// EntryNodeID 返回隧道转发监听所在的入口节点。
+func EntryNodeID(tx *gorm.DB, tunnelID uint) (uint, error) {
+	var entry models.ChainTunnel
+	res := tx.Where("tunnel_id = ? AND chain_type = ?", tunnelID, models.ChainTypeEntry).Order("id").Limit(1).Find(&entry)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return 0, ErrNoEntryNode
+	}
+	return entry.NodeID, nil
+}
+
+// Sync 为引入分配器之前创建的规则、转发与链路节点补写端口记录，冲突的只记日志。
+func (a *PortAllocator) Sync() {
+	var recorded []models.ForwardPort
+	_ = database.DB.Find(&recorded).Error
+	seen := make(map[portOwner]bool, len(recorded))
+	for _, r := range recorded {
+		seen[portOwner{kind: r.Kind, refID: r.RefID}] = true
+	}
+
+	record := func(nodeID uint, port int, kind string, refID uint) {
+		if port <= 0 || seen[portOwner{kind: kind, refID: refID}] {
+			return
+		}
+		err := database.DB.Transaction(func(tx *gorm.DB) error {
+			_, err := a.Assign(tx, nodeID, port, kind, refID)
+			return err
+		})
+		if err != nil {
+			WriteSystemLog("warn", "ports", fmt.Sprintf("%s %d: %v", kind, refID, err))
+		}
+	}
+
+	var rules []models.ForwardRule
+	_ = database.DB.Find(&rules).Error
+	for _, r := range rules {
+		record(r.ListenNodeID, r.ListenPort, models.PortOwnerRule, r.ID)
+	}
+	var chains []models.ChainTunnel
+	_ = database.DB.Where("chain_type <> ?", models.ChainTypeEntry).Find(&chains).Error
+	for _, c := range chains {
+		record(c.NodeID, c.Port, models.PortOwnerChain, c.ID)
+	}
+	var forwards []models.Forward
+	_ = database.DB.Find(&forwards).Error
+	for _, f := range forwards {
+		nodeID, err := EntryNodeID(database.DB, f.TunnelID)
+		if err != nil {
+			continue
+		}
+		record(nodeID, f.ListenPort, models.PortOwnerForward, f.ID)
+	}
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+)
+
+// quotaCheckInterval 配额检查周期，超额后最多多转发一个周期的流量。
+const quotaCheckInterval = 10 * time.Second
+
+// QuotaEnforcer 检查规则与隧道转发的周期用量，超额时停止转发，到重置日自动恢复。
+// 用量在流量落库时与总流量在同一事务内累加到 quota_used（见 flushTraffic / flushForwardTraffic），
+// 这里只处理周期重置与超额状态。
+type QuotaEnforcer struct {
+	fm  *ForwardManager
+	hub *AgentHub
+	// redeploy 恢复超额后被移除的隧道转发入口服务。
+	redeploy func(fwd models.Forward) error
+}
+
+func NewQuotaEnforcer(fm *ForwardManager, hub *AgentHub, redeploy func(fwd models.Forward) error) *QuotaEnforcer {
+	return &QuotaEnforcer{
+		fm:       fm,
+		hub:      hub,
+		redeploy: redeploy,
+	}
+}
+
+func (q *QuotaEnforcer) Start() {
+	go func() {
+		ticker := time.NewTicker(quotaCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			now := time.Now()
+			q.checkRules(now)
+			q.checkForwards(now)
+		}
+	}()
+}
+
+// advance 处理重置周期并累计用量，返回是否应恢复（此前超额）与是否应停止。
+func advance(p *models.QuotaPolicy, up, down int64, now time.Time) (resume, stop bool) {
+	if p.QuotaResetDay == 0 {
+		p.QuotaResetAt = nil
+	} else if p.QuotaResetAt == nil {
+		p.QuotaResetAt = models.NextQuotaReset(p.QuotaResetDay, now)
+	} else if !now.Before(*p.QuotaResetAt) {
+		p.QuotaUsed = 0
+		p.QuotaResetAt = models.NextQuotaReset(p.QuotaResetDay, now)
+	}
+	p.QuotaUsed += p.QuotaBytes(up, down)
+
+	over := p.OverQuota()
+	switch {
+	case p.QuotaExceeded && !over:
+		p.QuotaExceeded = false
+		return true, false
+	case !p.QuotaExceeded && over:
+		p.QuotaExceeded = true
+		return false, true
+	}
+	return false, false
+}
+
+func quotaColumns(p models.QuotaPolicy) map[string]interface{} {
+	return map[string]interface{}{
+		"quota_used":     p.QuotaUsed,
+		"quota_exceeded": p.QuotaExceeded,
+		"quota_reset_at": p.QuotaResetAt,
+	}
+}
+
+// checkQuotaColumns quota_used 由流量落库并发累加，检查时仅在周期重置时覆盖。
+func checkQuotaColumns(p models.QuotaPolicy, usedBefore int64) map[string]interface{} {
+	cols := quotaColumns(p)
+	if p.QuotaUsed == usedBefore {
+		delete(cols, "quota_used")
+	}
+	return cols
+}
+
+func (q *QuotaEnforcer) checkRules(now time.Time) {
+	var rules []models.ForwardRule
+	_ = database.DB.Where("traffic_quota > 0 OR quota_exceeded = ? OR quota_reset_at IS NOT NULL", true).Find(&rules).Error
+
+	for _, rule := range rules {
+		used := rule.QuotaUsed
+		resume, stop := advance(&rule.QuotaPolicy, 0, 0, now)
+		_ = database.DB.Model(&models.ForwardRule{}).Where("id = ?", rule.ID).Updates(checkQuotaColumns(rule.QuotaPolicy, used)).Error
+		switch {
+		case stop:
+			_ = q.fm.Stop(rule.ID)
+			WriteSystemLog("warn", "quota", fmt.Sprintf("rule %d (%s) exceeded traffic quota %d bytes, forwarding stopped", rule.ID, rule.Name, rule.TrafficQuota))
+		case resume:
+			if rule.IsActive && !rule.ScheduleOff {
+				if err := q.fm.Start(rule); err != nil {
+					WriteSystemLog("error", "quota", fmt.Sprintf("rule %d resume failed: %v", rule.ID, err))
+					continue
+				}
+			}
+			WriteSystemLog("info", "quota", fmt.Sprintf("rule %d (%s) traffic quota reset, forwarding resumed", rule.ID, rule.Name))
+		}
+	}
+}
+
+func (q *QuotaEnforcer) checkForwards(now time.Time) {
+	var forwards []models.Forward
+	_ = database.DB.Where("traffic_quota > 0 OR quota_exceeded = ? OR quota_reset_at IS NOT NULL", true).Find(&forwards).Error
+
+	for _, fwd := range forwards {
+		used := fwd.QuotaUsed
+		resume, stop := advance(&fwd.QuotaPolicy, 0, 0, now)
+		_ = database.DB.Model(&models.Forward{}).Where("id = ?", fwd.ID).Updates(checkQuotaColumns(fwd.QuotaPolicy, used)).Error
+		switch {
+		case stop:
+			removeForwardEntry(q.hub, fwd)
+			WriteSystemLog("warn", "quota", fmt.Sprintf("forward %d (%s) exceeded traffic quota %d bytes, entry service removed", fwd.ID, fwd.Name, fwd.TrafficQuota))
+		case resume:
+			if fwd.IsActive && !fwd.ScheduleOff && q.redeploy != nil {
+				if err := q.redeploy(fwd); err != nil {
+					WriteSystemLog("error", "quota", fmt.Sprintf("forward %d resume failed: %v", fwd.ID, err))
+					continue
+				}
+			}
+			WriteSystemLog("info", "quota", fmt.Sprintf("forward %d (%s) traffic quota reset, forwarding resumed", fwd.ID, fwd.Name))
+		}
+	}
+}
+
+// removeForwardEntry 删除隧道转发在入口节点上的服务，出口/中继服务保留以便快速恢复。
+func removeForwardEntry(hub *AgentHub, fwd models.Forward) {
+	if hub == nil {
+		return
+	}
+	var entry models.ChainTunnel
+	if err := database.DB.Where("tunnel_id = ? AND chain_type = ?", fwd.TunnelID, models.ChainTypeEntry).First(&entry).Error; err != nil {
+		return
+	}
+	for _, name := range []string{
+		fmt.Sprintf("fwd_%d_%d", fwd.TunnelID, fwd.ID),
+		fmt.Sprintf("chain_%d_%d_entry", fwd.TunnelID, fwd.ID),
+	} {
+		_ = hub.DeleteGostService(entry.NodeID, name)
+	}
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/folstingx/server/pkg/agentproto"
+	"github.com/folstingx/server/pkg/forwarder"
+)
+
+// ruleCommandTimeout 远程规则命令的等待时间，超时后规则启动失败并进入退避。
+const ruleCommandTimeout = 5 * time.Second
+
+// RemoteRuleStats Agent 周期上报（type=rule_stats）的远程规则计数。
+type RemoteRuleStats = agentproto.RuleStats
+
+// remoteRule 在节点 Agent 上运行的规则，实现 forwarder.Forwarder 与 forwarder.Supervised，
+// 由 ForwardManager 与本机转发器一样管理运行状态与流量落库。
+// 采集、故障注入与主机整形只对本机转发器生效。
+type remoteRule struct {
+	hub    *AgentHub
+	ruleID uint
+	nodeID uint
+	spec   forwarder.RemoteSpec
+
+	mu      sync.Mutex
+	session *AgentSession
+	stats   forwarder.Stats
+	rate    int64
+	err     error
+}
+
+func newRemoteRule(hub *AgentHub, ruleID, nodeID uint, spec forwarder.RemoteSpec) *remoteRule {
+	return &remoteRule{hub: hub, ruleID: ruleID, nodeID: nodeID, spec: spec, rate: spec.BandwidthLimit}
+}
+
+func (r *remoteRule) Start() error {
+	session, ok := r.hub.GetSession(r.nodeID)
+	if !ok {
+		return fmt.Errorf("listen node %d agent is not connected", r.nodeID)
+	}
+	data, _ := json.Marshal(map[string]interface{}{"rule_id": r.ruleID, "spec": r.spec})
+	if _, err := r.hub.sendRuleCommand(r.nodeID, "start_rule", data); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.session = session
+	r.mu.Unlock()
+	r.hub.trackRule(r)
+	return nil
+}
+
+// Stop Agent 已断开时视为已停止：断开的 Agent 会丢弃其上的规则。
+func (r *remoteRule) Stop() error {
+	r.mu.Lock()
+	session := r.session
+	r.mu.Unlock()
+	if cur, ok := r.hub.GetSession(r.nodeID); !ok || cur != session {
+		r.hub.untrackRule(r)
+		return nil
+	}
+	data, _ := json.Marshal(map[string]uint{"rule_id": r.ruleID})
+	resp, err := r.hub.sendRuleCommand(r.nodeID, "stop_rule", data)
+	if err != nil {
+		return err
+	}
+	// 停止响应携带最终计数，保证最后一次上报之后的流量也能落库。
+	var final RemoteRuleStats
+	if json.Unmarshal(resp.Data, &final) == nil && final.RuleID == r.ruleID {
+		r.update(final)
+	}
+	r.hub.untrackRule(r)
+	return nil
+}
+
+func (r *remoteRule) Stats() forwarder.Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.stats
+	s.BandwidthLimit = r.rate
+	return s
+}
+
+// Err Agent 报告监听退出、断开或以新连接重连（新连接上没有该规则）时返回错误。
+func (r *remoteRule) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if cur, ok := r.hub.GetSession(r.nodeID); !ok || cur != r.session {
+		return fmt.Errorf("listen node %d agent disconnected", r.nodeID)
+	}
+	return nil
+}
+
+// SetRate 异步下发新的限速，由带宽时段调度周期调用，失败时下个周期重试。
+func (r *remoteRule) SetRate(limit int64) {
+	r.mu.Lock()
+	if r.rate == limit {
+		r.mu.Unlock()
+		return
+	}
+	prev := r.rate
+	r.rate = limit
+	r.mu.Unlock()
+
+	go func() {
+		data, _ := json.Marshal(map[string]interface{}{"rule_id": r.ruleID, "limit": limit})
+		if _, err := r.hub.sendRuleCommand(r.nodeID, "set_rule_rate", data); err != nil {
+			r.mu.Lock()
+			if r.rate == limit {
+				r.rate = prev
+			}
+			r.mu.Unlock()
+		}
+	}()
+}
+
+func (r *remoteRule) update(st RemoteRuleStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bw := r.stats.BandwidthLimit
+	r.stats = st.Stats
+	r.stats.BandwidthLimit = bw
+	if st.Error != "" && r.err == nil {
+		r.err = fmt.Errorf("listener on node %d exited: %s", r.nodeID, st.Error)
+	}
+}
+
+// ===================== AgentHub 远程规则 =====================
+
+func (h *AgentHub) sendRuleCommand(nodeID uint, action string, data []byte) (*AgentReport, error) {
+	resp, err := h.SendToNode(nodeID, AgentCommand{Action: action, ID: generateRequestID(), Data: data}, ruleCommandTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type == "error" {
+		return nil, fmt.Errorf("%s failed on node %d: %s", action, nodeID, string(resp.Data))
+	}
+	return resp, nil
+}
+
+func (h *AgentHub) trackRule(r *remoteRule) {
+	h.rulesMu.Lock()
+	defer h.rulesMu.Unlock()
+	h.rules[r.ruleID] = r
+}
+
+func (h *AgentHub) untrackRule(r *remoteRule) {
+	h.rulesMu.Lock()
+	defer h.rulesMu.Unlock()
+	if h.rules[r.ruleID] == r {
+		delete(h.rules, r.ruleID)
+	}
+}
+
+// handleRuleStats 将上报的计数交给对应的远程规则，忽略不属于该节点的规则。
+func (h *AgentHub) handleRuleStats(nodeID uint, data json.RawMessage) {
+	var stats []RemoteRuleStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		WriteSystemLog("warn", "agent_hub", fmt.Sprintf("invalid rule stats from node %d: %v", nodeID, err))
+		return
+	}
+	h.rulesMu.RLock()
+	defer h.rulesMu.RUnlock()
+	for _, st := range stats {
+		if r, ok := h.rules[st.RuleID]; ok && r.nodeID == nodeID {
+			r.update(st)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+)
+
+// reconcileInterval 规则对账周期。
+const reconcileInterval = 5 * time.Second
+
+// RuleReconciler 周期性比对数据库中应运行的规则与本机运行中的转发器：
+// 补启未运行的规则（失败后按退避重试），重启监听意外退出的转发器，停止已停用或已删除规则的转发器。
+type RuleReconciler struct {
+	fm *ForwardManager
+}
+
+func NewRuleReconciler(fm *ForwardManager) *RuleReconciler {
+	return &RuleReconciler{fm: fm}
+}
+
+func (r *RuleReconciler) Start() {
+	go func() {
+		ticker := time.NewTicker(reconcileInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			r.Reconcile(now)
+		}
+	}()
+}
+
+// desiredRule 判断规则当前是否应在本机运行。
+func desiredRule(rule models.ForwardRule) bool {
+	return rule.IsActive && !rule.QuotaExceeded && !rule.ScheduleOff
+}
+
+func (r *RuleReconciler) Reconcile(now time.Time) {
+	var rules []models.ForwardRule
+	if err := database.DB.Find(&rules).Error; err != nil {
+		return
+	}
+	desired := make(map[uint]models.ForwardRule, len(rules))
+	for _, rule := range rules {
+		if desiredRule(rule) {
+			desired[rule.ID] = rule
+		}
+	}
+
+	for id, err := range r.fm.ReapFailed() {
+		WriteSystemLog("error", "forwarder", fmt.Sprintf("rule %d listener exited: %v", id, err))
+	}
+
+	running := make(map[uint]bool)
+	for _, id := range r.fm.Running() {
+		if _, ok := desired[id]; ok {
+			running[id] = true
+			continue
+		}
+		// 读取规则与此处之间规则可能刚被创建或启用，停止前再确认一次。
+		var rule models.ForwardRule
+		if res := database.DB.Limit(1).Find(&rule, id); res.Error == nil && (res.RowsAffected == 0 || !desiredRule(rule)) {
+			_ = r.fm.Stop(id)
+		}
+	}
+
+	for id, rule := range desired {
+		if running[id] {
+			continue
+		}
+		if rt := r.fm.Runtime(id); rt.BackoffUntil != nil && now.Before(*rt.BackoffUntil) {
+			continue
+		}
+		if err := r.fm.Start(rule); err != nil {
+			// 只在首次失败时记日志，退避重试期间的错误通过运行状态查看。
+			if rt := r.fm.Runtime(id); rt.Failures == 1 {
+				WriteSystemLog("error", "forwarder", fmt.Sprintf("rule %d (%s) start failed: %v", id, rule.Name, err))
+			}
+			continue
+		}
+		WriteSystemLog("info", "forwarder", fmt.Sprintf("rule %d (%s) started by reconciler", id, rule.Name))
+	}
+}
@@ -32,6 +32,12 @@ func StartLogRetentionJobs() {
       // DB 保留最近 7 天。
       _ = database.DB.Where("created_at < ?", time.Now().AddDate(0, 0, -7)).Delete(&models.SystemLog{}).Error
 
+      // 抓包文件体积大，与 DB 日志同样只保留 7 天。
+      PurgeCaptures(time.Now().AddDate(0, 0, -captureRetentionDays))
+
+      // 节点上下线事件与时延采样。
+      purgeNodeHealth(time.Now().AddDate(0, 0, -nodeHealthRetentionDays))
+
       // 文件保留最近 30 天。
       entries, err := os.ReadDir("logs")
       if err != nil {
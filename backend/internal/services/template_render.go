@@ -0,0 +1,138 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/folstingx/server/internal/models"
+)
+
+// templatePlaceholder 匹配 Spec 字符串中的 ${name}，变量名规则同 templateVarName。
+var (
+	templatePlaceholder = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	templateVarName     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// ValidateTemplate 校验模板类型、变量声明，以及 Spec 为 JSON 对象且只引用已声明的变量。
+func ValidateTemplate(tpl models.Template) error {
+	if tpl.Kind != models.TemplateKindRule && tpl.Kind != models.TemplateKindTunnel {
+		return fmt.Errorf("unsupported template kind %q", tpl.Kind)
+	}
+	declared := make(map[string]bool, len(tpl.Variables))
+	for _, v := range tpl.Variables {
+		if !templateVarName.MatchString(v.Name) {
+			return fmt.Errorf("invalid variable name %q", v.Name)
+		}
+		if declared[v.Name] {
+			return fmt.Errorf("variable %q declared twice", v.Name)
+		}
+		declared[v.Name] = true
+	}
+	spec, err := decodeSpec(tpl.Spec)
+	if err != nil {
+		return err
+	}
+	return walkSpec(spec, func(s string) (interface{}, error) {
+		for _, m := range templatePlaceholder.FindAllStringSubmatch(s, -1) {
+			if !declared[m[1]] {
+				return nil, fmt.Errorf("spec references undeclared variable %q", m[1])
+			}
+		}
+		return s, nil
+	})
+}
+
+// RenderTemplate 将变量代入模板 Spec 并返回结果 JSON。
+// 整个字符串恰为 "${name}" 时按变量原类型代入（数字、布尔等），否则按文本拼接；
+// 未提供的变量取默认值，必填变量缺失或传入未声明的变量时报错。
+func RenderTemplate(tpl models.Template, values map[string]interface{}) ([]byte, error) {
+	if err := ValidateTemplate(tpl); err != nil {
+		return nil, err
+	}
+	resolved := make(map[string]interface{}, len(tpl.Variables))
+	for _, v := range tpl.Variables {
+		val, ok := values[v.Name]
+		switch {
+		case ok:
+		case v.Default != nil:
+			val = v.Default
+		case v.Required:
+			return nil, fmt.Errorf("variable %q is required", v.Name)
+		}
+		resolved[v.Name] = val
+	}
+	for name := range values {
+		if _, ok := resolved[name]; !ok {
+			return nil, fmt.Errorf("unknown variable %q", name)
+		}
+	}
+
+	spec, err := decodeSpec(tpl.Spec)
+	if err != nil {
+		return nil, err
+	}
+	err = walkSpec(spec, func(s string) (interface{}, error) {
+		if m := templatePlaceholder.FindStringSubmatch(s); m != nil && m[0] == s {
+			return resolved[m[1]], nil
+		}
+		return templatePlaceholder.ReplaceAllStringFunc(s, func(p string) string {
+			switch val := resolved[p[2:len(p)-1]].(type) {
+			case nil:
+				return ""
+			case float64:
+				// 避免大整数被格式化为科学计数法
+				return strconv.FormatFloat(val, 'f', -1, 64)
+			default:
+				return fmt.Sprint(val)
+			}
+		}), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(spec)
+}
+
+func decodeSpec(raw []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var spec map[string]interface{}
+	if err := dec.Decode(&spec); err != nil || spec == nil {
+		return nil, errors.New("spec must be a JSON object")
+	}
+	return spec, nil
+}
+
+// walkSpec 原地替换 JSON 树中的所有字符串值。
+func walkSpec(node interface{}, fn func(string) (interface{}, error)) error {
+	visit := func(v interface{}, set func(interface{})) error {
+		if s, ok := v.(string); ok {
+			out, err := fn(s)
+			if err != nil {
+				return err
+			}
+			set(out)
+			return nil
+		}
+		return walkSpec(v, fn)
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if err := visit(v, func(out interface{}) { n[k] = out }); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, v := range n {
+			if err := visit(v, func(out interface{}) { n[i] = out }); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"time"
+
+	"github.com/folstingx/server/internal/database"
+	"github.com/folstingx/server/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TrafficDelta 一段时间内新增的上下行字节数。
+type TrafficDelta struct {
+	Up   int64
+	Down int64
+}
+
+// add 累加增量；计数器变小（转发器在两次采样间被重建）时按 0 计，避免扣减已落库的流量。
+func (d TrafficDelta) add(up, down int64) TrafficDelta {
+	if up > 0 {
+		d.Up += up
+	}
+	if down > 0 {
+		d.Down += down
+	}
+	return d
+}
+
+func (d TrafficDelta) zero() bool { return d.Up == 0 && d.Down == 0 }
+
+// flushTraffic 在一个事务内把增量累加到规则总量、周期配额用量与按小时的 TrafficStat，
+// 失败时整体回滚，由调用方把增量放回下次重试。
+func flushTraffic(deltas map[uint]TrafficDelta, conns map[uint]int64, now time.Time) error {
+	date, hour := now.Format("2006-01-02"), now.Hour()
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		for id, d := range deltas {
+			updates := map[string]interface{}{"connections": conns[id], "updated_at": now}
+			if !d.zero() {
+				updates["traffic_up"] = gorm.Expr("traffic_up + ?", d.Up)
+				updates["traffic_down"] = gorm.Expr("traffic_down + ?", d.Down)
+				updates["quota_used"] = quotaUsedExpr(d)
+			}
+			res := tx.Model(&models.ForwardRule{}).Where("id = ?", id).Updates(updates)
+			if res.Error != nil {
+				return res.Error
+			}
+			// 规则已删除或本周期无流量时不生成统计行。
+			if res.RowsAffected == 0 || d.zero() {
+				continue
+			}
+
+			if err := addHourlyStat(tx, models.TrafficStat{RuleID: id, Date: date, Hour: hour}, d, conns[id]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// quotaUsedExpr 按记录自身的 quota_direction 累加周期配额用量。
+func quotaUsedExpr(d TrafficDelta) clause.Expr {
+	return gorm.Expr("quota_used + CASE quota_direction WHEN 'up' THEN ? WHEN 'down' THEN ? ELSE ? END", d.Up, d.Down, d.Up+d.Down)
+}
+
+// addHourlyStat 将增量累加到 key（RuleID/ForwardID、日期与小时）对应的统计行，不存在时创建。
+func addHourlyStat(tx *gorm.DB, key models.TrafficStat, d TrafficDelta, conns int64) error {
+	var stat models.TrafficStat
+	found := tx.Where("rule_id = ? AND forward_id = ? AND date = ? AND hour = ?", key.RuleID, key.ForwardID, key.Date, key.Hour).Limit(1).Find(&stat)
+	if found.Error != nil {
+		return found.Error
+	}
+	if found.RowsAffected == 0 {
+		key.TrafficUp, key.TrafficDown, key.Connections = d.Up, d.Down, conns
+		return tx.Create(&key).Error
+	}
+	return tx.Model(&stat).Updates(map[string]interface{}{
+		"traffic_up":   gorm.Expr("traffic_up + ?", d.Up),
+		"traffic_down": gorm.Expr("traffic_down + ?", d.Down),
+		"connections":  conns,
+	}).Error
+}
+
+// ForwardTraffic 一条隧道转发在一次上报中的流量，TunnelID 为服务名中的隧道，与转发不符时忽略。
+type ForwardTraffic struct {
+	TrafficDelta
+	TunnelID    uint
+	Connections int64
+}
+
+// flushForwardTraffic 在一个事务内把节点上报的隧道转发流量按隧道倍率折算后，累加到
+// 转发与隧道的 FlowIn/FlowOut、转发的周期配额用量、所属用户的 TrafficUsed 以及按小时的转发 TrafficStat。
+func flushForwardTraffic(traffic map[uint]ForwardTraffic, now time.Time) error {
+	date, hour := now.Format("2006-01-02"), now.Hour()
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		for id, t := range traffic {
+			var fwd models.Forward
+			if err := tx.Preload("Tunnel").Limit(1).Find(&fwd, id).Error; err != nil {
+				return err
+			}
+			if fwd.ID == 0 || fwd.TunnelID != t.TunnelID {
+				continue
+			}
+			ratio := fwd.Tunnel.TrafficRatio
+			if ratio < 0 {
+				ratio = 0
+			}
+			d := TrafficDelta{Up: int64(float64(t.Up) * ratio), Down: int64(float64(t.Down) * ratio)}
+
+			updates := map[string]interface{}{"connections": t.Connections}
+			if !d.zero() {
+				updates["flow_in"] = gorm.Expr("flow_in + ?", d.Up)
+				updates["flow_out"] = gorm.Expr("flow_out + ?", d.Down)
+				updates["quota_used"] = quotaUsedExpr(d)
+			}
+			if err := tx.Model(&models.Forward{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+				return err
+			}
+			if d.zero() {
+				continue
+			}
+			if err := tx.Model(&models.Tunnel{}).Where("id = ?", fwd.TunnelID).Updates(map[string]interface{}{
+				"flow_in":  gorm.Expr("flow_in + ?", d.Up),
+				"flow_out": gorm.Expr("flow_out + ?", d.Down),
+			}).Error; err != nil {
+				return err
+			}
+			owner := fwd.OwnerID
+			if owner == 0 {
+				owner = fwd.Tunnel.OwnerID
+			}
+			if owner > 0 {
+				if err := tx.Model(&models.User{}).Where("id = ?", owner).
+					Update("traffic_used", gorm.Expr("traffic_used + ?", d.Up+d.Down)).Error; err != nil {
+					return err
+				}
+			}
+			if err := addHourlyStat(tx, models.TrafficStat{ForwardID: id, Date: date, Hour: hour}, d, t.Connections); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -23,6 +23,16 @@ type MonitorSnapshot struct {
   RuleStats      map[uint]RuleLiveStats `json:"rule_stats"`
   ActiveRules    int                    `json:"active_rules"`
   OnlineNodes    int64                  `json:"online_nodes"`
+  ShaperLimit    int64                  `json:"shaper_limit,omitempty"`
+  ShaperClasses  map[string]ShaperClassStats `json:"shaper_classes,omitempty"`
+}
+
+// ShaperClassStats 主机整形器中某优先级类别在最近一秒的出口占用。
+type ShaperClassStats struct {
+  Weight      int     `json:"weight"`
+  Rules       int     `json:"rules"`
+  BytesPerSec int64   `json:"bytes_per_sec"`
+  Utilization float64 `json:"utilization"` // 占整形总速率的比例 0-1
 }
 
 type RuleLiveStats struct {
@@ -53,6 +63,7 @@ func (t *TrafficCollector) collectLoop() {
   defer flush.Stop()
 
   var prevIn, prevOut uint64
+  prevClass := map[string]int64{}
   for {
     select {
     case <-tick.C:
@@ -65,6 +76,20 @@ func (t *TrafficCollector) collectLoop() {
         snap.TotalConn += s.Connections
       }
       snap.ActiveRules = len(stats)
+      if rate, usage, ok := t.fm.ShaperUsage(); ok {
+        snap.ShaperLimit = rate
+        snap.ShaperClasses = make(map[string]ShaperClassStats, len(usage))
+        for class, u := range usage {
+          delta := u.Bytes - prevClass[class]
+          prevClass[class] = u.Bytes
+          snap.ShaperClasses[class] = ShaperClassStats{
+            Weight:      u.Weight,
+            Rules:       u.Rules,
+            BytesPerSec: delta,
+            Utilization: float64(delta) / float64(rate),
+          }
+        }
+      }
 
       cpuP, _ := cpu.Percent(0, false)
       if len(cpuP) > 0 {
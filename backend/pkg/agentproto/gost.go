@@ -0,0 +1,73 @@
+package agentproto
+
+import "github.com/folstingx/server/pkg/forwarder"
+
+// ===================== 命令载荷 =====================
+
+// ServiceConfig add_service 载荷，参照 flux-panel GostUtil.AddService
+type ServiceConfig struct {
+	Name      string     `json:"name"`
+	Addr      string     `json:"addr"`     // 监听地址 :port
+	Handler   string     `json:"handler"`  // tcp, udp, relay, rtcp, rudp
+	Listener  string     `json:"listener"` // tcp, udp, rtcp, rudp, ws, wss
+	Forwarder *Forwarder `json:"forwarder,omitempty"`
+	Chain     string     `json:"chain,omitempty"`   // chain 引用名
+	Limiter   string     `json:"limiter,omitempty"` // 流量限速器引用名
+}
+
+// LimiterConfig add_limiter/update_limiter 载荷，Limits 形如 "$ 1024KB 1024KB"（服务级 入 出）
+type LimiterConfig struct {
+	Name   string   `json:"name"`
+	Limits []string `json:"limits"`
+}
+
+// Forwarder 目标转发配置
+type Forwarder struct {
+	Nodes []ForwarderNode `json:"nodes"`
+}
+
+// ForwarderNode 目标节点
+type ForwarderNode struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+// ChainConfig add_chain 载荷，参照 flux-panel GostUtil.AddChains
+type ChainConfig struct {
+	Name string     `json:"name"`
+	Hops []ChainHop `json:"hops"`
+}
+
+// ChainHop 一跳
+type ChainHop struct {
+	Name  string    `json:"name"`
+	Nodes []HopNode `json:"nodes"`
+}
+
+// HopNode 跳节点
+type HopNode struct {
+	Name      string `json:"name"`
+	Addr      string `json:"addr"`
+	Connector string `json:"connector"` // relay, http, socks5
+	Dialer    string `json:"dialer"`    // ws, wss, tcp
+	// Key 该跳节点的 relay 预共享密钥（forwarder.RelayKey），gost 忽略此字段。
+	Key []byte `json:"key,omitempty"`
+}
+
+// ===================== 上报载荷 =====================
+
+// RuleStats Agent 周期上报（type=rule_stats）的远程规则计数，计数器自规则在该节点上启动起累计。
+type RuleStats struct {
+	RuleID uint `json:"rule_id"`
+	forwarder.Stats
+	// Error 监听循环异常退出的原因，非空时面板将规则记为失败并退避重启。
+	Error string `json:"error,omitempty"`
+}
+
+// ServiceTraffic Agent 周期上报（type=traffic）的单个服务流量，字节数为距上次上报的增量。
+type ServiceTraffic struct {
+	Name        string `json:"name"`
+	UpBytes     int64  `json:"up_bytes"`
+	DownBytes   int64  `json:"down_bytes"`
+	Connections int64  `json:"connections"` // 上报时的活动连接数
+}
@@ -0,0 +1,176 @@
+// Package agentproto 定义面板与节点 Agent 之间 WebSocket 消息的格式与加密。
+//
+// 连接建立时 Agent 在 URL 中携带节点 ID 与自己的 nonce，面板随即发送明文 Hello 携带面板 nonce，
+// Agent 以明文 Auth 回应节点密钥对双方 nonce 的 HMAC，密钥本身不在连接上传输；
+// 之后每条消息都是 base64(nonce || AES-256-GCM(JSON))，两个方向的密钥由节点密钥与双方 nonce
+// 经 HKDF-SHA256 派生，每个连接各不相同。消息带严格递增的序号与发送时间，
+// 接收方拒绝序号不递增或时间偏差过大的消息。
+package agentproto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Version 协议版本，写在 Hello 中。
+const Version = 3
+
+// NonceSize 握手 nonce 的字节数。
+const NonceSize = 16
+
+// MaxClockSkew 消息时间戳与本机时间允许的最大偏差。
+const MaxClockSkew = 5 * time.Minute
+
+// Hello 面板在连接建立后发送的第一条（明文）消息。
+type Hello struct {
+	Type    string `json:"type"` // hello
+	Version int    `json:"version"`
+	Nonce   []byte `json:"nonce"`
+}
+
+// Auth Agent 收到 Hello 后发送的第一条（明文）消息，证明持有节点密钥。
+type Auth struct {
+	Type string `json:"type"` // auth
+	MAC  []byte `json:"mac"`
+}
+
+// Command 面板→Agent 的命令
+type Command struct {
+	Action string          `json:"action"` // add_service, delete_service, add_chain, start_rule, rotate_secret, etc.
+	ID     string          `json:"id"`     // 请求 ID (用于匹配响应)
+	Data   json.RawMessage `json:"data"`   // 命令载荷
+	Seq    uint64          `json:"seq"`
+	Time   int64           `json:"ts"` // 发送时间 unix 秒
+}
+
+// Report Agent→面板 的上报
+type Report struct {
+	Type   string          `json:"type"` // heartbeat, response, traffic, rule_stats, error
+	ID     string          `json:"id"`   // 响应 ID (匹配请求)
+	NodeID uint            `json:"node_id"`
+	Data   json.RawMessage `json:"data"`
+	Seq    uint64          `json:"seq"`
+	Time   int64           `json:"ts"`
+}
+
+// NewNonce 生成握手 nonce。
+func NewNonce() []byte {
+	b := make([]byte, NonceSize)
+	_, _ = rand.Read(b)
+	return b
+}
+
+// SessionKeys 由节点密钥与双方 nonce 派生本连接两个方向的 AES-256 密钥。
+func SessionKeys(secret string, agentNonce, panelNonce []byte) (toAgent, toPanel []byte) {
+	salt := make([]byte, 0, len(agentNonce)+len(panelNonce))
+	salt = append(append(salt, agentNonce...), panelNonce...)
+	return hkdfKey(secret, salt, "folstingx-agent panel->agent"), hkdfKey(secret, salt, "folstingx-agent agent->panel")
+}
+
+// AuthMAC 计算 Auth 中的 HMAC-SHA256，覆盖双方 nonce，每个连接各不相同。
+func AuthMAC(secret string, agentNonce, panelNonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("folstingx-agent auth"))
+	mac.Write(agentNonce)
+	mac.Write(panelNonce)
+	return mac.Sum(nil)
+}
+
+// VerifyAuth 以常量时间比较 Auth 中的 HMAC。
+func VerifyAuth(secret string, agentNonce, panelNonce, got []byte) bool {
+	return hmac.Equal(AuthMAC(secret, agentNonce, panelNonce), got)
+}
+
+func hkdfKey(secret string, salt []byte, info string) []byte {
+	key := make([]byte, 32)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, []byte(secret), salt, []byte(info)), key)
+	return key
+}
+
+// Seal 序列化并加密一条消息。
+func Seal(key []byte, v interface{}) ([]byte, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(out, sealed)
+	return out, nil
+}
+
+// Open 解密一条消息并反序列化到 v。
+func Open(key, msg []byte, v interface{}) error {
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(msg)))
+	n, err := base64.StdEncoding.Decode(data, msg)
+	if err != nil {
+		return err
+	}
+	data = data[:n]
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	if len(data) < aead.NonceSize() {
+		return errors.New("ciphertext too short")
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ReplayGuard 检查一个方向上收到的消息序号严格递增且时间戳在允许偏差内，非并发安全。
+type ReplayGuard struct {
+	last uint64
+}
+
+func (g *ReplayGuard) Check(seq uint64, ts int64, now time.Time) error {
+	if seq <= g.last {
+		return fmt.Errorf("replayed or out-of-order message: seq %d after %d", seq, g.last)
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > MaxClockSkew || d < -MaxClockSkew {
+		return fmt.Errorf("message timestamp off by %s", d.Round(time.Second))
+	}
+	g.last = seq
+	return nil
+}
+
+// Sequencer 为一个方向上发出的消息分配序号，非并发安全。
+type Sequencer struct {
+	next uint64
+}
+
+// Stamp 返回下一个序号与当前时间戳。
+func (s *Sequencer) Stamp(now time.Time) (uint64, int64) {
+	s.next++
+	return s.next, now.Unix()
+}
@@ -0,0 +1,143 @@
+package agentproto
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestReplayGuardCheck(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	at := func(d time.Duration) int64 { return now.Add(d).Unix() }
+	cases := []struct {
+		name string
+		last uint64
+		seq  uint64
+		ts   int64
+		ok   bool
+	}{
+		{"first message", 0, 1, at(0), true},
+		{"next seq", 1, 2, at(0), true},
+		{"gap is allowed", 1, 5, at(0), true},
+		{"zero seq", 0, 0, at(0), false},
+		{"replayed seq", 3, 3, at(0), false},
+		{"seq rollback", 3, 2, at(0), false},
+		{"skew within limit in the past", 1, 2, at(-MaxClockSkew), true},
+		{"skew within limit in the future", 1, 2, at(MaxClockSkew), true},
+		{"too old", 1, 2, at(-MaxClockSkew - time.Second), false},
+		{"too far in the future", 1, 2, at(MaxClockSkew + time.Second), false},
+	}
+	for _, c := range cases {
+		g := &ReplayGuard{last: c.last}
+		err := g.Check(c.seq, c.ts, now)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err=%v", c.name, err)
+			continue
+		}
+		// 被拒绝的消息不推进序号，合法消息推进到其序号。
+		want := c.last
+		if c.ok {
+			want = c.seq
+		}
+		if g.last != want {
+			t.Errorf("%s: last=%d, want %d", c.name, g.last, want)
+		}
+	}
+}
+
+// 被拒绝的消息不影响后续合法消息。
+func TestReplayGuardRejectDoesNotAdvance(t *testing.T) {
+	now := time.Now()
+	var g ReplayGuard
+	var s Sequencer
+	seq, ts := s.Stamp(now)
+	if err := g.Check(seq, ts, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Check(seq+1, now.Add(-time.Hour).Unix(), now); err == nil {
+		t.Fatal("stale message accepted")
+	}
+	seq, ts = s.Stamp(now)
+	if err := g.Check(seq, ts, now); err != nil {
+		t.Fatalf("next message after a rejected one: %v", err)
+	}
+}
+
+func TestSessionKeysDirections(t *testing.T) {
+	agentNonce, panelNonce := NewNonce(), NewNonce()
+	toAgent, toPanel := SessionKeys("secret", agentNonce, panelNonce)
+	if len(toAgent) != 32 || len(toPanel) != 32 {
+		t.Fatalf("key sizes %d/%d", len(toAgent), len(toPanel))
+	}
+	if bytes.Equal(toAgent, toPanel) {
+		t.Fatal("both directions share a key")
+	}
+
+	// 双方按相同输入派生出相同密钥。
+	a2, p2 := SessionKeys("secret", agentNonce, panelNonce)
+	if !bytes.Equal(toAgent, a2) || !bytes.Equal(toPanel, p2) {
+		t.Fatal("key derivation is not deterministic")
+	}
+
+	// 密钥或任一 nonce 改变时两个方向的密钥都改变。
+	others := []struct {
+		name                   string
+		secret                 string
+		agentNonce, panelNonce []byte
+	}{
+		{"secret", "other", agentNonce, panelNonce},
+		{"agent nonce", "secret", NewNonce(), panelNonce},
+		{"panel nonce", "secret", agentNonce, NewNonce()},
+		{"swapped nonces", "secret", panelNonce, agentNonce},
+	}
+	for _, o := range others {
+		a, p := SessionKeys(o.secret, o.agentNonce, o.panelNonce)
+		if bytes.Equal(a, toAgent) || bytes.Equal(p, toPanel) {
+			t.Errorf("%s: keys unchanged", o.name)
+		}
+	}
+
+	// 一个方向的密钥加密的消息不能用另一个方向的密钥打开。
+	msg, err := Seal(toAgent, Command{Action: "ping", Seq: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmd Command
+	if err := Open(toPanel, msg, &cmd); err == nil {
+		t.Fatal("panel->agent message opened with the agent->panel key")
+	}
+	if err := Open(toAgent, msg, &cmd); err != nil || cmd.Action != "ping" || cmd.Seq != 1 {
+		t.Fatalf("round trip: %v %+v", err, cmd)
+	}
+}
+
+func TestVerifyAuth(t *testing.T) {
+	agentNonce, panelNonce := NewNonce(), NewNonce()
+	mac := AuthMAC("secret", agentNonce, panelNonce)
+	cases := []struct {
+		name       string
+		secret     string
+		agentNonce []byte
+		panelNonce []byte
+		mac        []byte
+		ok         bool
+	}{
+		{"valid", "secret", agentNonce, panelNonce, mac, true},
+		{"wrong secret", "other", agentNonce, panelNonce, mac, false},
+		{"replayed on a new connection", "secret", agentNonce, NewNonce(), mac, false},
+		{"different agent nonce", "secret", NewNonce(), panelNonce, mac, false},
+		{"swapped nonces", "secret", panelNonce, agentNonce, mac, false},
+		{"truncated mac", "secret", agentNonce, panelNonce, mac[:16], false},
+		{"empty mac", "secret", agentNonce, panelNonce, nil, false},
+	}
+	for _, c := range cases {
+		if got := VerifyAuth(c.secret, c.agentNonce, c.panelNonce, c.mac); got != c.ok {
+			t.Errorf("%s: got %v", c.name, got)
+		}
+	}
+	// MAC 与会话密钥使用不同的派生，不会互相泄露。
+	toAgent, toPanel := SessionKeys("secret", agentNonce, panelNonce)
+	if bytes.Equal(mac, toAgent) || bytes.Equal(mac, toPanel) {
+		t.Fatal("auth mac equals a session key")
+	}
+}
@@ -0,0 +1,321 @@
+package forwarder
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// aeadMaxPayload 单个分块最大载荷，与 Shadowsocks AEAD 规范一致。
+const aeadMaxPayload = 0x3FFF
+
+var errAEADChunkTooLarge = errors.New("aead chunk too large")
+
+// aeadFactory 根据每个方向的 salt 派生子密钥并返回 AEAD。
+type aeadFactory func(salt []byte) (cipher.AEAD, error)
+
+// aeadWriter 负责 [len+tag][payload+tag] 分块加密写出。
+type aeadWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+	max   int
+}
+
+func newAEADWriter(w io.Writer, aead cipher.AEAD) *aeadWriter {
+	return newAEADWriterSize(w, aead, aeadMaxPayload)
+}
+
+// newAEADWriterSize 指定单块最大载荷，Shadowsocks 2022 为 0xFFFF。
+func newAEADWriterSize(w io.Writer, aead cipher.AEAD, maxPayload int) *aeadWriter {
+	return &aeadWriter{
+		w:     w,
+		aead:  aead,
+		nonce: make([]byte, aead.NonceSize()),
+		buf:   make([]byte, 2+aead.Overhead()+maxPayload+aead.Overhead()),
+		max:   maxPayload,
+	}
+}
+
+// writeChunk 写出一个分块，payload 不能超过单块最大载荷。
+func (a *aeadWriter) writeChunk(payload []byte) error {
+	if len(payload) > a.max {
+		return errAEADChunkTooLarge
+	}
+	overhead := a.aead.Overhead()
+	lenBuf := a.buf[:2]
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(payload)))
+	a.aead.Seal(lenBuf[:0], a.nonce, lenBuf, nil)
+	increaseNonce(a.nonce)
+	body := a.buf[2+overhead : 2+overhead+len(payload)]
+	copy(body, payload)
+	a.aead.Seal(body[:0], a.nonce, body, nil)
+	increaseNonce(a.nonce)
+	_, err := a.w.Write(a.buf[:2+overhead+len(payload)+overhead])
+	return err
+}
+
+// writeFixedChunk 写出一个不带长度前缀的分块，与 readFixedChunk 对应。
+func (a *aeadWriter) writeFixedChunk(payload []byte) error {
+	if len(payload) > a.max {
+		return errAEADChunkTooLarge
+	}
+	body := a.buf[:len(payload)]
+	copy(body, payload)
+	sealed := a.aead.Seal(body[:0], a.nonce, body, nil)
+	increaseNonce(a.nonce)
+	_, err := a.w.Write(sealed)
+	return err
+}
+
+func (a *aeadWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > a.max {
+			n = a.max
+		}
+		if err := a.writeChunk(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// aeadReader 负责分块解密读入。
+type aeadReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+	left  []byte
+	max   int
+}
+
+func newAEADReader(r io.Reader, aead cipher.AEAD) *aeadReader {
+	return newAEADReaderSize(r, aead, aeadMaxPayload)
+}
+
+func newAEADReaderSize(r io.Reader, aead cipher.AEAD, maxPayload int) *aeadReader {
+	return &aeadReader{
+		r:     r,
+		aead:  aead,
+		nonce: make([]byte, aead.NonceSize()),
+		buf:   make([]byte, maxPayload+aead.Overhead()),
+		max:   maxPayload,
+	}
+}
+
+// readChunk 读取并解密一个完整分块，返回值在下次调用前有效。
+func (a *aeadReader) readChunk() ([]byte, error) {
+	overhead := a.aead.Overhead()
+	lenBuf := a.buf[:2+overhead]
+	if _, err := io.ReadFull(a.r, lenBuf); err != nil {
+		return nil, err
+	}
+	if _, err := a.aead.Open(lenBuf[:0], a.nonce, lenBuf, nil); err != nil {
+		return nil, err
+	}
+	increaseNonce(a.nonce)
+	size := int(binary.BigEndian.Uint16(lenBuf[:2]))
+	if size > a.max {
+		return nil, errAEADChunkTooLarge
+	}
+	body := a.buf[:size+overhead]
+	if _, err := io.ReadFull(a.r, body); err != nil {
+		return nil, err
+	}
+	if _, err := a.aead.Open(body[:0], a.nonce, body, nil); err != nil {
+		return nil, err
+	}
+	increaseNonce(a.nonce)
+	return body[:size], nil
+}
+
+// readFixedChunk 读取一个已知长度的分块（不带长度前缀），用于 2022 协议头。
+func (a *aeadReader) readFixedChunk(size int) ([]byte, error) {
+	if size > a.max {
+		return nil, errAEADChunkTooLarge
+	}
+	body := a.buf[:size+a.aead.Overhead()]
+	if _, err := io.ReadFull(a.r, body); err != nil {
+		return nil, err
+	}
+	if _, err := a.aead.Open(body[:0], a.nonce, body, nil); err != nil {
+		return nil, err
+	}
+	increaseNonce(a.nonce)
+	return body[:size], nil
+}
+
+func (a *aeadReader) Read(p []byte) (int, error) {
+	if len(a.left) == 0 {
+		chunk, err := a.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		a.left = chunk
+	}
+	n := copy(p, a.left)
+	a.left = a.left[n:]
+	return n, nil
+}
+
+func increaseNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// aeadConn 在任意 net.Conn 上提供双向 AEAD 分块加密，每个方向先发送独立 salt。
+type aeadConn struct {
+	net.Conn
+	factory  aeadFactory
+	saltSize int
+	replay   *saltFilter
+
+	rmu    sync.Mutex
+	reader *aeadReader
+
+	wmu    sync.Mutex
+	writer *aeadWriter
+}
+
+func newAEADConn(conn net.Conn, factory aeadFactory, saltSize int, replay *saltFilter) *aeadConn {
+	return &aeadConn{Conn: conn, factory: factory, saltSize: saltSize, replay: replay}
+}
+
+func (c *aeadConn) initReader() error {
+	salt := make([]byte, c.saltSize)
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	if c.replay != nil && !c.replay.Add(salt) {
+		return errReplayedSalt
+	}
+	aead, err := c.factory(salt)
+	if err != nil {
+		return err
+	}
+	c.reader = newAEADReader(c.Conn, aead)
+	return nil
+}
+
+func (c *aeadConn) initWriter() error {
+	salt := make([]byte, c.saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := c.factory(salt)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Conn.Write(salt); err != nil {
+		return err
+	}
+	c.writer = newAEADWriter(c.Conn, aead)
+	return nil
+}
+
+func (c *aeadConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.reader == nil {
+		if err := c.initReader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.reader.Read(p)
+}
+
+func (c *aeadConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.writer == nil {
+		if err := c.initWriter(); err != nil {
+			return 0, err
+		}
+	}
+	return c.writer.Write(p)
+}
+
+// readMessage 读取一个完整分块，用于握手等按消息交互的场景。
+func (c *aeadConn) readMessage() ([]byte, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.reader == nil {
+		if err := c.initReader(); err != nil {
+			return nil, err
+		}
+	}
+	chunk, err := c.reader.readChunk()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), chunk...), nil
+}
+
+// hkdfAESGCM 返回基于 HKDF-SHA256 派生子密钥的 AES-GCM 工厂。
+func hkdfAESGCM(key []byte, info string) aeadFactory {
+	return func(salt []byte) (cipher.AEAD, error) {
+		subkey := make([]byte, len(key))
+		if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(info)), subkey); err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(subkey)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+}
+
+var errReplayedSalt = errors.New("replayed salt")
+
+// saltFilter 记录近期出现过的 salt，拒绝重放的握手。
+type saltFilter struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+func newSaltFilter(ttl time.Duration) *saltFilter {
+	return &saltFilter{ttl: ttl, seen: make(map[string]time.Time), pruned: time.Now()}
+}
+
+// Add 返回 false 表示 salt 已出现过。
+func (f *saltFilter) Add(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if now.Sub(f.pruned) > f.ttl {
+		for k, t := range f.seen {
+			if now.Sub(t) > f.ttl {
+				delete(f.seen, k)
+			}
+		}
+		f.pruned = now
+	}
+	key := string(salt)
+	if t, ok := f.seen[key]; ok && now.Sub(t) <= f.ttl {
+		return false
+	}
+	f.seen[key] = now
+	return true
+}
@@ -0,0 +1,112 @@
+package forwarder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func testAEADPair(t *testing.T) (*aeadConn, *aeadConn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { _ = a.Close(); _ = b.Close() })
+	key := RelayKey("test-secret")
+	return newAEADConn(a, hkdfAESGCM(key, relayInfo), relaySaltSize, nil),
+		newAEADConn(b, hkdfAESGCM(key, relayInfo), relaySaltSize, nil)
+}
+
+func TestAEADConnRoundTrip(t *testing.T) {
+	w, r := testAEADPair(t)
+	sizes := []int{1, aeadMaxPayload - 1, aeadMaxPayload, aeadMaxPayload + 1, 3*aeadMaxPayload + 7}
+	go func() {
+		for _, n := range sizes {
+			p := bytes.Repeat([]byte{byte(n)}, n)
+			if _, err := w.Write(p); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for _, n := range sizes {
+		got := make([]byte, n)
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("read %d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, bytes.Repeat([]byte{byte(n)}, n)) {
+			t.Fatalf("payload of %d bytes corrupted", n)
+		}
+	}
+}
+
+// 读缓冲小于分块时跨分块逐字节读取。
+func TestAEADReaderSmallBuffer(t *testing.T) {
+	w, r := testAEADPair(t)
+	want := make([]byte, aeadMaxPayload+100)
+	_, _ = rand.Read(want)
+	go func() { _, _ = w.Write(want) }()
+	got := make([]byte, 0, len(want))
+	one := make([]byte, 1)
+	for len(got) < len(want) {
+		n, err := r.Read(one)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, one[:n]...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("payload corrupted across chunk boundary")
+	}
+}
+
+func TestAEADChunkTooLarge(t *testing.T) {
+	aead, err := hkdfAESGCM(RelayKey("k"), relayInfo)(make([]byte, relaySaltSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := newAEADWriter(&buf, aead).writeChunk(make([]byte, aeadMaxPayload+1)); !errors.Is(err, errAEADChunkTooLarge) {
+		t.Fatalf("writeChunk: got %v", err)
+	}
+
+	// 对端声明的长度超过上限时拒绝读取。
+	open, _ := hkdfAESGCM(RelayKey("k"), relayInfo)(make([]byte, relaySaltSize))
+	if err := newAEADWriterSize(&buf, aead, 0xFFFF).writeChunk(make([]byte, aeadMaxPayload+1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAEADReader(&buf, open).readChunk(); !errors.Is(err, errAEADChunkTooLarge) {
+		t.Fatalf("readChunk: got %v", err)
+	}
+}
+
+func TestAEADTampered(t *testing.T) {
+	aead, _ := hkdfAESGCM(RelayKey("k"), relayInfo)(make([]byte, relaySaltSize))
+	var buf bytes.Buffer
+	if err := newAEADWriter(&buf, aead).writeChunk([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+	raw[len(raw)-1] ^= 1
+	open, _ := hkdfAESGCM(RelayKey("k"), relayInfo)(make([]byte, relaySaltSize))
+	if _, err := newAEADReader(bytes.NewReader(raw), open).readChunk(); err == nil {
+		t.Fatal("tampered chunk accepted")
+	}
+}
+
+func TestSaltFilter(t *testing.T) {
+	f := newSaltFilter(50 * time.Millisecond)
+	salt := []byte("0123456789abcdef")
+	if !f.Add(salt) {
+		t.Fatal("first salt rejected")
+	}
+	if f.Add(salt) {
+		t.Fatal("replayed salt accepted")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !f.Add(salt) {
+		t.Fatal("expired salt still rejected")
+	}
+}
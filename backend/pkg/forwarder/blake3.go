@@ -0,0 +1,112 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// 仅实现单块（≤1024 字节输入、≤32 字节输出）的 BLAKE3，
+// 足以满足 Shadowsocks 2022 的 derive_key 会话子密钥派生。
+
+const (
+	blake3ChunkLen = 1024
+	blake3BlockLen = 64
+
+	blake3ChunkStart        = 1 << 0
+	blake3ChunkEnd          = 1 << 1
+	blake3Root              = 1 << 3
+	blake3DeriveKeyContext  = 1 << 5
+	blake3DeriveKeyMaterial = 1 << 6
+)
+
+var blake3IV = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var blake3MsgPermutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func blake3G(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] = s[a] + s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] = s[a] + s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+func blake3Compress(cv [8]uint32, m [16]uint32, counter uint64, blockLen, flags uint32) [8]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	for r := 0; r < 7; r++ {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+		var p [16]uint32
+		for i, j := range blake3MsgPermutation {
+			p[i] = m[j]
+		}
+		m = p
+	}
+	var out [8]uint32
+	for i := range out {
+		out[i] = s[i] ^ s[i+8]
+	}
+	return out
+}
+
+// blake3Chunk 以 key 为初始链值处理单个 chunk，返回根输出的前 32 字节。
+func blake3Chunk(key [8]uint32, input []byte, flags uint32) [32]byte {
+	if len(input) > blake3ChunkLen {
+		panic("blake3: input exceeds single chunk")
+	}
+	cv := key
+	for first := true; first || len(input) > 0; first = false {
+		n := len(input)
+		if n > blake3BlockLen {
+			n = blake3BlockLen
+		}
+		var block [blake3BlockLen]byte
+		copy(block[:], input[:n])
+		input = input[n:]
+
+		var m [16]uint32
+		for i := range m {
+			m[i] = binary.LittleEndian.Uint32(block[i*4:])
+		}
+		f := flags
+		if first {
+			f |= blake3ChunkStart
+		}
+		if len(input) == 0 {
+			f |= blake3ChunkEnd | blake3Root
+		}
+		cv = blake3Compress(cv, m, 0, uint32(n), f)
+	}
+	var out [32]byte
+	for i, w := range cv {
+		binary.LittleEndian.PutUint32(out[i*4:], w)
+	}
+	return out
+}
+
+// blake3DeriveKey 对应 BLAKE3 derive_key(context, material)，out 长度不超过 32。
+func blake3DeriveKey(out []byte, context string, material []byte) {
+	ctxKey := blake3Chunk(blake3IV, []byte(context), blake3DeriveKeyContext)
+	var key [8]uint32
+	for i := range key {
+		key[i] = binary.LittleEndian.Uint32(ctxKey[i*4:])
+	}
+	sum := blake3Chunk(key, material, blake3DeriveKeyMaterial)
+	copy(out, sum[:])
+}
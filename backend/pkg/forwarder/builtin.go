@@ -0,0 +1,216 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+)
+
+// TCPOptions tcp 转发的可选项：入站监听可改用 ws/wss/mws/mwss/h2 传输层。
+type TCPOptions struct {
+	Transport string `json:"transport"`
+	TransportOptions
+}
+
+func mustSchema(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func stringList() map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}
+}
+
+// proxySchema socks5 与 http_connect 共用的选项结构，udp 仅 socks5 支持。
+func proxySchema(udp bool) json.RawMessage {
+	props := map[string]interface{}{
+		"users": map[string]interface{}{
+			"type":        "array",
+			"description": "认证用户，为空时须开启 allow_anonymous",
+			"items": map[string]interface{}{
+				"type":     "object",
+				"required": []string{"username", "password"},
+				"properties": map[string]interface{}{
+					"username": map[string]interface{}{"type": "string"},
+					"password": map[string]interface{}{"type": "string"},
+				},
+			},
+		},
+		"allow":           stringList(),
+		"deny":            stringList(),
+		"allow_anonymous": map[string]interface{}{"type": "boolean", "description": "不配置用户时允许匿名访问（开放代理）"},
+		"allow_local":     map[string]interface{}{"type": "boolean", "description": "允许访问回环、链路本地与未指定地址，默认拒绝"},
+	}
+	if udp {
+		props["udp"] = map[string]interface{}{"type": "boolean", "description": "允许 UDP ASSOCIATE"}
+	}
+	return mustSchema(map[string]interface{}{"type": "object", "properties": props})
+}
+
+// decodeTCPOptions 解析 tcp 选项。resolve 为 true 时把 cert_file/key_file 解析到本机证书目录，
+// 只在实际运行规则的一端进行；面板校验 Agent 上的规则时仅检查文件名。
+func decodeTCPOptions(options json.RawMessage, resolve bool) (TCPOptions, Transport, error) {
+	var opts TCPOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return opts, nil, err
+	}
+	for _, name := range []*string{&opts.CertFile, &opts.KeyFile} {
+		var err error
+		if resolve {
+			*name, err = certPath(*name)
+		} else {
+			err = checkCertName(*name)
+		}
+		if err != nil {
+			return opts, nil, err
+		}
+	}
+	if opts.Transport == "" || opts.Transport == "tcp" {
+		return opts, nil, nil
+	}
+	t, err := NewTransport(opts.Transport, opts.TransportOptions)
+	return opts, t, err
+}
+
+func decodeProxyOptions(options json.RawMessage) (ProxyOptions, error) {
+	var opts ProxyOptions
+	if err := decodeOptions(options, &opts); err != nil {
+		return opts, err
+	}
+	return opts, opts.Validate()
+}
+
+func decodeShadowsocksOptions(options json.RawMessage) (ShadowsocksOptions, error) {
+	var opts ShadowsocksOptions
+	if len(options) == 0 {
+		return opts, errors.New("shadowsocks inbound has no credentials")
+	}
+	if err := decodeOptions(options, &opts); err != nil {
+		return opts, err
+	}
+	return opts, ValidateShadowsocks(opts)
+}
+
+func proxyFactory(kind string) Factory {
+	return func(spec Spec) (Forwarder, error) {
+		opts, err := decodeProxyOptions(spec.Options)
+		if err != nil {
+			return nil, err
+		}
+		p, err := newProxyServer(kind, spec.ListenHost, spec.ListenPort, opts, spec.BandwidthLimit)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Dialer != nil {
+			p.SetDialer(spec.Dialer)
+		}
+		return p, nil
+	}
+}
+
+func validateProxy(options json.RawMessage) error {
+	_, err := decodeProxyOptions(options)
+	return err
+}
+
+func init() {
+	Register(Kind{
+		Name:        "tcp",
+		Description: "TCP 端口转发，可经 relay 链路",
+		NeedsTarget: true,
+		Schema: mustSchema(map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"transport": map[string]interface{}{"type": "string", "enum": []string{"tcp", "ws", "wss", "mws", "mwss", "h2"}, "default": "tcp"},
+				"path":      map[string]interface{}{"type": "string", "description": "ws/h2 请求路径"},
+				"host":      map[string]interface{}{"type": "string"},
+				"cert_file": map[string]interface{}{"type": "string", "description": "证书目录内的相对路径，留空使用自签证书"},
+				"key_file":  map[string]interface{}{"type": "string", "description": "证书目录内的相对路径"},
+			},
+		}),
+		Factory: func(spec Spec) (Forwarder, error) {
+			_, t, err := decodeTCPOptions(spec.Options, true)
+			if err != nil {
+				return nil, err
+			}
+			f := NewTCPForwarder(spec.ListenHost, spec.ListenPort, spec.TargetHost, spec.TargetPort, spec.BandwidthLimit)
+			if t != nil {
+				f.SetListenTransport(t)
+			}
+			if spec.Dialer != nil {
+				f.SetDialer(spec.Dialer)
+			}
+			return f, nil
+		},
+		Validate: func(options json.RawMessage) error {
+			_, _, err := decodeTCPOptions(options, false)
+			return err
+		},
+	})
+
+	Register(Kind{
+		Name:        "udp",
+		Description: "UDP 端口转发",
+		NeedsTarget: true,
+		Factory: func(spec Spec) (Forwarder, error) {
+			if spec.Dialer != nil {
+				return nil, errors.New("relay chain only supports tcp forwarding")
+			}
+			return NewUDPForwarder(spec.ListenHost, spec.ListenPort, spec.TargetHost, spec.TargetPort, spec.BandwidthLimit)
+		},
+	})
+
+	Register(Kind{
+		Name:        "socks5",
+		Description: "SOCKS5 代理入站，目标由客户端指定",
+		Schema:      proxySchema(true),
+		Factory:     proxyFactory("socks5"),
+		Validate:    validateProxy,
+	})
+	Register(Kind{
+		Name:        "http_connect",
+		Description: "HTTP CONNECT 代理入站，目标由客户端指定",
+		Schema:      proxySchema(false),
+		Factory:     proxyFactory("http_connect"),
+		Validate:    validateProxy,
+	})
+
+	Register(Kind{
+		Name:        "shadowsocks",
+		Description: "Shadowsocks 入站，配置目标时固定转发到目标",
+		Schema: mustSchema(map[string]interface{}{
+			"type":     "object",
+			"required": []string{"method", "password"},
+			"properties": map[string]interface{}{
+				"method":   map[string]interface{}{"type": "string", "enum": ShadowsocksMethods()},
+				"password": map[string]interface{}{"type": "string", "description": "2022 系列为 base64 编码的 PSK"},
+			},
+		}),
+		Factory: func(spec Spec) (Forwarder, error) {
+			opts, err := decodeShadowsocksOptions(spec.Options)
+			if err != nil {
+				return nil, err
+			}
+			target := ""
+			if spec.TargetHost != "" && spec.TargetPort > 0 {
+				target = net.JoinHostPort(spec.TargetHost, strconv.Itoa(spec.TargetPort))
+			}
+			ss, err := NewShadowsocksServer(spec.ListenHost, spec.ListenPort, target, opts, spec.BandwidthLimit)
+			if err != nil {
+				return nil, err
+			}
+			if spec.Dialer != nil {
+				ss.SetDialer(spec.Dialer)
+			}
+			return ss, nil
+		},
+		Validate: func(options json.RawMessage) error {
+			_, err := decodeShadowsocksOptions(options)
+			return err
+		},
+	})
+}
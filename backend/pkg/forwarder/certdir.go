@@ -0,0 +1,53 @@
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// certDir 规则选项中 cert_file/key_file 所在的目录，由面板或 Agent 的配置设置；
+// 为空时规则不能引用证书文件，只能使用自签证书。
+var certDir atomic.Value
+
+// SetCertDir 设置规则证书目录，规则的 cert_file/key_file 均相对该目录解析。
+func SetCertDir(dir string) {
+	certDir.Store(dir)
+}
+
+// checkCertName 校验规则中的证书文件名：只能是证书目录内的相对路径。
+func checkCertName(name string) error {
+	if name == "" || filepath.IsLocal(name) {
+		return nil
+	}
+	return fmt.Errorf("certificate %q must be a relative path inside the certificate directory", name)
+}
+
+// certPath 将证书文件名解析为证书目录下的路径，符号链接指向目录外时拒绝。
+func certPath(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	if err := checkCertName(name); err != nil {
+		return "", err
+	}
+	dir, _ := certDir.Load().(string)
+	if dir == "" {
+		return "", errors.New("rule certificates are disabled: no certificate directory is configured")
+	}
+	path := filepath.Join(dir, name)
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(realDir, realPath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("certificate %q resolves outside the certificate directory", name)
+	}
+	return realPath, nil
+}
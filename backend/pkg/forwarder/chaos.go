@@ -0,0 +1,186 @@
+package forwarder
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ChaosConfig 规则级故障注入配置，用于验证应用在劣质链路下的表现。
+type ChaosConfig struct {
+	LatencyMs         int     `json:"latency_ms"`          // 每次读写附加的延迟
+	JitterMs          int     `json:"jitter_ms"`           // 延迟随机抖动 ±jitter
+	BandwidthLimit    int64   `json:"bandwidth_limit"`     // 每连接双向限速 bytes/s，0 不限
+	DropPercent       float64 `json:"drop_percent"`        // UDP 随机丢包比例 0-100
+	ResetAfterBytes   int64   `json:"reset_after_bytes"`   // 连接累计传输该字节数后重置，0 不启用
+	ResetAfterSeconds int     `json:"reset_after_seconds"` // 连接存活该秒数后重置，0 不启用
+	RefusePercent     float64 `json:"refuse_percent"`      // 新连接直接拒绝的比例 0-100
+}
+
+func (c ChaosConfig) Validate() error {
+	switch {
+	case c.LatencyMs < 0 || c.JitterMs < 0 || c.BandwidthLimit < 0 || c.ResetAfterBytes < 0 || c.ResetAfterSeconds < 0:
+		return errors.New("chaos values must not be negative")
+	case c.JitterMs > c.LatencyMs && c.LatencyMs > 0:
+		return errors.New("jitter_ms must not exceed latency_ms")
+	case c.DropPercent > 100 || c.DropPercent < 0 || c.RefusePercent > 100 || c.RefusePercent < 0:
+		return errors.New("percentages must be between 0 and 100")
+	}
+	return nil
+}
+
+// Chaos 一次生效中的故障注入，Until 之后自动失效。
+type Chaos struct {
+	Config ChaosConfig
+	Until  time.Time
+}
+
+// Active 判断故障注入是否仍在生效窗口内。
+func (c *Chaos) Active() bool {
+	return c != nil && time.Now().Before(c.Until)
+}
+
+func (c *Chaos) hit(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+func (c *Chaos) delay() {
+	d := c.Config.LatencyMs
+	if c.Config.JitterMs > 0 {
+		d += rand.Intn(2*c.Config.JitterMs+1) - c.Config.JitterMs
+	}
+	if d > 0 {
+		time.Sleep(time.Duration(d) * time.Millisecond)
+	}
+}
+
+// Refuse 判断新连接是否应被拒绝。
+func (c *Chaos) Refuse() bool { return c.hit(c.Config.RefusePercent) }
+
+// Drop 判断 UDP 报文是否应被丢弃。
+func (c *Chaos) Drop() bool { return c.hit(c.Config.DropPercent) }
+
+// chaosSlot 供转发器嵌入，运行期间原子替换故障注入配置。
+type chaosSlot struct {
+	chaos atomic.Pointer[Chaos]
+}
+
+func (s *chaosSlot) SetChaos(c *Chaos) {
+	s.chaos.Store(c)
+}
+
+// ChaosActive 供状态展示，判断故障注入是否生效中。
+func (s *chaosSlot) ChaosActive() bool {
+	return s.activeChaos() != nil
+}
+
+// activeChaos 返回当前生效的故障注入，过期或未设置时为 nil。
+func (s *chaosSlot) activeChaos() *Chaos {
+	if c := s.chaos.Load(); c.Active() {
+		return c
+	}
+	return nil
+}
+
+// ChaosTarget 由支持故障注入的转发器实现。
+type ChaosTarget interface {
+	SetChaos(c *Chaos)
+	ChaosActive() bool
+}
+
+// refuseConn 以 RST 方式关闭连接，模拟对端拒绝。
+func refuseConn(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		_ = tc.SetLinger(0)
+	}
+	_ = conn.Close()
+}
+
+// wrapChaos 包装客户端连接，按配置注入延迟、限速与重置；c 为 nil 时原样返回。
+func wrapChaos(c *Chaos, in, out net.Conn) net.Conn {
+	if c == nil {
+		return in
+	}
+	cc := &chaosConn{Conn: in, out: out, chaos: c, limiter: NewTokenBucket(c.Config.BandwidthLimit)}
+	if c.Config.ResetAfterSeconds > 0 {
+		cc.timer = time.AfterFunc(time.Duration(c.Config.ResetAfterSeconds)*time.Second, cc.reset)
+	}
+	return cc
+}
+
+type chaosConn struct {
+	net.Conn
+	out     net.Conn
+	chaos   *Chaos
+	limiter *TokenBucket
+	total   atomic.Int64
+	timer   *time.Timer
+	once    sync.Once
+}
+
+func (c *chaosConn) reset() {
+	c.once.Do(func() {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		refuseConn(c.Conn)
+		refuseConn(c.out)
+	})
+}
+
+// account 计入传输量并在超限时重置，返回 false 表示连接已被重置。
+func (c *chaosConn) account(n int) bool {
+	if n <= 0 {
+		return true
+	}
+	waitBucket(c.limiter, c.chaos.Config.BandwidthLimit, n)
+	if limit := c.chaos.Config.ResetAfterBytes; limit > 0 && c.total.Add(int64(n)) >= limit {
+		c.reset()
+		return false
+	}
+	return true
+}
+
+func (c *chaosConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.chaos.delay()
+		if !c.account(n) {
+			return 0, net.ErrClosed
+		}
+	}
+	return n, err
+}
+
+func (c *chaosConn) Write(p []byte) (int, error) {
+	c.chaos.delay()
+	if !c.account(len(p)) {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *chaosConn) Close() error {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	return c.Conn.Close()
+}
+
+// waitBucket 分块等待令牌，避免单次请求超过桶容量。
+func waitBucket(tb *TokenBucket, rate int64, n int) {
+	if rate <= 0 {
+		return
+	}
+	for n > 0 {
+		step := n
+		if int64(step) > rate {
+			step = int(rate)
+		}
+		tb.Wait(step)
+		n -= step
+	}
+}
@@ -1,12 +1,19 @@
 ﻿package forwarder
 
-import "time"
+import (
+  "net"
+  "time"
+)
 
 type Stats struct {
-  UpBytes      int64     `json:"up_bytes"`
-  DownBytes    int64     `json:"down_bytes"`
-  Connections  int64     `json:"connections"`
-  LastActivity time.Time `json:"last_activity"`
+  UpBytes      int64      `json:"up_bytes"`
+  DownBytes    int64      `json:"down_bytes"`
+  Connections  int64      `json:"connections"`
+  LastActivity time.Time  `json:"last_activity"`
+  Hops         []HopStats `json:"hops,omitempty"`
+  ChaosActive  bool       `json:"chaos_active,omitempty"`
+  // BandwidthLimit 当前生效的限速 bytes/s，随带宽时段变化，0 表示不限速。
+  BandwidthLimit int64 `json:"bandwidth_limit"`
 }
 
 type Forwarder interface {
@@ -14,3 +21,8 @@ type Forwarder interface {
   Stop() error
   Stats() Stats
 }
+
+// Dialer 抽象转发器的出站连接方式（直连或经由 relay 链路）。
+type Dialer interface {
+  Dial(network, addr string) (net.Conn, error)
+}
@@ -0,0 +1,37 @@
+package forwarder
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// Supervised 由能报告运行期故障的转发器实现：监听意外关闭后 Err 返回原因，正常运行时为 nil。
+type Supervised interface {
+	Err() error
+}
+
+// healthSlot 供转发器嵌入，记录监听循环退出的原因。
+type healthSlot struct {
+	fatal atomic.Pointer[error]
+}
+
+func (s *healthSlot) Err() error {
+	if p := s.fatal.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+func (s *healthSlot) fail(err error) {
+	s.fatal.Store(&err)
+}
+
+func (s *healthSlot) resetHealth() {
+	s.fatal.Store(nil)
+}
+
+// listenerDead 判断 Accept/Read 错误是否表示监听已不可恢复，其余错误按临时故障重试。
+func listenerDead(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,92 @@
+package forwarder
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (s *ProxyServer) serveHTTPConnect(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if req.Method != http.MethodConnect {
+		writeHTTPStatus(conn, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	if len(s.users) > 0 || !s.anonymous {
+		user, pass, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+		if !ok || !s.authenticate(user, pass) {
+			writeHTTPStatus(conn, http.StatusProxyAuthRequired, map[string]string{"Proxy-Authenticate": `Basic realm="FolstingX"`})
+			return
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadRequest, nil)
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusForbidden, nil)
+		return
+	}
+	dialHost, ok := s.policy.Resolve(host, port)
+	if !ok {
+		writeHTTPStatus(conn, http.StatusForbidden, nil)
+		return
+	}
+
+	out, err := s.dial(net.JoinHostPort(dialHost, portStr))
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadGateway, nil)
+		return
+	}
+	defer out.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	// 客户端可能在 CONNECT 之后立即发送数据，已缓冲的部分需先转发。
+	s.relay(&bufferedConn{Conn: conn, r: br}, out, req.Host)
+}
+
+func writeHTTPStatus(conn net.Conn, code int, headers map[string]string) {
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 " + strconv.Itoa(code) + " " + http.StatusText(code) + "\r\n")
+	for k, v := range headers {
+		b.WriteString(k + ": " + v + "\r\n")
+	}
+	b.WriteString("Content-Length: 0\r\nConnection: close\r\n\r\n")
+	_, _ = conn.Write([]byte(b.String()))
+}
+
+func parseProxyAuth(header string) (string, string, bool) {
+	const prefix = "basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	user, pass, ok := strings.Cut(string(raw), ":")
+	return user, pass, ok
+}
+
+// bufferedConn 先读出 bufio 中残留的数据，再读底层连接。
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
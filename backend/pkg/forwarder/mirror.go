@@ -0,0 +1,154 @@
+package forwarder
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// mirrorQueueSize 每条镜像连接缓存的最大块数，写不及时直接丢弃，不影响主链路。
+const mirrorQueueSize = 256
+
+// MirrorTap 把每个连接的上行数据复制一份发往镜像目标，镜像端的响应被丢弃。
+type MirrorTap struct {
+	target string
+
+	mu      sync.Mutex
+	closed  bool
+	streams map[*mirrorStream]struct{}
+	udp     *net.UDPConn
+}
+
+func NewMirrorTap(target string) (*MirrorTap, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, err
+	}
+	return &MirrorTap{target: target, streams: make(map[*mirrorStream]struct{})}, nil
+}
+
+func (m *MirrorTap) OpenStream(client, server *net.TCPAddr) StreamTap {
+	s := &mirrorStream{m: m, ch: make(chan []byte, mirrorQueueSize), done: make(chan struct{})}
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.streams[s] = struct{}{}
+	m.mu.Unlock()
+	go s.run(m.target)
+	return s
+}
+
+func (m *MirrorTap) Datagram(client, server *net.UDPAddr, payload []byte, upstream bool) {
+	if !upstream {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	if m.udp == nil {
+		addr, err := net.ResolveUDPAddr("udp", m.target)
+		if err != nil {
+			return
+		}
+		if m.udp, err = net.DialUDP("udp", nil, addr); err != nil {
+			return
+		}
+	}
+	_, _ = m.udp.Write(payload)
+}
+
+func (m *MirrorTap) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	streams := m.streams
+	m.streams = nil
+	if m.udp != nil {
+		_ = m.udp.Close()
+	}
+	m.mu.Unlock()
+	for s := range streams {
+		s.Close()
+	}
+	return nil
+}
+
+type mirrorStream struct {
+	m    *MirrorTap
+	ch   chan []byte
+	once sync.Once
+	done chan struct{}
+}
+
+func (s *mirrorStream) run(target string) {
+	conn, err := net.DialTimeout("tcp", target, 5*time.Second)
+	if err != nil {
+		// 镜像目标不可达时丢弃该连接的全部数据。
+		for {
+			select {
+			case <-s.ch:
+			case <-s.done:
+				return
+			}
+		}
+	}
+	defer conn.Close()
+	// 镜像端的响应没有意义，读掉即可，避免对端窗口被塞满。
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case b := <-s.ch:
+			_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+		case <-s.done:
+			// 主连接已结束，尽量把已排队的数据写完。
+			for {
+				select {
+				case b := <-s.ch:
+					if _, err := conn.Write(b); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *mirrorStream) Upstream(p []byte) {
+	b := append([]byte(nil), p...)
+	select {
+	case <-s.done:
+	case s.ch <- b:
+	default:
+	}
+}
+
+func (s *mirrorStream) Downstream([]byte) {}
+
+func (s *mirrorStream) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.m.mu.Lock()
+		if s.m.streams != nil {
+			delete(s.m.streams, s)
+		}
+		s.m.mu.Unlock()
+	})
+}
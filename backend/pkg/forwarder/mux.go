@@ -0,0 +1,479 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 多路复用帧: cmd(1) + streamID(4) + length(2) + payload
+const (
+	muxSYN byte = iota + 1 // 打开流，载荷为目标地址
+	muxACK                 // 打开成功
+	muxPSH                 // 数据
+	muxFIN                 // 关闭
+	muxRST                 // 拒绝或重置，载荷为错误信息
+	muxWND                 // 窗口更新，载荷为 4 字节增量
+)
+
+const (
+	muxHeaderSize    = 7
+	muxMaxFrame      = 16 * 1024
+	muxWindow        = 256 * 1024
+	muxOpenTimeout   = 10 * time.Second
+	muxAcceptBacklog = 128
+)
+
+var (
+	errMuxClosed       = errors.New("mux session closed")
+	errMuxStreamClosed = errors.New("mux stream closed")
+	errMuxTimeout      = &muxTimeoutError{}
+)
+
+type muxTimeoutError struct{}
+
+func (*muxTimeoutError) Error() string   { return "mux i/o timeout" }
+func (*muxTimeoutError) Timeout() bool   { return true }
+func (*muxTimeoutError) Temporary() bool { return true }
+
+// muxSession 在一条可靠连接上承载多个双向流，带简单的按流窗口流控。
+type muxSession struct {
+	conn   net.Conn
+	client bool
+
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+
+	accept    chan *muxStream
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMuxSession(conn net.Conn, client bool) *muxSession {
+	s := &muxSession{
+		conn:    conn,
+		client:  client,
+		streams: make(map[uint32]*muxStream),
+		accept:  make(chan *muxStream, muxAcceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	} else {
+		s.nextID = 2
+	}
+	go s.recvLoop()
+	return s
+}
+
+func (s *muxSession) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *muxSession) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *muxSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		_ = s.conn.Close()
+		s.mu.Lock()
+		for _, st := range s.streams {
+			st.reset(errMuxClosed)
+		}
+		s.streams = map[uint32]*muxStream{}
+		s.mu.Unlock()
+	})
+	return nil
+}
+
+// Open 打开一个指向 addr 的新流，等待对端确认。
+func (s *muxSession) Open(addr string) (net.Conn, error) {
+	if s.IsClosed() {
+		return nil, errMuxClosed
+	}
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID += 2
+	st := newMuxStream(id, s)
+	st.ready = make(chan error, 1)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxSYN, id, []byte(addr)); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	select {
+	case err := <-st.ready:
+		if err != nil {
+			s.removeStream(id)
+			return nil, err
+		}
+		return st, nil
+	case <-s.closed:
+		return nil, errMuxClosed
+	case <-time.After(muxOpenTimeout):
+		s.removeStream(id)
+		_ = s.writeFrame(muxRST, id, nil)
+		return nil, errMuxTimeout
+	}
+}
+
+// Accept 返回对端新打开的流及其目标地址。
+func (s *muxSession) Accept() (*muxStream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.closed:
+		return nil, errMuxClosed
+	}
+}
+
+func (s *muxSession) writeFrame(cmd byte, id uint32, payload []byte) error {
+	var hdr [muxHeaderSize]byte
+	hdr[0] = cmd
+	binary.BigEndian.PutUint32(hdr[1:5], id)
+	binary.BigEndian.PutUint16(hdr[5:7], uint16(len(payload)))
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.IsClosed() {
+		return errMuxClosed
+	}
+	// 头部与载荷合并写出，避免加密层拆成两个分块。
+	frame := make([]byte, 0, muxHeaderSize+len(payload))
+	frame = append(frame, hdr[:]...)
+	frame = append(frame, payload...)
+	if _, err := s.conn.Write(frame); err != nil {
+		_ = s.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *muxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *muxSession) getStream(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxSession) recvLoop() {
+	defer s.Close()
+	var hdr [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			return
+		}
+		cmd := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:5])
+		size := int(binary.BigEndian.Uint16(hdr[5:7]))
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return
+		}
+
+		switch cmd {
+		case muxSYN:
+			if s.client {
+				continue
+			}
+			st := newMuxStream(id, s)
+			st.target = string(payload)
+			s.mu.Lock()
+			s.streams[id] = st
+			s.mu.Unlock()
+			select {
+			case s.accept <- st:
+			default:
+				s.removeStream(id)
+				_ = s.writeFrame(muxRST, id, []byte("accept backlog full"))
+			}
+		case muxACK:
+			if st := s.getStream(id); st != nil && st.ready != nil {
+				select {
+				case st.ready <- nil:
+				default:
+				}
+			}
+		case muxPSH:
+			if st := s.getStream(id); st != nil {
+				if !st.push(payload) {
+					s.removeStream(id)
+					st.reset(errMuxStreamClosed)
+					_ = s.writeFrame(muxRST, id, []byte("window exceeded"))
+				}
+			}
+		case muxFIN:
+			if st := s.getStream(id); st != nil {
+				st.remoteClose()
+			}
+		case muxRST:
+			if st := s.getStream(id); st != nil {
+				s.removeStream(id)
+				msg := "stream reset by peer"
+				if len(payload) > 0 {
+					msg = string(payload)
+				}
+				err := errors.New(msg)
+				if st.ready != nil {
+					select {
+					case st.ready <- err:
+					default:
+					}
+				}
+				st.reset(err)
+			}
+		case muxWND:
+			if st := s.getStream(id); st != nil && len(payload) == 4 {
+				st.grant(int(binary.BigEndian.Uint32(payload)))
+			}
+		}
+	}
+}
+
+// muxStream 是会话中的一个流，实现 net.Conn。
+type muxStream struct {
+	id     uint32
+	sess   *muxSession
+	target string
+	ready  chan error
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buf        bytes.Buffer
+	sendWnd    int
+	consumed   int
+	remoteFIN  bool
+	localFIN   bool
+	err        error
+	rDeadline  time.Time
+	wDeadline  time.Time
+	deadlineTm *time.Timer
+}
+
+func newMuxStream(id uint32, sess *muxSession) *muxStream {
+	st := &muxStream{id: id, sess: sess, sendWnd: muxWindow}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// Target 返回对端请求连接的地址（仅服务端流有效）。
+func (st *muxStream) Target() string { return st.target }
+
+// Ack 确认或拒绝对端打开的流。
+func (st *muxStream) Ack(err error) error {
+	if err != nil {
+		st.sess.removeStream(st.id)
+		st.reset(err)
+		return st.sess.writeFrame(muxRST, st.id, []byte(err.Error()))
+	}
+	return st.sess.writeFrame(muxACK, st.id, nil)
+}
+
+func (st *muxStream) push(p []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.buf.Len()+len(p) > muxWindow {
+		return false
+	}
+	st.buf.Write(p)
+	st.cond.Broadcast()
+	return true
+}
+
+func (st *muxStream) remoteClose() {
+	st.mu.Lock()
+	st.remoteFIN = true
+	both := st.localFIN
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if both {
+		st.sess.removeStream(st.id)
+	}
+}
+
+func (st *muxStream) reset(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *muxStream) grant(n int) {
+	st.mu.Lock()
+	st.sendWnd += n
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *muxStream) deadlineExceeded(d time.Time) bool {
+	return !d.IsZero() && !time.Now().Before(d)
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for st.buf.Len() == 0 {
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+		if st.remoteFIN {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if st.localFIN {
+			st.mu.Unlock()
+			return 0, errMuxStreamClosed
+		}
+		if st.deadlineExceeded(st.rDeadline) {
+			st.mu.Unlock()
+			return 0, errMuxTimeout
+		}
+		st.cond.Wait()
+	}
+	n, _ := st.buf.Read(p)
+	st.consumed += n
+	var update int
+	if st.consumed >= muxWindow/2 {
+		update = st.consumed
+		st.consumed = 0
+	}
+	st.mu.Unlock()
+
+	if update > 0 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(update))
+		_ = st.sess.writeFrame(muxWND, st.id, b[:])
+	}
+	return n, nil
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		for st.sendWnd <= 0 && st.err == nil && !st.localFIN && !st.deadlineExceeded(st.wDeadline) {
+			st.cond.Wait()
+		}
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		}
+		if st.localFIN {
+			st.mu.Unlock()
+			return written, errMuxStreamClosed
+		}
+		if st.sendWnd <= 0 {
+			st.mu.Unlock()
+			return written, errMuxTimeout
+		}
+		n := len(p)
+		if n > muxMaxFrame {
+			n = muxMaxFrame
+		}
+		if n > st.sendWnd {
+			n = st.sendWnd
+		}
+		st.sendWnd -= n
+		st.mu.Unlock()
+
+		if err := st.sess.writeFrame(muxPSH, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.localFIN {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localFIN = true
+	both := st.remoteFIN || st.err != nil
+	st.cond.Broadcast()
+	if st.deadlineTm != nil {
+		st.deadlineTm.Stop()
+	}
+	st.mu.Unlock()
+	if both {
+		st.sess.removeStream(st.id)
+	}
+	if st.err != nil {
+		return nil
+	}
+	return st.sess.writeFrame(muxFIN, st.id, nil)
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.sess.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.sess.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rDeadline = t
+	st.wDeadline = t
+	st.mu.Unlock()
+	st.armDeadline(t)
+	return nil
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rDeadline = t
+	st.mu.Unlock()
+	st.armDeadline(t)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.wDeadline = t
+	st.mu.Unlock()
+	st.armDeadline(t)
+	return nil
+}
+
+// armDeadline 在截止时间唤醒等待中的读写。
+func (st *muxStream) armDeadline(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.deadlineTm != nil {
+		st.deadlineTm.Stop()
+	}
+	st.deadlineTm = time.AfterFunc(time.Until(t), func() {
+		st.mu.Lock()
+		st.cond.Broadcast()
+		st.mu.Unlock()
+	})
+}
@@ -0,0 +1,82 @@
+package forwarder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func testMuxPair(t *testing.T) (*muxSession, *muxSession) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, server := newMuxSession(a, true), newMuxSession(b, false)
+	t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+	return client, server
+}
+
+// 双向传输超过流控窗口的数据。
+func TestMuxStreamRoundTrip(t *testing.T) {
+	client, server := testMuxPair(t)
+	go func() {
+		st, err := server.Accept()
+		if err != nil {
+			return
+		}
+		if st.Target() != "example.com:80" {
+			_ = st.Ack(errors.New("bad target " + st.Target()))
+			return
+		}
+		_ = st.Ack(nil)
+		_, _ = io.Copy(st, st)
+		_ = st.Close()
+	}()
+
+	conn, err := client.Open("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 4*muxWindow+123)
+	_, _ = rand.Read(want)
+	go func() { _, _ = conn.Write(want) }()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("echoed payload differs")
+	}
+	if client.NumStreams() != 1 {
+		t.Fatalf("streams = %d", client.NumStreams())
+	}
+	_ = conn.Close()
+}
+
+func TestMuxOpenRejected(t *testing.T) {
+	client, server := testMuxPair(t)
+	go func() {
+		st, err := server.Accept()
+		if err == nil {
+			_ = st.Ack(errors.New("connection refused"))
+		}
+	}()
+	if _, err := client.Open("127.0.0.1:1"); err == nil || err.Error() != "connection refused" {
+		t.Fatalf("Open: got %v", err)
+	}
+	if client.NumStreams() != 0 {
+		t.Fatalf("rejected stream not removed")
+	}
+}
+
+func TestMuxSessionClose(t *testing.T) {
+	client, server := testMuxPair(t)
+	_ = server.Close()
+	if _, err := client.Open("x:1"); err == nil {
+		t.Fatal("Open on closed session succeeded")
+	}
+	if _, err := server.Accept(); !errors.Is(err, errMuxClosed) {
+		t.Fatalf("Accept: got %v", err)
+	}
+}
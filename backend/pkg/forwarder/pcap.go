@@ -0,0 +1,282 @@
+package forwarder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pcapLinkTypeRaw = 101   // LINKTYPE_RAW，报文以 IPv4/IPv6 头开始
+	pcapSnapLen     = 65535 // 单条记录上限
+	pcapMaxSegment  = 65000 // 合成 TCP 段的最大载荷
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+var errCaptureClosed = errors.New("capture closed")
+
+// PcapCapture 把转发流量写成 pcap 文件，TCP/UDP/IP 头由转发数据合成。
+// 达到 maxBytes 或 duration 后自动停止，停止后 Done 关闭。
+type PcapCapture struct {
+	mu       sync.Mutex
+	file     *os.File
+	w        *bufio.Writer
+	maxBytes int64
+	closed   bool
+	timer    *time.Timer
+	done     chan struct{}
+	ipID     uint16
+
+	written atomic.Int64
+	packets atomic.Int64
+}
+
+func NewPcapCapture(path string, maxBytes int64, duration time.Duration) (*PcapCapture, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	p := &PcapCapture{
+		file:     f,
+		w:        bufio.NewWriter(f),
+		maxBytes: maxBytes,
+		done:     make(chan struct{}),
+	}
+	// 全局头：小端 magic、版本 2.4、无时区修正。
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	if _, err := p.w.Write(hdr); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	p.written.Store(int64(len(hdr)))
+	if duration > 0 {
+		p.timer = time.AfterFunc(duration, func() { _ = p.Close() })
+	}
+	return p, nil
+}
+
+// Done 在抓包因时间/大小到限或被 Close 后关闭。
+func (p *PcapCapture) Done() <-chan struct{} { return p.done }
+
+func (p *PcapCapture) Bytes() int64   { return p.written.Load() }
+func (p *PcapCapture) Packets() int64 { return p.packets.Load() }
+
+func (p *PcapCapture) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closeLocked()
+}
+
+func (p *PcapCapture) closeLocked() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	close(p.done)
+	err := p.w.Flush()
+	if cerr := p.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writePacket 写出一条记录，超出大小上限时停止抓包。调用方需持有 mu。
+func (p *PcapCapture) writePacket(pkt []byte) error {
+	if p.closed {
+		return errCaptureClosed
+	}
+	if p.maxBytes > 0 && p.written.Load()+int64(16+len(pkt)) > p.maxBytes {
+		return p.closeLocked()
+	}
+	now := time.Now()
+	rec := make([]byte, 16)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	if _, err := p.w.Write(rec); err != nil {
+		return err
+	}
+	if _, err := p.w.Write(pkt); err != nil {
+		return err
+	}
+	p.written.Add(int64(16 + len(pkt)))
+	p.packets.Add(1)
+	return nil
+}
+
+func (p *PcapCapture) OpenStream(client, server *net.TCPAddr) StreamTap {
+	s := &pcapStream{p: p, client: client, server: server, seqC: rand.Uint32(), seqS: rand.Uint32()}
+	// 合成三次握手，便于抓包工具识别并跟踪流。
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = s.segment(true, tcpFlagSYN, nil)
+	s.seqC++
+	_ = s.segment(false, tcpFlagSYN|tcpFlagACK, nil)
+	s.seqS++
+	_ = s.segment(true, tcpFlagACK, nil)
+	return s
+}
+
+func (p *PcapCapture) Datagram(client, server *net.UDPAddr, payload []byte, upstream bool) {
+	src, dst := client, server
+	if !upstream {
+		src, dst = server, client
+	}
+	if len(payload) > pcapSnapLen-48 {
+		payload = payload[:pcapSnapLen-48]
+	}
+	udp := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], payload)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.writePacket(p.ipPacket(src.IP, dst.IP, 17, udp, 6))
+}
+
+// ipPacket 在传输层数据前加上 IP 头并计算校验和，csumOff 为传输层校验和字段偏移。
+func (p *PcapCapture) ipPacket(src, dst net.IP, proto byte, l4 []byte, csumOff int) []byte {
+	src4, dst4 := src.To4(), dst.To4()
+	var pkt, pseudo []byte
+	if src4 != nil && dst4 != nil {
+		p.ipID++
+		pkt = make([]byte, 20+len(l4))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(pkt[4:], p.ipID)
+		binary.BigEndian.PutUint16(pkt[6:], 0x4000)
+		pkt[8] = 64
+		pkt[9] = proto
+		copy(pkt[12:16], src4)
+		copy(pkt[16:20], dst4)
+		binary.BigEndian.PutUint16(pkt[10:], inetChecksum(pkt[:20], 0))
+		pseudo = append(append(append([]byte{}, src4...), dst4...), 0, proto, byte(len(l4)>>8), byte(len(l4)))
+		copy(pkt[20:], l4)
+	} else {
+		pkt = make([]byte, 40+len(l4))
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(l4)))
+		pkt[6] = proto
+		pkt[7] = 64
+		copy(pkt[8:24], src.To16())
+		copy(pkt[24:40], dst.To16())
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:32], pkt[8:40])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(l4)))
+		pseudo[39] = proto
+		copy(pkt[40:], l4)
+	}
+	body := pkt[len(pkt)-len(l4):]
+	binary.BigEndian.PutUint16(body[csumOff:], inetChecksum(body, sumWords(pseudo)))
+	return pkt
+}
+
+func sumWords(b []byte) uint32 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+func inetChecksum(b []byte, initial uint32) uint16 {
+	sum := initial + sumWords(b)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// pcapStream 维护一条合成 TCP 流的双向序列号。
+type pcapStream struct {
+	p          *PcapCapture
+	client     *net.TCPAddr
+	server     *net.TCPAddr
+	seqC, seqS uint32
+	closed     bool
+}
+
+// segment 写出一个 TCP 段，调用方需持有 p.mu。
+func (s *pcapStream) segment(fromClient bool, flags byte, payload []byte) error {
+	src, dst, seq, ack := s.client, s.server, s.seqC, s.seqS
+	if !fromClient {
+		src, dst, seq, ack = s.server, s.client, s.seqS, s.seqC
+	}
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	return s.p.writePacket(s.p.ipPacket(src.IP, dst.IP, 6, tcp, 16))
+}
+
+func (s *pcapStream) data(fromClient bool, b []byte) {
+	s.p.mu.Lock()
+	defer s.p.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for len(b) > 0 {
+		n := len(b)
+		if n > pcapMaxSegment {
+			n = pcapMaxSegment
+		}
+		if s.segment(fromClient, tcpFlagPSH|tcpFlagACK, b[:n]) != nil {
+			return
+		}
+		if fromClient {
+			s.seqC += uint32(n)
+		} else {
+			s.seqS += uint32(n)
+		}
+		b = b[n:]
+	}
+}
+
+func (s *pcapStream) Upstream(b []byte)   { s.data(true, b) }
+func (s *pcapStream) Downstream(b []byte) { s.data(false, b) }
+
+func (s *pcapStream) Close() {
+	s.p.mu.Lock()
+	defer s.p.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	_ = s.segment(true, tcpFlagFIN|tcpFlagACK, nil)
+	s.seqC++
+	_ = s.segment(false, tcpFlagFIN|tcpFlagACK, nil)
+	s.seqS++
+	_ = s.segment(true, tcpFlagACK, nil)
+}
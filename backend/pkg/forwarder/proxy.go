@@ -0,0 +1,394 @@
+package forwarder
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyUser 代理认证用户。
+type ProxyUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// ProxyOptions socks5 / http_connect 入站配置，对应规则的 inbound_config。
+type ProxyOptions struct {
+	Users []ProxyUser `json:"users"`
+	Allow []string    `json:"allow"` // 目标白名单，空表示不限制
+	Deny  []string    `json:"deny"`  // 目标黑名单，优先于白名单
+	UDP   bool        `json:"udp"`   // 是否允许 SOCKS5 UDP ASSOCIATE
+	// AllowAnonymous 未配置用户时须显式开启，否则监听地址成为开放代理。
+	AllowAnonymous bool `json:"allow_anonymous"`
+	// AllowLocal 显式开启后不再附加 DefaultProxyDeny，允许访问节点本机等地址。
+	AllowLocal bool `json:"allow_local"`
+}
+
+// DefaultProxyDeny 代理入站默认拒绝的目标：回环、链路本地（含云厂商元数据服务）与未指定地址，
+// 避免客户端经代理访问节点自身的服务。
+var DefaultProxyDeny = []string{"127.0.0.0/8", "::1", "169.254.0.0/16", "fe80::/10", "0.0.0.0/8", "::"}
+
+// EffectiveDeny 返回实际生效的黑名单：未开启 allow_local 时附加 DefaultProxyDeny。
+func (o ProxyOptions) EffectiveDeny() []string {
+	if o.AllowLocal {
+		return o.Deny
+	}
+	deny := make([]string, 0, len(o.Deny)+len(DefaultProxyDeny))
+	deny = append(deny, o.Deny...)
+	return append(deny, DefaultProxyDeny...)
+}
+
+var errProxyNoUsers = errors.New("proxy requires at least one user, or allow_anonymous to accept unauthenticated clients")
+
+// Validate 校验目标策略与认证配置。
+func (o ProxyOptions) Validate() error {
+	if _, err := NewDestPolicy(o.Allow, o.EffectiveDeny()); err != nil {
+		return err
+	}
+	for _, u := range o.Users {
+		if u.Username != "" {
+			return nil
+		}
+	}
+	if !o.AllowAnonymous {
+		return errProxyNoUsers
+	}
+	return nil
+}
+
+// ===================== 目标地址策略 =====================
+
+type destRule struct {
+	cidr   *net.IPNet
+	ip     net.IP
+	domain string // 精确域名
+	suffix string // 通配后缀，如 .example.com
+	any    bool
+	port   int // 0 表示任意端口
+}
+
+// DestPolicy 目标地址访问策略，规则格式:
+// 10.0.0.0/8、1.2.3.4、example.com、*.example.com、*，均可追加 :port。
+type DestPolicy struct {
+	allow []destRule
+	deny  []destRule
+}
+
+func NewDestPolicy(allow, deny []string) (*DestPolicy, error) {
+	p := &DestPolicy{}
+	for _, s := range allow {
+		r, err := parseDestRule(s)
+		if err != nil {
+			return nil, err
+		}
+		p.allow = append(p.allow, r)
+	}
+	for _, s := range deny {
+		r, err := parseDestRule(s)
+		if err != nil {
+			return nil, err
+		}
+		p.deny = append(p.deny, r)
+	}
+	return p, nil
+}
+
+func parseDestRule(s string) (destRule, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "" {
+		return destRule{}, fmt.Errorf("empty destination rule")
+	}
+	var r destRule
+	host := s
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return r, fmt.Errorf("invalid port in destination rule %q", s)
+		}
+		host, r.port = h, port
+	}
+	switch {
+	case host == "*" || host == "":
+		r.any = true
+	case strings.Contains(host, "/"):
+		_, cidr, err := net.ParseCIDR(host)
+		if err != nil {
+			return r, fmt.Errorf("invalid cidr in destination rule %q", s)
+		}
+		r.cidr = cidr
+	case net.ParseIP(host) != nil:
+		r.ip = net.ParseIP(host)
+	case strings.HasPrefix(host, "*."):
+		r.suffix = host[1:]
+	case strings.HasPrefix(host, "."):
+		r.suffix = host
+	default:
+		r.domain = host
+	}
+	return r, nil
+}
+
+func (r destRule) needsIP() bool { return r.cidr != nil || r.ip != nil }
+
+func (r destRule) match(host string, ips []net.IP, port int) bool {
+	if r.port != 0 && r.port != port {
+		return false
+	}
+	switch {
+	case r.any:
+		return true
+	case r.domain != "":
+		return host == r.domain
+	case r.suffix != "":
+		return host == r.suffix[1:] || strings.HasSuffix(host, r.suffix)
+	}
+	for _, ip := range ips {
+		if r.cidr != nil && r.cidr.Contains(ip) {
+			return true
+		}
+		if r.ip != nil && r.ip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve 判断是否允许访问 host:port，返回实际应拨号的主机。
+// 存在 IP 规则时域名只解析一次，返回通过检查的 IP，拨号不再重新解析，
+// 避免 DNS rebinding 在检查与拨号之间换成被拒绝的地址；解析失败时拒绝。
+func (p *DestPolicy) Resolve(host string, port int) (string, bool) {
+	if p == nil || (len(p.allow) == 0 && len(p.deny) == 0) {
+		return host, true
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	var ips []net.IP
+	if ip := net.ParseIP(name); ip != nil {
+		ips = []net.IP{ip}
+	} else if p.needsIP() {
+		ips, _ = net.LookupIP(name)
+		if len(ips) == 0 {
+			return "", false
+		}
+		host = ips[0].String()
+	}
+	for _, r := range p.deny {
+		if r.match(name, ips, port) {
+			return "", false
+		}
+	}
+	if len(p.allow) == 0 {
+		return host, true
+	}
+	for _, r := range p.allow {
+		if !r.match(name, ips, port) {
+			continue
+		}
+		// 由 IP 规则放行时拨号命中的那个地址。
+		if r.needsIP() && net.ParseIP(name) == nil {
+			for _, ip := range ips {
+				if r.match(name, []net.IP{ip}, port) {
+					return ip.String(), true
+				}
+			}
+		}
+		return host, true
+	}
+	return "", false
+}
+
+func (p *DestPolicy) needsIP() bool {
+	for _, r := range p.deny {
+		if r.needsIP() {
+			return true
+		}
+	}
+	for _, r := range p.allow {
+		if r.needsIP() {
+			return true
+		}
+	}
+	return false
+}
+
+// ===================== 代理服务公共部分 =====================
+
+// ProxyServer 是 socks5 / http_connect 入站代理，目标地址由客户端决定。
+type ProxyServer struct {
+	kind       string
+	listenAddr string
+	listener   net.Listener
+	users      map[string]string
+	anonymous  bool
+	policy     *DestPolicy
+	allowUDP   bool
+	dialer     Dialer
+	closed     atomic.Bool
+	upBytes    atomic.Int64
+	downBytes  atomic.Int64
+	conns      atomic.Int64
+	limiter    *TokenBucket
+	wg         sync.WaitGroup
+
+	mu     sync.Mutex
+	active map[net.Conn]struct{}
+	tapSlot
+	chaosSlot
+	shaperSlot
+	healthSlot
+}
+
+func newProxyServer(kind string, listenHost string, listenPort int, opts ProxyOptions, limit int64) (*ProxyServer, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	policy, err := NewDestPolicy(opts.Allow, opts.EffectiveDeny())
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string, len(opts.Users))
+	for _, u := range opts.Users {
+		if u.Username != "" {
+			users[u.Username] = u.Password
+		}
+	}
+	return &ProxyServer{
+		kind:       kind,
+		listenAddr: net.JoinHostPort(listenHost, strconv.Itoa(listenPort)),
+		users:      users,
+		anonymous:  opts.AllowAnonymous,
+		policy:     policy,
+		allowUDP:   opts.UDP,
+		limiter:    NewTokenBucket(limit),
+		active:     make(map[net.Conn]struct{}),
+	}, nil
+}
+
+func NewSOCKS5Server(listenHost string, listenPort int, opts ProxyOptions, limit int64) (*ProxyServer, error) {
+	return newProxyServer("socks5", listenHost, listenPort, opts, limit)
+}
+
+func NewHTTPConnectServer(listenHost string, listenPort int, opts ProxyOptions, limit int64) (*ProxyServer, error) {
+	return newProxyServer("http_connect", listenHost, listenPort, opts, limit)
+}
+
+// SetDialer 指定出站拨号方式（例如 relay 链路），需在 Start 之前调用。
+func (s *ProxyServer) SetDialer(d Dialer) {
+	s.dialer = d
+}
+
+func (s *ProxyServer) Start() error {
+	ln, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		return err
+	}
+	s.listener = ln
+	s.closed.Store(false)
+	s.resetHealth()
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return nil
+}
+
+func (s *ProxyServer) acceptLoop() {
+	defer s.wg.Done()
+	for !s.closed.Load() {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.closed.Load() {
+				return
+			}
+			if listenerDead(err) {
+				s.fail(err)
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		s.track(conn, true)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.track(conn, false)
+			defer conn.Close()
+			if chaos := s.activeChaos(); chaos != nil && chaos.Refuse() {
+				refuseConn(conn)
+				return
+			}
+			if s.kind == "socks5" {
+				s.serveSOCKS5(conn)
+			} else {
+				s.serveHTTPConnect(conn)
+			}
+		}()
+	}
+}
+
+func (s *ProxyServer) track(conn net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.active[conn] = struct{}{}
+	} else {
+		delete(s.active, conn)
+	}
+}
+
+func (s *ProxyServer) Stop() error {
+	if s.closed.Swap(true) {
+		return nil
+	}
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	s.mu.Lock()
+	for c := range s.active {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	if c, ok := s.dialer.(io.Closer); ok {
+		_ = c.Close()
+	}
+	return nil
+}
+
+func (s *ProxyServer) Limiter() *TokenBucket { return s.limiter }
+
+func (s *ProxyServer) Stats() Stats {
+	st := Stats{UpBytes: s.upBytes.Load(), DownBytes: s.downBytes.Load(), Connections: s.conns.Load(), LastActivity: time.Now()}
+	if hs, ok := s.dialer.(interface{ HopStats() []HopStats }); ok {
+		st.Hops = hs.HopStats()
+	}
+	return st
+}
+
+func (s *ProxyServer) authenticate(user, pass string) bool {
+	if len(s.users) == 0 {
+		return s.anonymous
+	}
+	expected, ok := s.users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(pass)) == 1
+}
+
+func (s *ProxyServer) dial(addr string) (net.Conn, error) {
+	if s.dialer != nil {
+		return s.dialer.Dial("tcp", addr)
+	}
+	return net.DialTimeout("tcp", addr, 5*time.Second)
+}
+
+// relay 已建立 CONNECT 隧道后双向转发并计入统计，target 为客户端请求的地址。
+func (s *ProxyServer) relay(in, out net.Conn, target string) {
+	s.conns.Add(1)
+	defer s.conns.Add(-1)
+	st := s.openStream(in.RemoteAddr(), out.RemoteAddr(), target)
+	in = wrapChaos(s.activeChaos(), in, out)
+	pipeConnsTap(s.shape(in), s.shape(out), s.limiter, &s.upBytes, &s.downBytes, st)
+}
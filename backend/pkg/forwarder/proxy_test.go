@@ -0,0 +1,82 @@
+package forwarder
+
+import "testing"
+
+func TestProxyOptionsRequireUsers(t *testing.T) {
+	if err := (ProxyOptions{}).Validate(); err == nil {
+		t.Fatal("proxy without users accepted")
+	}
+	if err := (ProxyOptions{Users: []ProxyUser{{Password: "p"}}}).Validate(); err == nil {
+		t.Fatal("proxy with only unnamed users accepted")
+	}
+	if err := (ProxyOptions{AllowAnonymous: true}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (ProxyOptions{Users: []ProxyUser{{Username: "u", Password: "p"}}}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSOCKS5Server("127.0.0.1", 0, ProxyOptions{}, 0); err == nil {
+		t.Fatal("open socks5 proxy created")
+	}
+
+	s, _ := NewHTTPConnectServer("127.0.0.1", 0, ProxyOptions{Users: []ProxyUser{{Username: "u", Password: "p"}}}, 0)
+	if s.authenticate("u", "x") || !s.authenticate("u", "p") {
+		t.Fatal("password check")
+	}
+	s, _ = NewHTTPConnectServer("127.0.0.1", 0, ProxyOptions{AllowAnonymous: true}, 0)
+	if !s.authenticate("", "") {
+		t.Fatal("anonymous proxy rejected client")
+	}
+}
+
+func TestDestPolicyResolve(t *testing.T) {
+	p, _ := NewDestPolicy(nil, []string{"127.0.0.0/8", "::1/128"})
+	if _, ok := p.Resolve("localhost", 80); ok {
+		t.Fatal("denied cidr reached through a hostname")
+	}
+	if _, ok := p.Resolve("no-such-host.invalid", 80); ok {
+		t.Fatal("unresolvable host permitted while ip rules exist")
+	}
+
+	// 由 IP 规则放行的域名返回检查过的 IP，拨号不再解析。
+	p, _ = NewDestPolicy([]string{"127.0.0.1"}, nil)
+	if host, ok := p.Resolve("localhost", 80); !ok || host != "127.0.0.1" {
+		t.Fatalf("got %q %v", host, ok)
+	}
+
+	// 只有域名规则时保留域名。
+	p, _ = NewDestPolicy([]string{"*.example.com"}, nil)
+	if host, ok := p.Resolve("a.example.com", 443); !ok || host != "a.example.com" {
+		t.Fatalf("got %q %v", host, ok)
+	}
+	if _, ok := p.Resolve("example.org", 443); ok {
+		t.Fatal("host outside allow list permitted")
+	}
+}
+
+func TestProxyDefaultDeny(t *testing.T) {
+	opts := ProxyOptions{AllowAnonymous: true}
+	s, err := NewSOCKS5Server("127.0.0.1", 0, opts, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"127.0.0.1", "localhost", "::1", "169.254.169.254", "fe80::1", "0.0.0.0", "::"} {
+		if _, ok := s.policy.Resolve(host, 80); ok {
+			t.Fatalf("%s permitted without allow_local", host)
+		}
+	}
+	if _, ok := s.policy.Resolve("8.8.8.8", 53); !ok {
+		t.Fatal("public address denied")
+	}
+
+	// 显式开启 allow_local 后仅保留作者自己的黑名单。
+	opts.AllowLocal = true
+	opts.Deny = []string{"127.0.0.2"}
+	s, _ = NewSOCKS5Server("127.0.0.1", 0, opts, 0)
+	if _, ok := s.policy.Resolve("127.0.0.1", 80); !ok {
+		t.Fatal("loopback denied with allow_local")
+	}
+	if _, ok := s.policy.Resolve("127.0.0.2", 80); ok {
+		t.Fatal("author deny list dropped with allow_local")
+	}
+}
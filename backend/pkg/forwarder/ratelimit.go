@@ -27,12 +27,16 @@ func NewTokenBucket(bytesPerSec int64) *TokenBucket {
 }
 
 func (t *TokenBucket) Wait(n int) {
-  if t == nil || t.rate <= 0 || n <= 0 {
+  if t == nil || n <= 0 {
     return
   }
   need := int64(n)
-  for {
+  for need > 0 {
     t.mu.Lock()
+    if t.rate <= 0 {
+      t.mu.Unlock()
+      return
+    }
     now := time.Now()
     elapsed := now.Sub(t.lastFill).Seconds()
     if elapsed > 0 {
@@ -42,12 +46,18 @@ func (t *TokenBucket) Wait(n int) {
       }
       t.lastFill = now
     }
-    if t.tokens >= need {
-      t.tokens -= need
+    // 单次请求超过桶容量时按桶容量分批放行，否则永远等不到足够的令牌。
+    step := need
+    if step > t.burst {
+      step = t.burst
+    }
+    if t.tokens >= step {
+      t.tokens -= step
+      need -= step
       t.mu.Unlock()
-      return
+      continue
     }
-    missing := need - t.tokens
+    missing := step - t.tokens
     wait := time.Duration(float64(missing)/float64(t.rate)*float64(time.Second))
     t.mu.Unlock()
     if wait < time.Millisecond {
@@ -56,3 +66,39 @@ func (t *TokenBucket) Wait(n int) {
     time.Sleep(wait)
   }
 }
+
+// SetRate 运行期间调整限速，正在等待的请求按新速率继续；bytesPerSec<=0 表示不限速。
+func (t *TokenBucket) SetRate(bytesPerSec int64) {
+  if t == nil {
+    return
+  }
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if bytesPerSec <= 0 {
+    t.rate, t.burst, t.tokens = 0, 0, 0
+    return
+  }
+  if t.rate <= 0 {
+    t.tokens = bytesPerSec
+    t.lastFill = time.Now()
+  }
+  t.rate, t.burst = bytesPerSec, bytesPerSec
+  if t.tokens > t.burst {
+    t.tokens = t.burst
+  }
+}
+
+// Rate 返回当前限速 bytes/s，0 表示不限速。
+func (t *TokenBucket) Rate() int64 {
+  if t == nil {
+    return 0
+  }
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  return t.rate
+}
+
+// RateLimited 由持有令牌桶的转发器实现，供运行期间调整限速。
+type RateLimited interface {
+  Limiter() *TokenBucket
+}
@@ -0,0 +1,119 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Spec 构建转发器所需的通用参数，类型相关的配置放在 Options。
+type Spec struct {
+	ListenHost     string
+	ListenPort     int
+	TargetHost     string // 未配置目标时为空（代理类入站由客户端指定目标）
+	TargetPort     int
+	BandwidthLimit int64
+	Options        json.RawMessage
+	Dialer         Dialer // 非 nil 表示出站需经 relay 链路
+}
+
+// Factory 按 Spec 构建一个尚未启动的转发器。
+type Factory func(spec Spec) (Forwarder, error)
+
+// Kind 一种可注册的转发类型。
+type Kind struct {
+	Name        string
+	Description string
+	// Schema 描述 Options 的 JSON Schema，供前端生成表单；无选项时为空对象。
+	Schema json.RawMessage
+	// NeedsTarget 为 false 时目标由客户端在连接时指定（socks5 等代理入站）。
+	NeedsTarget bool
+	Factory     Factory
+	// Validate 可选，在保存规则前校验 Options，不占用端口。
+	Validate func(options json.RawMessage) error
+}
+
+// KindInfo 对外展示的转发类型描述，不含工厂函数。
+type KindInfo struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	NeedsTarget bool            `json:"needs_target"`
+	Schema      json.RawMessage `json:"schema"`
+}
+
+var (
+	kindsMu sync.RWMutex
+	kinds   = make(map[string]Kind)
+)
+
+// Register 注册转发类型，通常在各实现文件的 init 中调用；重名时 panic。
+func Register(k Kind) {
+	if k.Name == "" || k.Factory == nil {
+		panic("forwarder: Register requires a name and factory")
+	}
+	kindsMu.Lock()
+	defer kindsMu.Unlock()
+	if _, dup := kinds[k.Name]; dup {
+		panic("forwarder: Register called twice for " + k.Name)
+	}
+	if len(k.Schema) == 0 {
+		k.Schema = json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	kinds[k.Name] = k
+}
+
+// Lookup 按名称查找已注册的转发类型。
+func Lookup(name string) (Kind, bool) {
+	kindsMu.RLock()
+	defer kindsMu.RUnlock()
+	k, ok := kinds[name]
+	return k, ok
+}
+
+// Kinds 返回所有已注册类型，按名称排序。
+func Kinds() []KindInfo {
+	kindsMu.RLock()
+	defer kindsMu.RUnlock()
+	out := make([]KindInfo, 0, len(kinds))
+	for _, k := range kinds {
+		out = append(out, KindInfo{Name: k.Name, Description: k.Description, NeedsTarget: k.NeedsTarget, Schema: k.Schema})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Build 按类型名构建转发器。
+func Build(kind string, spec Spec) (Forwarder, error) {
+	k, ok := Lookup(kind)
+	if !ok {
+		return nil, fmt.Errorf("unsupported forwarder type %q", kind)
+	}
+	if k.NeedsTarget && (spec.TargetHost == "" || spec.TargetPort <= 0) {
+		return nil, fmt.Errorf("%s forwarder requires a target", kind)
+	}
+	return k.Factory(spec)
+}
+
+// ValidateOptions 校验类型是否已注册及其 Options 是否合法。
+func ValidateOptions(kind string, options json.RawMessage) error {
+	k, ok := Lookup(kind)
+	if !ok {
+		return fmt.Errorf("unsupported forwarder type %q", kind)
+	}
+	if k.Validate == nil {
+		return nil
+	}
+	return k.Validate(options)
+}
+
+// decodeOptions 解析 Options，空值保留 v 的零值。
+func decodeOptions(options json.RawMessage, v interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(options, v); err != nil {
+		return fmt.Errorf("invalid options: %v", err)
+	}
+	return nil
+}
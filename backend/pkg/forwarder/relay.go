@@ -0,0 +1,455 @@
+package forwarder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// FolstingX 原生 relay 协议:
+//   传输层之上先做 AEAD 分块加密 (每个方向独立 salt，HKDF-SHA256 派生子密钥)，
+//   客户端首个分块为握手消息 magic(4) + unix 时间戳(8)，服务端校验后回复 magic，
+//   之后在加密连接上跑多路复用会话，每个流的 SYN 载荷是下一跳或最终目标地址。
+// 多跳时由入口逐跳嵌套建立会话，每一跳使用该节点自己的密钥认证。
+
+const (
+	relaySaltSize     = 32
+	relayHandshakeTTL = 2 * time.Minute
+	relayDialTimeout  = 5 * time.Second
+	relayInfo         = "folstingx-relay-v1"
+)
+
+var relayMagic = []byte("FXR1")
+
+var errRelayAuth = errors.New("relay handshake failed")
+
+// RelayKey 由节点密钥派生 relay 协议使用的 32 字节预共享密钥。
+func RelayKey(secret string) []byte {
+	key := make([]byte, 32)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte("folstingx-relay-psk")), key)
+	return key
+}
+
+func relayClientHandshake(conn net.Conn, key []byte) (*aeadConn, error) {
+	ac := newAEADConn(conn, hkdfAESGCM(key, relayInfo), relaySaltSize, nil)
+	hello := make([]byte, 12)
+	copy(hello, relayMagic)
+	binary.BigEndian.PutUint64(hello[4:], uint64(time.Now().Unix()))
+	if _, err := ac.Write(hello); err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(relayDialTimeout))
+	resp, err := ac.readMessage()
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil || !bytes.Equal(resp, relayMagic) {
+		return nil, errRelayAuth
+	}
+	return ac, nil
+}
+
+func relayServerHandshake(conn net.Conn, key []byte, replay *saltFilter) (*aeadConn, error) {
+	ac := newAEADConn(conn, hkdfAESGCM(key, relayInfo), relaySaltSize, replay)
+	_ = conn.SetReadDeadline(time.Now().Add(relayDialTimeout))
+	hello, err := ac.readMessage()
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil || len(hello) != 12 || !bytes.Equal(hello[:4], relayMagic) {
+		return nil, errRelayAuth
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint64(hello[4:])), 0)
+	if d := time.Since(ts); d > relayHandshakeTTL || d < -relayHandshakeTTL {
+		return nil, errRelayAuth
+	}
+	if _, err := ac.Write(relayMagic); err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
+
+// ===================== Relay 服务端 =====================
+
+// RelayServer 是中继/出口节点上运行的 relay 监听器。
+type RelayServer struct {
+	listenAddr string
+	key        []byte
+	listener   net.Listener
+	transport  Transport
+	target     string
+	replay     *saltFilter
+	closed     atomic.Bool
+	upBytes    atomic.Int64
+	downBytes  atomic.Int64
+	conns      atomic.Int64
+	limiter    *TokenBucket
+	wg         sync.WaitGroup
+
+	mu       sync.Mutex
+	sessions map[*muxSession]struct{}
+}
+
+func NewRelayServer(listenHost string, listenPort int, key []byte, limit int64) *RelayServer {
+	return &RelayServer{
+		listenAddr: net.JoinHostPort(listenHost, strconv.Itoa(listenPort)),
+		key:        key,
+		replay:     newSaltFilter(2 * relayHandshakeTTL),
+		limiter:    NewTokenBucket(limit),
+		sessions:   make(map[*muxSession]struct{}),
+	}
+}
+
+// SetTransport 指定 relay 监听的传输层，默认 tcp。
+func (s *RelayServer) SetTransport(t Transport) {
+	s.transport = t
+}
+
+// SetTarget 指定后所有流都连接该地址而忽略客户端请求的目标，对应 gost relay 服务的转发模式。
+func (s *RelayServer) SetTarget(addr string) {
+	s.target = addr
+}
+
+func (s *RelayServer) Start() error {
+	var ln net.Listener
+	var err error
+	if s.transport != nil {
+		ln, err = s.transport.Listen(s.listenAddr)
+	} else {
+		ln, err = net.Listen("tcp", s.listenAddr)
+	}
+	if err != nil {
+		return err
+	}
+	s.listener = ln
+	s.closed.Store(false)
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return nil
+}
+
+func (s *RelayServer) acceptLoop() {
+	defer s.wg.Done()
+	for !s.closed.Load() {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.closed.Load() {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		s.wg.Add(1)
+		go s.handleConn(conn)
+	}
+}
+
+func (s *RelayServer) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	ac, err := relayServerHandshake(conn, s.key, s.replay)
+	if err != nil {
+		// 认证失败时读完剩余数据再关闭，避免暴露协议特征。
+		_ = conn.SetReadDeadline(time.Now().Add(relayDialTimeout))
+		_, _ = io.Copy(io.Discard, conn)
+		_ = conn.Close()
+		return
+	}
+
+	sess := newMuxSession(ac, false)
+	s.mu.Lock()
+	s.sessions[sess] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, sess)
+		s.mu.Unlock()
+		_ = sess.Close()
+	}()
+
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.handleStream(st)
+	}
+}
+
+func (s *RelayServer) handleStream(st *muxStream) {
+	defer s.wg.Done()
+	defer st.Close()
+
+	target := st.Target()
+	if s.target != "" {
+		target = s.target
+	}
+	out, err := net.DialTimeout("tcp", target, relayDialTimeout)
+	if err != nil {
+		_ = st.Ack(err)
+		return
+	}
+	defer out.Close()
+	if err := st.Ack(nil); err != nil {
+		return
+	}
+
+	s.conns.Add(1)
+	defer s.conns.Add(-1)
+	pipeConns(st, out, s.limiter, &s.upBytes, &s.downBytes)
+}
+
+func (s *RelayServer) Stop() error {
+	if s.closed.Swap(true) {
+		return nil
+	}
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	s.mu.Lock()
+	for sess := range s.sessions {
+		_ = sess.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *RelayServer) Limiter() *TokenBucket { return s.limiter }
+
+func (s *RelayServer) Stats() Stats {
+	return Stats{UpBytes: s.upBytes.Load(), DownBytes: s.downBytes.Load(), Connections: s.conns.Load(), LastActivity: time.Now()}
+}
+
+// pipeConns 双向拷贝 in/out，任一方向结束即返回；上行方向受 limiter 限速。
+// 字节数在每次写出后即时累加，长连接也能实时反映流量。
+func pipeConns(in, out net.Conn, limiter *TokenBucket, up, down *atomic.Int64) {
+	pipeConnsTap(in, out, limiter, up, down, nil)
+}
+
+// pipeConnsTap 同 pipeConns，st 非空时双向数据同时交给旁路观察者，返回前关闭 st。
+func pipeConnsTap(in, out net.Conn, limiter *TokenBucket, up, down *atomic.Int64, st StreamTap) {
+	var upW, downW io.Writer = &countingWriter{w: out, n: up}, &countingWriter{w: in, n: down}
+	if st != nil {
+		defer st.Close()
+		upW = &tapWriter{w: upW, fn: st.Upstream}
+		downW = &tapWriter{w: downW, fn: st.Downstream}
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upW, &rateLimitedReader{r: in, limiter: limiter})
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(downW, out)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// ===================== Relay 链路拨号 =====================
+
+// RelayHop 描述链路中的一跳 relay 节点，Transport 为空时使用 tcp。
+type RelayHop struct {
+	Name      string
+	Addr      string
+	Key       []byte
+	Transport Transport
+}
+
+// HopStats 单跳的链路统计，字节数为该跳连接上的加密后流量。
+type HopStats struct {
+	Name      string `json:"name"`
+	Addr      string `json:"addr"`
+	UpBytes   int64  `json:"up_bytes"`
+	DownBytes int64  `json:"down_bytes"`
+	Streams   int64  `json:"streams"`
+	Connected bool   `json:"connected"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type hopState struct {
+	hop     RelayHop
+	sess    *muxSession
+	dialing *hopDial // 正在重建的会话，并发调用方等待同一次拨号
+	up      atomic.Int64
+	down    atomic.Int64
+	lastErr atomic.Value
+}
+
+// hopDial 一次进行中的逐跳拨号，done 关闭后 sess/err 可读。
+type hopDial struct {
+	done chan struct{}
+	sess *muxSession
+	err  error
+}
+
+// ChainDialer 经由 entry→relay→exit 多跳 relay 节点建立到目标的连接。
+// 每一跳复用一个多路复用会话，后一跳的会话嵌套在前一跳的流之上。
+// mu 只保护会话的查找与替换，拨号与握手在锁外进行，慢速跳点不阻塞已建立会话上的新连接。
+type ChainDialer struct {
+	mu   sync.Mutex
+	hops []*hopState
+	gen  uint64 // Close 时递增，丢弃关闭前发起的拨号结果
+}
+
+func NewChainDialer(hops []RelayHop) *ChainDialer {
+	d := &ChainDialer{}
+	for _, h := range hops {
+		d.hops = append(d.hops, &hopState{hop: h})
+	}
+	return d
+}
+
+func (d *ChainDialer) Dial(network, addr string) (net.Conn, error) {
+	if len(d.hops) == 0 {
+		return net.DialTimeout(network, addr, relayDialTimeout)
+	}
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("relay chain does not support network %s", network)
+	}
+	sess, err := d.session(len(d.hops) - 1)
+	if err != nil {
+		return nil, err
+	}
+	return sess.Open(addr)
+}
+
+// session 返回与第 i 跳的会话，必要时逐跳重建；同一跳同时只有一次拨号，其余调用方等待其结果。
+func (d *ChainDialer) session(i int) (*muxSession, error) {
+	h := d.hops[i]
+	d.mu.Lock()
+	if h.sess != nil && !h.sess.IsClosed() {
+		sess := h.sess
+		d.mu.Unlock()
+		return sess, nil
+	}
+	if call := h.dialing; call != nil {
+		d.mu.Unlock()
+		<-call.done
+		return call.sess, call.err
+	}
+	call := &hopDial{done: make(chan struct{})}
+	h.dialing = call
+	gen := d.gen
+	d.mu.Unlock()
+
+	call.sess, call.err = d.dialHop(i)
+
+	d.mu.Lock()
+	h.dialing = nil
+	if call.err == nil {
+		if gen != d.gen {
+			// 拨号期间链路已关闭，不再安装会话。
+			_ = call.sess.Close()
+			call.sess, call.err = nil, fmt.Errorf("hop %d (%s): %w", i, h.hop.Addr, net.ErrClosed)
+		} else {
+			h.sess = call.sess
+		}
+	}
+	d.mu.Unlock()
+	close(call.done)
+	return call.sess, call.err
+}
+
+// dialHop 建立到第 i 跳的新会话，第 i 跳之前的会话按需复用或重建。不持有 d.mu。
+func (d *ChainDialer) dialHop(i int) (*muxSession, error) {
+	h := d.hops[i]
+	var raw net.Conn
+	var err error
+	if i == 0 {
+		raw, err = net.DialTimeout("tcp", h.hop.Addr, relayDialTimeout)
+	} else {
+		var prev *muxSession
+		prev, err = d.session(i - 1)
+		if err == nil {
+			raw, err = prev.Open(h.hop.Addr)
+		}
+	}
+	if err == nil && h.hop.Transport != nil {
+		under := raw
+		if raw, err = h.hop.Transport.Client(under, h.hop.Addr); err != nil {
+			_ = under.Close()
+		}
+	}
+	if err != nil {
+		h.lastErr.Store(err.Error())
+		return nil, fmt.Errorf("hop %d (%s): %w", i, h.hop.Addr, err)
+	}
+
+	ac, err := relayClientHandshake(&countingConn{Conn: raw, up: &h.up, down: &h.down}, h.hop.Key)
+	if err != nil {
+		_ = raw.Close()
+		h.lastErr.Store(err.Error())
+		return nil, fmt.Errorf("hop %d (%s): %w", i, h.hop.Addr, err)
+	}
+	h.lastErr.Store("")
+	return newMuxSession(ac, true), nil
+}
+
+func (d *ChainDialer) HopStats() []HopStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]HopStats, 0, len(d.hops))
+	for _, h := range d.hops {
+		hs := HopStats{Name: h.hop.Name, Addr: h.hop.Addr, UpBytes: h.up.Load(), DownBytes: h.down.Load()}
+		if h.sess != nil && !h.sess.IsClosed() {
+			hs.Connected = true
+			hs.Streams = int64(h.sess.NumStreams())
+		}
+		if v, ok := h.lastErr.Load().(string); ok {
+			hs.LastError = v
+		}
+		out = append(out, hs)
+	}
+	return out
+}
+
+func (d *ChainDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gen++
+	for _, h := range d.hops {
+		if h.sess != nil {
+			_ = h.sess.Close()
+			h.sess = nil
+		}
+	}
+	return nil
+}
+
+// countingConn 统计经过连接的原始字节数。
+type countingConn struct {
+	net.Conn
+	up   *atomic.Int64
+	down *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.down.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.up.Add(int64(n))
+	return n, err
+}
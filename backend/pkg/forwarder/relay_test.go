@@ -0,0 +1,160 @@
+package forwarder
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(c, c); _ = c.Close() }()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func startRelay(t *testing.T, secret string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+	s := NewRelayServer("127.0.0.1", port, RelayKey(secret), 0)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Stop() })
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+func TestChainDialerMultiHop(t *testing.T) {
+	target := echoServer(t)
+	d := NewChainDialer([]RelayHop{
+		{Name: "relay", Addr: startRelay(t, "a"), Key: RelayKey("a")},
+		{Name: "exit", Addr: startRelay(t, "b"), Key: RelayKey("b")},
+	})
+	defer d.Close()
+
+	for i := 0; i < 3; i++ {
+		conn, err := d.Dial("tcp", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := []byte("ping " + strconv.Itoa(i))
+		_, _ = conn.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("echo %d: %q %v", i, got, err)
+		}
+		_ = conn.Close()
+	}
+	for _, hs := range d.HopStats() {
+		if !hs.Connected || hs.LastError != "" {
+			t.Fatalf("hop %s: %+v", hs.Name, hs)
+		}
+	}
+}
+
+func TestChainDialerWrongKey(t *testing.T) {
+	d := NewChainDialer([]RelayHop{{Addr: startRelay(t, "right"), Key: RelayKey("wrong")}})
+	defer d.Close()
+	if _, err := d.Dial("tcp", echoServer(t)); err == nil {
+		t.Fatal("dial with wrong key succeeded")
+	}
+	if hs := d.HopStats(); hs[0].Connected || hs[0].LastError == "" {
+		t.Fatalf("hop stats: %+v", hs[0])
+	}
+}
+
+// 握手重放：同一份客户端握手数据第二次发送时被拒绝。
+func TestRelayHandshakeReplay(t *testing.T) {
+	key := RelayKey("k")
+	replay := newSaltFilter(2 * relayHandshakeTTL)
+
+	// 录制一次客户端握手。
+	a, b := net.Pipe()
+	var recorded bytes.Buffer
+	go func() {
+		_, _ = relayClientHandshake(&recordConn{Conn: a, w: &recorded}, key)
+	}()
+	if _, err := relayServerHandshake(b, key, replay); err != nil {
+		t.Fatal(err)
+	}
+	_ = a.Close()
+	_ = b.Close()
+
+	c, s := net.Pipe()
+	defer c.Close()
+	go func() { _, _ = c.Write(recorded.Bytes()); _, _ = io.Copy(io.Discard, c) }()
+	if _, err := relayServerHandshake(s, key, replay); err == nil {
+		t.Fatal("replayed handshake accepted")
+	}
+	_ = s.Close()
+}
+
+// 慢速跳点拨号期间 HopStats 与 Close 不被阻塞。
+func TestChainDialerSlowHop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	d := NewChainDialer([]RelayHop{{Addr: ln.Addr().String(), Key: RelayKey("k")}})
+	dialed := make(chan error, 1)
+	go func() {
+		_, err := d.Dial("tcp", "127.0.0.1:1")
+		dialed <- err
+	}()
+	c := <-accepted
+
+	done := make(chan struct{})
+	go func() {
+		_ = d.HopStats()
+		_ = d.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("HopStats/Close blocked by an in-flight dial")
+	}
+	_ = c.Close()
+	if err := <-dialed; err == nil {
+		t.Fatal("dial to silent hop succeeded")
+	}
+}
+
+type recordConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	_, _ = c.w.Write(p)
+	return c.Conn.Write(p)
+}
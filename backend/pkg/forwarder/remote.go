@@ -0,0 +1,63 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// RemoteSpec 可序列化的转发器描述：面板下发给节点 Agent，由 Agent 在节点上构建并启动转发器。
+type RemoteSpec struct {
+	Kind           string          `json:"kind"`
+	ListenPort     int             `json:"listen_port"`
+	TargetHost     string          `json:"target_host,omitempty"`
+	TargetPort     int             `json:"target_port,omitempty"`
+	BandwidthLimit int64           `json:"bandwidth_limit"`
+	Options        json.RawMessage `json:"options,omitempty"`
+	Hops           []HopSpec       `json:"hops,omitempty"`
+}
+
+// HopSpec relay 跳点的可序列化描述，传输层在构建时按名称创建。
+type HopSpec struct {
+	Name      string `json:"name"`
+	Addr      string `json:"addr"`
+	Key       []byte `json:"key"`
+	Transport string `json:"transport"`
+	// Host 经 CDN 中转时用于 SNI 与证书校验的域名，直连时为空并跳过证书校验。
+	Host string `json:"host,omitempty"`
+}
+
+// RelayHop 创建传输层并转换为 relay 跳点。
+func (h HopSpec) RelayHop() (RelayHop, error) {
+	transport, err := NewTransport(h.Transport, TransportOptions{
+		Host:     h.Host,
+		Insecure: h.Host == "",
+	})
+	if err != nil {
+		return RelayHop{}, fmt.Errorf("hop %s: %v", h.Name, err)
+	}
+	return RelayHop{Name: h.Name, Addr: h.Addr, Key: h.Key, Transport: transport}, nil
+}
+
+// Build 构建尚未启动的转发器，Hops 非空时出站经 relay 链路。
+func (s RemoteSpec) Build() (Forwarder, error) {
+	spec := Spec{
+		ListenHost:     "0.0.0.0",
+		ListenPort:     s.ListenPort,
+		TargetHost:     s.TargetHost,
+		TargetPort:     s.TargetPort,
+		BandwidthLimit: s.BandwidthLimit,
+		Options:        s.Options,
+	}
+	if len(s.Hops) > 0 {
+		hops := make([]RelayHop, 0, len(s.Hops))
+		for _, h := range s.Hops {
+			hop, err := h.RelayHop()
+			if err != nil {
+				return nil, err
+			}
+			hops = append(hops, hop)
+		}
+		spec.Dialer = NewChainDialer(hops)
+	}
+	return Build(s.Kind, spec)
+}
@@ -0,0 +1,434 @@
+package forwarder
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ShadowsocksOptions shadowsocks 入站配置，对应规则的 inbound_config。
+type ShadowsocksOptions struct {
+	Method   string `json:"method"`
+	Password string `json:"password"` // 2022 系列为 base64 编码的 PSK
+}
+
+const (
+	ss2022MaxPayload   = 0xFFFF
+	ss2022TimeWindow   = 30 * time.Second
+	ss2022HeaderClient = 0
+	ss2022HeaderServer = 1
+	ss2022SubkeyInfo   = "shadowsocks 2022 session subkey"
+	ssSubkeyInfo       = "ss-subkey"
+)
+
+var errSSBadHeader = errors.New("shadowsocks: bad header")
+
+// ssCipher 描述一种 Shadowsocks AEAD 加密方式及其主密钥。
+type ssCipher struct {
+	method  string
+	key     []byte
+	is2022  bool
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ShadowsocksMethods 返回支持的加密方式。
+func ShadowsocksMethods() []string {
+	return []string{
+		"aes-128-gcm", "aes-192-gcm", "aes-256-gcm", "chacha20-ietf-poly1305",
+		"2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305",
+	}
+}
+
+// newSSCipher 校验加密方式与密码并生成主密钥。
+func newSSCipher(method, password string) (*ssCipher, error) {
+	c := &ssCipher{method: method}
+	var keySize int
+	switch method {
+	case "aes-128-gcm", "2022-blake3-aes-128-gcm":
+		keySize, c.newAEAD = 16, newAESGCM
+	case "aes-192-gcm":
+		keySize, c.newAEAD = 24, newAESGCM
+	case "aes-256-gcm", "2022-blake3-aes-256-gcm":
+		keySize, c.newAEAD = 32, newAESGCM
+	case "chacha20-ietf-poly1305", "2022-blake3-chacha20-poly1305":
+		keySize, c.newAEAD = chacha20poly1305.KeySize, chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("unsupported shadowsocks method %q", method)
+	}
+	if password == "" {
+		return nil, errors.New("shadowsocks password is required")
+	}
+	c.is2022 = len(method) > 5 && method[:5] == "2022-"
+	if c.is2022 {
+		key, err := base64.StdEncoding.DecodeString(password)
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("%s requires a base64 encoded %d-byte key", method, keySize)
+		}
+		c.key = key
+	} else {
+		c.key = evpBytesToKey(password, keySize)
+	}
+	return c, nil
+}
+
+// ValidateShadowsocks 检查 inbound_config 中的加密方式与密码是否可用。
+func ValidateShadowsocks(opts ShadowsocksOptions) error {
+	_, err := newSSCipher(opts.Method, opts.Password)
+	return err
+}
+
+// GenerateShadowsocksPassword 为指定加密方式生成随机密码。
+func GenerateShadowsocksPassword(method string) string {
+	size := 16
+	switch method {
+	case "2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305":
+		size = 32
+	}
+	b := make([]byte, size)
+	_, _ = rand.Read(b)
+	if len(method) > 5 && method[:5] == "2022-" {
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// evpBytesToKey 即 OpenSSL EVP_BytesToKey(MD5)，经典 AEAD 方式由密码派生主密钥。
+func evpBytesToKey(password string, keySize int) []byte {
+	var key, prev []byte
+	for len(key) < keySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keySize]
+}
+
+// sessionAEAD 按 salt 派生会话子密钥。
+func (c *ssCipher) sessionAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if c.is2022 {
+		material := make([]byte, 0, len(c.key)+len(salt))
+		material = append(append(material, c.key...), salt...)
+		blake3DeriveKey(subkey, ss2022SubkeyInfo, material)
+	} else if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte(ssSubkeyInfo)), subkey); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// ===================== 服务端 =====================
+
+// ShadowsocksServer 原生 Shadowsocks AEAD / 2022 入站（TCP）。
+// 配置了 target 时所有连接转发到该目标，否则转发到客户端请求的地址。
+type ShadowsocksServer struct {
+	listenAddr string
+	target     string
+	cipher     *ssCipher
+	listener   net.Listener
+	replay     *saltFilter
+	dialer     Dialer
+	closed     atomic.Bool
+	upBytes    atomic.Int64
+	downBytes  atomic.Int64
+	conns      atomic.Int64
+	limiter    *TokenBucket
+	wg         sync.WaitGroup
+
+	mu     sync.Mutex
+	active map[net.Conn]struct{}
+	tapSlot
+	chaosSlot
+	shaperSlot
+	healthSlot
+}
+
+func NewShadowsocksServer(listenHost string, listenPort int, target string, opts ShadowsocksOptions, limit int64) (*ShadowsocksServer, error) {
+	c, err := newSSCipher(opts.Method, opts.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &ShadowsocksServer{
+		listenAddr: net.JoinHostPort(listenHost, strconv.Itoa(listenPort)),
+		target:     target,
+		cipher:     c,
+		replay:     newSaltFilter(2 * ss2022TimeWindow),
+		limiter:    NewTokenBucket(limit),
+		active:     make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// SetDialer 指定出站拨号方式（例如 relay 链路），需在 Start 之前调用。
+func (s *ShadowsocksServer) SetDialer(d Dialer) {
+	s.dialer = d
+}
+
+func (s *ShadowsocksServer) Start() error {
+	ln, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		return err
+	}
+	s.listener = ln
+	s.closed.Store(false)
+	s.resetHealth()
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return nil
+}
+
+func (s *ShadowsocksServer) acceptLoop() {
+	defer s.wg.Done()
+	for !s.closed.Load() {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.closed.Load() {
+				return
+			}
+			if listenerDead(err) {
+				s.fail(err)
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		s.mu.Lock()
+		s.active[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.active, conn)
+				s.mu.Unlock()
+			}()
+			defer conn.Close()
+			if chaos := s.activeChaos(); chaos != nil && chaos.Refuse() {
+				refuseConn(conn)
+				return
+			}
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *ShadowsocksServer) handleConn(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	var (
+		in   net.Conn
+		addr string
+		err  error
+	)
+	if s.cipher.is2022 {
+		in, addr, err = s.accept2022(conn)
+	} else {
+		in, addr, err = s.acceptAEAD(conn)
+	}
+	if err != nil {
+		// 认证失败时读完剩余数据再关闭，避免暴露协议特征。
+		_, _ = io.Copy(io.Discard, conn)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if s.target != "" {
+		addr = s.target
+	}
+	var out net.Conn
+	if s.dialer != nil {
+		out, err = s.dialer.Dial("tcp", addr)
+	} else {
+		out, err = net.DialTimeout("tcp", addr, 5*time.Second)
+	}
+	if err != nil {
+		return
+	}
+	defer out.Close()
+
+	s.conns.Add(1)
+	defer s.conns.Add(-1)
+	st := s.openStream(conn.RemoteAddr(), out.RemoteAddr(), addr)
+	in = wrapChaos(s.activeChaos(), in, out)
+	pipeConnsTap(s.shape(in), s.shape(out), s.limiter, &s.upBytes, &s.downBytes, st)
+}
+
+// acceptAEAD 处理经典 AEAD 请求：[salt][chunk(addr + payload)]...
+func (s *ShadowsocksServer) acceptAEAD(conn net.Conn) (net.Conn, string, error) {
+	ac := newAEADConn(conn, s.cipher.sessionAEAD, len(s.cipher.key), s.replay)
+	host, port, err := readSOCKS5Addr(ac)
+	if err != nil {
+		return nil, "", err
+	}
+	return ac, net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// accept2022 处理 SIP022 请求：[salt][固定头][可变头]...
+func (s *ShadowsocksServer) accept2022(conn net.Conn) (net.Conn, string, error) {
+	salt := make([]byte, len(s.cipher.key))
+	if _, err := io.ReadFull(conn, salt); err != nil {
+		return nil, "", err
+	}
+	aead, err := s.cipher.sessionAEAD(salt)
+	if err != nil {
+		return nil, "", err
+	}
+	r := newAEADReaderSize(conn, aead, ss2022MaxPayload)
+
+	// 固定头: type(1) + timestamp(8) + 可变头长度(2)
+	fixed, err := r.readFixedChunk(11)
+	if err != nil {
+		return nil, "", err
+	}
+	if fixed[0] != ss2022HeaderClient {
+		return nil, "", errSSBadHeader
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint64(fixed[1:9])), 0)
+	if d := time.Since(ts); d > ss2022TimeWindow || d < -ss2022TimeWindow {
+		return nil, "", errSSBadHeader
+	}
+	// 只有通过认证的 salt 才记入重放过滤器。
+	if !s.replay.Add(salt) {
+		return nil, "", errReplayedSalt
+	}
+	varLen := int(binary.BigEndian.Uint16(fixed[9:11]))
+
+	// 可变头: ATYP+ADDR+PORT + padding 长度(2) + padding + 首包载荷
+	vh, err := r.readFixedChunk(varLen)
+	if err != nil {
+		return nil, "", err
+	}
+	br := bytes.NewReader(vh)
+	host, port, err := readSOCKS5Addr(br)
+	if err != nil {
+		return nil, "", err
+	}
+	var padLen uint16
+	if err := binary.Read(br, binary.BigEndian, &padLen); err != nil {
+		return nil, "", err
+	}
+	if int(padLen) > br.Len() {
+		return nil, "", errSSBadHeader
+	}
+	_, _ = br.Seek(int64(padLen), io.SeekCurrent)
+	r.left = append([]byte(nil), vh[len(vh)-br.Len():]...)
+
+	sc := &ss2022Conn{Conn: conn, cipher: s.cipher, reader: r, reqSalt: salt}
+	return sc, net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// ss2022Conn 服务端 2022 连接，首次写出时发送响应头。
+type ss2022Conn struct {
+	net.Conn
+	cipher  *ssCipher
+	reader  *aeadReader
+	reqSalt []byte
+
+	wmu    sync.Mutex
+	writer *aeadWriter
+}
+
+func (c *ss2022Conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *ss2022Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.writer != nil {
+		return c.writer.Write(p)
+	}
+
+	salt := make([]byte, len(c.cipher.key))
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	aead, err := c.cipher.sessionAEAD(salt)
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	buf.Write(salt)
+	w := newAEADWriterSize(&buf, aead, ss2022MaxPayload)
+
+	first := p
+	if len(first) > ss2022MaxPayload {
+		first = first[:ss2022MaxPayload]
+	}
+	// 固定头: type(1) + timestamp(8) + 请求 salt + 首块长度(2)
+	header := make([]byte, 0, 1+8+len(c.reqSalt)+2)
+	header = append(header, ss2022HeaderServer)
+	header = binary.BigEndian.AppendUint64(header, uint64(time.Now().Unix()))
+	header = append(header, c.reqSalt...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(first)))
+	if err := w.writeFixedChunk(header); err != nil {
+		return 0, err
+	}
+	if err := w.writeFixedChunk(first); err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	w.w = c.Conn
+	c.writer = w
+
+	if rest := p[len(first):]; len(rest) > 0 {
+		n, err := w.Write(rest)
+		return len(first) + n, err
+	}
+	return len(first), nil
+}
+
+func (s *ShadowsocksServer) Stop() error {
+	if s.closed.Swap(true) {
+		return nil
+	}
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	s.mu.Lock()
+	for c := range s.active {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	if c, ok := s.dialer.(io.Closer); ok {
+		_ = c.Close()
+	}
+	return nil
+}
+
+func (s *ShadowsocksServer) Limiter() *TokenBucket { return s.limiter }
+
+func (s *ShadowsocksServer) Stats() Stats {
+	st := Stats{UpBytes: s.upBytes.Load(), DownBytes: s.downBytes.Load(), Connections: s.conns.Load(), LastActivity: time.Now()}
+	if hs, ok := s.dialer.(interface{ HopStats() []HopStats }); ok {
+		st.Hops = hs.HopStats()
+	}
+	return st
+}
@@ -0,0 +1,324 @@
+package forwarder
+
+import (
+	"container/heap"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 规则优先级类别，权重决定主机出口拥塞时各规则分得的带宽比例。
+const (
+	ClassInteractive = "interactive"
+	ClassStandard    = "standard"
+	ClassBulk        = "bulk"
+)
+
+// DefaultClassWeights 未在配置中覆盖时各类别的权重。
+var DefaultClassWeights = map[string]int{
+	ClassInteractive: 8,
+	ClassStandard:    4,
+	ClassBulk:        1,
+}
+
+// ValidPriorityClass 判断类别名是否合法，空值按 standard 处理。
+func ValidPriorityClass(class string) bool {
+	_, ok := DefaultClassWeights[class]
+	return ok || class == ""
+}
+
+// shaperChunk 单次排队的最大字节数，越小各规则交替越细。
+const shaperChunk = 16 << 10
+
+// ClassUsage 某优先级类别的累计出口用量。
+type ClassUsage struct {
+	Weight int   `json:"weight"`
+	Rules  int   `json:"rules"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// HostShaper 主机级出口整形器：所有规则共享一个总速率，拥塞时按规则权重
+// 以 start-time fair queuing 分配，空闲时任一规则都能用满总带宽。
+type HostShaper struct {
+	rate    int64
+	burst   float64
+	weights map[string]int
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	vtime   float64
+	queue   shaperQueue
+	flows   map[*ShaperFlow]struct{}
+	usage   map[string]*atomic.Int64
+	kick    chan struct{}
+	closed  chan struct{}
+	closeMu sync.Once
+}
+
+// NewHostShaper 创建总速率为 rate bytes/s 的整形器；weights 为空的类别使用默认权重。
+func NewHostShaper(rate int64, weights map[string]int) *HostShaper {
+	w := make(map[string]int, len(DefaultClassWeights))
+	usage := make(map[string]*atomic.Int64, len(DefaultClassWeights))
+	for class, def := range DefaultClassWeights {
+		w[class] = def
+		if v, ok := weights[class]; ok && v > 0 {
+			w[class] = v
+		}
+		usage[class] = new(atomic.Int64)
+	}
+	burst := float64(rate) / 10
+	if burst < shaperChunk {
+		burst = shaperChunk
+	}
+	s := &HostShaper{
+		rate:    rate,
+		burst:   burst,
+		weights: w,
+		tokens:  burst,
+		last:    time.Now(),
+		flows:   make(map[*ShaperFlow]struct{}),
+		usage:   usage,
+		kick:    make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	go s.dispatch()
+	return s
+}
+
+// Rate 返回整形器的总速率 bytes/s。
+func (s *HostShaper) Rate() int64 { return s.rate }
+
+// Flow 为一条规则注册整形流，规则停止时需调用 Close。
+func (s *HostShaper) Flow(class string) *ShaperFlow {
+	if class == "" {
+		class = ClassStandard
+	}
+	weight, ok := s.weights[class]
+	if !ok {
+		class, weight = ClassStandard, s.weights[ClassStandard]
+	}
+	f := &ShaperFlow{s: s, class: class, weight: float64(weight)}
+	s.mu.Lock()
+	s.flows[f] = struct{}{}
+	s.mu.Unlock()
+	return f
+}
+
+// Usage 返回各类别的权重、活跃规则数与累计字节数。
+func (s *HostShaper) Usage() map[string]ClassUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]ClassUsage, len(s.weights))
+	for class, w := range s.weights {
+		out[class] = ClassUsage{Weight: w, Bytes: s.usage[class].Load()}
+	}
+	for f := range s.flows {
+		u := out[f.class]
+		u.Rules++
+		out[f.class] = u
+	}
+	return out
+}
+
+// Close 停止调度并放行所有排队中的请求。
+func (s *HostShaper) Close() {
+	s.closeMu.Do(func() {
+		close(s.closed)
+		s.mu.Lock()
+		for s.queue.Len() > 0 {
+			close(heap.Pop(&s.queue).(*shaperWaiter).ready)
+		}
+		s.mu.Unlock()
+	})
+}
+
+func (s *HostShaper) refill(now time.Time) {
+	s.tokens += now.Sub(s.last).Seconds() * float64(s.rate)
+	if s.tokens > s.burst {
+		s.tokens = s.burst
+	}
+	s.last = now
+}
+
+// wait 为 f 申请 n 字节（n 不超过 shaperChunk）的发送额度。
+func (s *HostShaper) wait(f *ShaperFlow, n int) {
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	s.mu.Lock()
+	start := s.vtime
+	if f.finish > start {
+		start = f.finish
+	}
+	f.finish = start + float64(n)/f.weight
+	s.refill(time.Now())
+	if s.queue.Len() == 0 && s.tokens >= float64(n) {
+		s.tokens -= float64(n)
+		s.vtime = start
+		s.mu.Unlock()
+		s.usage[f.class].Add(int64(n))
+		return
+	}
+	w := &shaperWaiter{start: start, seq: s.queue.seq, n: n, ready: make(chan struct{})}
+	s.queue.seq++
+	heap.Push(&s.queue, w)
+	s.mu.Unlock()
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+	<-w.ready
+	s.usage[f.class].Add(int64(n))
+}
+
+// dispatch 按 start tag 从小到大放行排队请求，令牌不足时睡到足够为止。
+func (s *HostShaper) dispatch() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		s.refill(time.Now())
+		for s.queue.Len() > 0 && s.tokens >= float64(s.queue.items[0].n) {
+			w := heap.Pop(&s.queue).(*shaperWaiter)
+			s.tokens -= float64(w.n)
+			s.vtime = w.start
+			close(w.ready)
+		}
+		sleep := time.Hour
+		if s.queue.Len() > 0 {
+			missing := float64(s.queue.items[0].n) - s.tokens
+			sleep = time.Duration(missing / float64(s.rate) * float64(time.Second))
+			if sleep < time.Millisecond {
+				sleep = time.Millisecond
+			}
+		}
+		s.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(sleep)
+		select {
+		case <-s.closed:
+			return
+		case <-s.kick:
+		case <-timer.C:
+		}
+	}
+}
+
+// ShaperFlow 单条规则在主机整形器中的流。
+type ShaperFlow struct {
+	s      *HostShaper
+	class  string
+	weight float64
+	finish float64 // 受 s.mu 保护
+	once   sync.Once
+}
+
+// Class 返回流所属的优先级类别。
+func (f *ShaperFlow) Class() string { return f.class }
+
+// Wait 阻塞直到主机出口允许发送 n 字节。
+func (f *ShaperFlow) Wait(n int) {
+	if f == nil {
+		return
+	}
+	for n > 0 {
+		step := n
+		if step > shaperChunk {
+			step = shaperChunk
+		}
+		f.s.wait(f, step)
+		n -= step
+	}
+}
+
+// Close 注销流，不再计入该类别的活跃规则数。
+func (f *ShaperFlow) Close() {
+	if f == nil {
+		return
+	}
+	f.once.Do(func() {
+		f.s.mu.Lock()
+		delete(f.s.flows, f)
+		f.s.mu.Unlock()
+	})
+}
+
+type shaperWaiter struct {
+	start float64
+	seq   uint64
+	n     int
+	ready chan struct{}
+}
+
+type shaperQueue struct {
+	items []*shaperWaiter
+	seq   uint64
+}
+
+func (q shaperQueue) Len() int { return len(q.items) }
+
+func (q shaperQueue) Less(i, j int) bool {
+	if q.items[i].start != q.items[j].start {
+		return q.items[i].start < q.items[j].start
+	}
+	return q.items[i].seq < q.items[j].seq
+}
+
+func (q shaperQueue) Swap(i, j int) { q.items[i], q.items[j] = q.items[j], q.items[i] }
+
+func (q *shaperQueue) Push(x any) { q.items = append(q.items, x.(*shaperWaiter)) }
+
+func (q *shaperQueue) Pop() any {
+	old := q.items
+	w := old[len(old)-1]
+	q.items = old[:len(old)-1]
+	return w
+}
+
+// Shapeable 由接入主机整形器的转发器实现，flow 为 nil 表示不整形。
+type Shapeable interface {
+	SetShaperFlow(f *ShaperFlow)
+}
+
+// shaperSlot 供转发器嵌入，运行期间原子替换整形流。
+type shaperSlot struct {
+	flow atomic.Pointer[ShaperFlow]
+}
+
+func (s *shaperSlot) SetShaperFlow(f *ShaperFlow) {
+	s.flow.Store(f)
+}
+
+// shapeWait 为即将发出的 n 字节排队，未接入整形器时立即返回。
+func (s *shaperSlot) shapeWait(n int) {
+	s.flow.Load().Wait(n)
+}
+
+// shape 包装连接，使写出的数据受主机整形器调度；未接入时原样返回。
+func (s *shaperSlot) shape(c net.Conn) net.Conn {
+	f := s.flow.Load()
+	if f == nil {
+		return c
+	}
+	return &shapedConn{Conn: c, flow: f}
+}
+
+type shapedConn struct {
+	net.Conn
+	flow *ShaperFlow
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	c.flow.Wait(len(p))
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,309 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5 协议常量 (RFC 1928 / RFC 1929)
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xFF
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded       = 0x00
+	socks5RepFailure         = 0x01
+	socks5RepNotAllowed      = 0x02
+	socks5RepHostUnreachable = 0x04
+	socks5RepCmdNotSupported = 0x07
+	socks5RepAtypNotSupport  = 0x08
+)
+
+const socks5UDPIdleTimeout = 2 * time.Minute
+
+var errSOCKS5BadAddr = errors.New("socks5: bad address")
+
+func (s *ProxyServer) serveSOCKS5(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := s.socks5Negotiate(conn); err != nil {
+		return
+	}
+
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(conn, hdr); err != nil || hdr[0] != socks5Version {
+		return
+	}
+	host, port, err := readSOCKS5Addr(conn)
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5RepAtypNotSupport, nil)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	switch hdr[1] {
+	case socks5CmdConnect:
+		dialHost, ok := s.policy.Resolve(host, port)
+		if !ok {
+			writeSOCKS5Reply(conn, socks5RepNotAllowed, nil)
+			return
+		}
+		target := net.JoinHostPort(host, strconv.Itoa(port))
+		out, err := s.dial(net.JoinHostPort(dialHost, strconv.Itoa(port)))
+		if err != nil {
+			writeSOCKS5Reply(conn, socks5RepHostUnreachable, nil)
+			return
+		}
+		defer out.Close()
+		writeSOCKS5Reply(conn, socks5RepSucceeded, out.LocalAddr())
+		s.relay(conn, out, target)
+	case socks5CmdUDPAssociate:
+		// relay 链路只承载 TCP，经链路转发时不提供 UDP。
+		if !s.allowUDP || s.dialer != nil {
+			writeSOCKS5Reply(conn, socks5RepCmdNotSupported, nil)
+			return
+		}
+		s.socks5UDPAssociate(conn)
+	default:
+		writeSOCKS5Reply(conn, socks5RepCmdNotSupported, nil)
+	}
+}
+
+func (s *ProxyServer) socks5Negotiate(conn net.Conn) error {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[0] != socks5Version {
+		return errors.New("socks5: bad version")
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	want := byte(socks5AuthPassword)
+	if len(s.users) == 0 && s.anonymous {
+		want = socks5AuthNone
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return errors.New("socks5: no acceptable auth method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return err
+	}
+	if want == socks5AuthNone {
+		return nil
+	}
+
+	// RFC 1929 用户名/密码子协商
+	ver := make([]byte, 2)
+	if _, err := io.ReadFull(conn, ver); err != nil {
+		return err
+	}
+	user := make([]byte, ver[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plen); err != nil {
+		return err
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return err
+	}
+	if !s.authenticate(string(user), string(pass)) {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return errors.New("socks5: authentication failed")
+	}
+	_, err := conn.Write([]byte{0x01, 0x00})
+	return err
+}
+
+func readSOCKS5Addr(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		size := net.IPv4len
+		if atyp[0] == socks5AtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, errSOCKS5BadAddr
+	}
+	p := make([]byte, 2)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(p)), nil
+}
+
+// appendSOCKS5Addr 以 ATYP+ADDR+PORT 格式追加地址。
+func appendSOCKS5Addr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	port := 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, ip16...)
+	} else {
+		b = append(b, socks5AtypIPv4, 0, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func writeSOCKS5Reply(conn net.Conn, rep byte, bound net.Addr) {
+	_, _ = conn.Write(appendSOCKS5Addr([]byte{socks5Version, rep, 0x00}, bound))
+}
+
+// socks5UDPAssociate 为控制连接建立一个 UDP 中继，控制连接断开时结束。
+func (s *ProxyServer) socks5UDPAssociate(ctrl net.Conn) {
+	localIP := ctrl.LocalAddr().(*net.TCPAddr).IP
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		writeSOCKS5Reply(ctrl, socks5RepFailure, nil)
+		return
+	}
+	defer relayConn.Close()
+	outConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		writeSOCKS5Reply(ctrl, socks5RepFailure, nil)
+		return
+	}
+	defer outConn.Close()
+	writeSOCKS5Reply(ctrl, socks5RepSucceeded, relayConn.LocalAddr())
+
+	s.conns.Add(1)
+	defer s.conns.Add(-1)
+
+	clientIP := ctrl.RemoteAddr().(*net.TCPAddr).IP
+	var (
+		mu         sync.Mutex
+		clientAddr *net.UDPAddr
+	)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// 客户端 → 目标
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 65535)
+		for {
+			_ = relayConn.SetReadDeadline(time.Now().Add(socks5UDPIdleTimeout))
+			n, from, err := relayConn.ReadFromUDP(buf)
+			if err != nil {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue
+				}
+				return
+			}
+			if !from.IP.Equal(clientIP) || n < 4 || buf[2] != 0 {
+				continue
+			}
+			mu.Lock()
+			clientAddr = from
+			mu.Unlock()
+			r := bytes.NewReader(buf[3:n])
+			host, port, err := readSOCKS5Addr(r)
+			if err != nil {
+				continue
+			}
+			dialHost, ok := s.policy.Resolve(host, port)
+			if !ok {
+				continue
+			}
+			dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(dialHost, strconv.Itoa(port)))
+			if err != nil {
+				continue
+			}
+			payload := buf[n-r.Len() : n]
+			s.limiter.Wait(len(payload))
+			s.shapeWait(len(payload))
+			if _, err := outConn.WriteToUDP(payload, dst); err == nil {
+				s.upBytes.Add(int64(len(payload)))
+				s.datagram(from, dst, payload, true)
+			}
+		}
+	}()
+
+	// 目标 → 客户端
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := outConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			to := clientAddr
+			mu.Unlock()
+			if to == nil {
+				continue
+			}
+			pkt := appendSOCKS5Addr([]byte{0, 0, 0}, from)
+			pkt = append(pkt, buf[:n]...)
+			s.shapeWait(len(pkt))
+			if _, err := relayConn.WriteToUDP(pkt, to); err == nil {
+				s.downBytes.Add(int64(n))
+				s.datagram(to, from, buf[:n], false)
+			}
+		}
+	}()
+
+	// 控制连接关闭即结束关联。
+	_, _ = io.Copy(io.Discard, ctrl)
+	close(done)
+	_ = relayConn.Close()
+	_ = outConn.Close()
+	wg.Wait()
+}
@@ -0,0 +1,96 @@
+package forwarder
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// Tap 旁路观察转发流量（镜像或抓包）。实现必须并发安全且不能阻塞转发。
+type Tap interface {
+	// OpenStream 在 TCP 连接建立后调用，返回值接收该连接的双向数据。
+	OpenStream(client, server *net.TCPAddr) StreamTap
+	// Datagram 每个 UDP 报文调用一次，upstream 表示 client → server 方向。
+	Datagram(client, server *net.UDPAddr, payload []byte, upstream bool)
+	Close() error
+}
+
+// StreamTap 单个 TCP 连接的旁路观察者。
+type StreamTap interface {
+	Upstream(p []byte)
+	Downstream(p []byte)
+	Close()
+}
+
+// Tappable 由支持旁路观察的转发器实现，可在运行中随时替换或清除。
+type Tappable interface {
+	SetTap(t Tap)
+}
+
+// tapSlot 供转发器嵌入，运行期间原子替换当前 Tap。
+type tapSlot struct {
+	tap atomic.Pointer[Tap]
+}
+
+func (s *tapSlot) SetTap(t Tap) {
+	if t == nil {
+		s.tap.Store(nil)
+		return
+	}
+	s.tap.Store(&t)
+}
+
+func (s *tapSlot) currentTap() Tap {
+	if p := s.tap.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// openStream 没有 Tap 时返回 nil。
+func (s *tapSlot) openStream(client net.Addr, server net.Addr, target string) StreamTap {
+	t := s.currentTap()
+	if t == nil {
+		return nil
+	}
+	return t.OpenStream(tapTCPAddr(client, ""), tapTCPAddr(server, target))
+}
+
+func (s *tapSlot) datagram(client, server *net.UDPAddr, payload []byte, upstream bool) {
+	if t := s.currentTap(); t != nil {
+		t.Datagram(client, server, payload, upstream)
+	}
+}
+
+// tapTCPAddr 优先使用目标地址中的 IP，经 relay 链路时连接对端并非真实目标。
+func tapTCPAddr(addr net.Addr, target string) *net.TCPAddr {
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		p, _ := strconv.Atoi(port)
+		if ip := net.ParseIP(host); ip != nil {
+			return &net.TCPAddr{IP: ip, Port: p}
+		}
+		if a, ok := addr.(*net.TCPAddr); ok {
+			return &net.TCPAddr{IP: a.IP, Port: p}
+		}
+		return &net.TCPAddr{IP: net.IPv4zero, Port: p}
+	}
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// tapWriter 把成功写出的数据同时交给 Tap。
+type tapWriter struct {
+	w  io.Writer
+	fn func([]byte)
+}
+
+func (t *tapWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if n > 0 {
+		t.fn(p[:n])
+	}
+	return n, err
+}
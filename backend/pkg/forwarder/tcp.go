@@ -19,7 +19,13 @@ type TCPForwarder struct {
   downBytes  atomic.Int64
   conns      atomic.Int64
   limiter    *TokenBucket
+  dialer     Dialer
+  transport  Transport
   wg         sync.WaitGroup
+  tapSlot
+  chaosSlot
+  shaperSlot
+  healthSlot
 }
 
 func NewTCPForwarder(listenHost string, listenPort int, targetHost string, targetPort int, limit int64) *TCPForwarder {
@@ -30,13 +36,37 @@ func NewTCPForwarder(listenHost string, listenPort int, targetHost string, targe
   }
 }
 
+// SetDialer 指定出站拨号方式（例如 relay 链路），需在 Start 之前调用。
+func (f *TCPForwarder) SetDialer(d Dialer) {
+  f.dialer = d
+}
+
+// SetListenTransport 指定入站监听使用的传输层（ws/wss/mws/mwss/h2），默认 tcp。
+func (f *TCPForwarder) SetListenTransport(t Transport) {
+  f.transport = t
+}
+
+func (f *TCPForwarder) dial() (net.Conn, error) {
+  if f.dialer != nil {
+    return f.dialer.Dial("tcp", f.targetAddr)
+  }
+  return net.DialTimeout("tcp", f.targetAddr, 5*time.Second)
+}
+
 func (f *TCPForwarder) Start() error {
-  ln, err := net.Listen("tcp", f.listenAddr)
+  var ln net.Listener
+  var err error
+  if f.transport != nil {
+    ln, err = f.transport.Listen(f.listenAddr)
+  } else {
+    ln, err = net.Listen("tcp", f.listenAddr)
+  }
   if err != nil {
     return err
   }
   f.listener = ln
   f.closed.Store(false)
+  f.resetHealth()
   f.wg.Add(1)
   go f.acceptLoop()
   return nil
@@ -50,6 +80,10 @@ func (f *TCPForwarder) acceptLoop() {
       if f.closed.Load() {
         return
       }
+      if listenerDead(err) {
+        f.fail(err)
+        return
+      }
       time.Sleep(50 * time.Millisecond)
       continue
     }
@@ -64,24 +98,21 @@ func (f *TCPForwarder) handleConn(in net.Conn) {
   defer f.conns.Add(-1)
   defer in.Close()
 
-  out, err := net.DialTimeout("tcp", f.targetAddr, 5*time.Second)
+  chaos := f.activeChaos()
+  if chaos != nil && chaos.Refuse() {
+    refuseConn(in)
+    return
+  }
+  out, err := f.dial()
   if err != nil {
     return
   }
   defer out.Close()
+  in = wrapChaos(chaos, in, out)
+  in, out = f.shape(in), f.shape(out)
 
-  done := make(chan struct{}, 2)
-  go func() {
-    n, _ := io.Copy(out, &rateLimitedReader{r: in, limiter: f.limiter})
-    f.upBytes.Add(n)
-    done <- struct{}{}
-  }()
-  go func() {
-    n, _ := io.Copy(in, out)
-    f.downBytes.Add(n)
-    done <- struct{}{}
-  }()
-  <-done
+  st := f.openStream(in.RemoteAddr(), out.RemoteAddr(), f.targetAddr)
+  pipeConnsTap(in, out, f.limiter, &f.upBytes, &f.downBytes, st)
 }
 
 func (f *TCPForwarder) Stop() error {
@@ -91,12 +122,21 @@ func (f *TCPForwarder) Stop() error {
   if f.listener != nil {
     _ = f.listener.Close()
   }
+  if c, ok := f.dialer.(io.Closer); ok {
+    _ = c.Close()
+  }
   f.wg.Wait()
   return nil
 }
 
+func (f *TCPForwarder) Limiter() *TokenBucket { return f.limiter }
+
 func (f *TCPForwarder) Stats() Stats {
-  return Stats{UpBytes: f.upBytes.Load(), DownBytes: f.downBytes.Load(), Connections: f.conns.Load(), LastActivity: time.Now()}
+  s := Stats{UpBytes: f.upBytes.Load(), DownBytes: f.downBytes.Load(), Connections: f.conns.Load(), LastActivity: time.Now()}
+  if hs, ok := f.dialer.(interface{ HopStats() []HopStats }); ok {
+    s.Hops = hs.HopStats()
+  }
+  return s
 }
 
 type rateLimitedReader struct {
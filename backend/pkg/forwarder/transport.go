@@ -0,0 +1,716 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport 定义节点之间的传输层，对应 gost 的 listener/dialer：
+// tcp、ws、wss、mws、mwss (多路复用 ws) 与 h2 (HTTP/2 over TLS)。
+type Transport interface {
+	Name() string
+	Listen(addr string) (net.Listener, error)
+	Dial(network, addr string) (net.Conn, error)
+	// Client 在已建立的连接上完成传输层握手，用于多跳嵌套场景。
+	Client(conn net.Conn, addr string) (net.Conn, error)
+}
+
+// TransportOptions 传输层参数。
+type TransportOptions struct {
+	Path     string `json:"path"`      // ws/h2 请求路径
+	Host     string `json:"host"`      // Host 头与 TLS SNI，经 CDN 时填写域名
+	CertFile string `json:"cert_file"` // 服务端证书，空则使用自签证书
+	KeyFile  string `json:"key_file"`
+	Insecure bool   `json:"insecure"` // 客户端跳过证书校验
+}
+
+const transportDialTimeout = 10 * time.Second
+
+// NewTransport 按名称构造传输层，空名称等同 tcp。
+func NewTransport(name string, opts TransportOptions) (Transport, error) {
+	switch name {
+	case "", "tcp":
+		return tcpTransport{}, nil
+	case "ws", "wss", "mws", "mwss":
+		if opts.Path == "" {
+			opts.Path = "/ws"
+		}
+		return &wsTransport{
+			name: name,
+			tls:  name == "wss" || name == "mwss",
+			mux:  name == "mws" || name == "mwss",
+			opts: opts,
+		}, nil
+	case "h2":
+		if opts.Path == "" {
+			opts.Path = "/h2"
+		}
+		return newH2Transport(opts), nil
+	default:
+		return nil, fmt.Errorf("unsupported transport %q", name)
+	}
+}
+
+// ===================== tcp =====================
+
+type tcpTransport struct{}
+
+func (tcpTransport) Name() string { return "tcp" }
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) { return net.Listen("tcp", addr) }
+
+func (tcpTransport) Dial(network, addr string) (net.Conn, error) {
+	return net.DialTimeout(network, addr, transportDialTimeout)
+}
+
+func (tcpTransport) Client(conn net.Conn, _ string) (net.Conn, error) { return conn, nil }
+
+// ===================== TLS =====================
+
+var (
+	selfSignedOnce sync.Once
+	selfSignedCert tls.Certificate
+	selfSignedErr  error
+)
+
+func serverTLSConfig(opts TransportOptions, nextProtos ...string) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if opts.CertFile != "" && opts.KeyFile != "" {
+		cert, err = tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	} else {
+		selfSignedOnce.Do(func() { selfSignedCert, selfSignedErr = generateSelfSigned() })
+		cert, err = selfSignedCert, selfSignedErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: nextProtos, MinVersion: tls.VersionTLS12}, nil
+}
+
+func clientTLSConfig(opts TransportOptions, addr string, nextProtos ...string) *tls.Config {
+	serverName := opts.Host
+	if serverName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			serverName = host
+		}
+	}
+	return &tls.Config{ServerName: serverName, InsecureSkipVerify: opts.Insecure, NextProtos: nextProtos, MinVersion: tls.VersionTLS12}
+}
+
+func generateSelfSigned() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "folstingx"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// ===================== 通用 accept 队列监听器 =====================
+
+// chanListener 将 HTTP 处理器中得到的连接转换为 net.Listener。
+type chanListener struct {
+	ln        net.Listener
+	server    *http.Server
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newChanListener(ln net.Listener) *chanListener {
+	return &chanListener{ln: ln, conns: make(chan net.Conn, muxAcceptBacklog), closed: make(chan struct{})}
+}
+
+func (l *chanListener) push(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.closed:
+		_ = c.Close()
+		return false
+	}
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		if l.server != nil {
+			_ = l.server.Close()
+		}
+		_ = l.ln.Close()
+	})
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr { return l.ln.Addr() }
+
+// ===================== ws / wss / mws / mwss =====================
+
+// wsTransport 的 mu 只保护会话池的查找与替换，mws/mwss 建立会话的拨号在锁外进行，
+// 同一地址同时只有一次拨号，慢速或失联的地址不阻塞其他地址与已建立会话上的新流。
+type wsTransport struct {
+	name string
+	tls  bool
+	mux  bool
+	opts TransportOptions
+
+	mu      sync.Mutex
+	pool    map[string]*muxSession
+	dialing map[string]*hopDial
+	gen     uint64 // Close 时递增，丢弃关闭前发起的拨号结果
+}
+
+func (t *wsTransport) Name() string { return t.name }
+
+func (t *wsTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.tls {
+		cfg, err := serverTLSConfig(t.opts, "http/1.1")
+		if err != nil {
+			_ = ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, cfg)
+	}
+
+	cl := newChanListener(ln)
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  32 * 1024,
+		WriteBufferSize: 32 * 1024,
+		CheckOrigin:     func(r *http.Request) bool { return true },
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(t.opts.Path, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := newWSConn(ws)
+		if !t.mux {
+			cl.push(conn)
+			return
+		}
+		go func() {
+			sess := newMuxSession(conn, false)
+			defer sess.Close()
+			for {
+				st, err := sess.Accept()
+				if err != nil {
+					return
+				}
+				if err := st.Ack(nil); err != nil {
+					return
+				}
+				if !cl.push(st) {
+					return
+				}
+			}
+		}()
+	})
+	cl.server = &http.Server{Handler: mux, ReadHeaderTimeout: transportDialTimeout}
+	go func() { _ = cl.server.Serve(ln) }()
+	return cl, nil
+}
+
+func (t *wsTransport) Dial(network, addr string) (net.Conn, error) {
+	if !t.mux {
+		return t.dialWS(nil, addr)
+	}
+	sess, err := t.session(addr)
+	if err != nil {
+		return nil, err
+	}
+	return sess.Open("")
+}
+
+// session 返回到 addr 的多路复用会话，必要时在锁外重新拨号，并发调用方等待同一次拨号的结果。
+func (t *wsTransport) session(addr string) (*muxSession, error) {
+	t.mu.Lock()
+	if sess := t.pool[addr]; sess != nil && !sess.IsClosed() {
+		t.mu.Unlock()
+		return sess, nil
+	}
+	if call := t.dialing[addr]; call != nil {
+		t.mu.Unlock()
+		<-call.done
+		return call.sess, call.err
+	}
+	if t.pool == nil {
+		t.pool = make(map[string]*muxSession)
+		t.dialing = make(map[string]*hopDial)
+	}
+	call := &hopDial{done: make(chan struct{})}
+	t.dialing[addr] = call
+	gen := t.gen
+	t.mu.Unlock()
+
+	conn, err := t.dialWS(nil, addr)
+	if err == nil {
+		call.sess = newMuxSession(conn, true)
+	}
+	call.err = err
+
+	t.mu.Lock()
+	delete(t.dialing, addr)
+	if call.err == nil {
+		if gen != t.gen {
+			_ = call.sess.Close()
+			call.sess, call.err = nil, fmt.Errorf("%s %s: %w", t.name, addr, net.ErrClosed)
+		} else {
+			t.pool[addr] = call.sess
+		}
+	}
+	t.mu.Unlock()
+	close(call.done)
+	return call.sess, call.err
+}
+
+// Client 在已有连接上升级为 websocket；mws/mwss 会为该连接单独建立一个会话。
+func (t *wsTransport) Client(conn net.Conn, addr string) (net.Conn, error) {
+	ws, err := t.dialWS(conn, addr)
+	if err != nil || !t.mux {
+		return ws, err
+	}
+	sess := newMuxSession(ws, true)
+	st, err := sess.Open("")
+	if err != nil {
+		_ = sess.Close()
+		return nil, err
+	}
+	return &ownedStream{Conn: st, sess: sess}, nil
+}
+
+// ownedStream 关闭时一并关闭其独占的会话。
+type ownedStream struct {
+	net.Conn
+	sess *muxSession
+}
+
+func (c *ownedStream) Close() error {
+	_ = c.Conn.Close()
+	return c.sess.Close()
+}
+
+func (t *wsTransport) dialWS(under net.Conn, addr string) (net.Conn, error) {
+	scheme := "ws"
+	if t.tls {
+		scheme = "wss"
+	}
+	host := addr
+	header := http.Header{}
+	if t.opts.Host != "" {
+		header.Set("Host", t.opts.Host)
+	}
+	dialer := websocket.Dialer{
+		HandshakeTimeout: transportDialTimeout,
+		ReadBufferSize:   32 * 1024,
+		WriteBufferSize:  32 * 1024,
+		TLSClientConfig:  clientTLSConfig(t.opts, addr, "http/1.1"),
+	}
+	if under != nil {
+		dialer.NetDialContext = func(ctx context.Context, network, a string) (net.Conn, error) { return under, nil }
+	} else {
+		dialer.NetDialContext = (&net.Dialer{Timeout: transportDialTimeout}).DialContext
+	}
+	ws, resp, err := dialer.Dial(scheme+"://"+host+t.opts.Path, header)
+	if resp != nil && resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(ws), nil
+}
+
+func (t *wsTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gen++
+	for addr, sess := range t.pool {
+		_ = sess.Close()
+		delete(t.pool, addr)
+	}
+	return nil
+}
+
+// wsConn 把 websocket 二进制消息流适配为 net.Conn。
+type wsConn struct {
+	ws     *websocket.Conn
+	rmu    sync.Mutex
+	reader io.Reader
+	wmu    sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn { return &wsConn{ws: ws} }
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for {
+		if c.reader == nil {
+			_, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(p)
+		if errors.Is(err, io.EOF) {
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	c.wmu.Lock()
+	_ = c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.wmu.Unlock()
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
+
+// ===================== h2 =====================
+
+// h2Transport 每个连接对应一个 HTTP/2 双向流式 POST 请求，天然在一条 TLS 连接上复用。
+type h2Transport struct {
+	opts TransportOptions
+
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}
+
+func newH2Transport(opts TransportOptions) *h2Transport {
+	return &h2Transport{opts: opts, clients: make(map[string]*http.Client)}
+}
+
+func (t *h2Transport) Name() string { return "h2" }
+
+func (t *h2Transport) Listen(addr string) (net.Listener, error) {
+	cfg, err := serverTLSConfig(t.opts, "h2")
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cl := newChanListener(ln)
+	mux := http.NewServeMux()
+	mux.HandleFunc(t.opts.Path, func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if r.Method != http.MethodPost || r.ProtoMajor != 2 || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		conn := newH2Conn(r.Body, &flushWriter{w: w, f: flusher}, ln.Addr(), remoteAddr(r.RemoteAddr))
+		if !cl.push(conn) {
+			return
+		}
+		// 处理器返回即结束流，需等待连接关闭。
+		select {
+		case <-conn.done:
+		case <-r.Context().Done():
+			_ = conn.Close()
+		}
+	})
+	cl.server = &http.Server{Handler: mux, TLSConfig: cfg, ReadHeaderTimeout: transportDialTimeout}
+	go func() { _ = cl.server.ServeTLS(ln, "", "") }()
+	return cl, nil
+}
+
+func (t *h2Transport) client(addr string, under net.Conn) *http.Client {
+	tr := &http.Transport{
+		TLSClientConfig:     clientTLSConfig(t.opts, addr, "h2"),
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: transportDialTimeout,
+		DialContext:         (&net.Dialer{Timeout: transportDialTimeout}).DialContext,
+	}
+	if under != nil {
+		used := false
+		var mu sync.Mutex
+		tr.DialContext = func(ctx context.Context, network, a string) (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if used {
+				return nil, errors.New("h2 underlying connection already used")
+			}
+			used = true
+			return under, nil
+		}
+	}
+	return &http.Client{Transport: tr}
+}
+
+func (t *h2Transport) Dial(network, addr string) (net.Conn, error) {
+	t.mu.Lock()
+	c, ok := t.clients[addr]
+	if !ok {
+		c = t.client(addr, nil)
+		t.clients[addr] = c
+	}
+	t.mu.Unlock()
+	return t.open(c, addr)
+}
+
+func (t *h2Transport) Client(conn net.Conn, addr string) (net.Conn, error) {
+	return t.open(t.client(addr, conn), addr)
+}
+
+func (t *h2Transport) open(c *http.Client, addr string) (net.Conn, error) {
+	host := addr
+	if t.opts.Host != "" {
+		host = t.opts.Host
+	}
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, "https://"+addr+t.opts.Path, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	req.ContentLength = -1
+	ctx, cancel := context.WithTimeout(context.Background(), transportDialTimeout)
+	defer cancel()
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := c.Do(req)
+		ch <- result{resp, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return nil, r.err
+		}
+		if r.resp.StatusCode != http.StatusOK {
+			_ = r.resp.Body.Close()
+			return nil, fmt.Errorf("h2 transport: unexpected status %s", r.resp.Status)
+		}
+		conn := newH2Conn(r.resp.Body, pw, nil, remoteAddr(addr))
+		conn.onClose = func() { _ = pr.Close() }
+		return conn, nil
+	case <-ctx.Done():
+		_ = pw.CloseWithError(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+func (t *h2Transport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr, c := range t.clients {
+		c.CloseIdleConnections()
+		delete(t.clients, addr)
+	}
+	return nil
+}
+
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.f.Flush()
+	return n, err
+}
+
+// h2Conn 将 HTTP/2 请求体与响应体组合为 net.Conn。
+// 流上的单次读写无法中断，读写截止时间到达时关闭整个流，阻塞中的读写返回超时错误。
+type h2Conn struct {
+	r         io.ReadCloser
+	w         io.Writer
+	local     net.Addr
+	remote    net.Addr
+	done      chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+
+	dmu      sync.Mutex
+	rTimer   *time.Timer
+	wTimer   *time.Timer
+	timedOut atomic.Bool
+}
+
+func newH2Conn(r io.ReadCloser, w io.Writer, local, remote net.Addr) *h2Conn {
+	return &h2Conn{r: r, w: w, local: local, remote: remote, done: make(chan struct{})}
+}
+
+func (c *h2Conn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && c.timedOut.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *h2Conn) Write(p []byte) (int, error) {
+	if c.timedOut.Load() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := c.w.Write(p)
+	if err != nil && c.timedOut.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *h2Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.dmu.Lock()
+		stopTimer(c.rTimer)
+		stopTimer(c.wTimer)
+		c.dmu.Unlock()
+		if wc, ok := c.w.(io.Closer); ok {
+			_ = wc.Close()
+		}
+		_ = c.r.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *h2Conn) LocalAddr() net.Addr {
+	if c.local == nil {
+		return &net.TCPAddr{}
+	}
+	return c.local
+}
+
+func (c *h2Conn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return &net.TCPAddr{}
+	}
+	return c.remote
+}
+
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	c.rTimer = c.armDeadline(c.rTimer, t)
+	c.wTimer = c.armDeadline(c.wTimer, t)
+	return nil
+}
+
+func (c *h2Conn) SetReadDeadline(t time.Time) error {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	c.rTimer = c.armDeadline(c.rTimer, t)
+	return nil
+}
+
+func (c *h2Conn) SetWriteDeadline(t time.Time) error {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	c.wTimer = c.armDeadline(c.wTimer, t)
+	return nil
+}
+
+// armDeadline 替换截止时间定时器，零值表示取消；调用方需持有 c.dmu。
+func (c *h2Conn) armDeadline(old *time.Timer, t time.Time) *time.Timer {
+	stopTimer(old)
+	if t.IsZero() {
+		return nil
+	}
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		c.timedOut.Store(true)
+		_ = c.Close()
+	})
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+func remoteAddr(addr string) net.Addr {
+	if a, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		return a
+	}
+	return &net.TCPAddr{}
+}
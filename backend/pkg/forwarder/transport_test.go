@@ -0,0 +1,294 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// h2Pair 建立一条 h2 传输连接，返回客户端与服务端两端。
+func h2Pair(t *testing.T, tr Transport, ln net.Listener) (net.Conn, net.Conn) {
+	t.Helper()
+	client, err := tr.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 服务端在收到首个数据帧前不会交付连接。
+	if _, err := client.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+	return client, server
+}
+
+func TestH2ConnDeadline(t *testing.T) {
+	tr, err := NewTransport("h2", TransportOptions{Insecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, server := h2Pair(t, tr, ln)
+	buf := make([]byte, 2)
+	// 取消的截止时间不生效。
+	_ = client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_ = client.SetReadDeadline(time.Time{})
+	time.Sleep(100 * time.Millisecond)
+	if _, err := server.Write([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("read after cleared deadline: %v", err)
+	}
+
+	// 对端不再发送数据时，阻塞的读在截止时间返回超时。
+	for i := 0; i < 2; i++ {
+		client, server := h2Pair(t, tr, ln)
+		c := []net.Conn{client, server}[i]
+		_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		start := time.Now()
+		if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("conn %d read: got %v", i, err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Fatalf("conn %d deadline fired after %s", i, d)
+		}
+	}
+}
+
+// echoServe 在传输监听上回显每个连接收到的数据。
+func echoServe(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			_, _ = io.Copy(c, c)
+		}()
+	}
+}
+
+func roundTrip(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q, want %q", buf, msg)
+	}
+}
+
+func TestWSTransportRoundTrip(t *testing.T) {
+	for _, name := range []string{"ws", "wss", "mws", "mwss"} {
+		t.Run(name, func(t *testing.T) {
+			tr, err := NewTransport(name, TransportOptions{Insecure: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln, err := tr.Listen("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go echoServe(ln)
+			defer tr.(*wsTransport).Close()
+
+			for i := 0; i < 3; i++ {
+				c, err := tr.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				roundTrip(t, c, "hello "+name)
+				_ = c.Close()
+			}
+		})
+	}
+}
+
+func TestMWSSessionReuse(t *testing.T) {
+	tr, err := NewTransport("mws", TransportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := tr.(*wsTransport)
+	defer ws.Close()
+	ln, err := tr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echoServe(ln)
+	addr := ln.Addr().String()
+
+	c1, err := tr.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	first := ws.pool[addr]
+	c2, err := tr.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if ws.pool[addr] != first {
+		t.Fatal("second dial opened a new session")
+	}
+	roundTrip(t, c1, "one")
+	roundTrip(t, c2, "two")
+
+	// 会话断开后下一次拨号重建。
+	_ = first.Close()
+	c3, err := tr.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	if ws.pool[addr] == first {
+		t.Fatal("closed session reused")
+	}
+	roundTrip(t, c3, "three")
+}
+
+func TestMWSSlowAddrDoesNotBlock(t *testing.T) {
+	tr, err := NewTransport("mws", TransportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := tr.(*wsTransport)
+	ln, err := tr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echoServe(ln)
+
+	// 只接受 TCP 不回应 websocket 握手的地址。
+	stall, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		heldMu sync.Mutex
+		held   []net.Conn
+	)
+	go func() {
+		for {
+			c, err := stall.Accept()
+			if err != nil {
+				return
+			}
+			heldMu.Lock()
+			held = append(held, c)
+			heldMu.Unlock()
+		}
+	}()
+	slow := make(chan error, 1)
+	go func() {
+		_, err := tr.Dial("tcp", stall.Addr().String())
+		slow <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := tr.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			_ = c.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("dial blocked behind a stalled address")
+	}
+
+	// 关闭后，进行中的拨号结果不再进入会话池。
+	_ = ws.Close()
+	_ = stall.Close()
+	heldMu.Lock()
+	for _, c := range held {
+		_ = c.Close()
+	}
+	heldMu.Unlock()
+	if err := <-slow; err == nil {
+		t.Fatal("stalled dial succeeded")
+	}
+}
+
+func TestTCPOptionsCertDir(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	for _, p := range []string{filepath.Join(dir, "a.pem"), filepath.Join(outside, "b.pem")} {
+		if err := os.WriteFile(p, []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "b.pem"), filepath.Join(dir, "link.pem")); err != nil {
+		t.Fatal(err)
+	}
+	opts := func(name string) json.RawMessage {
+		b, _ := json.Marshal(map[string]string{"transport": "wss", "cert_file": name, "key_file": name})
+		return b
+	}
+
+	// 校验只看文件名，不依赖本机证书目录。
+	SetCertDir("")
+	if err := ValidateOptions("tcp", opts("a.pem")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/etc/ssl/private/key.pem", "../b.pem", "sub/../../b.pem"} {
+		if err := ValidateOptions("tcp", opts(name)); err == nil {
+			t.Fatalf("%s accepted", name)
+		}
+	}
+
+	cases := []struct {
+		dir  string
+		name string
+		ok   bool
+	}{
+		{"", "a.pem", false}, // 未配置证书目录
+		{dir, "a.pem", true},
+		{dir, "missing.pem", false},
+		{dir, "link.pem", false}, // 符号链接指向目录外
+		{dir, "", true},          // 自签证书
+	}
+	for _, c := range cases {
+		SetCertDir(c.dir)
+		_, _, err := decodeTCPOptions(opts(c.name), true)
+		if (err == nil) != c.ok {
+			t.Errorf("dir=%q name=%q: err=%v", c.dir, c.name, err)
+		}
+	}
+	SetCertDir("")
+}
@@ -18,6 +18,10 @@ type UDPForwarder struct {
   conns      atomic.Int64
   limiter    *TokenBucket
   wg         sync.WaitGroup
+  tapSlot
+  chaosSlot
+  shaperSlot
+  healthSlot
 }
 
 func NewUDPForwarder(listenHost string, listenPort int, targetHost string, targetPort int, limit int64) (*UDPForwarder, error) {
@@ -43,6 +47,7 @@ func (f *UDPForwarder) Start() error {
   }
   f.conn = conn
   f.closed.Store(false)
+  f.resetHealth()
   f.wg.Add(1)
   go f.loop()
   return nil
@@ -61,22 +66,37 @@ func (f *UDPForwarder) loop() {
       if f.closed.Load() {
         return
       }
+      if listenerDead(err) {
+        f.fail(err)
+        return
+      }
       continue
     }
     f.conns.Store(1)
+    chaos := f.activeChaos()
+    if chaos != nil {
+      if chaos.Drop() {
+        continue
+      }
+      chaos.delay()
+    }
     f.limiter.Wait(n)
     f.upBytes.Add(int64(n))
+    f.datagram(clientAddr, f.targetAddr, buf[:n], true)
 
     upstream, err := net.DialUDP("udp", nil, f.targetAddr)
     if err != nil {
       continue
     }
+    f.shapeWait(n)
     _, _ = upstream.Write(buf[:n])
     _ = upstream.SetReadDeadline(time.Now().Add(3 * time.Second))
     rn, _, err := upstream.ReadFromUDP(buf)
-    if err == nil && rn > 0 {
+    if err == nil && rn > 0 && (chaos == nil || !chaos.Drop()) {
+      f.shapeWait(rn)
       _, _ = f.conn.WriteToUDP(buf[:rn], clientAddr)
       f.downBytes.Add(int64(rn))
+      f.datagram(clientAddr, f.targetAddr, buf[:rn], false)
     }
     _ = upstream.Close()
   }
@@ -93,6 +113,8 @@ func (f *UDPForwarder) Stop() error {
   return nil
 }
 
+func (f *UDPForwarder) Limiter() *TokenBucket { return f.limiter }
+
 func (f *UDPForwarder) Stats() Stats {
   return Stats{UpBytes: f.upBytes.Load(), DownBytes: f.downBytes.Load(), Connections: f.conns.Load(), LastActivity: time.Now()}
 }